@@ -0,0 +1,707 @@
+package main
+
+import (
+	"byor/04/util"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The append-only file (AOF) logs every write command in the request
+// format of the protocol: u32 length, u32 nargs, then a u32 length and
+// the bytes of each argument. Replaying it through doRequest() rebuilds
+// the keyspace. Commands that depend on the time they run at are logged
+// with absolute times instead, so a replay doesn't extend TTLs.
+
+type AofFsync int
+
+const (
+	FsyncAlways   AofFsync = iota // before replying to the command
+	FsyncEverySec                 // by a background goroutine
+	FsyncNo                       // left to the OS
+)
+
+var aofFsyncNames = []string{
+	FsyncAlways:   "always",
+	FsyncEverySec: "everysec",
+	FsyncNo:       "no",
+}
+
+func parseAofFsync(s string) (AofFsync, bool) {
+	for i, name := range aofFsyncNames {
+		if strings.EqualFold(s, name) {
+			return AofFsync(i), true
+		}
+	}
+	return 0, false
+}
+
+var gAof = struct {
+	mu            sync.Mutex // guards the fields used by the goroutines
+	file          *os.File   // nil if the AOF is off
+	seal          *sealer    // of the file
+	unsynced      bool       // written since the last fsync
+	size          int64
+	baseSize      int64 // after the last rewrite, for the auto rewrite
+	db            int   // the database selected in the file, -1 if none
+	loading       bool  // replaying the file, don't log the commands again
+	writeStatus   string
+	rewrite       *aofRewrite // the running rewrite, nil if none
+	rewriteStatus string      // of the last rewrite
+}{db: -1, writeStatus: "ok", rewriteStatus: "ok"}
+
+// An AOF rewrite writes the commands that recreate the keyspace, as it
+// was when the rewrite started, to a temp file. Commands logged in the
+// meantime are also kept in `buf`; once the dataset is written, the event
+// loop appends them and renames the temp file over the AOF.
+type aofRewrite struct {
+	f    *os.File
+	w    *sealWriter // of `f`
+	tmp  string
+	buf  []byte // commands logged since the start, guarded by gAof.mu
+	db   int    // the database selected at the end of `buf`
+	done bool   // the dataset is written, guarded by gAof.mu
+	err  error
+}
+
+func aofPath() string {
+	return filepath.Join(gConfig.dir, gConfig.appendfilename)
+}
+
+// appendCmd encodes a command like a request.
+func appendCmd(out []byte, args ...string) []byte {
+	pos := len(out)
+	out = appendU32(out, 0)
+	out = appendU32(out, uint32(len(args)))
+	for _, arg := range args {
+		out = appendStr(out, arg)
+	}
+	binary.LittleEndian.PutUint32(out[pos:], uint32(len(out)-pos-4))
+	return out
+}
+
+// nsToMs converts a time in nowNs() time to unix milliseconds, rounding
+// up so a replayed TTL doesn't end early.
+func nsToMs(at int64) int64 {
+	ms := int64(time.Millisecond)
+	if at > 0 {
+		return (at + ms - 1) / ms
+	}
+	return at / ms
+}
+
+func formatMs(at int64) string {
+	return strconv.FormatInt(nsToMs(at), 10)
+}
+
+// aofExpireMs converts the time argument of an expire option or command
+// executed at `now` to unix milliseconds. The argument was validated by
+// the command.
+func aofExpireMs(opt string, arg string, now int64) string {
+	n, _ := strconv.ParseInt(arg, 10, 64)
+	opt = strings.ToLower(opt)
+	unit := time.Millisecond
+	switch opt {
+	case "ex", "exat", "expire", "hexpire":
+		unit = time.Second
+	}
+	at := n * int64(unit)
+	switch opt {
+	case "ex", "px", "expire", "pexpire", "hexpire", "hpexpire":
+		at += now
+	}
+	return formatMs(at)
+}
+
+// aofTranslate returns the command to log for `cmd`, which started at
+// `now` and replied `res`, or nil if it changed nothing.
+func aofTranslate(cmd []string, now int64, res Response) []string {
+	switch strings.ToLower(cmd[0]) {
+	case "set":
+		out := append([]string(nil), cmd[:3]...)
+		for i := 3; i < len(cmd); i++ {
+			if cmdIs(cmd[i], "ex") || cmdIs(cmd[i], "px") {
+				out = append(out, "pxat", aofExpireMs(cmd[i], cmd[i+1], now))
+				i++
+			} else {
+				out = append(out, cmd[i])
+			}
+		}
+		return out
+	case "expire", "pexpire":
+		return []string{"pexpireat", cmd[1], aofExpireMs(cmd[0], cmd[2], now)}
+	case "getex":
+		if res.ResponseCode != RES_OK || len(cmd) == 2 {
+			return nil
+		}
+		if len(cmd) == 3 {
+			return []string{"persist", cmd[1]}
+		}
+		return []string{"pexpireat", cmd[1], aofExpireMs(cmd[2], cmd[3], now)}
+	case "hexpire", "hpexpire":
+		out := []string{"hpexpireat", cmd[1], aofExpireMs(cmd[0], cmd[2], now)}
+		return append(out, cmd[3:]...)
+	case "restore":
+		for _, opt := range cmd[4:] {
+			if cmdIs(opt, "absttl") {
+				return cmd
+			}
+		}
+		if cmd[2] == "0" {
+			return cmd
+		}
+		out := []string{cmd[0], cmd[1], aofExpireMs("px", cmd[2], now)}
+		return append(append(out, cmd[3:]...), "absttl")
+	case "ts.add":
+		if cmd[2] == "*" {
+			out := append([]string(nil), cmd...)
+			out[2] = string(res.ResponseData) // the timestamp used
+			return out
+		}
+		return cmd
+	case "rdbimport":
+		return nil // logged entry by entry by the import
+	case "throttle":
+		// Log the new state rather than rerun the algorithm at another time
+		gMap.RLock()
+		defer gMap.RUnlock()
+		ent, ok := gMap.m.Get(cmd[1])
+		if !ok || ent.typ != TypeStr {
+			return nil
+		}
+		out := []string{"set", cmd[1], string(ent.val.([]byte))}
+		if ent.expireAt != 0 {
+			out = append(out, "pxat", formatMs(ent.expireAt))
+		}
+		return out
+	}
+	return cmd
+}
+
+// aofFeedCommand logs a write command executed in database `db`.
+func aofFeedCommand(db int, cmd []string, now int64, res Response) {
+	if gAof.file == nil || gAof.loading || res.ResponseCode == RES_ERR {
+		return
+	}
+	if args := aofTranslate(cmd, now, res); args != nil {
+		aofFeed(db, args...)
+	}
+}
+
+// aofFeed logs a command for database `db`, such as the DEL of an
+// evicted key.
+func aofFeed(db int, args ...string) {
+	if gAof.file == nil || gAof.loading {
+		return
+	}
+	aofFeedCmds(db, appendCmd(nil, args...))
+}
+
+// aofFeedEntry logs the commands that recreate an entry added without a
+// command of its own, such as by an import.
+func aofFeedEntry(db int, key string, ent *Entry) {
+	if gAof.file == nil || gAof.loading {
+		return
+	}
+	if cmds := appendEntryCmds(nil, key, ent, nowNs()); len(cmds) > 0 {
+		aofFeedCmds(db, cmds)
+	}
+}
+
+// aofFeedCmds logs encoded commands for database `db`.
+func aofFeedCmds(db int, cmds []byte) {
+	var out []byte
+	if db != gAof.db {
+		out = appendCmd(out, "select", strconv.Itoa(db))
+		gAof.db = db
+	}
+	aofWrite(append(out, cmds...))
+
+	if rw := gAof.rewrite; rw != nil {
+		out = out[:0]
+		if db != rw.db {
+			out = appendCmd(out, "select", strconv.Itoa(db))
+			rw.db = db
+		}
+		out = append(out, cmds...)
+		gAof.mu.Lock()
+		rw.buf = append(rw.buf, out...)
+		gAof.mu.Unlock()
+	}
+}
+
+// aofWrite appends to the AOF from the event loop. The write() only
+// reaches the page cache; the fsync is done here for FsyncAlways and by
+// aofSyncLoop() for FsyncEverySec.
+func aofWrite(data []byte) {
+	gAof.mu.Lock()
+	defer gAof.mu.Unlock()
+	data = gAof.seal.wrap(data, gAof.size)
+	n, err := gAof.file.Write(data)
+	if err == nil && gConfig.appendfsync == FsyncAlways {
+		err = gAof.file.Sync()
+	}
+	if err != nil {
+		util.Msg("writing the AOF: " + err.Error())
+		gAof.writeStatus = "err"
+		if n > 0 && n < len(data) {
+			// Drop the partial record so the file stays replayable
+			if gAof.file.Truncate(gAof.size) != nil {
+				gAof.size += int64(n)
+			}
+		}
+		if gConfig.appendfsync == FsyncAlways {
+			// The command can't be acknowledged as durable
+			os.Exit(1)
+		}
+		return
+	}
+	gAof.size += int64(n)
+	gAof.unsynced = true
+	gAof.writeStatus = "ok"
+}
+
+// aofSyncLoop fsyncs the AOF once per second for FsyncEverySec, so the
+// event loop never waits for the disk.
+func aofSyncLoop() {
+	for range time.Tick(time.Second) {
+		gAof.mu.Lock()
+		f := gAof.file
+		unsynced := gAof.unsynced
+		gAof.unsynced = false
+		gAof.mu.Unlock()
+		if f == nil || !unsynced {
+			continue
+		}
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			util.Msg("fsync of the AOF: " + err.Error())
+		}
+	}
+}
+
+// openAof opens the AOF for appending.
+func openAof(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	seal, err := fileSealer(path)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	gAof.mu.Lock()
+	gAof.file = f
+	gAof.seal = seal
+	gAof.size = info.Size()
+	gAof.baseSize = info.Size()
+	gAof.db = -1
+	gAof.mu.Unlock()
+	return nil
+}
+
+// loadAof replays the AOF at `path` into the keyspace. An incomplete
+// record at the end, left by a crash during a write, is dropped with a
+// warning; any other damage is an error.
+func loadAof(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, seal, end, err := unseal(raw)
+	if err != nil {
+		return err
+	}
+	if end != len(raw) {
+		util.Msg(fmt.Sprintf("AOF ends with an incomplete encrypted chunk at offset %d, truncating %d bytes",
+			end, len(raw)-end))
+		if err := os.Truncate(path, int64(end)); err != nil {
+			return err
+		}
+	}
+	gAof.loading = true
+	defer func() { gAof.loading = false }()
+
+	conn := &Conn{}
+	pos := 0
+	for pos < len(data) {
+		if len(data)-pos < 4 || uint64(len(data)-pos-4) < uint64(binary.LittleEndian.Uint32(data[pos:])) {
+			if seal != nil {
+				return fmt.Errorf("incomplete record in the encrypted AOF")
+			}
+			util.Msg(fmt.Sprintf("AOF ends with an incomplete record at offset %d, truncating %d bytes",
+				pos, len(data)-pos))
+			return os.Truncate(path, int64(pos))
+		}
+		body := data[pos+4 : pos+4+int(binary.LittleEndian.Uint32(data[pos:]))]
+		cmd, err := parseReq(body)
+		if err != nil || len(cmd) == 0 {
+			return fmt.Errorf("bad AOF record at offset %d", pos)
+		}
+		name := strings.ToLower(cmd[0])
+		if name != "select" && gCmdFlags[name]&cmdWrite == 0 {
+			return fmt.Errorf("unexpected command %q in the AOF at offset %d", cmd[0], pos)
+		}
+		if _, err := doRequest(Request{RequestData: body, Conn: conn}); err != nil {
+			return fmt.Errorf("bad AOF record at offset %d", pos)
+		}
+		pos += 4 + len(body)
+	}
+	return nil
+}
+
+// appendEntryCmds appends the commands that recreate the entry, or
+// nothing if it has expired at `now`. Strings and hashes are written as
+// plain commands; other types as a RESTORE of their serialized value.
+func appendEntryCmds(out []byte, key string, ent *Entry, now int64) []byte {
+	if ent.expired(now) {
+		return out
+	}
+	switch ent.typ {
+	case TypeStr:
+		if ent.expireAt != 0 {
+			return appendCmd(out, "set", key, string(ent.val.([]byte)), "pxat", formatMs(ent.expireAt))
+		}
+		return appendCmd(out, "set", key, string(ent.val.([]byte)))
+	case TypeHash:
+		out = appendHashCmds(out, key, ent.val.(*Hash), now)
+	default:
+		if ent.expireAt != 0 {
+			return appendCmd(out, "restore", key, formatMs(ent.expireAt), string(dumpPayload(ent)), "absttl")
+		}
+		return appendCmd(out, "restore", key, "0", string(dumpPayload(ent)))
+	}
+	if ent.expireAt != 0 {
+		out = appendCmd(out, "pexpireat", key, formatMs(ent.expireAt))
+	}
+	return out
+}
+
+const kAofHashBatch = 64 // fields per HSET
+
+// appendHashCmds appends HSETs of the live fields, then one HPEXPIREAT
+// per distinct field expire time.
+func appendHashCmds(out []byte, key string, h *Hash, now int64) []byte {
+	args := []string{"hset", key}
+	byExpire := map[int64][]string{}
+	for field := range h.fields {
+		f, ok := h.Get(field, now)
+		if !ok {
+			continue
+		}
+		args = append(args, field, string(f.val))
+		if len(args) == 2+2*kAofHashBatch {
+			out = appendCmd(out, args...)
+			args = args[:2]
+		}
+		if f.expireAt != 0 {
+			ms := nsToMs(f.expireAt)
+			byExpire[ms] = append(byExpire[ms], field)
+		}
+	}
+	if len(args) > 2 {
+		out = appendCmd(out, args...)
+	}
+	for ms, fields := range byExpire {
+		for len(fields) > 0 {
+			n := len(fields)
+			if n > kAofHashBatch {
+				n = kAofHashBatch
+			}
+			args := []string{"hpexpireat", key, strconv.FormatInt(ms, 10), "fields", strconv.Itoa(n)}
+			out = appendCmd(out, append(args, fields[:n]...)...)
+			fields = fields[n:]
+		}
+	}
+	return out
+}
+
+// writeAofDataset writes the commands that recreate the databases.
+// `record` encodes the commands of an entry.
+func writeAofDataset(w io.Writer, dbs []*Hamt, record func(key string, ent *Entry) ([]byte, error)) (err error) {
+	var out []byte
+	for i, db := range dbs {
+		if db.Len() == 0 {
+			continue
+		}
+		out = appendCmd(out, "select", strconv.Itoa(i))
+		db.Range(func(key string, ent *Entry) bool {
+			var rec []byte
+			if rec, err = record(key, ent); err != nil {
+				return false
+			}
+			out = append(out, rec...)
+			if len(out) >= 64<<10 {
+				if _, err = w.Write(out); err != nil {
+					return false
+				}
+				out = out[:0]
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// writeAofFile writes the commands that recreate the databases to `path`,
+// through a temp file like writeSnapshot().
+func writeAofFile(path string, dbs []*Hamt, now int64) (err error) {
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	w, err := newSealWriter(f)
+	if err != nil {
+		return err
+	}
+	err = writeAofDataset(w, dbs, func(key string, ent *Entry) ([]byte, error) {
+		hot, err := hotEntry(ent)
+		if err != nil {
+			return nil, err
+		}
+		return appendEntryCmds(nil, key, hot, now), nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// loadDataFiles fills the keyspace at startup. With the AOF on, the AOF
+// is loaded if it exists; otherwise the snapshot is loaded and an AOF is
+// written from it, so the data survives the next restart.
+func loadDataFiles() error {
+	if gConfig.storage != StorageMemory {
+		return nil // the engine has its own files
+	}
+	if !gConfig.appendonly {
+		if err := loadSnapshot(snapshotPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("loading the snapshot: %v", err)
+		}
+		return reencryptSnapshot()
+	}
+
+	err := loadAof(aofPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := loadSnapshot(snapshotPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("loading the snapshot: %v", err)
+		}
+		gMap.RLock()
+		err = writeAofFile(aofPath(), gMap.dbs, nowNs())
+		gMap.RUnlock()
+		if err != nil {
+			return fmt.Errorf("creating the AOF: %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("loading the AOF: %v", err)
+	} else if seal, err := fileSealer(aofPath()); err != nil {
+		return fmt.Errorf("loading the AOF: %v", err)
+	} else if !seal.current() {
+		// Written with an old key or without encryption
+		gMap.RLock()
+		err = writeAofFile(aofPath(), gMap.dbs, nowNs())
+		gMap.RUnlock()
+		if err != nil {
+			return fmt.Errorf("encrypting the AOF: %v", err)
+		}
+	}
+	if err := reencryptSnapshot(); err != nil {
+		return err
+	}
+	gSave.dirty = 0
+
+	if err := openAof(aofPath()); err != nil {
+		return fmt.Errorf("opening the AOF: %v", err)
+	}
+	if gConfig.appendfsync == FsyncEverySec {
+		go aofSyncLoop()
+	}
+	return nil
+}
+
+// startAofRewrite starts a background rewrite. The caller must hold the
+// write lock of gMap.
+func startAofRewrite() error {
+	if gAof.file == nil {
+		return errors.New("the AOF is off")
+	}
+	if gAof.rewrite != nil {
+		return errors.New("background AOF rewrite already in progress")
+	}
+	if gSave.job != nil {
+		return errors.New("background save in progress")
+	}
+	tmp := fmt.Sprintf("%s.rewrite-%d", aofPath(), os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w, err := newSealWriter(f)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	job := newSnapshotJob(appendEntryCmds)
+	rw := &aofRewrite{f: f, w: w, tmp: tmp, db: -1}
+	gAof.mu.Lock()
+	gAof.rewrite = rw
+	gAof.mu.Unlock()
+
+	go func() {
+		err := writeAofDataset(w, job.dbs, job.record)
+		// Catch up with the commands logged meanwhile, so the event loop
+		// has little left to write when it switches files
+		for i := 0; i < 10 && err == nil; i++ {
+			gAof.mu.Lock()
+			buf := rw.buf
+			rw.buf = nil
+			gAof.mu.Unlock()
+			if len(buf) == 0 {
+				break
+			}
+			_, err = w.Write(buf)
+		}
+		if err == nil {
+			err = f.Sync()
+		}
+		gMap.Lock()
+		gSave.job = nil
+		gMap.Unlock()
+		gAof.mu.Lock()
+		rw.err = err
+		rw.done = true
+		gAof.mu.Unlock()
+	}()
+	return nil
+}
+
+// finishAofRewrite appends the rest of the buffered commands to the new
+// file and renames it over the AOF. It runs on the event loop, so no
+// command is logged in between.
+func finishAofRewrite(rw *aofRewrite) {
+	gAof.mu.Lock()
+	gAof.rewrite = nil
+	buf := rw.buf
+	err := rw.err
+	gAof.mu.Unlock()
+
+	if err == nil {
+		_, err = rw.w.Write(buf)
+	}
+	if err == nil {
+		err = rw.f.Sync()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = rw.f.Stat()
+	}
+	if err == nil {
+		err = os.Rename(rw.tmp, aofPath())
+	}
+	if err != nil {
+		util.Msg("AOF rewrite: " + err.Error())
+		rw.f.Close()
+		os.Remove(rw.tmp)
+		gAof.mu.Lock()
+		gAof.rewriteStatus = "err"
+		gAof.mu.Unlock()
+		return
+	}
+	if err := syncDir(filepath.Dir(aofPath())); err != nil {
+		util.Msg("AOF rewrite: " + err.Error())
+	}
+
+	// The new file is already at its end, writes continue from there
+	gAof.mu.Lock()
+	old := gAof.file
+	gAof.file = rw.f
+	gAof.seal = rw.w.s
+	gAof.size = info.Size()
+	gAof.baseSize = info.Size()
+	gAof.db = rw.db
+	gAof.unsynced = false
+	gAof.rewriteStatus = "ok"
+	gAof.mu.Unlock()
+	old.Close()
+}
+
+// aofCron finishes a rewrite whose dataset is written and starts one when
+// the AOF has grown by auto-aof-rewrite-percentage since the last one.
+// Called by the event loop.
+func aofCron() {
+	if gAof.file == nil {
+		return
+	}
+	gAof.mu.Lock()
+	rw := gAof.rewrite
+	done := rw != nil && rw.done
+	gAof.mu.Unlock()
+	if done {
+		finishAofRewrite(rw)
+		return
+	}
+
+	pct := gConfig.autoAofRewritePercentage
+	if rw != nil || pct <= 0 || gAof.size < gConfig.autoAofRewriteMinSize {
+		return
+	}
+	base := gAof.baseSize
+	if base < 1 {
+		base = 1
+	}
+	if (gAof.size-base)*100/base < int64(pct) {
+		return
+	}
+	gMap.Lock()
+	defer gMap.Unlock()
+	if gSave.job == nil {
+		if err := startAofRewrite(); err != nil {
+			util.Msg("AOF rewrite: " + err.Error())
+		}
+	}
+}
+
+// bgrewriteaof
+func doBgRewriteAof(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	if err := startAofRewrite(); err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+	return []byte("Background append only file rewriting started"), RES_OK
+}
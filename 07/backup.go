@@ -0,0 +1,360 @@
+package main
+
+import (
+	"byor/04/util"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -backup-dir, the server writes snapshots into that directory on
+// the cron schedule of -backup-schedule, named after the UTC time they
+// were taken at, like backup-20240131T153000Z.snap. They are written
+// like a BGSAVE, and encrypted if the data files are.
+//
+// The manifest of the directory lists the backups, oldest first, with a
+// "name size sha256" line each. It is replaced through a temp file after
+// each backup. Then the backups beyond -backup-keep or older than
+// -backup-max-age are removed, except the newest one. A backup is restored
+// by the restore tool, which verifies its checksum.
+
+const (
+	kBackupManifest   = "MANIFEST"
+	kBackupPrefix     = "backup-"
+	kBackupSuffix     = ".snap"
+	kBackupTimeLayout = "20060102T150405Z"
+)
+
+var gBackup = struct {
+	schedule   *cronSchedule
+	lastMinute int64  // unix minute of the last schedule check
+	pending    bool   // a scheduled backup waits for the running save
+	running    bool   // until the manifest is updated
+	last       int64  // unix time of the last successful backup
+	lastStatus string // of the last backup
+}{lastStatus: "ok"}
+
+// A cronSchedule holds the allowed values of each field of a cron line,
+// as bit sets.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool // the field was "*"
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses a cron line: minute, hour, day of month, month and
+// day of week, each a "*", a number, a range "a-b", a list of those, with
+// an optional step "/n". Sunday is 0 or 7. Macros like @daily are allowed.
+func parseCron(s string) (*cronSchedule, error) {
+	if line, ok := cronMacros[strings.ToLower(strings.TrimSpace(s))]; ok {
+		s = line
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, errors.New("a schedule has 5 fields: minute hour day month weekday")
+	}
+	c := &cronSchedule{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("field %d %q: %v", i+1, field, err)
+		}
+		*sets[i] = set
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // Sunday
+	}
+	return c, nil
+}
+
+func parseCronField(field string, lo int, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, errors.New("bad step")
+			}
+			step = n
+			part = part[:i]
+		}
+		from, to := lo, hi
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.New("not a number")
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.New("not a number")
+				}
+			} else if step > 1 {
+				to = hi // "a/n" runs to the end
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("out of range %d-%d", lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the schedule fires at the minute of `t`. Like
+// cron, when both days are restricted, either may match.
+func (c *cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 ||
+		c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// backupInit parses the schedule if backups are on.
+func backupInit() error {
+	if gConfig.backupDir == "" {
+		return nil
+	}
+	if gConfig.storage != StorageMemory {
+		return errors.New("backups are not supported by the lsm storage engine")
+	}
+	schedule, err := parseCron(gConfig.backupSchedule)
+	if err != nil {
+		return fmt.Errorf("backup schedule: %v", err)
+	}
+	gBackup.schedule = schedule
+	return os.MkdirAll(gConfig.backupDir, 0755)
+}
+
+// backupCron starts the scheduled backups. A backup due while a save
+// runs is started once it ends. Called by the event loop.
+func backupCron() {
+	if gBackup.schedule == nil {
+		return
+	}
+	now := time.Now()
+	if minute := now.Unix() / 60; minute != gBackup.lastMinute {
+		gBackup.lastMinute = minute
+		if gBackup.schedule.matches(now) {
+			gBackup.pending = true
+		}
+	}
+	if !gBackup.pending {
+		return
+	}
+	gMap.Lock()
+	defer gMap.Unlock()
+	if gSave.job != nil || gBackup.running {
+		return
+	}
+	gBackup.pending = false
+	startBackup(now)
+}
+
+// startBackup writes a backup from a goroutine. The caller must hold the
+// write lock of gMap, and check that no save or backup runs.
+func startBackup(now time.Time) {
+	job := newSnapshotJob(appendRecord)
+	gBackup.running = true
+	dir := gConfig.backupDir
+	name := backupName(now)
+
+	go func() {
+		err := writeSnapshot(filepath.Join(dir, name), job.dbs, job.record)
+		gMap.Lock()
+		gSave.job = nil
+		gMap.Unlock()
+		if err == nil {
+			err = recordBackup(dir, name, now, gConfig.backupKeep, gConfig.backupMaxAge)
+		}
+
+		gMap.Lock()
+		defer gMap.Unlock()
+		gBackup.running = false
+		if err != nil {
+			util.Msg("backup: " + err.Error())
+			gBackup.lastStatus = "err"
+			return
+		}
+		gBackup.last = now.Unix()
+		gBackup.lastStatus = "ok"
+	}()
+}
+
+func backupName(t time.Time) string {
+	return kBackupPrefix + t.UTC().Format(kBackupTimeLayout) + kBackupSuffix
+}
+
+// backupTime returns the time of a backup from its name.
+func backupTime(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, kBackupPrefix) || !strings.HasSuffix(name, kBackupSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(kBackupTimeLayout, name[len(kBackupPrefix):len(name)-len(kBackupSuffix)])
+	return t, err == nil
+}
+
+type backupEntry struct {
+	name   string
+	size   int64
+	sha256 string // in hex
+}
+
+// readBackupManifest returns the backups listed in the manifest of `dir`,
+// none if it doesn't exist.
+func readBackupManifest(dir string) ([]backupEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, kBackupManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var out []backupEntry
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: bad line %d", kBackupManifest, i+1)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if _, ok := backupTime(fields[0]); !ok || err != nil {
+			return nil, fmt.Errorf("%s: bad line %d", kBackupManifest, i+1)
+		}
+		out = append(out, backupEntry{name: fields[0], size: size, sha256: fields[2]})
+	}
+	return out, nil
+}
+
+// writeBackupManifest replaces the manifest of `dir` through a temp file.
+func writeBackupManifest(dir string, backups []backupEntry) error {
+	var b bytes.Buffer
+	for _, e := range backups {
+		fmt.Fprintf(&b, "%s %d %s\n", e.name, e.size, e.sha256)
+	}
+	path := filepath.Join(dir, kBackupManifest)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// fileSha256 returns the size and the SHA-256 of the file at `path`.
+func fileSha256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordBackup adds the backup `name`, taken at `now`, to the manifest of
+// `dir`, then prunes the backups beyond `keep` or older than `maxAge`.
+// Zero means no limit. The newest backup is always kept.
+func recordBackup(dir string, name string, now time.Time, keep int, maxAge time.Duration) error {
+	size, sum, err := fileSha256(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	backups, err := readBackupManifest(dir)
+	if err != nil {
+		return err
+	}
+	kept := backups[:0]
+	for _, e := range backups {
+		if e.name != name { // taken twice within a second
+			kept = append(kept, e)
+		}
+	}
+	backups = append(kept, backupEntry{name: name, size: size, sha256: sum})
+	sort.Slice(backups, func(i, j int) bool { return backups[i].name < backups[j].name })
+
+	// The names sort by time
+	var pruned []backupEntry
+	for len(backups) > 1 {
+		t, _ := backupTime(backups[0].name)
+		if (keep <= 0 || len(backups) <= keep) && (maxAge <= 0 || now.Sub(t) <= maxAge) {
+			break
+		}
+		pruned = append(pruned, backups[0])
+		backups = backups[1:]
+	}
+	// The manifest never lists a removed backup
+	if err := writeBackupManifest(dir, backups); err != nil {
+		return err
+	}
+	for _, e := range pruned {
+		if err := os.Remove(filepath.Join(dir, e.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// backup
+// Takes a backup now, like a scheduled one.
+func doBackup(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	if gConfig.backupDir == "" {
+		return []byte("backups are off, set -backup-dir"), RES_ERR
+	}
+	if gBackup.running {
+		return []byte("backup already in progress"), RES_ERR
+	}
+	if gSave.job != nil {
+		return errJobRunning(), RES_ERR
+	}
+	startBackup(time.Now())
+	return []byte("Background backup started"), RES_OK
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	for _, c := range []struct {
+		spec string
+		at   string
+		want bool
+	}{
+		{"@hourly", "2024-01-31 15:00", true},
+		{"@hourly", "2024-01-31 15:01", false},
+		{"*/15 * * * *", "2024-01-31 15:45", true},
+		{"*/15 * * * *", "2024-01-31 15:46", false},
+		{"5/20 * * * *", "2024-02-02 00:45", true},
+		{"30 2-4,8 * * *", "2024-01-31 08:30", true},
+		{"30 2-4,8 * * *", "2024-01-31 05:30", false},
+		{"0 0 * * 7", "2024-02-04 00:00", true}, // a Sunday
+		// Either the day of the month or of the week, as in cron
+		{"0 0 1 * 1", "2024-02-05 00:00", true},
+		{"0 0 1 * 1", "2024-02-01 00:00", true},
+		{"0 0 1 * 1", "2024-02-02 00:00", false},
+		{"0 0 1 * *", "2024-02-02 00:00", false},
+	} {
+		s, err := parseCron(c.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", c.spec, err)
+		}
+		at, _ := time.ParseInLocation("2006-01-02 15:04", c.at, time.Local)
+		if got := s.matches(at); got != c.want {
+			t.Errorf("%s at %s: %v", c.spec, c.at, got)
+		}
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "a * * * *", "*/0 * * * *", "5-1 * * * *", "0 0 0 * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parsed %q", spec)
+		}
+	}
+}
+
+// addBackup writes a backup file taken at `now` and records it.
+func addBackup(t *testing.T, dir string, now time.Time, keep int, maxAge time.Duration) string {
+	name := backupName(now)
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordBackup(dir, name, now, keep, maxAge); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// checkBackups checks that the manifest and the backup files are `want`.
+func checkBackups(t *testing.T, dir string, want ...string) {
+	t.Helper()
+	backups, err := readBackupManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, kBackupPrefix+"*"))
+	if len(backups) != len(want) || len(files) != len(want) {
+		t.Fatalf("%d backups in the manifest and %d files, want %d", len(backups), len(files), len(want))
+	}
+	for i, e := range backups {
+		if e.name != want[i] || filepath.Base(files[i]) != want[i] {
+			t.Fatalf("backup %d: %s, want %s", i, e.name, want[i])
+		}
+	}
+}
+
+func TestRecordBackup(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var names []string
+	for i := 0; i < 10; i++ {
+		names = append(names, addBackup(t, dir, base.Add(time.Duration(i)*time.Hour), 5, 0))
+	}
+	checkBackups(t, dir, names[5:]...)
+
+	// The age prunes more than the count
+	last := addBackup(t, dir, base.Add(10*time.Hour), 5, 3*time.Hour)
+	checkBackups(t, dir, names[7], names[8], names[9], last)
+
+	// The newest backup is kept however old
+	old := addBackup(t, dir, base.Add(20*time.Hour), 5, time.Minute)
+	if err := recordBackup(dir, old, base.Add(100*time.Hour), 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	checkBackups(t, dir, old)
+}
+
+func TestBackupRestore(t *testing.T) {
+	s := newTestServer(t)
+	gConfig.backupDir = t.TempDir()
+	t.Cleanup(func() { gConfig.backupDir = "" })
+	s.expect("", "set", "a", "1")
+	s.expect("1", "hset", "h", "f", "v")
+
+	s.expect("Background backup started", "backup")
+	for i := 0; ; i++ {
+		gMap.RLock()
+		running := gBackup.running
+		gMap.RUnlock()
+		if !running {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("the backup didn't end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if gBackup.lastStatus != "ok" {
+		t.Fatal("the backup failed")
+	}
+	backups, err := readBackupManifest(gConfig.backupDir)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("%d backups: %v", len(backups), err)
+	}
+	path := filepath.Join(gConfig.backupDir, backups[0].name)
+	if size, sum, err := fileSha256(path); err != nil || size != backups[0].size || sum != backups[0].sha256 {
+		t.Fatalf("the manifest doesn't match the backup: %v", err)
+	}
+
+	initKeyspace(16)
+	if err := loadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	s.expect("1", "get", "a")
+	s.expect("v", "hget", "h", "f")
+}
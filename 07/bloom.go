@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// A scalable Bloom filter (Almeida et al.). It starts with one filter
+// sized for the capacity and error rate given at creation. When that is
+// full, a sub-filter `expansion` times larger is added with half the
+// error rate, so the sum of the error rates stays below the target.
+type bloomLayer struct {
+	bits     []uint64
+	nbits    uint64
+	k        uint32 // number of hash functions
+	capacity uint64
+	count    uint64
+}
+
+type BloomFilter struct {
+	errorRate  float64
+	expansion  uint32
+	nonScaling bool
+	layers     []*bloomLayer
+}
+
+const (
+	kBloomDefaultErrorRate = 0.01
+	kBloomDefaultCapacity  = 100
+	kBloomDefaultExpansion = 2
+	kBloomTightening       = 0.5
+	kBloomMaxBits          = 1 << 32 // of all the sub-filters, 512 MiB
+)
+
+// bloomBits returns the size in bits of a sub-filter for `capacity` items
+// at `errorRate`. It is a float so callers can check it against
+// kBloomMaxBits before it overflows.
+func bloomBits(capacity float64, errorRate float64) float64 {
+	// m = -n*ln(p) / ln(2)^2
+	return math.Max(64, math.Ceil(-capacity*math.Log(errorRate)/(math.Ln2*math.Ln2)))
+}
+
+// bloomHashes returns the number of hash functions of a sub-filter at
+// `errorRate`.
+func bloomHashes(errorRate float64) uint32 {
+	// k = -log2(p)
+	k := uint32(math.Ceil(-math.Log2(errorRate)))
+	if k < 1 {
+		k = 1
+	}
+	return k
+}
+
+// layerRate returns the error rate of the i-th sub-filter, 0 being the
+// first.
+func (bf *BloomFilter) layerRate(i int) float64 {
+	return bf.errorRate * math.Pow(kBloomTightening, float64(i+1))
+}
+
+// newBloomLayer creates a sub-filter. The caller must check its size
+// against kBloomMaxBits.
+func newBloomLayer(capacity uint64, errorRate float64) *bloomLayer {
+	nbits := uint64(bloomBits(float64(capacity), errorRate))
+	return &bloomLayer{
+		bits:     make([]uint64, (nbits+63)/64),
+		nbits:    nbits,
+		k:        bloomHashes(errorRate),
+		capacity: capacity,
+	}
+}
+
+func newBloomFilter(errorRate float64, capacity uint64, expansion uint32, nonScaling bool) *BloomFilter {
+	bf := &BloomFilter{errorRate: errorRate, expansion: expansion, nonScaling: nonScaling}
+	bf.layers = append(bf.layers, newBloomLayer(capacity, bf.layerRate(0)))
+	return bf
+}
+
+// bloomHash returns two independent hashes of the item. The k bit
+// positions are derived from them by double hashing.
+func bloomHash(item string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(item))
+	sum := h.Sum(nil)
+	h1 := uint64(0)
+	h2 := uint64(0)
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[8+i])
+	}
+	return h1, h2 | 1
+}
+
+func (l *bloomLayer) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < uint64(l.k); i++ {
+		pos := (h1 + i*h2) % l.nbits
+		if l.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *bloomLayer) set(h1, h2 uint64) {
+	for i := uint64(0); i < uint64(l.k); i++ {
+		pos := (h1 + i*h2) % l.nbits
+		l.bits[pos/64] |= 1 << (pos % 64)
+	}
+	l.count++
+}
+
+var (
+	errBloomFull     = errors.New("non scaling filter is full")
+	errBloomTooLarge = errors.New("filter is full and too large to expand")
+)
+
+// Add inserts the item. Returns false if it may already be present.
+func (bf *BloomFilter) Add(item string) (bool, error) {
+	h1, h2 := bloomHash(item)
+	for _, l := range bf.layers {
+		if l.test(h1, h2) {
+			return false, nil
+		}
+	}
+	last := bf.layers[len(bf.layers)-1]
+	if last.count >= last.capacity {
+		if bf.nonScaling {
+			return false, errBloomFull
+		}
+		capacity := float64(last.capacity) * float64(bf.expansion)
+		rate := bf.layerRate(len(bf.layers))
+		if float64(bf.bits())+bloomBits(capacity, rate) > kBloomMaxBits {
+			return false, errBloomTooLarge
+		}
+		last = newBloomLayer(last.capacity*uint64(bf.expansion), rate)
+		bf.layers = append(bf.layers, last)
+	}
+	last.set(h1, h2)
+	return true, nil
+}
+
+// Exists reports whether the item may be present.
+func (bf *BloomFilter) Exists(item string) bool {
+	h1, h2 := bloomHash(item)
+	for _, l := range bf.layers {
+		if l.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bf *BloomFilter) Capacity() uint64 {
+	total := uint64(0)
+	for _, l := range bf.layers {
+		total += l.capacity
+	}
+	return total
+}
+
+func (bf *BloomFilter) Count() uint64 {
+	total := uint64(0)
+	for _, l := range bf.layers {
+		total += l.count
+	}
+	return total
+}
+
+// bits returns the size in bits of all the sub-filters.
+func (bf *BloomFilter) bits() uint64 {
+	total := uint64(0)
+	for _, l := range bf.layers {
+		total += l.nbits
+	}
+	return total
+}
+
+func (bf *BloomFilter) Bytes() uint64 {
+	total := uint64(0)
+	for _, l := range bf.layers {
+		total += uint64(len(l.bits)) * 8
+	}
+	return total
+}
+
+// FillRatio returns the fraction of bits set over all sub-filters.
+func (bf *BloomFilter) FillRatio() float64 {
+	set := 0
+	total := uint64(0)
+	for _, l := range bf.layers {
+		for _, w := range l.bits {
+			set += bits.OnesCount64(w)
+		}
+		total += l.nbits
+	}
+	return float64(set) / float64(total)
+}
+
+// Encode serializes the filter.
+func (bf *BloomFilter) Encode(out []byte) []byte {
+	out = appendF64(out, bf.errorRate)
+	out = appendU32(out, bf.expansion)
+	if bf.nonScaling {
+		out = append(out, 1)
+	} else {
+		out = append(out, 0)
+	}
+	out = appendU32(out, uint32(len(bf.layers)))
+	for _, l := range bf.layers {
+		out = appendU64(out, l.capacity)
+		out = appendU64(out, l.count)
+		out = appendU32(out, l.k)
+		out = appendU64(out, l.nbits)
+		for _, w := range l.bits {
+			out = appendU64(out, w)
+		}
+	}
+	return out
+}
+
+// decodeBloomFilter reads a filter written by Encode(). Every sub-filter
+// must have the size and hash count that Add() would give it.
+func decodeBloomFilter(d *decoder) (*BloomFilter, error) {
+	bf := &BloomFilter{}
+	bf.errorRate = d.f64()
+	bf.expansion = d.u32()
+	bf.nonScaling = d.u8() != 0
+	n := d.u32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if !(bf.errorRate > 0 && bf.errorRate < 1) || bf.expansion == 0 || n == 0 {
+		return nil, errBadData
+	}
+	total := uint64(0)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		l := &bloomLayer{}
+		l.capacity = d.u64()
+		l.count = d.u64()
+		l.k = d.u32()
+		l.nbits = d.u64()
+		if d.err != nil {
+			break
+		}
+		rate := bf.layerRate(int(i))
+		if l.capacity == 0 || l.count > l.capacity || l.k != bloomHashes(rate) ||
+			float64(l.nbits) != bloomBits(float64(l.capacity), rate) {
+			return nil, errBadData
+		}
+		if i > 0 {
+			prev := bf.layers[i-1].capacity
+			if l.capacity/uint64(bf.expansion) != prev || l.capacity%uint64(bf.expansion) != 0 {
+				return nil, errBadData
+			}
+		}
+		if total += l.nbits; total > kBloomMaxBits {
+			return nil, errBadData
+		}
+		if l.nbits > uint64(len(d.data))*8 {
+			return nil, errShortData
+		}
+		l.bits = make([]uint64, (l.nbits+63)/64)
+		for j := range l.bits {
+			l.bits[j] = d.u64()
+		}
+		bf.layers = append(bf.layers, l)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return bf, nil
+}
+
+// lookupBloom returns the Bloom filter at `key`, creating one with the
+// default parameters if `create` is set. The caller must hold the lock of
+// gMap.
+func lookupBloom(key string, create bool) (*BloomFilter, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		if !create {
+			return nil, ""
+		}
+		bf := newBloomFilter(kBloomDefaultErrorRate, kBloomDefaultCapacity, kBloomDefaultExpansion, false)
+		dbSet(key, &Entry{typ: TypeBloom, val: bf})
+		return bf, ""
+	}
+	if ent.typ != TypeBloom {
+		return nil, errWrongType
+	}
+	return ent.val.(*BloomFilter), ""
+}
+
+// bf.reserve key error_rate capacity [EXPANSION n] [NONSCALING]
+func doBfReserve(cmd []string) ([]byte, ResponseCode) {
+	errorRate, err := strconv.ParseFloat(cmd[2], 64)
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		return []byte("error rate should be between 0 and 1"), RES_ERR
+	}
+	capacity, err := strconv.ParseUint(cmd[3], 10, 64)
+	if err != nil || capacity == 0 {
+		return []byte("capacity should be positive"), RES_ERR
+	}
+	expansion := uint64(kBloomDefaultExpansion)
+	nonScaling := false
+	for i := 4; i < len(cmd); i++ {
+		if cmdIs(cmd[i], "nonscaling") {
+			nonScaling = true
+		} else if cmdIs(cmd[i], "expansion") && i+1 < len(cmd) {
+			expansion, err = strconv.ParseUint(cmd[i+1], 10, 32)
+			if err != nil || expansion == 0 {
+				return []byte("expansion should be positive"), RES_ERR
+			}
+			i++
+		} else {
+			return []byte("syntax error"), RES_ERR
+		}
+	}
+	size := bloomBits(float64(capacity), errorRate*kBloomTightening)
+	if size > kBloomMaxBits {
+		return []byte("capacity is too large for the error rate"), RES_ERR
+	}
+	// The filter must be able to grow at least once
+	next := bloomBits(float64(capacity)*float64(expansion), errorRate*kBloomTightening*kBloomTightening)
+	if !nonScaling && size+next > kBloomMaxBits {
+		return []byte("expansion is too large"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	if _, ok := lookupEntry(cmd[1]); ok {
+		return []byte("item exists"), RES_ERR
+	}
+	bf := newBloomFilter(errorRate, capacity, uint32(expansion), nonScaling)
+	dbSet(cmd[1], &Entry{typ: TypeBloom, val: bf})
+	return nil, RES_OK
+}
+
+// bf.add key item
+func doBfAdd(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	bf, errMsg := lookupBloom(cmd[1], true)
+	if bf == nil {
+		return []byte(errMsg), RES_ERR
+	}
+	added, err := bf.Add(cmd[2])
+	if err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+	if added {
+		return []byte("1"), RES_OK
+	}
+	return []byte("0"), RES_OK
+}
+
+// bf.madd key item [item ...]
+func doBfMAdd(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	bf, errMsg := lookupBloom(cmd[1], true)
+	if bf == nil {
+		return []byte(errMsg), RES_ERR
+	}
+	out := []byte{}
+	outArr(&out, uint32(len(cmd)-2))
+	for _, item := range cmd[2:] {
+		added, err := bf.Add(item)
+		if err != nil {
+			outErr(&out, err.Error())
+		} else if added {
+			outInt(&out, 1)
+		} else {
+			outInt(&out, 0)
+		}
+	}
+	return out, RES_ARR
+}
+
+// bf.exists key item
+func doBfExists(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	bf, errMsg := lookupBloom(cmd[1], false)
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if bf != nil && bf.Exists(cmd[2]) {
+		return []byte("1"), RES_OK
+	}
+	return []byte("0"), RES_OK
+}
+
+// bf.mexists key item [item ...]
+func doBfMExists(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	bf, errMsg := lookupBloom(cmd[1], false)
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	out := []byte{}
+	outArr(&out, uint32(len(cmd)-2))
+	for _, item := range cmd[2:] {
+		if bf != nil && bf.Exists(item) {
+			outInt(&out, 1)
+		} else {
+			outInt(&out, 0)
+		}
+	}
+	return out, RES_ARR
+}
+
+// bf.info key
+func doBfInfo(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	bf, errMsg := lookupBloom(cmd[1], false)
+	if bf == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	out := []byte{}
+	outArr(&out, 14)
+	outStr(&out, "capacity")
+	outInt(&out, int64(bf.Capacity()))
+	outStr(&out, "items")
+	outInt(&out, int64(bf.Count()))
+	outStr(&out, "filters")
+	outInt(&out, int64(len(bf.layers)))
+	outStr(&out, "size")
+	outInt(&out, int64(bf.Bytes()))
+	outStr(&out, "fill_ratio")
+	outDbl(&out, bf.FillRatio())
+	outStr(&out, "error_rate")
+	outDbl(&out, bf.errorRate)
+	outStr(&out, "expansion")
+	outInt(&out, int64(bf.expansion))
+	return out, RES_ARR
+}
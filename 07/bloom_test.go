@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomCommands(t *testing.T) {
+	s := newTestServer(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"bf.reserve", "b", "0", "100"}, "(error) error rate should be between 0 and 1"},
+		{[]string{"bf.reserve", "b", "0.01", "0"}, "(error) capacity should be positive"},
+		{[]string{"bf.reserve", "b", "0.01", "1000000000000000000"}, "(error) capacity is too large for the error rate"},
+		{[]string{"bf.reserve", "b", "0.01", "1000", "expansion", "0"}, "(error) expansion should be positive"},
+		{[]string{"bf.reserve", "b", "0.01", "1000", "expansion", "4000000000"}, "(error) expansion is too large"},
+		{[]string{"exists", "b"}, "0"},
+		// A filter that never grows may have any expansion
+		{[]string{"bf.reserve", "b", "0.01", "3", "expansion", "4000000000", "nonscaling"}, ""},
+		{[]string{"bf.reserve", "b", "0.01", "3"}, "(error) item exists"},
+		{[]string{"bf.madd", "b", "x", "y", "z", "w"}, "[1 1 1 (error) non scaling filter is full]"},
+		{[]string{"bf.add", "b", "x"}, "0"},
+		{[]string{"bf.mexists", "b", "x", "w", "nokey"}, "[1 0 0]"},
+		// BF.ADD creates a filter with the defaults
+		{[]string{"bf.add", "d", "x"}, "1"},
+		{[]string{"bf.exists", "d", "x"}, "1"},
+		{[]string{"bf.exists", "d", "y"}, "0"},
+		{[]string{"bf.exists", "nokey", "x"}, "0"},
+		{[]string{"bf.info", "nokey"}, "(nil)"},
+		{[]string{"set", "str", "v"}, ""},
+		{[]string{"bf.add", "str", "x"}, "(error) " + errWrongType},
+	} {
+		s.expect(c.want, c.args...)
+	}
+}
+
+func TestBloomErrorRate(t *testing.T) {
+	const n = 20000
+	bf := newBloomFilter(0.01, 1000, 2, false)
+	for i := 0; i < n; i++ {
+		if _, err := bf.Add(fmt.Sprint("in", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No false negatives, and the false positives within the error rate
+	for i := 0; i < n; i++ {
+		if !bf.Exists(fmt.Sprint("in", i)) {
+			t.Fatalf("in%d is missing", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < 10*n; i++ {
+		if bf.Exists(fmt.Sprint("out", i)) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / (10 * n); rate > 0.01 {
+		t.Errorf("false positive rate %.4f", rate)
+	}
+	if len(bf.layers) != 5 || bf.Capacity() != 31000 {
+		t.Errorf("%d sub-filters for %d items", len(bf.layers), bf.Capacity())
+	}
+
+	got, err := decodeBloomFilter(&decoder{data: bf.Encode(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if !got.Exists(fmt.Sprint("in", i)) {
+			t.Fatalf("in%d is missing after decoding", i)
+		}
+	}
+}
+
+func TestBloomMaxBits(t *testing.T) {
+	// The next sub-filter would be 1000 << 20 items
+	bf := newBloomFilter(0.01, 1000, 1<<20, false)
+	bf.layers[0].count = bf.layers[0].capacity
+	if _, err := bf.Add("x"); err != errBloomTooLarge {
+		t.Fatalf("add to a full filter: %v", err)
+	}
+	if len(bf.layers) != 1 {
+		t.Fatalf("%d sub-filters", len(bf.layers))
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc64"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// check [-fix] [-key-file file] file...
+// Validates snapshot and AOF files offline. Prints where a file breaks,
+// and with -fix cuts it there so the server can load the valid part.
+// The formats are those of snapshot.go, aof.go and crypt.go. Encrypted
+// files are checked with the key of -key-file or $BYOR_ENCRYPTION_KEY.
+
+const (
+	kSnapshotMagic   = "BYORSNAP"
+	kSnapshotVersion = 1
+	kOpSelectDB      = 0xfe
+	kOpEOF           = 0xff
+	kMaxArgs         = 4096
+
+	kCryptMagic     = "BYORENC1"
+	kCryptHeaderLen = len(kCryptMagic) + 8 + 16
+	kCryptNonceLen  = 12
+)
+
+// The value types of the server, for reports
+var typeNames = []string{"string", "suggest", "vectorset", "bloom", "cms", "topk", "tdigest", "timeseries", "hash"}
+
+var gCrcTable = crc64.MakeTable(crc64.ECMA)
+
+// A breakage is where a file stops being valid. The data before `offset`
+// is a valid prefix.
+type breakage struct {
+	offset int
+	record int    // index of the bad record
+	what   string // the bad record, if known
+	reason string
+}
+
+func (b *breakage) String() string {
+	s := fmt.Sprintf("breaks at offset %d, record %d", b.offset, b.record)
+	if b.what != "" {
+		s += " (" + b.what + ")"
+	}
+	return s + ": " + b.reason
+}
+
+// reader reads little-endian fields, recording the first short read.
+type reader struct {
+	data []byte
+	pos  int
+	bad  bool
+}
+
+func (r *reader) bytes(n uint64) []byte {
+	if r.bad || n > uint64(len(r.data)-r.pos) {
+		r.bad = true
+		return nil
+	}
+	out := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return out
+}
+
+func (r *reader) u8() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) u64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// parseKey returns the AEAD and the key id of a key of 64 hex digits.
+func parseKey(s string) (cipher.AEAD, []byte, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != 32 {
+		return nil, nil, errors.New("an encryption key must be 64 hex digits")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(append([]byte("byor key id\x00"), raw...))
+	return aead, sum[:8], nil
+}
+
+// decrypt returns the content of an encrypted file, and where the file
+// breaks or nil. The content is that of the chunks before the breakage.
+func decrypt(data []byte, aead cipher.AEAD, id []byte) ([]byte, *breakage) {
+	if len(data) < kCryptHeaderLen {
+		return nil, &breakage{reason: "truncated encryption header"}
+	}
+	if aead == nil {
+		return nil, &breakage{reason: "encrypted, and no key is given"}
+	}
+	if !bytes.Equal(data[len(kCryptMagic):len(kCryptMagic)+8], id) {
+		return nil, &breakage{reason: fmt.Sprintf("encrypted with another key (id %x)", data[len(kCryptMagic):len(kCryptMagic)+8])}
+	}
+	salt := data[len(kCryptMagic)+8 : kCryptHeaderLen]
+	var plain []byte
+	r := &reader{data: data, pos: kCryptHeaderLen}
+	for chunks := 0; r.pos < len(data); chunks++ {
+		start := r.pos
+		sealed := r.bytes(uint64(r.u32()))
+		if r.bad || len(sealed) < kCryptNonceLen {
+			return plain, &breakage{offset: start, record: chunks, what: "encrypted chunk", reason: "incomplete chunk at the end (torn write)"}
+		}
+		ad := make([]byte, 24)
+		copy(ad, salt)
+		binary.LittleEndian.PutUint64(ad[16:], uint64(start))
+		chunk, err := aead.Open(nil, sealed[:kCryptNonceLen], sealed[kCryptNonceLen:], ad)
+		if err != nil {
+			return plain, &breakage{offset: start, record: chunks, what: "encrypted chunk", reason: "failed authentication, damaged or tampered with"}
+		}
+		plain = append(plain, chunk...)
+	}
+	return plain, nil
+}
+
+// checkSnapshot returns the number of records, and where the snapshot
+// breaks or nil.
+func checkSnapshot(data []byte) (int, *breakage) {
+	r := &reader{data: data}
+	r.bytes(uint64(len(kSnapshotMagic)))
+	if version := r.u32(); r.bad || version > kSnapshotVersion {
+		return 0, &breakage{reason: "bad header or unsupported version"}
+	}
+	records := 0
+	db := -1
+	for {
+		start := r.pos
+		op := r.u8()
+		switch {
+		case r.bad:
+			return records, &breakage{offset: start, record: records, reason: "truncated before the end marker"}
+		case op == kOpEOF:
+			sum := r.u64()
+			if r.bad {
+				return records, &breakage{offset: start, record: records, reason: "truncated checksum"}
+			}
+			if sum != crc64.Checksum(data[:start+1], gCrcTable) {
+				// The damage can be anywhere, so there is no valid prefix
+				return records, &breakage{offset: 0, record: 0, reason: "checksum mismatch"}
+			}
+			if r.pos != len(data) {
+				return records, &breakage{offset: r.pos, record: records, reason: "trailing data after the end marker"}
+			}
+			return records, nil
+		case op == kOpSelectDB:
+			db = int(r.u32())
+			if r.bad {
+				return records, &breakage{offset: start, record: records, reason: "truncated database selector"}
+			}
+			continue
+		case db < 0 || int(op) >= len(typeNames):
+			return records, &breakage{offset: start, record: records, reason: fmt.Sprintf("bad record type %d", op)}
+		}
+		r.u64() // expireAt
+		key := r.bytes(uint64(r.u32()))
+		what := fmt.Sprintf("%s in db %d", typeNames[op], db)
+		if !r.bad {
+			what = fmt.Sprintf("%s key %q in db %d", typeNames[op], key, db)
+		}
+		r.bytes(uint64(r.u32()))
+		if r.bad {
+			return records, &breakage{offset: start, record: records, what: what, reason: "truncated record"}
+		}
+		records++
+	}
+}
+
+// checkAof returns the number of records, and where the AOF breaks or
+// nil.
+func checkAof(data []byte) (int, *breakage) {
+	records := 0
+	pos := 0
+	for pos < len(data) {
+		r := &reader{data: data, pos: pos}
+		body := r.bytes(uint64(r.u32()))
+		if r.bad {
+			return records, &breakage{offset: pos, record: records, reason: "incomplete record at the end (torn write)"}
+		}
+		args, err := parseCmd(body)
+		what := ""
+		if len(args) > 0 {
+			what = summarize(args)
+		}
+		if err == nil {
+			err = checkPayload(args)
+		}
+		if err != nil {
+			return records, &breakage{offset: pos, record: records, what: what, reason: err.Error()}
+		}
+		pos = r.pos
+		records++
+	}
+	return records, nil
+}
+
+// parseCmd parses a request body, which must be used up exactly.
+func parseCmd(body []byte) ([]string, error) {
+	r := &reader{data: body}
+	n := r.u32()
+	if r.bad || n == 0 || n > kMaxArgs {
+		return nil, errors.New("bad argument count")
+	}
+	args := make([]string, 0, n)
+	for i := uint32(0); i < n; i++ {
+		arg := r.bytes(uint64(r.u32()))
+		if r.bad {
+			return args, errors.New("argument out of bounds")
+		}
+		args = append(args, string(arg))
+	}
+	if r.pos != len(body) {
+		return args, errors.New("trailing bytes in the record")
+	}
+	for _, c := range args[0] {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '.') {
+			return args, errors.New("not a command name")
+		}
+	}
+	return args, nil
+}
+
+// checkPayload verifies the checksum of the value of a RESTORE, which
+// ends with a CRC-64 of the rest.
+func checkPayload(args []string) error {
+	if !strings.EqualFold(args[0], "restore") || len(args) < 4 {
+		return nil
+	}
+	p := []byte(args[3])
+	if len(p) < 8 || binary.LittleEndian.Uint64(p[len(p)-8:]) != crc64.Checksum(p[:len(p)-8], gCrcTable) {
+		return errors.New("RESTORE payload checksum mismatch")
+	}
+	return nil
+}
+
+// summarize shortens a command for reports.
+func summarize(args []string) string {
+	parts := []string{}
+	for i, arg := range args {
+		if i == 3 {
+			parts = append(parts, "...")
+			break
+		}
+		if len(arg) > 32 {
+			arg = arg[:32] + "..."
+		}
+		parts = append(parts, fmt.Sprintf("%q", arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// fixSnapshot rewrites the snapshot as its valid prefix with a new end
+// marker and checksum, through a temp file.
+func fixSnapshot(path string, data []byte, offset int) error {
+	out := append([]byte(nil), data[:offset]...)
+	out = append(out, kOpEOF)
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], crc64.Checksum(out, gCrcTable))
+	out = append(out, sum[:]...)
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	if err := os.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checkEncrypted checks an encrypted file. A broken chunk is cut with
+// -fix in an AOF, other damage is only reported. Returns false if the
+// file is left broken.
+func checkEncrypted(path string, data []byte, fix bool, aead cipher.AEAD, id []byte) bool {
+	plain, brk := decrypt(data, aead, id)
+	kind := "encrypted AOF"
+	isSnapshot := bytes.HasPrefix(plain, []byte(kSnapshotMagic))
+	if isSnapshot {
+		kind = "encrypted snapshot"
+	}
+	if brk != nil {
+		fmt.Printf("%s: %s %s\n", path, kind, brk)
+		if !fix || isSnapshot || brk.offset < kCryptHeaderLen {
+			return false
+		}
+		if err := os.Truncate(path, int64(brk.offset)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		fmt.Printf("%s: fixed, kept %d chunks\n", path, brk.record)
+		data = data[:brk.offset]
+	}
+
+	var records int
+	if isSnapshot {
+		records, brk = checkSnapshot(plain)
+	} else {
+		records, brk = checkAof(plain)
+	}
+	if brk != nil {
+		fmt.Printf("%s: %s content %s\n", path, kind, brk)
+		return false
+	}
+	fmt.Printf("%s: %s OK, %d records, %d bytes\n", path, kind, records, len(data))
+	return true
+}
+
+// checkFile checks one file and fixes it if asked. Returns false if the
+// file is left broken.
+func checkFile(path string, fix bool, aead cipher.AEAD, id []byte) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	if bytes.HasPrefix(data, []byte(kCryptMagic)) {
+		return checkEncrypted(path, data, fix, aead, id)
+	}
+
+	isSnapshot := bytes.HasPrefix(data, []byte(kSnapshotMagic))
+	kind := "AOF"
+	var records int
+	var brk *breakage
+	if isSnapshot {
+		kind = "snapshot"
+		records, brk = checkSnapshot(data)
+	} else {
+		records, brk = checkAof(data)
+	}
+	if brk == nil {
+		fmt.Printf("%s: %s OK, %d records, %d bytes\n", path, kind, records, len(data))
+		return true
+	}
+	fmt.Printf("%s: %s %s\n", path, kind, brk)
+	fmt.Printf("%s: the first %d bytes (%d records) are valid, %d bytes after them are not\n",
+		path, brk.offset, brk.record, len(data)-brk.offset)
+	if !fix {
+		return false
+	}
+
+	if isSnapshot {
+		if brk.offset < len(kSnapshotMagic)+4 {
+			fmt.Printf("%s: can't fix, no valid prefix\n", path)
+			return false
+		}
+		err = fixSnapshot(path, data, brk.offset)
+	} else {
+		err = os.Truncate(path, int64(brk.offset))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	fmt.Printf("%s: fixed, kept %d records\n", path, brk.record)
+	return true
+}
+
+func main() {
+	fix := flag.Bool("fix", false, "cut broken files at the first bad record")
+	keyFile := flag.String("key-file", "", "file of the encryption key (default $BYOR_ENCRYPTION_KEY)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: check [-fix] [-key-file file] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	key := os.Getenv("BYOR_ENCRYPTION_KEY")
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		key = string(data)
+	}
+	var aead cipher.AEAD
+	var id []byte
+	if key != "" {
+		var err error
+		if aead, id, err = parseKey(key); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	ok := true
+	for _, path := range flag.Args() {
+		if !checkFile(path, *fix, aead, id) {
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
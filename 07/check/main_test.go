@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func appendU32(out []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(out, b[:]...)
+}
+
+func appendU64(out []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(out, b[:]...)
+}
+
+func appendStr(out []byte, s string) []byte {
+	return append(appendU32(out, uint32(len(s))), s...)
+}
+
+// aofRecord encodes a command like the server appends it.
+func aofRecord(args ...string) []byte {
+	body := appendU32(nil, uint32(len(args)))
+	for _, arg := range args {
+		body = appendStr(body, arg)
+	}
+	return append(appendU32(nil, uint32(len(body))), body...)
+}
+
+// restorePayload is a RESTORE value with a valid checksum.
+func restorePayload(body string) string {
+	return string(appendU64([]byte(body), crc64.Checksum([]byte(body), gCrcTable)))
+}
+
+// snapshotRecords returns the header and records of a snapshot of `n`
+// string keys in db 0, without the end marker.
+func snapshotRecords(n int) []byte {
+	out := appendU32([]byte(kSnapshotMagic), kSnapshotVersion)
+	out = appendU32(append(out, kOpSelectDB), 0)
+	for i := 0; i < n; i++ {
+		out = append(out, 0)
+		out = appendU64(out, 0)
+		out = appendStr(out, string(rune('a'+i)))
+		out = appendStr(out, "value")
+	}
+	return out
+}
+
+// endSnapshot appends the end marker and checksum.
+func endSnapshot(out []byte) []byte {
+	out = append(out, kOpEOF)
+	return appendU64(out, crc64.Checksum(out, gCrcTable))
+}
+
+func TestCheckAof(t *testing.T) {
+	set := aofRecord("set", "k", "v")
+	del := aofRecord("del", "k")
+	// One argument and a stray byte
+	trailing := append(appendStr(appendU32(nil, 1), "set"), 0)
+	badRestore := []byte(restorePayload("payload"))
+	badRestore[0] ^= 1
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		records int
+		offset  int
+		reason  string // empty if the AOF is valid
+	}{
+		{"empty", nil, 0, 0, ""},
+		{"valid", bytes.Join([][]byte{set, del, aofRecord("restore", "k", "0", restorePayload("payload"))}, nil), 3, 0, ""},
+		{"torn length", append(append([]byte{}, set...), 1, 0), 1, len(set), "torn write"},
+		{"torn body", append(append([]byte{}, set...), del[:len(del)-1]...), 1, len(set), "torn write"},
+		{"no arguments", append(appendU32(nil, 4), appendU32(nil, 0)...), 0, 0, "bad argument count"},
+		{"trailing bytes", append(appendU32(nil, uint32(len(trailing))), trailing...), 0, 0, "trailing bytes"},
+		{"not a command", append(append([]byte{}, set...), aofRecord("s3t", "k")...), 1, len(set), "not a command name"},
+		{"bad RESTORE checksum", aofRecord("restore", "k", "0", string(badRestore)), 0, 0, "checksum mismatch"},
+	} {
+		records, brk := checkAof(c.data)
+		if records != c.records {
+			t.Errorf("%s: %d records, want %d", c.name, records, c.records)
+		}
+		if c.reason == "" {
+			if brk != nil {
+				t.Errorf("%s: %s", c.name, brk)
+			}
+			continue
+		}
+		if brk == nil || brk.offset != c.offset || !strings.Contains(brk.reason, c.reason) {
+			t.Errorf("%s: %v, want a breakage at %d: %s", c.name, brk, c.offset, c.reason)
+		}
+	}
+}
+
+func TestCheckSnapshot(t *testing.T) {
+	three := snapshotRecords(3)
+	two := snapshotRecords(2)
+	badSum := endSnapshot(snapshotRecords(3))
+	badSum[len(badSum)-1] ^= 1
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		records int
+		offset  int
+		reason  string // empty if the snapshot is valid
+	}{
+		{"valid", endSnapshot(three), 3, 0, ""},
+		{"no records", endSnapshot(snapshotRecords(0)), 0, 0, ""},
+		{"bad version", endSnapshot(appendU32([]byte(kSnapshotMagic), kSnapshotVersion+1)), 0, 0, "unsupported version"},
+		{"no end marker", three, 3, len(three), "truncated before the end marker"},
+		{"torn record", three[:len(three)-2], 2, len(two), "truncated record"},
+		{"bad type", endSnapshot(append(append([]byte{}, two...), byte(len(typeNames)))), 2, len(two), "bad record type"},
+		{"checksum", badSum, 3, 0, "checksum mismatch"},
+		{"trailing data", append(endSnapshot(three), 0), 3, len(endSnapshot(three)), "trailing data"},
+	} {
+		records, brk := checkSnapshot(c.data)
+		if records != c.records {
+			t.Errorf("%s: %d records, want %d", c.name, records, c.records)
+		}
+		if c.reason == "" {
+			if brk != nil {
+				t.Errorf("%s: %s", c.name, brk)
+			}
+			continue
+		}
+		if brk == nil || brk.offset != c.offset || !strings.Contains(brk.reason, c.reason) {
+			t.Errorf("%s: %v, want a breakage at %d: %s", c.name, brk, c.offset, c.reason)
+		}
+	}
+}
+
+func TestCheckFix(t *testing.T) {
+	dir := t.TempDir()
+	set := aofRecord("set", "k", "v")
+	three := snapshotRecords(3)
+	for _, c := range []struct {
+		name string
+		data []byte
+		want []byte // the file after -fix
+	}{
+		{"aof", append(append([]byte{}, set...), set[:5]...), set},
+		{"snapshot", three[:len(three)-2], endSnapshot(snapshotRecords(2))},
+	} {
+		path := filepath.Join(dir, c.name)
+		if err := os.WriteFile(path, c.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if checkFile(path, false, nil, nil) {
+			t.Errorf("%s: a broken file passes", c.name)
+		}
+		if !checkFile(path, true, nil, nil) {
+			t.Errorf("%s: not fixed", c.name)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, c.want) {
+			t.Errorf("%s: %q after the fix, want %q", c.name, got, c.want)
+		}
+		if !checkFile(path, false, nil, nil) {
+			t.Errorf("%s: broken after the fix", c.name)
+		}
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	const key = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	aead, id, err := parseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	// seal writes the chunks like the server, authenticating the salt and
+	// the offset of each chunk.
+	seal := func(chunks ...string) []byte {
+		out := append(append([]byte(kCryptMagic), id...), salt...)
+		for _, chunk := range chunks {
+			ad := append(append([]byte{}, salt...), appendU64(nil, uint64(len(out)))...)
+			nonce := make([]byte, kCryptNonceLen)
+			rand.Read(nonce)
+			sealed := aead.Seal(nonce, nonce, []byte(chunk), ad)
+			out = append(appendU32(out, uint32(len(sealed))), sealed...)
+		}
+		return out
+	}
+	valid := seal("hello ", "world")
+	first := len(seal("hello "))
+	tampered := append([]byte{}, valid...)
+	tampered[len(tampered)-1] ^= 1
+	otherID := append([]byte{}, valid...)
+	otherID[len(kCryptMagic)] ^= 1
+	// Swapped chunks fail: each is bound to its offset
+	swapped := seal("world", "hello ")
+	copy(swapped[kCryptHeaderLen:], valid[first:])
+	copy(swapped[kCryptHeaderLen+len(valid)-first:], valid[kCryptHeaderLen:first])
+
+	for _, c := range []struct {
+		name   string
+		data   []byte
+		plain  string
+		offset int
+		reason string // empty if the file is valid
+	}{
+		{"valid", valid, "hello world", 0, ""},
+		{"header only", seal(), "", 0, ""},
+		{"torn header", valid[:kCryptHeaderLen-1], "", 0, "truncated encryption header"},
+		{"torn chunk", valid[:len(valid)-1], "hello ", first, "torn write"},
+		{"tampered", tampered, "hello ", first, "failed authentication"},
+		{"swapped", swapped, "", kCryptHeaderLen, "failed authentication"},
+		{"another key", otherID, "", 0, "encrypted with another key"},
+	} {
+		plain, brk := decrypt(c.data, aead, id)
+		if string(plain) != c.plain {
+			t.Errorf("%s: content %q, want %q", c.name, plain, c.plain)
+		}
+		if c.reason == "" {
+			if brk != nil {
+				t.Errorf("%s: %s", c.name, brk)
+			}
+			continue
+		}
+		if brk == nil || brk.offset != c.offset || !strings.Contains(brk.reason, c.reason) {
+			t.Errorf("%s: %v, want a breakage at %d: %s", c.name, brk, c.offset, c.reason)
+		}
+	}
+	if _, brk := decrypt(valid, nil, nil); brk == nil || !strings.Contains(brk.reason, "no key") {
+		t.Errorf("no key: %v", brk)
+	}
+}
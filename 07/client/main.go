@@ -4,6 +4,7 @@ import (
 	"byor/04/util"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
 	"syscall"
 )
@@ -52,11 +53,74 @@ func readRes(fd int) error {
 
 	// print the result
 	resCode := binary.LittleEndian.Uint32(rbuf[4:8])
+	if resCode == resArr {
+		fmt.Printf("server says: [%d]\n", resCode)
+		_, err = printValue(rbuf[8:4+length], "")
+		return err
+	}
 	fmt.Printf("server says: [%d] %s\n", resCode, string(rbuf[8:8+length-4]))
 
 	return nil
 }
 
+const resArr = 3
+
+// printValue prints one serialized value and returns the bytes consumed.
+func printValue(data []byte, indent string) (int, error) {
+	if len(data) < 1 {
+		return 0, fmt.Errorf("bad response")
+	}
+	switch data[0] {
+	case 0: // nil
+		fmt.Printf("%s(nil)\n", indent)
+		return 1, nil
+	case 1, 2: // err, str
+		if len(data) < 5 {
+			return 0, fmt.Errorf("bad response")
+		}
+		n := int(binary.LittleEndian.Uint32(data[1:5]))
+		if len(data) < 5+n {
+			return 0, fmt.Errorf("bad response")
+		}
+		tag := "str"
+		if data[0] == 1 {
+			tag = "err"
+		}
+		fmt.Printf("%s(%s) %s\n", indent, tag, string(data[5:5+n]))
+		return 5 + n, nil
+	case 3: // int
+		if len(data) < 9 {
+			return 0, fmt.Errorf("bad response")
+		}
+		fmt.Printf("%s(int) %d\n", indent, int64(binary.LittleEndian.Uint64(data[1:9])))
+		return 9, nil
+	case 4: // dbl
+		if len(data) < 9 {
+			return 0, fmt.Errorf("bad response")
+		}
+		fmt.Printf("%s(dbl) %g\n", indent, math.Float64frombits(binary.LittleEndian.Uint64(data[1:9])))
+		return 9, nil
+	case 5: // arr
+		if len(data) < 5 {
+			return 0, fmt.Errorf("bad response")
+		}
+		n := binary.LittleEndian.Uint32(data[1:5])
+		fmt.Printf("%s(arr) len=%d\n", indent, n)
+		pos := 5
+		for i := uint32(0); i < n; i++ {
+			rv, err := printValue(data[pos:], indent+"  ")
+			if err != nil {
+				return 0, err
+			}
+			pos += rv
+		}
+		fmt.Printf("%s(arr) end\n", indent)
+		return pos, nil
+	default:
+		return 0, fmt.Errorf("bad response")
+	}
+}
+
 func main() {
 	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
 	if err != nil {
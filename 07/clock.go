@@ -0,0 +1,33 @@
+package main
+
+import "time"
+
+// Clock is the time source of the server. Code that stores times in the
+// keyspace reads it through nowNs() so tests can swap in their own clock.
+type Clock interface {
+	// Now returns nanoseconds since the Unix epoch.
+	Now() int64
+}
+
+// monotonicClock reads the monotonic clock, anchored to the wall clock
+// when it is created. It never goes backwards when the wall clock is
+// adjusted, and stored times stay meaningful across restarts.
+type monotonicClock struct {
+	wall  int64
+	start time.Time
+}
+
+func newMonotonicClock() *monotonicClock {
+	start := time.Now()
+	return &monotonicClock{wall: start.UnixNano(), start: start}
+}
+
+func (c *monotonicClock) Now() int64 {
+	return c.wall + int64(time.Since(c.start))
+}
+
+var gClock Clock = newMonotonicClock()
+
+func nowNs() int64 {
+	return gClock.Now()
+}
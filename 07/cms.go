@@ -0,0 +1,315 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// A Count-Min Sketch is a `depth` x `width` matrix of counters. An item
+// increments one counter per row and its count is estimated by the
+// smallest of them, which never underestimates. The counters saturate at
+// the largest uint64 rather than wrap.
+type CountMinSketch struct {
+	width    uint32
+	depth    uint32
+	counters []uint64 // row major
+	total    uint64   // sum of all increments
+}
+
+// Bounds width*depth, 512 MiB of counters
+const kCmsMaxCounters = 1 << 26
+
+func newCountMinSketch(width, depth uint32) *CountMinSketch {
+	return &CountMinSketch{
+		width:    width,
+		depth:    depth,
+		counters: make([]uint64, uint64(width)*uint64(depth)),
+	}
+}
+
+// cmsDimsForError returns the dimensions for which an estimate is within
+// `errRate` * total of the true count with probability 1 - `prob`, or
+// false if the sketch would have more than kCmsMaxCounters.
+func cmsDimsForError(errRate, prob float64) (uint64, uint64, bool) {
+	width := math.Ceil(math.E / errRate)
+	depth := math.Max(1, math.Ceil(math.Log(1/prob)))
+	if width*depth > kCmsMaxCounters {
+		return 0, 0, false
+	}
+	return uint64(width), uint64(depth), true
+}
+
+// addSatU64 returns a+b, or the largest uint64 if that overflows.
+func addSatU64(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+// mulSatU64 returns a*b, or the largest uint64 if that overflows.
+func mulSatU64(a, b uint64) uint64 {
+	if hi, lo := bits.Mul64(a, b); hi == 0 {
+		return lo
+	}
+	return math.MaxUint64
+}
+
+// cmsReplyCount returns a count as a reply int, which tops out at the
+// largest int64.
+func cmsReplyCount(c uint64) int64 {
+	if c > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(c)
+}
+
+func (s *CountMinSketch) index(row uint32, h1, h2 uint64) int {
+	return int(uint64(row)*uint64(s.width) + (h1+uint64(row)*h2)%uint64(s.width))
+}
+
+// IncrBy adds `incr` to the item. Returns the new estimate.
+func (s *CountMinSketch) IncrBy(item string, incr uint64) uint64 {
+	h1, h2 := bloomHash(item)
+	est := uint64(math.MaxUint64)
+	for row := uint32(0); row < s.depth; row++ {
+		i := s.index(row, h1, h2)
+		s.counters[i] = addSatU64(s.counters[i], incr)
+		if s.counters[i] < est {
+			est = s.counters[i]
+		}
+	}
+	s.total = addSatU64(s.total, incr)
+	return est
+}
+
+// Query returns the estimated count of the item.
+func (s *CountMinSketch) Query(item string) uint64 {
+	h1, h2 := bloomHash(item)
+	est := uint64(math.MaxUint64)
+	for row := uint32(0); row < s.depth; row++ {
+		if c := s.counters[s.index(row, h1, h2)]; c < est {
+			est = c
+		}
+	}
+	return est
+}
+
+// Merge sets the sketch to the weighted sum of `srcs`, which must all have
+// the same dimensions as `s`.
+func (s *CountMinSketch) Merge(srcs []*CountMinSketch, weights []uint64) {
+	counters := make([]uint64, len(s.counters))
+	total := uint64(0)
+	for i, src := range srcs {
+		for j, c := range src.counters {
+			counters[j] = addSatU64(counters[j], mulSatU64(c, weights[i]))
+		}
+		total = addSatU64(total, mulSatU64(src.total, weights[i]))
+	}
+	s.counters = counters
+	s.total = total
+}
+
+func (s *CountMinSketch) Encode(out []byte) []byte {
+	out = appendU32(out, s.width)
+	out = appendU32(out, s.depth)
+	out = appendU64(out, s.total)
+	for _, c := range s.counters {
+		out = appendU64(out, c)
+	}
+	return out
+}
+
+func decodeCountMinSketch(d *decoder) (*CountMinSketch, error) {
+	width := d.u32()
+	depth := d.u32()
+	total := d.u64()
+	if d.err != nil {
+		return nil, d.err
+	}
+	n := uint64(width) * uint64(depth)
+	if n == 0 || n > kCmsMaxCounters {
+		return nil, errBadData
+	}
+	if n > uint64(len(d.data))/8 {
+		return nil, errShortData
+	}
+	s := newCountMinSketch(width, depth)
+	s.total = total
+	for i := range s.counters {
+		s.counters[i] = d.u64()
+	}
+	return s, d.err
+}
+
+// lookupCms returns the sketch at `key`. The caller must hold the lock of
+// gMap.
+func lookupCms(key string) (*CountMinSketch, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		return nil, ""
+	}
+	if ent.typ != TypeCms {
+		return nil, errWrongType
+	}
+	return ent.val.(*CountMinSketch), ""
+}
+
+func cmsCreate(key string, width, depth uint64) ([]byte, ResponseCode) {
+	if width*depth > kCmsMaxCounters {
+		return []byte("width * depth is too large"), RES_ERR
+	}
+	gMap.Lock()
+	defer gMap.Unlock()
+	if _, ok := lookupEntry(key); ok {
+		return []byte("item exists"), RES_ERR
+	}
+	dbSet(key, &Entry{typ: TypeCms, val: newCountMinSketch(uint32(width), uint32(depth))})
+	return nil, RES_OK
+}
+
+// cms.initbydim key width depth
+func doCmsInitByDim(cmd []string) ([]byte, ResponseCode) {
+	width, err1 := strconv.ParseUint(cmd[2], 10, 32)
+	depth, err2 := strconv.ParseUint(cmd[3], 10, 32)
+	if err1 != nil || err2 != nil || width == 0 || depth == 0 {
+		return []byte("expect positive int"), RES_ERR
+	}
+	return cmsCreate(cmd[1], width, depth)
+}
+
+// cms.initbyprob key error probability
+func doCmsInitByProb(cmd []string) ([]byte, ResponseCode) {
+	errRate, err1 := strconv.ParseFloat(cmd[2], 64)
+	prob, err2 := strconv.ParseFloat(cmd[3], 64)
+	if err1 != nil || err2 != nil || errRate <= 0 || errRate >= 1 || prob <= 0 || prob >= 1 {
+		return []byte("error and probability should be between 0 and 1"), RES_ERR
+	}
+	width, depth, ok := cmsDimsForError(errRate, prob)
+	if !ok {
+		return []byte("error rate too small"), RES_ERR
+	}
+	return cmsCreate(cmd[1], width, depth)
+}
+
+// cms.incrby key item incr [item incr ...]
+func doCmsIncrBy(cmd []string) ([]byte, ResponseCode) {
+	if len(cmd)%2 != 0 {
+		return []byte("syntax error"), RES_ERR
+	}
+	incrs := make([]uint64, 0, len(cmd)/2-1)
+	for i := 3; i < len(cmd); i += 2 {
+		incr, err := strconv.ParseUint(cmd[i], 10, 64)
+		if err != nil {
+			return []byte("expect int"), RES_ERR
+		}
+		incrs = append(incrs, incr)
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	s, errMsg := lookupCms(cmd[1])
+	if s == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	out := []byte{}
+	outArr(&out, uint32(len(incrs)))
+	for i, incr := range incrs {
+		outInt(&out, cmsReplyCount(s.IncrBy(cmd[2+2*i], incr)))
+	}
+	return out, RES_ARR
+}
+
+// cms.query key item [item ...]
+func doCmsQuery(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	s, errMsg := lookupCms(cmd[1])
+	if s == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	out := []byte{}
+	outArr(&out, uint32(len(cmd)-2))
+	for _, item := range cmd[2:] {
+		outInt(&out, cmsReplyCount(s.Query(item)))
+	}
+	return out, RES_ARR
+}
+
+// cms.merge dest numkeys src [src ...] [WEIGHTS w [w ...]]
+func doCmsMerge(cmd []string) ([]byte, ResponseCode) {
+	n, err := strconv.Atoi(cmd[2])
+	if err != nil || n <= 0 || 3+n > len(cmd) {
+		return []byte("bad number of keys"), RES_ERR
+	}
+	srcKeys := cmd[3 : 3+n]
+	weights := make([]uint64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	if rest := cmd[3+n:]; len(rest) > 0 {
+		if !cmdIs(rest[0], "weights") || len(rest) != n+1 {
+			return []byte("syntax error"), RES_ERR
+		}
+		for i := range weights {
+			weights[i], err = strconv.ParseUint(rest[1+i], 10, 64)
+			if err != nil {
+				return []byte("expect int"), RES_ERR
+			}
+		}
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	dst, errMsg := lookupCms(cmd[1])
+	if dst == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	srcs := make([]*CountMinSketch, n)
+	for i, key := range srcKeys {
+		srcs[i], errMsg = lookupCms(key)
+		if srcs[i] == nil {
+			if errMsg != "" {
+				return []byte(errMsg), RES_ERR
+			}
+			return nil, RES_NX
+		}
+		if srcs[i].width != dst.width || srcs[i].depth != dst.depth {
+			return []byte("sketch dimensions do not match"), RES_ERR
+		}
+	}
+	dst.Merge(srcs, weights)
+	return nil, RES_OK
+}
+
+// cms.info key
+func doCmsInfo(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	s, errMsg := lookupCms(cmd[1])
+	if s == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	out := []byte{}
+	outArr(&out, 6)
+	outStr(&out, "width")
+	outInt(&out, int64(s.width))
+	outStr(&out, "depth")
+	outInt(&out, int64(s.depth))
+	outStr(&out, "count")
+	outInt(&out, cmsReplyCount(s.total))
+	return out, RES_ARR
+}
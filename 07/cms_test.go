@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// zipfStream returns `n` draws of items from a Zipf distribution and their
+// exact counts.
+func zipfStream(seed int64, n int, items uint64) ([]string, map[string]uint64) {
+	z := rand.NewZipf(rand.New(rand.NewSource(seed)), 1.2, 1, items-1)
+	stream := make([]string, n)
+	exact := map[string]uint64{}
+	for i := range stream {
+		stream[i] = fmt.Sprint("item", z.Uint64())
+		exact[stream[i]]++
+	}
+	return stream, exact
+}
+
+func TestCmsBounds(t *testing.T) {
+	const errRate, prob = 0.001, 0.01
+	width, depth, ok := cmsDimsForError(errRate, prob)
+	if !ok {
+		t.Fatal("no dimensions")
+	}
+	for seed := int64(1); seed <= 5; seed++ {
+		s := newCountMinSketch(uint32(width), uint32(depth))
+		stream, exact := zipfStream(seed, 100000, 50000)
+		for i, item := range stream {
+			s.IncrBy(item, uint64(1+i%3))
+			exact[item] += uint64(i % 3) // IncrBy counted 1+i%3
+		}
+
+		over := 0
+		for item, count := range exact {
+			est := s.Query(item)
+			if est < count {
+				t.Fatalf("seed %d: %s estimated %d, counted %d", seed, item, est, count)
+			}
+			if float64(est-count) > errRate*float64(s.total) {
+				over++
+			}
+		}
+		// Each estimate is within the error with probability 1-prob
+		if float64(over) > 2*prob*float64(len(exact)) {
+			t.Errorf("seed %d: %d of %d estimates beyond the error", seed, over, len(exact))
+		}
+	}
+}
+
+func TestCmsMerge(t *testing.T) {
+	a, b, dst := newCountMinSketch(500, 4), newCountMinSketch(500, 4), newCountMinSketch(500, 4)
+	streamA, exactA := zipfStream(1, 5000, 1000)
+	streamB, exactB := zipfStream(2, 5000, 1000)
+	for _, item := range streamA {
+		a.IncrBy(item, 1)
+	}
+	for _, item := range streamB {
+		b.IncrBy(item, 1)
+	}
+	dst.Merge([]*CountMinSketch{a, b}, []uint64{2, 3})
+	for item := range exactA {
+		if want := 2*exactA[item] + 3*exactB[item]; dst.Query(item) < want {
+			t.Fatalf("%s estimated %d after merging, counted %d", item, dst.Query(item), want)
+		}
+	}
+	if dst.total != 2*a.total+3*b.total {
+		t.Fatalf("total %d", dst.total)
+	}
+}
+
+func TestCmsTooLarge(t *testing.T) {
+	for _, cmd := range [][]string{
+		{"cms.initbydim", "c", "4294967295", "4294967295"},
+		{"cms.initbydim", "c", "100000000", "1"},
+		{"cms.initbyprob", "c", "1e-300", "0.5"},
+		{"cms.initbyprob", "c", "0.0000001", "1e-300"},
+	} {
+		var code ResponseCode
+		if cmd[0] == "cms.initbydim" {
+			_, code = doCmsInitByDim(cmd)
+		} else {
+			_, code = doCmsInitByProb(cmd)
+		}
+		if code != RES_ERR {
+			t.Errorf("%v: %v, want an error", cmd, code)
+		}
+	}
+}
+
+func TestCmsSaturates(t *testing.T) {
+	s := newTestServer(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"cms.initbydim", "c", "100", "4"}, ""},
+		{[]string{"cms.initbydim", "d", "100", "4"}, ""},
+		{[]string{"cms.incrby", "c", "x", "18446744073709551615"}, "[9223372036854775807]"},
+		// A wrapped counter would read 0
+		{[]string{"cms.incrby", "c", "x", "1"}, "[9223372036854775807]"},
+		{[]string{"cms.incrby", "d", "x", "3"}, "[3]"},
+		{[]string{"cms.merge", "d", "2", "c", "d", "weights", "2", "1"}, ""},
+		{[]string{"cms.query", "d", "x", "y"}, "[9223372036854775807 0]"},
+		{[]string{"cms.info", "d"}, "[width 100 depth 4 count 9223372036854775807]"},
+	} {
+		s.expect(c.want, c.args...)
+	}
+
+	c := newCountMinSketch(100, 4)
+	c.IncrBy("x", math.MaxUint64-1)
+	c.IncrBy("x", 5)
+	if c.Query("x") != math.MaxUint64 || c.total != math.MaxUint64 {
+		t.Fatalf("count %d, total %d", c.Query("x"), c.total)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Helpers for the binary encoding of values. Every field is little-endian
+// and strings are prefixed by a uint32 length, like the request format.
+
+var (
+	errShortData = errors.New("data too short")
+	errBadData   = errors.New("bad data") // the fields break an invariant of the value
+)
+
+func appendF64(out []byte, val float64) []byte {
+	return appendU64(out, math.Float64bits(val))
+}
+
+func appendStr(out []byte, val string) []byte {
+	out = appendU32(out, uint32(len(val)))
+	return append(out, val...)
+}
+
+// decoder reads the fields back. After the first error every read returns
+// zero and `err` is kept.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = errShortData
+		return nil
+	}
+	out := d.data[:n]
+	d.data = d.data[n:]
+	return out
+}
+
+func (d *decoder) u8() byte {
+	b := d.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) u32() uint32 {
+	b := d.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) u64() uint64 {
+	b := d.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) f64() float64 {
+	return math.Float64frombits(d.u64())
+}
+
+func (d *decoder) str() string {
+	return string(d.bytes(int(d.u32())))
+}
+
+// encodeValue serializes the value of an entry, without its key or TTL.
+func encodeValue(ent *Entry, out []byte) []byte {
+	switch ent.typ {
+	case TypeStr:
+		return appendStr(out, string(ent.val.([]byte)))
+	case TypeSug:
+		return ent.val.(*SugDict).Encode(out)
+	case TypeVset:
+		return ent.val.(*VectorSet).Encode(out)
+	case TypeBloom:
+		return ent.val.(*BloomFilter).Encode(out)
+	case TypeCms:
+		return ent.val.(*CountMinSketch).Encode(out)
+	case TypeTopK:
+		return ent.val.(*TopK).Encode(out)
+	case TypeTDigest:
+		return ent.val.(*TDigest).Encode(out)
+	case TypeTs:
+		return ent.val.(*TimeSeries).Encode(out)
+	case TypeHash:
+		return ent.val.(*Hash).Encode(out)
+	default:
+		panic("unknown value type")
+	}
+}
+
+// decodeValue reads a value written by encodeValue.
+func decodeValue(typ ValueType, d *decoder) (interface{}, error) {
+	switch typ {
+	case TypeStr:
+		return []byte(d.str()), d.err
+	case TypeSug:
+		return decodeSugDict(d)
+	case TypeVset:
+		return decodeVectorSet(d)
+	case TypeBloom:
+		return decodeBloomFilter(d)
+	case TypeCms:
+		return decodeCountMinSketch(d)
+	case TypeTopK:
+		return decodeTopK(d)
+	case TypeTDigest:
+		return decodeTDigest(d)
+	case TypeTs:
+		return decodeTimeSeries(d)
+	case TypeHash:
+		return decodeHash(d)
+	default:
+		return nil, errors.New("unknown value type")
+	}
+}
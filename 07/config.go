@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const kDefaultDatabases = 16
+
+// Server settings, from the command line
+var gConfig = struct {
+	port             int
+	databases        int
+	maxmemory        int64 // in bytes, 0 for no limit
+	maxmemoryPolicy  EvictPolicy
+	maxmemorySamples int
+	dir              string // for the data files
+	dbfilename       string // of the snapshot
+	appendonly       bool
+	appendfsync      AofFsync
+	appendfilename   string
+
+	autoAofRewritePercentage int   // growth since the last rewrite, 0 for no auto rewrite
+	autoAofRewriteMinSize    int64 // of the AOF for an auto rewrite
+
+	storage         StorageEngine
+	lsmMemtableSize int64 // flushed to an SSTable when full
+
+	tierIdle    time.Duration // values idle longer are spilled to disk, 0 for never
+	tierMinSize int64         // of the entries to spill
+
+	encryptionKeyFile    string // see crypt.go
+	encryptionOldKeyFile string
+
+	backupDir      string        // of the scheduled backups, "" for none, see backup.go
+	backupSchedule string        // in the cron format
+	backupKeep     int           // backups kept, 0 for no limit
+	backupMaxAge   time.Duration // of the backups kept, 0 for no limit
+}{
+	port:             1234,
+	databases:        kDefaultDatabases,
+	maxmemoryPolicy:  EvictNone,
+	maxmemorySamples: 5,
+	dir:              ".",
+	dbfilename:       "dump.snap",
+	appendfsync:      FsyncEverySec,
+	appendfilename:   "appendonly.aof",
+
+	autoAofRewritePercentage: 100,
+	autoAofRewriteMinSize:    64 << 20,
+
+	lsmMemtableSize: 4 << 20,
+
+	tierMinSize: 256,
+
+	backupSchedule: "@hourly",
+	backupKeep:     24,
+}
+
+// parseMemSize parses a byte count with an optional kb, mb or gb suffix.
+func parseMemSize(s string) (int64, error) {
+	mult := int64(1)
+	lower := strings.ToLower(s)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"b", 1}} {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = lower[:len(lower)-len(u.suffix)]
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid memory size")
+	}
+	return n * mult, nil
+}
+
+func parseFlags() {
+	flag.IntVar(&gConfig.port, "port", gConfig.port, "TCP port to listen on")
+	flag.IntVar(&gConfig.databases, "databases", gConfig.databases, "number of databases")
+	flag.Func("maxmemory", "memory limit of the keyspace, like 100mb (default no limit)", func(s string) (err error) {
+		gConfig.maxmemory, err = parseMemSize(s)
+		return err
+	})
+	flag.Func("maxmemory-policy", "noeviction, allkeys-lru, allkeys-lfu or volatile-ttl", func(s string) error {
+		policy, ok := parseEvictPolicy(s)
+		if !ok {
+			return errors.New("unknown policy")
+		}
+		gConfig.maxmemoryPolicy = policy
+		return nil
+	})
+	flag.IntVar(&gConfig.maxmemorySamples, "maxmemory-samples", gConfig.maxmemorySamples, "keys sampled per eviction")
+	flag.StringVar(&gConfig.dir, "dir", gConfig.dir, "directory of the data files")
+	flag.StringVar(&gConfig.dbfilename, "dbfilename", gConfig.dbfilename, "snapshot file name")
+	flag.BoolVar(&gConfig.appendonly, "appendonly", gConfig.appendonly, "log write commands to the AOF")
+	flag.Func("appendfsync", "fsync of the AOF: always, everysec or no (default everysec)", func(s string) error {
+		policy, ok := parseAofFsync(s)
+		if !ok {
+			return errors.New("unknown fsync policy")
+		}
+		gConfig.appendfsync = policy
+		return nil
+	})
+	flag.StringVar(&gConfig.appendfilename, "appendfilename", gConfig.appendfilename, "AOF file name")
+	flag.IntVar(&gConfig.autoAofRewritePercentage, "auto-aof-rewrite-percentage", gConfig.autoAofRewritePercentage,
+		"rewrite the AOF when it grows by this percentage, 0 to disable")
+	flag.Func("auto-aof-rewrite-min-size", "minimum AOF size for an auto rewrite (default 64mb)", func(s string) (err error) {
+		gConfig.autoAofRewriteMinSize, err = parseMemSize(s)
+		return err
+	})
+	flag.Func("storage", "storage engine of the strings: memory or lsm (default memory)", func(s string) error {
+		engine, ok := parseStorageEngine(s)
+		if !ok {
+			return errors.New("unknown storage engine")
+		}
+		gConfig.storage = engine
+		return nil
+	})
+	flag.Func("lsm-memtable-size", "memtable size of the lsm storage engine (default 4mb)", func(s string) (err error) {
+		gConfig.lsmMemtableSize, err = parseMemSize(s)
+		return err
+	})
+	flag.DurationVar(&gConfig.tierIdle, "tier-idle", gConfig.tierIdle,
+		"spill values not accessed for this long to the value log, like 72h, 0 to disable")
+	flag.Func("tier-min-size", "minimum size of the keys to spill (default 256b)", func(s string) (err error) {
+		gConfig.tierMinSize, err = parseMemSize(s)
+		return err
+	})
+	flag.StringVar(&gConfig.encryptionKeyFile, "encryption-key-file", gConfig.encryptionKeyFile,
+		"file of the key that encrypts the snapshot and the AOF (default $"+kCryptKeyEnv+")")
+	flag.StringVar(&gConfig.encryptionOldKeyFile, "encryption-old-key-file", gConfig.encryptionOldKeyFile,
+		"file of the previous key, to rotate keys (default $"+kCryptOldKeyEnv+")")
+	flag.StringVar(&gConfig.backupDir, "backup-dir", gConfig.backupDir, "directory of the scheduled backups, none if empty")
+	flag.StringVar(&gConfig.backupSchedule, "backup-schedule", gConfig.backupSchedule,
+		"when to back up, like \"30 */6 * * *\" or @daily, in local time")
+	flag.IntVar(&gConfig.backupKeep, "backup-keep", gConfig.backupKeep, "number of backups kept, 0 for no limit")
+	flag.DurationVar(&gConfig.backupMaxAge, "backup-max-age", gConfig.backupMaxAge,
+		"remove backups older than this, like 168h, 0 for no limit")
+	flag.Parse()
+	if gConfig.databases < 1 {
+		gConfig.databases = 1
+	}
+	if gConfig.lsmMemtableSize < 4<<10 {
+		gConfig.lsmMemtableSize = 4 << 10
+	}
+	if gConfig.maxmemorySamples < 1 {
+		gConfig.maxmemorySamples = 1
+	}
+}
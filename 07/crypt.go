@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// With an encryption key, snapshots and AOFs are written encrypted with
+// AES-256-GCM, in chunks that are authenticated separately so the AOF
+// can be appended to:
+//
+//	header: "BYORENC1" key id[8] salt[16]
+//	chunk:  u32 length, nonce[12], ciphertext and tag
+//
+// The key id tells a wrong key apart from a damaged file. The nonces are
+// random. The chunk is also bound to the salt of the file and its offset
+// in it, so chunks can't be moved around or between files. Cutting the
+// file at a chunk boundary is caught by the checksum of a snapshot but not
+// in an AOF, where a torn chunk at the end is dropped like a torn record.
+//
+// The key is 64 hex digits, from -encryption-key-file or the
+// BYOR_ENCRYPTION_KEY variable. To rotate it, start with the new key and
+// the old one in -encryption-old-key-file or BYOR_ENCRYPTION_OLD_KEY: the
+// data files not under the new key are rewritten with it at startup.
+// Plaintext files are encrypted the same way, and an old key alone
+// decrypts the files.
+
+const (
+	kCryptMagic     = "BYORENC1"
+	kCryptHeaderLen = len(kCryptMagic) + 8 + 16
+	kCryptNonceLen  = 12
+	kCryptTagLen    = 16
+
+	kCryptKeyEnv    = "BYOR_ENCRYPTION_KEY"
+	kCryptOldKeyEnv = "BYOR_ENCRYPTION_OLD_KEY"
+)
+
+type cryptKey struct {
+	id   [8]byte
+	aead cipher.AEAD
+}
+
+var gCrypt = struct {
+	key *cryptKey // of the new files, nil if they are not encrypted
+	old *cryptKey // also accepted when reading, nil if none
+}{}
+
+var errNoCryptKey = errors.New("the file is encrypted but no encryption key is set")
+
+// parseCryptKey parses a key written as hex digits.
+func parseCryptKey(s string) (*cryptKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("an encryption key must be 64 hex digits")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k := &cryptKey{aead: aead}
+	sum := sha256.Sum256(append([]byte("byor key id\x00"), raw...))
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+// readCryptKey reads a key from the file at `path`, or from the variable
+// `env` if `path` is empty. Returns nil if neither is set.
+func readCryptKey(path string, env string) (*cryptKey, error) {
+	s := os.Getenv(env)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s = string(data)
+	}
+	if s == "" {
+		return nil, nil
+	}
+	return parseCryptKey(s)
+}
+
+// initCrypt loads the keys picked by the config.
+func initCrypt() error {
+	var err error
+	if gCrypt.key, err = readCryptKey(gConfig.encryptionKeyFile, kCryptKeyEnv); err != nil {
+		return fmt.Errorf("encryption key: %v", err)
+	}
+	if gCrypt.old, err = readCryptKey(gConfig.encryptionOldKeyFile, kCryptOldKeyEnv); err != nil {
+		return fmt.Errorf("old encryption key: %v", err)
+	}
+	if gCrypt.key != nil && gConfig.storage != StorageMemory {
+		return errors.New("encryption is not supported by the lsm storage engine")
+	}
+	return nil
+}
+
+// A sealer encrypts the chunks of a file. A nil sealer leaves them as is.
+type sealer struct {
+	key  *cryptKey
+	salt [16]byte
+}
+
+// newSealer returns the sealer of a new file, nil if encryption is off.
+func newSealer() (*sealer, error) {
+	if gCrypt.key == nil {
+		return nil, nil
+	}
+	s := &sealer{key: gCrypt.key}
+	if _, err := rand.Read(s.salt[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// current reports whether the file of the sealer is encrypted like new
+// files are.
+func (s *sealer) current() bool {
+	if s == nil {
+		return gCrypt.key == nil
+	}
+	return s.key == gCrypt.key
+}
+
+// header returns the start of the file.
+func (s *sealer) header() []byte {
+	if s == nil {
+		return nil
+	}
+	out := append([]byte(kCryptMagic), s.key.id[:]...)
+	return append(out, s.salt[:]...)
+}
+
+func (s *sealer) additionalData(off int64) []byte {
+	var ad [24]byte
+	copy(ad[:], s.salt[:])
+	binary.LittleEndian.PutUint64(ad[16:], uint64(off))
+	return ad[:]
+}
+
+// sealAt appends the nonce and ciphertext of `plain`, stored at offset
+// `off` of the file.
+func (s *sealer) sealAt(out []byte, plain []byte, off int64) []byte {
+	nonce := make([]byte, kCryptNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // the OS has no randomness left, nothing can be encrypted
+	}
+	out = append(out, nonce...)
+	return s.key.aead.Seal(out, nonce, plain, s.additionalData(off))
+}
+
+// openAt decrypts what sealAt() wrote at offset `off`.
+func (s *sealer) openAt(sealed []byte, off int64) ([]byte, error) {
+	if len(sealed) < kCryptNonceLen+kCryptTagLen {
+		return nil, errors.New("encrypted chunk too short")
+	}
+	nonce, ct := sealed[:kCryptNonceLen], sealed[kCryptNonceLen:]
+	plain, err := s.key.aead.Open(nil, nonce, ct, s.additionalData(off))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted chunk at offset %d failed authentication, the file is damaged or was tampered with", off)
+	}
+	return plain, nil
+}
+
+// wrap returns the chunk of `data` to write at offset `off`, or `data`
+// itself if the file is not encrypted.
+func (s *sealer) wrap(data []byte, off int64) []byte {
+	if s == nil {
+		return data
+	}
+	out := appendU32(nil, uint32(kCryptNonceLen+len(data)+kCryptTagLen))
+	return s.sealAt(out, data, off)
+}
+
+// sealWriter writes each write to `w` as a chunk.
+type sealWriter struct {
+	w   io.Writer
+	s   *sealer
+	off int64 // of the next chunk in the file
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	chunk := sw.s.wrap(p, sw.off)
+	if _, err := sw.w.Write(chunk); err != nil {
+		return 0, err
+	}
+	sw.off += int64(len(chunk))
+	return len(p), nil
+}
+
+// newSealWriter writes the header of a new file to `f` and returns the
+// writer of its content.
+func newSealWriter(f io.Writer) (*sealWriter, error) {
+	s, err := newSealer()
+	if err != nil {
+		return nil, err
+	}
+	header := s.header()
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: f, s: s, off: int64(len(header))}, nil
+}
+
+// readSealer returns the sealer of the file starting with `data`, nil if
+// the file is not encrypted.
+func readSealer(data []byte) (*sealer, error) {
+	if !bytes.HasPrefix(data, []byte(kCryptMagic)) {
+		return nil, nil
+	}
+	if len(data) < kCryptHeaderLen {
+		return nil, errors.New("truncated encryption header")
+	}
+	var id [8]byte
+	copy(id[:], data[len(kCryptMagic):])
+	s := &sealer{}
+	for _, k := range []*cryptKey{gCrypt.key, gCrypt.old} {
+		if k != nil && k.id == id {
+			s.key = k
+			break
+		}
+	}
+	if s.key == nil {
+		if gCrypt.key == nil && gCrypt.old == nil {
+			return nil, errNoCryptKey
+		}
+		return nil, fmt.Errorf("the file is encrypted with another key (id %x), wrong encryption key?", id)
+	}
+	copy(s.salt[:], data[len(kCryptMagic)+8:])
+	return s, nil
+}
+
+// fileSealer returns the sealer of the file at `path`.
+func fileSealer(path string) (*sealer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, kCryptHeaderLen)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return readSealer(header[:n])
+}
+
+// unseal returns the content of a data file, its sealer, and the length
+// of the file up to its last complete chunk. Files that are not encrypted
+// are returned as is, with a nil sealer.
+func unseal(data []byte) (plain []byte, s *sealer, end int, err error) {
+	if s, err = readSealer(data); err != nil || s == nil {
+		return data, nil, len(data), err
+	}
+
+	pos := kCryptHeaderLen
+	for pos < len(data) {
+		if len(data)-pos < 4 || uint64(len(data)-pos-4) < uint64(binary.LittleEndian.Uint32(data[pos:])) {
+			break // torn write
+		}
+		n := int(binary.LittleEndian.Uint32(data[pos:]))
+		chunk, err := s.openAt(data[pos+4:pos+4+n], int64(pos))
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		plain = append(plain, chunk...)
+		pos += 4 + n
+	}
+	return plain, s, pos, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey    = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testOldKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+// useCryptKeys encrypts new files with `key` and also reads those of
+// `old` until the test ends. An empty string is no key.
+func useCryptKeys(t *testing.T, key, old string) {
+	saved := gCrypt
+	t.Cleanup(func() { gCrypt = saved })
+	parse := func(s string) *cryptKey {
+		if s == "" {
+			return nil
+		}
+		k, err := parseCryptKey(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	gCrypt.key, gCrypt.old = parse(key), parse(old)
+}
+
+// sealChunks returns a file of the chunks encrypted with the current key.
+func sealChunks(t *testing.T, chunks ...string) []byte {
+	var buf bytes.Buffer
+	sw, err := newSealWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		sw.Write([]byte(chunk))
+	}
+	return buf.Bytes()
+}
+
+func TestParseCryptKey(t *testing.T) {
+	for _, c := range []struct {
+		key string
+		ok  bool
+	}{
+		{testKey, true},
+		{" " + testKey + "\n", true},
+		{strings.ToUpper(testKey), true},
+		{testKey[:62], false},
+		{testKey + "00", false},
+		{"x" + testKey[1:], false},
+		{"", false},
+	} {
+		if _, err := parseCryptKey(c.key); (err == nil) != c.ok {
+			t.Errorf("%q: %v", c.key, err)
+		}
+	}
+	a, _ := parseCryptKey(testKey)
+	b, _ := parseCryptKey(testOldKey)
+	if a.id == b.id {
+		t.Error("two keys have the same id")
+	}
+}
+
+func TestUnseal(t *testing.T) {
+	useCryptKeys(t, testKey, "")
+	file := sealChunks(t, "hello ", "world")
+	first := len(sealChunks(t, "hello "))
+	if bytes.Contains(file, []byte("hello")) {
+		t.Fatal("the content is in clear")
+	}
+	tampered := append([]byte(nil), file...)
+	tampered[len(tampered)-1] ^= 1
+	// The chunks of another file of the same key have another salt
+	other := sealChunks(t, "hello ", "world")
+	spliced := append(append([]byte(nil), file[:first]...), other[first:]...)
+
+	for _, c := range []struct {
+		name  string
+		key   string
+		old   string
+		data  []byte
+		plain string
+		end   int
+		err   string // empty if the file is read
+	}{
+		{"encrypted", testKey, "", file, "hello world", len(file), ""},
+		{"old key", testOldKey, testKey, file, "hello world", len(file), ""},
+		{"old key alone", "", testKey, file, "hello world", len(file), ""},
+		{"not encrypted", testKey, "", []byte("plain"), "plain", 5, ""},
+		{"torn chunk", testKey, "", file[:len(file)-1], "hello ", first, ""},
+		{"header only", testKey, "", file[:kCryptHeaderLen], "", kCryptHeaderLen, ""},
+		{"torn header", testKey, "", file[:kCryptHeaderLen-1], "", 0, "truncated encryption header"},
+		{"tampered", testKey, "", tampered, "", 0, "failed authentication"},
+		{"spliced", testKey, "", spliced, "", 0, "failed authentication"},
+		{"wrong key", testOldKey, "", file, "", 0, "another key"},
+		{"no key", "", "", file, "", 0, errNoCryptKey.Error()},
+	} {
+		useCryptKeys(t, c.key, c.old)
+		plain, _, end, err := unseal(c.data)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: %v, want %s", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil || string(plain) != c.plain || end != c.end {
+			t.Errorf("%s: %q up to %d: %v, want %q up to %d", c.name, plain, end, err, c.plain, c.end)
+		}
+	}
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	useCryptKeys(t, testKey, "")
+	s := newTestServer(t)
+	s.expect("", "set", "secret", "attack at dawn")
+	s.expect("1", "hset", "h", "f", "v")
+	if _, code := s.do("save"); code != RES_OK {
+		t.Fatal("save failed")
+	}
+	data, err := os.ReadFile(snapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(kCryptMagic)) || bytes.Contains(data, []byte("attack at dawn")) {
+		t.Fatal("the snapshot is not encrypted")
+	}
+
+	// Only the key or an old key reads it back
+	for _, c := range []struct {
+		key string
+		old string
+		ok  bool
+	}{
+		{testKey, "", true},
+		{testOldKey, testKey, true},
+		{testOldKey, "", false},
+		{"", "", false},
+	} {
+		useCryptKeys(t, c.key, c.old)
+		initKeyspace(16)
+		if err := loadSnapshot(snapshotPath()); (err == nil) != c.ok {
+			t.Fatalf("key %.4s, old key %.4s: %v", c.key, c.old, err)
+		}
+		if c.ok {
+			s.expect("attack at dawn", "get", "secret")
+			s.expect("v", "hget", "h", "f")
+		}
+	}
+}
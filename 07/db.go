@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strconv"
+)
+
+// initKeyspace replaces the keyspace with `n` empty databases.
+func initKeyspace(n int) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	gMap.cur = 0
+	resetDatabases(n)
+}
+
+// resetDatabases replaces the databases with `n` empty ones. The caller
+// must hold the lock of gMap.
+func resetDatabases(n int) {
+	gMap.dbs = make([]*Hamt, n)
+	gMap.used = make([]int64, n)
+	gMap.exp = make([]*keySet, n)
+	gMap.hexp = make([]*keySet, n)
+	for i := range gMap.dbs {
+		gMap.dbs[i] = newHamt()
+		gMap.exp[i] = newKeySet()
+		gMap.hexp[i] = newKeySet()
+	}
+	gMap.m = gMap.dbs[gMap.cur]
+	tierRecount()
+}
+
+// selectDB makes database `i` the target of the following commands.
+func selectDB(i int) {
+	if gMap.cur == i {
+		return
+	}
+	gMap.Lock()
+	gMap.cur = i
+	gMap.m = gMap.dbs[i]
+	gMap.Unlock()
+}
+
+func parseDBIndex(arg string) (int, bool) {
+	i, err := strconv.Atoi(arg)
+	if err != nil || i < 0 || i >= len(gMap.dbs) {
+		return 0, false
+	}
+	return i, true
+}
+
+// select index
+func doSelect(conn *Conn, cmd []string) ([]byte, ResponseCode) {
+	i, ok := parseDBIndex(cmd[1])
+	if !ok {
+		return []byte("DB index is out of range"), RES_ERR
+	}
+	conn.db = i
+	selectDB(i)
+	return nil, RES_OK
+}
+
+// swapdb index1 index2
+// Clients see the other database's data right away, so a dataset can be
+// built in a spare database and switched in atomically.
+func doSwapDB(cmd []string) ([]byte, ResponseCode) {
+	i, ok1 := parseDBIndex(cmd[1])
+	j, ok2 := parseDBIndex(cmd[2])
+	if !ok1 || !ok2 {
+		return []byte("DB index is out of range"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	gMap.dbs[i], gMap.dbs[j] = gMap.dbs[j], gMap.dbs[i]
+	gMap.used[i], gMap.used[j] = gMap.used[j], gMap.used[i]
+	gMap.exp[i], gMap.exp[j] = gMap.exp[j], gMap.exp[i]
+	gMap.hexp[i], gMap.hexp[j] = gMap.hexp[j], gMap.hexp[i]
+	gMap.m = gMap.dbs[gMap.cur]
+	return nil, RES_OK
+}
+
+// move key index
+// Replies RES_NX if the key is missing or already exists in the target.
+func doMove(cmd []string) ([]byte, ResponseCode) {
+	i, ok := parseDBIndex(cmd[2])
+	if !ok {
+		return []byte("DB index is out of range"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	if i == gMap.cur {
+		return []byte("source and destination are the same"), RES_ERR
+	}
+	ent, ok := lookupEntry(cmd[1])
+	if !ok {
+		return nil, RES_NX
+	}
+	if other, exists := gMap.dbs[i].Get(cmd[1]); exists && !other.expired(nowNs()) {
+		return nil, RES_NX
+	}
+	dbDelete(cmd[1])
+	dbSetIn(i, cmd[1], ent)
+	return nil, RES_OK
+}
+
+// flushdb [ASYNC | SYNC]
+func doFlushDB(cmd []string) ([]byte, ResponseCode) {
+	async, ok := parseFlushMode(cmd)
+	if !ok {
+		return []byte("syntax error"), RES_ERR
+	}
+
+	gMap.Lock()
+	old := gMap.m
+	gMap.m = newHamt()
+	gMap.dbs[gMap.cur] = gMap.m
+	gMap.used[gMap.cur] = 0
+	gMap.exp[gMap.cur] = newKeySet()
+	gMap.hexp[gMap.cur] = newKeySet()
+	tierRecount()
+	gMap.Unlock()
+
+	if async {
+		go freeKeyspace(old)
+	}
+	return nil, RES_OK
+}
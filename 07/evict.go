@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// Eviction policies, applied when the memory use is above maxmemory
+type EvictPolicy int
+
+const (
+	EvictNone        EvictPolicy = iota // reject writes instead
+	EvictAllKeysLRU                     // least recently used
+	EvictAllKeysLFU                     // least frequently used
+	EvictVolatileTTL                    // nearest expire time, among keys with a TTL
+)
+
+var evictPolicyNames = []string{
+	EvictNone:        "noeviction",
+	EvictAllKeysLRU:  "allkeys-lru",
+	EvictAllKeysLFU:  "allkeys-lfu",
+	EvictVolatileTTL: "volatile-ttl",
+}
+
+func parseEvictPolicy(name string) (EvictPolicy, bool) {
+	for i, n := range evictPolicyNames {
+		if strings.EqualFold(name, n) {
+			return EvictPolicy(i), true
+		}
+	}
+	return 0, false
+}
+
+const errOOM = "OOM command not allowed when used memory > 'maxmemory'"
+
+// Like Redis, the best candidates of the samples are kept in a small pool
+// across evictions, so each eviction picks a better key than the samples
+// of one round alone would give.
+const kEvictionPoolSize = 16
+
+type evictCandidate struct {
+	db    int
+	key   string
+	ent   *Entry
+	score int64 // higher is evicted first
+}
+
+var gEvictionPool []evictCandidate
+
+// evictScore rates the entry for the policy. Expired entries go first.
+func evictScore(ent *Entry, now int64) int64 {
+	if ent.expired(now) {
+		return math.MaxInt64
+	}
+	switch gConfig.maxmemoryPolicy {
+	case EvictAllKeysLRU:
+		return now - ent.atime
+	case EvictAllKeysLFU:
+		return 255 - int64(ent.decayedFreq(now))
+	case EvictVolatileTTL:
+		return math.MaxInt64 - 1 - ent.expireAt
+	}
+	return 0
+}
+
+// evictionPoolPopulate samples the keys of database `db` into the pool.
+func evictionPoolPopulate(db int, now int64) {
+	pool := gEvictionPool
+	consider := func(key string, ent *Entry) {
+		for _, c := range pool {
+			if c.ent == ent {
+				return
+			}
+		}
+		score := evictScore(ent, now)
+		if len(pool) == kEvictionPoolSize {
+			if score <= pool[0].score {
+				return
+			}
+			pool = pool[1:]
+		}
+		pool = append(pool, evictCandidate{db, key, ent, score})
+		sort.Slice(pool, func(i, j int) bool { return pool[i].score < pool[j].score })
+	}
+
+	if gConfig.maxmemoryPolicy == EvictVolatileTTL {
+		exp := gMap.exp[db]
+		for i := 0; i < gConfig.maxmemorySamples && exp.Len() > 0; i++ {
+			key := exp.Random()
+			ent, _ := gMap.dbs[db].Get(key)
+			consider(key, ent)
+		}
+	} else {
+		for i := 0; i < gConfig.maxmemorySamples && gMap.dbs[db].Len() > 0; i++ {
+			key, ent, _ := gMap.dbs[db].Random()
+			consider(key, ent)
+		}
+	}
+	gEvictionPool = append(gEvictionPool[:0], pool...)
+}
+
+// evictOne deletes the best candidate. Returns false if there is no key
+// to evict under the policy.
+func evictOne() bool {
+	now := nowNs()
+	for attempt := 0; attempt < 2; attempt++ {
+		for db := range gMap.dbs {
+			evictionPoolPopulate(db, now)
+		}
+		// Take the best candidate that still exists
+		for len(gEvictionPool) > 0 {
+			c := gEvictionPool[len(gEvictionPool)-1]
+			gEvictionPool = gEvictionPool[:len(gEvictionPool)-1]
+			if c.db >= len(gMap.dbs) {
+				continue
+			}
+			if ent, _ := gMap.dbs[c.db].Get(c.key); ent != c.ent {
+				continue // deleted, overwritten or swapped since sampled
+			}
+			dbDeleteIn(c.db, c.key)
+			if c.ent.expired(now) {
+				gStats.expiredKeys++
+			} else {
+				gStats.evictedKeys++
+				aofFeed(c.db, "del", c.key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// freeMemoryIfNeeded evicts keys until the memory use is within
+// maxmemory. Returns false if that is not possible, in which case the
+// command should be rejected.
+func freeMemoryIfNeeded() bool {
+	if gConfig.maxmemory == 0 {
+		return true
+	}
+	gMap.Lock()
+	defer gMap.Unlock()
+	for usedMemory() > gConfig.maxmemory {
+		if gConfig.maxmemoryPolicy == EvictNone || !evictOne() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+func isExpireOption(opt string) bool {
+	for _, name := range []string{"ex", "px", "exat", "pxat"} {
+		if cmdIs(opt, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpireOption returns the expire time in nowNs() time given by
+// EX seconds, PX ms, EXAT unix-seconds or PXAT unix-ms.
+func parseExpireOption(opt string, arg string) (int64, bool) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	unit := time.Millisecond
+	if cmdIs(opt, "ex") || cmdIs(opt, "exat") {
+		unit = time.Second
+	}
+	if n > math.MaxInt64/int64(unit)/2 {
+		return 0, false
+	}
+	at := n * int64(unit)
+	if cmdIs(opt, "ex") || cmdIs(opt, "px") {
+		at += nowNs()
+	}
+	return at, true
+}
+
+// expire key seconds, pexpire key ms, expireat key unix-seconds and
+// pexpireat key unix-ms
+// A time that is not in the future deletes the key.
+func doExpire(cmd []string) ([]byte, ResponseCode) {
+	n, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return []byte("expect int"), RES_ERR
+	}
+	unit := time.Millisecond
+	if cmdIs(cmd[0], "expire") || cmdIs(cmd[0], "expireat") {
+		unit = time.Second
+	}
+	if n > math.MaxInt64/int64(unit)/2 || n < math.MinInt64/int64(unit)/2 {
+		return []byte("invalid expire time"), RES_ERR
+	}
+	now := nowNs()
+	at := n * int64(unit)
+	if cmdIs(cmd[0], "expire") || cmdIs(cmd[0], "pexpire") {
+		at += now
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	ent, ok := lookupEntry(cmd[1])
+	if !ok {
+		return nil, RES_NX
+	}
+	if at <= now {
+		dbDelete(cmd[1])
+	} else {
+		setExpire(cmd[1], ent, at)
+	}
+	return nil, RES_OK
+}
+
+// ttl key and pttl key
+// Replies -2 if the key doesn't exist and -1 if it has no TTL.
+func doTTL(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	ent, ok := lookupEntry(cmd[1])
+	if !ok {
+		return []byte("-2"), RES_OK
+	}
+	if ent.expireAt == 0 {
+		return []byte("-1"), RES_OK
+	}
+	left := time.Duration(ent.expireAt - nowNs())
+	if cmdIs(cmd[0], "ttl") {
+		return []byte(strconv.FormatInt(int64((left+time.Second/2)/time.Second), 10)), RES_OK
+	}
+	return []byte(strconv.FormatInt(left.Milliseconds(), 10)), RES_OK
+}
+
+// persist key
+func doPersist(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	ent, ok := lookupEntry(cmd[1])
+	if !ok || ent.expireAt == 0 {
+		return nil, RES_NX
+	}
+	setExpire(cmd[1], ent, 0)
+	return nil, RES_OK
+}
+
+// setExpire sets the expire time of the entry at `key`, or removes it if
+// `at` is 0. The caller must hold the lock of gMap.
+func setExpire(key string, ent *Entry, at int64) {
+	ent.expireAt = at
+	if at != 0 {
+		gMap.exp[gMap.cur].Add(key)
+	} else {
+		gMap.exp[gMap.cur].Remove(key)
+	}
+}
+
+// keySet is a set of keys that can be scanned with a cursor and sampled
+// at random, which a Go map can't do without bias: its iteration starts at
+// a random slot but then favours the keys that follow long empty runs.
+type keySet struct {
+	keys   []string
+	pos    map[string]int // index of each key in `keys`
+	cursor int            // where the active expiry continues
+}
+
+func newKeySet() *keySet {
+	return &keySet{pos: make(map[string]int)}
+}
+
+func (s *keySet) Len() int {
+	return len(s.keys)
+}
+
+func (s *keySet) Add(key string) {
+	if _, ok := s.pos[key]; !ok {
+		s.pos[key] = len(s.keys)
+		s.keys = append(s.keys, key)
+	}
+}
+
+// Remove deletes the key by moving the last key into its place.
+func (s *keySet) Remove(key string) {
+	i, ok := s.pos[key]
+	if !ok {
+		return
+	}
+	last := len(s.keys) - 1
+	s.keys[i] = s.keys[last]
+	s.pos[s.keys[i]] = i
+	s.keys = s.keys[:last]
+	delete(s.pos, key)
+}
+
+func (s *keySet) Random() string {
+	return s.keys[rand.Intn(len(s.keys))]
+}
+
+// Lazy expiry only frees keys that are accessed again. The active expiry
+// cycle runs from the event loop and checks the keys with a TTL of each
+// database in rounds of kActiveExpireSamples, continuing where the last
+// cycle stopped. A database gets another round while more than
+// kActiveExpireStalePerc of the keys checked were expired, until the time
+// budget of the cycle runs out. While the cycles keep finding many
+// expired keys they run more often, down to kActiveExpireMinInterval.
+const (
+	kActiveExpireSamples     = 20
+	kActiveExpireStalePerc   = 10
+	kActiveExpireInterval    = int64(100 * time.Millisecond)
+	kActiveExpireMinInterval = int64(10 * time.Millisecond)
+	kActiveExpireBudget      = int64(5 * time.Millisecond)
+)
+
+var gActiveExpire = struct {
+	next     int64 // nowNs() time of the next cycle
+	interval int64
+}{interval: kActiveExpireInterval}
+
+// activeExpireTimeout returns the poll() timeout in ms until the next
+// cycle is due.
+func activeExpireTimeout() int {
+	left := gActiveExpire.next - nowNs()
+	if left <= 0 {
+		return 0
+	}
+	return int((left + int64(time.Millisecond) - 1) / int64(time.Millisecond))
+}
+
+// activeExpireCycle runs a cycle if one is due.
+func activeExpireCycle() {
+	start := nowNs()
+	if start < gActiveExpire.next {
+		return
+	}
+	deadline := start + kActiveExpireBudget
+
+	gMap.Lock()
+	checked, expired := 0, 0
+	timedOut := false
+	for db := range gMap.dbs {
+		c, e, ok := activeExpireDB(db, deadline)
+		checked += c
+		expired += e
+		if ok {
+			c, e, ok = activeExpireHashFields(db, deadline)
+			checked += c
+			expired += e
+		}
+		if !ok {
+			timedOut = true
+			break
+		}
+	}
+	gMap.Unlock()
+
+	// Adapt the frequency to the share of expired keys found
+	if timedOut || expired*100 > checked*kActiveExpireStalePerc {
+		gActiveExpire.interval /= 2
+		if gActiveExpire.interval < kActiveExpireMinInterval {
+			gActiveExpire.interval = kActiveExpireMinInterval
+		}
+	} else if gActiveExpire.interval < kActiveExpireInterval {
+		gActiveExpire.interval *= 2
+		if gActiveExpire.interval > kActiveExpireInterval {
+			gActiveExpire.interval = kActiveExpireInterval
+		}
+	}
+	gActiveExpire.next = nowNs() + gActiveExpire.interval
+}
+
+// activeExpireDB deletes expired keys of database `db` until few of the
+// keys checked are expired. Returns false if the deadline was reached.
+func activeExpireDB(db int, deadline int64) (int, int, bool) {
+	exp := gMap.exp[db]
+	checked, expired := 0, 0
+	for {
+		now := nowNs()
+		n, e := 0, 0
+		for ; n < kActiveExpireSamples && exp.Len() > 0; n++ {
+			if exp.cursor >= exp.Len() {
+				exp.cursor = 0
+			}
+			key := exp.keys[exp.cursor]
+			if ent, _ := gMap.dbs[db].Get(key); ent.expired(now) {
+				// The last key is moved into the cursor position
+				dbDeleteIn(db, key)
+				gStats.expiredKeys++
+				e++
+			} else {
+				exp.cursor++
+			}
+		}
+		checked += n
+		expired += e
+		if n == 0 || e*100 <= n*kActiveExpireStalePerc {
+			return checked, expired, true
+		}
+		if nowNs() >= deadline {
+			return checked, expired, false
+		}
+	}
+}
+
+// activeExpireHashFields deletes expired fields of up to
+// kActiveExpireSamples hashes of database `db`, like activeExpireDB does
+// for keys. Returns false if the deadline was reached.
+func activeExpireHashFields(db int, deadline int64) (int, int, bool) {
+	hexp := gMap.hexp[db]
+	checked, expired := 0, 0
+	for visited := 0; visited < kActiveExpireSamples && hexp.Len() > 0; visited++ {
+		if hexp.cursor >= hexp.Len() {
+			hexp.cursor = 0
+		}
+		key := hexp.keys[hexp.cursor]
+		ent, ok := gMap.dbs[db].Get(key)
+		var h *Hash
+		if ok {
+			h, _ = ent.val.(*Hash)
+		}
+		if h == nil {
+			// Not a hash with field TTLs anymore, or a cold value. Removing
+			// moves the last key into the cursor position.
+			hexp.Remove(key)
+			continue
+		}
+		protectForSave(key, ent)
+		timedOut := false
+		for {
+			c, e := h.expireFields(kActiveExpireSamples, nowNs())
+			checked += c
+			expired += e
+			gStats.expiredFields += int64(e)
+			if c == 0 || e*100 <= c*kActiveExpireStalePerc {
+				break
+			}
+			if nowNs() >= deadline {
+				timedOut = true
+				break
+			}
+		}
+
+		// Removing the key from `hexp` moves the last key into the cursor
+		// position
+		if h.Len() == 0 {
+			dbDeleteIn(db, key)
+			gStats.expiredKeys++
+		} else {
+			updateMemUsageIn(db, key, ent)
+			if h.volatile.Len() == 0 {
+				hexp.Remove(key)
+			} else {
+				hexp.cursor++
+			}
+		}
+		if timedOut {
+			return checked, expired, false
+		}
+	}
+	return checked, expired, true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+func TestActiveExpiryReclaimsMemory(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newTestServer(t)
+	s.expect("", "set", "keep", "v")
+	baseUsed := usedMemory()
+	baseHeap := heapInUse()
+
+	const n = 20000
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("key:", i)
+		s.expect("", "set", key, value, "px", fmt.Sprint(1+i%1000))
+		if i%10 == 0 {
+			s.do("hset", "h"+key, "f", value, "g", value)
+			s.do("hpexpire", "h"+key, "500", "fields", "2", "f", "g")
+		}
+	}
+	filled := heapInUse()
+	if filled < baseHeap+n*1000 {
+		t.Fatalf("heap grew from %d to %d only", baseHeap, filled)
+	}
+
+	// No key is accessed again
+	clock.advance(time.Second)
+	for i := 0; i < 100 && (gMap.exp[0].Len() > 0 || gMap.hexp[0].Len() > 0); i++ {
+		clock.advance(time.Duration(gActiveExpire.interval))
+		activeExpireCycle()
+	}
+	if gMap.exp[0].Len() != 0 || gMap.hexp[0].Len() != 0 {
+		t.Fatalf("%d keys and %d hashes left with a TTL", gMap.exp[0].Len(), gMap.hexp[0].Len())
+	}
+	// The hashes went with their last field
+	s.expect("1", "dbsize")
+	if used := usedMemory(); used != baseUsed {
+		t.Fatalf("used memory %d, was %d", used, baseUsed)
+	}
+	if left := heapInUse(); left > baseHeap+(filled-baseHeap)/10 {
+		t.Fatalf("heap at %d after expiry, %d before filling and %d filled", left, baseHeap, filled)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"math/bits"
+	"math/rand"
+)
+
+// Hamt is a database of the keyspace: a hash array mapped trie from keys
+// to entries. Each node covers 5 bits of the key hash and holds only its
+// used slots, a bitmap telling which. Keys whose 64 hash bits are all
+// equal share a collision node at the bottom.
+//
+// The trie is persistent: Snapshot() returns a frozen copy in O(1), which
+// a goroutine can read while the event loop keeps writing. Nodes are
+// tagged with the generation that created them. A write changes the
+// nodes of the current generation in place, and copies the others on the
+// path to the key, so the writes after a snapshot copy each node once.
+// Entries are shared with the snapshot, see snapshotJob.protect().
+type Hamt struct {
+	root *hamtNode
+	size int
+	gen  uint64 // of the nodes this trie may change, 0 if frozen
+}
+
+type hamtNode struct {
+	gen    uint64
+	bitmap uint32
+	slots  []hamtSlot // in the order of the bitmap
+}
+
+// A slot holds either an entry or a subtrie.
+type hamtSlot struct {
+	hash uint64
+	key  string
+	ent  *Entry
+	sub  *hamtNode
+}
+
+const (
+	kHamtBits = 5
+	kHamtMask = 1<<kHamtBits - 1
+)
+
+var gHamtGen uint64
+
+// The hash seed is random so clients can't pick colliding keys.
+var gHamtSeed = rand.Uint64()
+
+func newHamt() *Hamt {
+	gHamtGen++
+	return &Hamt{gen: gHamtGen}
+}
+
+// hamtHash is FNV-1a over the seed and the key.
+func hamtHash(key string) uint64 {
+	h := uint64(14695981039346656037) ^ gHamtSeed
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (h *Hamt) Len() int {
+	return h.size
+}
+
+// Snapshot returns a frozen copy of the trie. The nodes become shared,
+// so the next writes of `h` copy them.
+func (h *Hamt) Snapshot() *Hamt {
+	gHamtGen++
+	h.gen = gHamtGen
+	return &Hamt{root: h.root, size: h.size}
+}
+
+func (h *Hamt) Get(key string) (*Entry, bool) {
+	hash := hamtHash(key)
+	n := h.root
+	for shift := uint(0); n != nil; shift += kHamtBits {
+		var s *hamtSlot
+		if shift >= 64 {
+			for i := range n.slots {
+				if n.slots[i].key == key {
+					s = &n.slots[i]
+				}
+			}
+		} else if bit := uint32(1) << (hash >> shift & kHamtMask); n.bitmap&bit != 0 {
+			s = &n.slots[bits.OnesCount32(n.bitmap&(bit-1))]
+		}
+		if s == nil {
+			return nil, false
+		}
+		if s.sub == nil {
+			return s.ent, s.key == key
+		}
+		n = s.sub
+	}
+	return nil, false
+}
+
+// editable returns the node, or a copy of it that this trie may change.
+func (h *Hamt) editable(n *hamtNode) *hamtNode {
+	if h.gen == 0 {
+		panic("write to a frozen keyspace")
+	}
+	if n.gen == h.gen {
+		return n
+	}
+	return &hamtNode{gen: h.gen, bitmap: n.bitmap, slots: append([]hamtSlot(nil), n.slots...)}
+}
+
+func (h *Hamt) Set(key string, ent *Entry) {
+	slot := hamtSlot{hash: hamtHash(key), key: key, ent: ent}
+	if h.root == nil {
+		h.root = &hamtNode{gen: h.gen}
+	}
+	var added bool
+	h.root, added = h.set(h.root, 0, slot)
+	if added {
+		h.size++
+	}
+}
+
+// set stores the slot in the subtrie `n` at depth `shift`. Returns the
+// node that replaces `n`, and whether the key is new.
+func (h *Hamt) set(n *hamtNode, shift uint, slot hamtSlot) (*hamtNode, bool) {
+	if shift >= 64 {
+		for i := range n.slots {
+			if n.slots[i].key == slot.key {
+				n = h.editable(n)
+				n.slots[i] = slot
+				return n, false
+			}
+		}
+		n = h.editable(n)
+		n.slots = append(n.slots, slot)
+		return n, true
+	}
+
+	bit := uint32(1) << (slot.hash >> shift & kHamtMask)
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	if n.bitmap&bit == 0 {
+		n = h.editable(n)
+		n.slots = append(n.slots, hamtSlot{})
+		copy(n.slots[i+1:], n.slots[i:])
+		n.slots[i] = slot
+		n.bitmap |= bit
+		return n, true
+	}
+	cur := n.slots[i]
+	if cur.sub != nil {
+		sub, added := h.set(cur.sub, shift+kHamtBits, slot)
+		if sub != cur.sub {
+			n = h.editable(n)
+			n.slots[i].sub = sub
+		}
+		return n, added
+	}
+	if cur.key == slot.key {
+		if cur.ent != slot.ent {
+			n = h.editable(n)
+			n.slots[i] = slot
+		}
+		return n, false
+	}
+	n = h.editable(n)
+	n.slots[i] = hamtSlot{sub: h.pair(shift+kHamtBits, cur, slot)}
+	return n, true
+}
+
+// pair returns a subtrie at depth `shift` holding two entries.
+func (h *Hamt) pair(shift uint, a, b hamtSlot) *hamtNode {
+	n := &hamtNode{gen: h.gen}
+	if shift >= 64 {
+		n.slots = []hamtSlot{a, b}
+		return n
+	}
+	ca, cb := uint32(a.hash>>shift&kHamtMask), uint32(b.hash>>shift&kHamtMask)
+	switch {
+	case ca == cb:
+		n.bitmap = 1 << ca
+		n.slots = []hamtSlot{{sub: h.pair(shift+kHamtBits, a, b)}}
+	case ca < cb:
+		n.bitmap = 1<<ca | 1<<cb
+		n.slots = []hamtSlot{a, b}
+	default:
+		n.bitmap = 1<<ca | 1<<cb
+		n.slots = []hamtSlot{b, a}
+	}
+	return n
+}
+
+func (h *Hamt) Delete(key string) {
+	if h.root == nil {
+		return
+	}
+	root, removed := h.del(h.root, 0, hamtHash(key), key)
+	if removed {
+		h.root = root
+		h.size--
+	}
+}
+
+// del removes the key from the subtrie `n`. Returns the node that
+// replaces `n`, and whether the key was there. A subtrie left with a
+// single entry is replaced by the entry, so only the root may be empty.
+func (h *Hamt) del(n *hamtNode, shift uint, hash uint64, key string) (*hamtNode, bool) {
+	i := -1
+	var bit uint32
+	if shift >= 64 {
+		for j := range n.slots {
+			if n.slots[j].key == key {
+				i = j
+			}
+		}
+	} else if bit = 1 << (hash >> shift & kHamtMask); n.bitmap&bit != 0 {
+		i = bits.OnesCount32(n.bitmap & (bit - 1))
+	}
+	if i < 0 {
+		return n, false
+	}
+
+	cur := n.slots[i]
+	if cur.sub != nil {
+		sub, removed := h.del(cur.sub, shift+kHamtBits, hash, key)
+		if !removed {
+			return n, false
+		}
+		n = h.editable(n)
+		if len(sub.slots) == 1 && sub.slots[0].sub == nil {
+			n.slots[i] = sub.slots[0]
+		} else {
+			n.slots[i].sub = sub
+		}
+		return n, true
+	}
+	if cur.key != key {
+		return n, false
+	}
+	n = h.editable(n)
+	copy(n.slots[i:], n.slots[i+1:])
+	n.slots[len(n.slots)-1] = hamtSlot{}
+	n.slots = n.slots[:len(n.slots)-1]
+	n.bitmap &^= bit
+	return n, true
+}
+
+// Range calls `fn` for every entry until it returns false. The trie must
+// not be changed meanwhile.
+func (h *Hamt) Range(fn func(key string, ent *Entry) bool) {
+	if h.root != nil {
+		h.root.rangeSlots(fn)
+	}
+}
+
+func (n *hamtNode) rangeSlots(fn func(key string, ent *Entry) bool) bool {
+	for i := range n.slots {
+		s := &n.slots[i]
+		if s.sub != nil {
+			if !s.sub.rangeSlots(fn) {
+				return false
+			}
+		} else if !fn(s.key, s.ent) {
+			return false
+		}
+	}
+	return true
+}
+
+// Random returns an entry picked by a random walk from the root. Entries
+// in sparse parts of the trie are picked more often, which is good enough
+// for sampling.
+func (h *Hamt) Random() (string, *Entry, bool) {
+	n := h.root
+	for n != nil && len(n.slots) > 0 {
+		s := &n.slots[rand.Intn(len(n.slots))]
+		if s.sub == nil {
+			return s.key, s.ent, true
+		}
+		n = s.sub
+	}
+	return "", nil, false
+}
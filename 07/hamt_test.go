@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// checkHamt compares the trie with a map through Len, Get and Range.
+func checkHamt(t *testing.T, h *Hamt, want map[string]*Entry) {
+	t.Helper()
+	if h.Len() != len(want) {
+		t.Fatalf("%d keys, want %d", h.Len(), len(want))
+	}
+	n := 0
+	h.Range(func(key string, ent *Entry) bool {
+		if want[key] != ent {
+			t.Fatalf("range: wrong entry at %s", key)
+		}
+		n++
+		return true
+	})
+	if n != len(want) {
+		t.Fatalf("range: %d keys, want %d", n, len(want))
+	}
+	for key, ent := range want {
+		if got, ok := h.Get(key); !ok || got != ent {
+			t.Fatalf("get %s: %v", key, ok)
+		}
+	}
+}
+
+func copyEntries(m map[string]*Entry) map[string]*Entry {
+	out := make(map[string]*Entry, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func TestHamt(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	h := newHamt()
+	want := map[string]*Entry{}
+	var snaps []*Hamt
+	var snapWant []map[string]*Entry
+	for i := 0; i < 200000; i++ {
+		key := fmt.Sprint("k", rng.Intn(5000))
+		if rng.Intn(3) < 2 {
+			ent := &Entry{}
+			h.Set(key, ent)
+			want[key] = ent
+		} else {
+			h.Delete(key)
+			delete(want, key)
+		}
+		if _, ok := h.Get("x" + key); ok {
+			t.Fatalf("got the missing key x%s", key)
+		}
+		// Snapshots keep the keys of their time
+		if i%20000 == 0 {
+			snaps = append(snaps, h.Snapshot())
+			snapWant = append(snapWant, copyEntries(want))
+		}
+	}
+	checkHamt(t, h, want)
+	for i, snap := range snaps {
+		checkHamt(t, snap, snapWant[i])
+	}
+
+	for key := range want {
+		h.Delete(key)
+	}
+	if h.Len() != 0 || len(h.root.slots) != 0 {
+		t.Fatal("not empty after deleting every key")
+	}
+}
+
+// TestHamtCollisions stores keys of the same hash, which end up in the
+// list of a node below the last level of the bitmaps.
+func TestHamtCollisions(t *testing.T) {
+	h := newHamt()
+	h.root = &hamtNode{gen: h.gen}
+	want := map[string]*Entry{}
+	var snap *Hamt
+	var snapWant map[string]*Entry
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprint(i)
+		want[key] = &Entry{}
+		var added bool
+		h.root, added = h.set(h.root, 0, hamtSlot{hash: 42, key: key, ent: want[key]})
+		if !added {
+			t.Fatalf("set %s: not added", key)
+		}
+		h.size++
+		if i == 20 {
+			snap = h.Snapshot()
+			snapWant = copyEntries(want)
+		}
+	}
+	for i := 0; i < 50; i += 2 {
+		key := fmt.Sprint(i)
+		var removed bool
+		h.root, removed = h.del(h.root, 0, 42, key)
+		if !removed {
+			t.Fatalf("del %s: not removed", key)
+		}
+		h.size--
+		delete(want, key)
+	}
+	if _, removed := h.del(h.root, 0, 42, "0"); removed {
+		t.Fatal("removed a missing key")
+	}
+
+	// Get hashes the key, so only Range reaches the colliding keys
+	for _, c := range []struct {
+		h    *Hamt
+		want map[string]*Entry
+	}{{h, want}, {snap, snapWant}} {
+		n := 0
+		c.h.Range(func(key string, ent *Entry) bool {
+			if c.want[key] != ent {
+				t.Fatalf("range: wrong entry at %s", key)
+			}
+			n++
+			return true
+		})
+		if n != len(c.want) || c.h.Len() != n {
+			t.Fatalf("range: %d keys, Len %d, want %d", n, c.h.Len(), len(c.want))
+		}
+	}
+}
+
+// The benchmarks compare the trie with the map that held the keyspace
+// before it.
+
+const kBenchKeys = 1 << 20
+
+func benchKeys() []string {
+	out := make([]string, kBenchKeys)
+	for i := range out {
+		out[i] = fmt.Sprint("key:", i)
+	}
+	return out
+}
+
+func BenchmarkHamtSet(b *testing.B) {
+	keys := benchKeys()
+	h := newHamt()
+	ent := &Entry{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Set(keys[i%kBenchKeys], ent)
+	}
+}
+
+func BenchmarkMapSet(b *testing.B) {
+	keys := benchKeys()
+	m := map[string]*Entry{}
+	ent := &Entry{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m[keys[i%kBenchKeys]] = ent
+	}
+}
+
+// A write after each snapshot of a BGSAVE copies the nodes on its path.
+func BenchmarkHamtSetAfterSnapshot(b *testing.B) {
+	keys := benchKeys()
+	h := newHamt()
+	ent := &Entry{}
+	for _, key := range keys {
+		h.Set(key, ent)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			h.Snapshot()
+		}
+		h.Set(keys[i*7919%kBenchKeys], ent)
+	}
+}
+
+func BenchmarkHamtGet(b *testing.B) {
+	keys := benchKeys()
+	h := newHamt()
+	for _, key := range keys {
+		h.Set(key, &Entry{})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Get(keys[i*7919%kBenchKeys])
+	}
+}
+
+func BenchmarkMapGet(b *testing.B) {
+	keys := benchKeys()
+	m := map[string]*Entry{}
+	for _, key := range keys {
+		m[key] = &Entry{}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = m[keys[i*7919%kBenchKeys]]
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// A Hash maps fields to values. Each field can have its own expire time.
+// Expired fields are deleted by the commands that access the hash and by
+// the active expiry cycle, which visits the fields with a TTL through
+// `volatile`. The key is deleted with its last field.
+type hashField struct {
+	val      []byte
+	expireAt int64 // in nowNs() time, 0 if the field doesn't expire
+}
+
+type Hash struct {
+	fields   map[string]*hashField
+	volatile *keySet // the fields with a TTL
+	bytes    int64   // sizes of the fields and values, for entryMemUsage()
+}
+
+const kHashFieldOverhead = 64
+
+func newHash() *Hash {
+	return &Hash{fields: make(map[string]*hashField), volatile: newKeySet()}
+}
+
+// Get returns the field unless it has expired.
+func (h *Hash) Get(field string, now int64) (*hashField, bool) {
+	f, ok := h.fields[field]
+	if !ok || (f.expireAt != 0 && f.expireAt <= now) {
+		return nil, false
+	}
+	return f, true
+}
+
+// Set stores the value and clears the TTL of the field. Returns true if
+// the field is new.
+func (h *Hash) Set(field string, val []byte, now int64) bool {
+	_, exists := h.Get(field, now)
+	h.Del(field)
+	h.fields[field] = &hashField{val: val}
+	h.bytes += int64(len(field)+len(val)) + kHashFieldOverhead
+	return !exists
+}
+
+// Del deletes the field, expired or not. Returns true if it was present.
+func (h *Hash) Del(field string) bool {
+	f, ok := h.fields[field]
+	if !ok {
+		return false
+	}
+	delete(h.fields, field)
+	h.volatile.Remove(field)
+	h.bytes -= int64(len(field)+len(f.val)) + kHashFieldOverhead
+	return true
+}
+
+func (h *Hash) SetExpire(field string, f *hashField, at int64) {
+	f.expireAt = at
+	if at != 0 {
+		h.volatile.Add(field)
+	} else {
+		h.volatile.Remove(field)
+	}
+}
+
+// Len returns the number of fields, including the expired ones that
+// haven't been deleted yet.
+func (h *Hash) Len() int {
+	return len(h.fields)
+}
+
+// live reports whether some field hasn't expired.
+func (h *Hash) live(now int64) bool {
+	if len(h.fields) > h.volatile.Len() {
+		return true
+	}
+	for _, field := range h.volatile.keys {
+		if h.fields[field].expireAt > now {
+			return true
+		}
+	}
+	return false
+}
+
+// expiredFields returns the fields that have expired.
+func (h *Hash) expiredFields(now int64) []string {
+	var out []string
+	for _, field := range h.volatile.keys {
+		if h.fields[field].expireAt <= now {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
+// expireFields deletes up to `n` expired fields found by scanning the
+// fields with a TTL. Returns the number of fields checked and deleted.
+func (h *Hash) expireFields(n int, now int64) (int, int) {
+	checked, expired := 0, 0
+	exp := h.volatile
+	for ; checked < n && exp.Len() > 0; checked++ {
+		if exp.cursor >= exp.Len() {
+			exp.cursor = 0
+		}
+		field := exp.keys[exp.cursor]
+		if h.fields[field].expireAt <= now {
+			h.Del(field) // moves the last field into the cursor position
+			expired++
+		} else {
+			exp.cursor++
+		}
+	}
+	return checked, expired
+}
+
+func (h *Hash) Encode(out []byte) []byte {
+	out = appendU32(out, uint32(len(h.fields)))
+	for field, f := range h.fields {
+		out = appendStr(out, field)
+		out = appendStr(out, string(f.val))
+		out = appendU64(out, uint64(f.expireAt))
+	}
+	return out
+}
+
+func decodeHash(d *decoder) (*Hash, error) {
+	h := newHash()
+	n := d.u32()
+	if d.err == nil && n == 0 {
+		return nil, errBadData
+	}
+	if uint64(n) > uint64(len(d.data))/16 {
+		return nil, errShortData
+	}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		field := d.str()
+		val := []byte(d.str())
+		at := int64(d.u64())
+		if _, dup := h.fields[field]; dup || at < 0 {
+			return nil, errBadData
+		}
+		h.Set(field, val, 0)
+		if at != 0 {
+			h.SetExpire(field, h.fields[field], at)
+		}
+	}
+	return h, d.err
+}
+
+// lookupHash returns the hash at `key`, creating it if `create` is set.
+// The caller must hold the lock of gMap.
+func lookupHash(key string, create bool) (*Hash, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		if !create {
+			return nil, ""
+		}
+		h := newHash()
+		dbSet(key, &Entry{typ: TypeHash, val: h})
+		return h, ""
+	}
+	if ent.typ != TypeHash {
+		return nil, errWrongType
+	}
+	return ent.val.(*Hash), ""
+}
+
+// hashExpired reports whether the entry is a hash whose fields have all
+// expired, which is as good as deleted. Hashes with field TTLs are never
+// spilled to the value log, see tierCron().
+func hashExpired(ent *Entry, now int64) bool {
+	if ent.typ != TypeHash {
+		return false
+	}
+	h, ok := ent.val.(*Hash)
+	return ok && !h.live(now)
+}
+
+// lookupLiveHash returns the hash at `key` like lookupHash() does, after
+// deleting its expired fields, and the key with the last one. Reads use it
+// so the fields they count are live. The caller must hold the write lock
+// of gMap.
+func lookupLiveHash(key string) (*Hash, string) {
+	now := nowNs()
+	ent, ok := gMap.m.Get(key)
+	if !ok || ent.typ != TypeHash || ent.expired(now) {
+		return lookupHash(key, false)
+	}
+	h, ok := ent.val.(*Hash)
+	if !ok {
+		return lookupHash(key, false)
+	}
+	if expired := h.expiredFields(now); len(expired) > 0 {
+		protectForSave(key, ent)
+		for _, field := range expired {
+			h.Del(field)
+		}
+		gStats.expiredFields += int64(len(expired))
+		if h.Len() == 0 {
+			dbDelete(key)
+			gStats.expiredKeys++
+			return nil, ""
+		}
+		updateMemUsageIn(gMap.cur, key, ent)
+		hashUpdateExpire(key, h)
+	}
+	return lookupHash(key, false)
+}
+
+// hashUpdateExpire keeps the key in gMap.hexp while some field has a TTL.
+// The expiry sweep and the tiering rely on it, as a key left there could
+// be spilled while the sweep still visits it. The caller must hold the
+// lock of gMap.
+func hashUpdateExpire(key string, h *Hash) {
+	if h.volatile.Len() > 0 {
+		gMap.hexp[gMap.cur].Add(key)
+	} else {
+		gMap.hexp[gMap.cur].Remove(key)
+	}
+}
+
+// hashDeleteIfEmpty deletes the key once no live field is left. The
+// caller must hold the lock of gMap.
+func hashDeleteIfEmpty(key string, h *Hash) {
+	if !h.live(nowNs()) {
+		dbDelete(key)
+	}
+}
+
+// hset key field value [field value ...]
+// Replies the number of new fields.
+func doHSet(cmd []string) ([]byte, ResponseCode) {
+	if len(cmd)%2 != 0 {
+		return []byte("syntax error"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	h, errMsg := lookupHash(cmd[1], true)
+	if h == nil {
+		return []byte(errMsg), RES_ERR
+	}
+	now := nowNs()
+	added := 0
+	for i := 2; i < len(cmd); i += 2 {
+		if h.Set(cmd[i], []byte(cmd[i+1]), now) {
+			added++
+		}
+	}
+	hashUpdateExpire(cmd[1], h)
+	return []byte(strconv.Itoa(added)), RES_OK
+}
+
+// hget key field
+func doHGet(cmd []string) ([]byte, ResponseCode) {
+	// Expired fields are deleted, which needs the write lock
+	gMap.Lock()
+	defer gMap.Unlock()
+	h, errMsg := lookupLiveHash(cmd[1])
+	if h == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	f, ok := h.Get(cmd[2], nowNs())
+	if !ok {
+		return nil, RES_NX
+	}
+	return append([]byte(nil), f.val...), RES_OK
+}
+
+// hdel key field [field ...]
+// Replies the number of fields deleted.
+func doHDel(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	h, errMsg := lookupHash(cmd[1], false)
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if h == nil {
+		return []byte("0"), RES_OK
+	}
+	now := nowNs()
+	deleted := 0
+	for _, field := range cmd[2:] {
+		if _, ok := h.Get(field, now); ok {
+			deleted++
+		}
+		h.Del(field)
+	}
+	hashUpdateExpire(cmd[1], h)
+	hashDeleteIfEmpty(cmd[1], h)
+	return []byte(strconv.Itoa(deleted)), RES_OK
+}
+
+// hlen key
+func doHLen(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	h, errMsg := lookupLiveHash(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if h == nil {
+		return []byte("0"), RES_OK
+	}
+	return []byte(strconv.Itoa(h.Len())), RES_OK
+}
+
+// hgetall key
+// Replies an array of fields and values.
+func doHGetAll(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	h, errMsg := lookupLiveHash(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	out := []byte{}
+	if h == nil {
+		outArr(&out, 0)
+		return out, RES_ARR
+	}
+	now := nowNs()
+	items := []byte{}
+	n := uint32(0)
+	for field := range h.fields {
+		if f, ok := h.Get(field, now); ok {
+			outStr(&items, field)
+			outStr(&items, string(f.val))
+			n += 2
+		}
+	}
+	outArr(&out, n)
+	return append(out, items...), RES_ARR
+}
+
+// parseHashFields parses `FIELDS numfields field [field ...]` at `pos`,
+// which must end the command.
+func parseHashFields(cmd []string, pos int) ([]string, bool) {
+	if pos+1 >= len(cmd) || !cmdIs(cmd[pos], "fields") {
+		return nil, false
+	}
+	n, err := strconv.Atoi(cmd[pos+1])
+	if err != nil || n <= 0 || pos+2+n != len(cmd) {
+		return nil, false
+	}
+	return cmd[pos+2:], true
+}
+
+// hexpire key seconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+// and hpexpire with milliseconds, hexpireat with unix seconds and
+// hpexpireat with unix milliseconds.
+// Replies per field: -2 if there is no such field, 0 if the condition is
+// not met, 1 if the TTL was set and 2 if the field was deleted because
+// the time is not in the future.
+func doHExpire(cmd []string) ([]byte, ResponseCode) {
+	n, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil || n < 0 {
+		return []byte("invalid expire time"), RES_ERR
+	}
+	unit := time.Millisecond
+	if cmdIs(cmd[0], "hexpire") || cmdIs(cmd[0], "hexpireat") {
+		unit = time.Second
+	}
+	if n > math.MaxInt64/int64(unit)/2 {
+		return []byte("invalid expire time"), RES_ERR
+	}
+	absolute := cmdIs(cmd[0], "hexpireat") || cmdIs(cmd[0], "hpexpireat")
+	pos := 3
+	cond := ""
+	for _, c := range []string{"nx", "xx", "gt", "lt"} {
+		if pos < len(cmd) && cmdIs(cmd[pos], c) {
+			cond = c
+			pos++
+			break
+		}
+	}
+	fields, ok := parseHashFields(cmd, pos)
+	if !ok {
+		return []byte("syntax error"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	h, errMsg := lookupHash(cmd[1], false)
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	now := nowNs()
+	at := n * int64(unit)
+	if !absolute {
+		at += now
+	}
+	out := []byte{}
+	outArr(&out, uint32(len(fields)))
+	for _, field := range fields {
+		var f *hashField
+		if h != nil {
+			f, ok = h.Get(field, now)
+		}
+		if f == nil || !ok {
+			outInt(&out, -2)
+			continue
+		}
+		// No TTL counts as an infinite one for GT and LT
+		met := true
+		switch cond {
+		case "nx":
+			met = f.expireAt == 0
+		case "xx":
+			met = f.expireAt != 0
+		case "gt":
+			met = f.expireAt != 0 && at > f.expireAt
+		case "lt":
+			met = f.expireAt == 0 || at < f.expireAt
+		}
+		if !met {
+			outInt(&out, 0)
+		} else if at <= now {
+			h.Del(field)
+			outInt(&out, 2)
+		} else {
+			h.SetExpire(field, f, at)
+			outInt(&out, 1)
+		}
+	}
+	if h != nil {
+		hashUpdateExpire(cmd[1], h)
+		hashDeleteIfEmpty(cmd[1], h)
+	}
+	return out, RES_ARR
+}
+
+// httl key FIELDS numfields field [field ...] and hpttl
+// Replies per field: -2 if there is no such field, -1 if it has no TTL,
+// or the time to live.
+func doHTTL(cmd []string) ([]byte, ResponseCode) {
+	fields, ok := parseHashFields(cmd, 2)
+	if !ok {
+		return []byte("syntax error"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	h, errMsg := lookupLiveHash(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	now := nowNs()
+	out := []byte{}
+	outArr(&out, uint32(len(fields)))
+	for _, field := range fields {
+		var f *hashField
+		if h != nil {
+			f, ok = h.Get(field, now)
+		}
+		if f == nil || !ok {
+			outInt(&out, -2)
+		} else if f.expireAt == 0 {
+			outInt(&out, -1)
+		} else if left := time.Duration(f.expireAt - now); cmdIs(cmd[0], "httl") {
+			outInt(&out, int64((left+time.Second/2)/time.Second))
+		} else {
+			outInt(&out, left.Milliseconds())
+		}
+	}
+	return out, RES_ARR
+}
+
+// hpersist key FIELDS numfields field [field ...]
+// Replies per field: -2 if there is no such field, -1 if it has no TTL
+// and 1 if the TTL was removed.
+func doHPersist(cmd []string) ([]byte, ResponseCode) {
+	fields, ok := parseHashFields(cmd, 2)
+	if !ok {
+		return []byte("syntax error"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	h, errMsg := lookupHash(cmd[1], false)
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	now := nowNs()
+	out := []byte{}
+	outArr(&out, uint32(len(fields)))
+	for _, field := range fields {
+		var f *hashField
+		if h != nil {
+			f, ok = h.Get(field, now)
+		}
+		if f == nil || !ok {
+			outInt(&out, -2)
+		} else if f.expireAt == 0 {
+			outInt(&out, -1)
+		} else {
+			h.SetExpire(field, f, 0)
+			outInt(&out, 1)
+		}
+	}
+	if h != nil {
+		hashUpdateExpire(cmd[1], h)
+	}
+	return out, RES_ARR
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHashFieldExpiry(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newTestServer(t)
+
+	s.expect("2", "hset", "h", "f", "v", "g", "w")
+	s.expect("[1 1]", "hpexpire", "h", "1", "fields", "2", "f", "g")
+	clock.advance(2 * time.Millisecond)
+
+	// Every read sees the hash as gone
+	s.expect("0", "exists", "h")
+	s.expect("none", "type", "h")
+	s.expect("-2", "ttl", "h")
+	s.expect("(nil)", "get", "h")
+	if _, ok := gMap.m.Get("h"); !ok {
+		t.Fatal("the hash was deleted before a hash command read it")
+	}
+	s.expect("0", "hlen", "h")
+	if _, ok := gMap.m.Get("h"); ok {
+		t.Fatal("the hash is left empty")
+	}
+	s.expect("0", "dbsize")
+
+	// Some fields expire
+	s.expect("3", "hset", "h", "a", "1", "b", "2", "c", "3")
+	s.expect("[1 1]", "hpexpire", "h", "10", "fields", "2", "a", "b")
+	before := usedMemory()
+	clock.advance(10 * time.Millisecond)
+	s.expect("(nil)", "hget", "h", "a")
+	s.expect("1", "hlen", "h")
+	s.expect("[c 3]", "hgetall", "h")
+	if usedMemory() >= before {
+		t.Fatal("the expired fields still count as used memory")
+	}
+	if gMap.hexp[0].Len() != 0 {
+		t.Fatal("the hash has no field TTL left but is still visited by the expiry cycle")
+	}
+	s.expect("1", "exists", "h")
+	s.expect("hash", "type", "h")
+
+	// A hash whose fields have all expired is replaced by a write
+	s.expect("[1]", "hpexpire", "h", "5", "fields", "1", "c")
+	clock.advance(5 * time.Millisecond)
+	s.expect("1", "hset", "h", "d", "4")
+	s.expect("[d 4]", "hgetall", "h")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Counters reported by INFO stats
+var gStats struct {
+	expiredKeys   int64
+	expiredFields int64 // of hashes
+	evictedKeys   int64
+}
+
+// info [section]
+// Replies "name:value" lines grouped in sections, like Redis.
+func doInfo(cmd []string) ([]byte, ResponseCode) {
+	section := "all"
+	if len(cmd) == 2 {
+		section = strings.ToLower(cmd[1])
+	}
+
+	var b strings.Builder
+	sections := []struct {
+		name  string
+		title string
+		fn    func(b *strings.Builder)
+	}{
+		{"memory", "Memory", infoMemory},
+		{"persistence", "Persistence", infoPersistence},
+		{"storage", "Storage", infoStorage},
+		{"stats", "Stats", infoStats},
+		{"keyspace", "Keyspace", infoKeyspace},
+	}
+	found := false
+	for _, s := range sections {
+		if section != "all" && section != s.name {
+			continue
+		}
+		found = true
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "# %s\n", s.title)
+		s.fn(&b)
+	}
+	if !found {
+		return []byte("unknown section"), RES_ERR
+	}
+	return []byte(b.String()), RES_OK
+}
+
+// infoKeyspace reports the key counts of the non-empty databases.
+func infoKeyspace(b *strings.Builder) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	for i, db := range gMap.dbs {
+		if db.Len() == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "db%d:keys=%d,expires=%d\n", i, db.Len(), gMap.exp[i].Len())
+	}
+}
+
+func infoMemory(b *strings.Builder) {
+	gMap.RLock()
+	used := usedMemory()
+	gMap.RUnlock()
+	fmt.Fprintf(b, "used_memory:%d\n", used)
+	fmt.Fprintf(b, "maxmemory:%d\n", gConfig.maxmemory)
+	fmt.Fprintf(b, "maxmemory_policy:%s\n", evictPolicyNames[gConfig.maxmemoryPolicy])
+	fmt.Fprintf(b, "tier_idle_ms:%d\n", gConfig.tierIdle.Milliseconds())
+	fmt.Fprintf(b, "cold_keys:%d\n", gTier.cold)
+	fmt.Fprintf(b, "cold_bytes:%d\n", gTier.live)
+	fmt.Fprintf(b, "value_log_size:%d\n", gTier.size)
+}
+
+func infoStats(b *strings.Builder) {
+	fmt.Fprintf(b, "expired_keys:%d\n", gStats.expiredKeys)
+	fmt.Fprintf(b, "expired_fields:%d\n", gStats.expiredFields)
+	fmt.Fprintf(b, "evicted_keys:%d\n", gStats.evictedKeys)
+	fmt.Fprintf(b, "cold_spills:%d\n", gTier.spills)
+	fmt.Fprintf(b, "cold_loads:%d\n", gTier.coldLoads)
+}
+
+func infoPersistence(b *strings.Builder) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	inProgress := 0
+	if gSave.job != nil {
+		inProgress = 1
+	}
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\n", gSave.dirty)
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\n", inProgress)
+	fmt.Fprintf(b, "rdb_last_save_time:%d\n", gSave.lastSave)
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\n", gSave.lastStatus)
+	exporting := 0
+	if gRdbExport.running {
+		exporting = 1
+	}
+	fmt.Fprintf(b, "rdb_export_in_progress:%d\n", exporting)
+	fmt.Fprintf(b, "rdb_last_export_status:%s\n", gRdbExport.lastStatus)
+	if gConfig.backupDir != "" {
+		running := 0
+		if gBackup.running {
+			running = 1
+		}
+		fmt.Fprintf(b, "backup_dir:%s\n", gConfig.backupDir)
+		fmt.Fprintf(b, "backup_in_progress:%d\n", running)
+		fmt.Fprintf(b, "backup_last_time:%d\n", gBackup.last)
+		fmt.Fprintf(b, "backup_last_status:%s\n", gBackup.lastStatus)
+	}
+
+	gAof.mu.Lock()
+	defer gAof.mu.Unlock()
+	enabled := 0
+	if gAof.file != nil {
+		enabled = 1
+	}
+	rewriting := 0
+	if gAof.rewrite != nil {
+		rewriting = 1
+	}
+	fmt.Fprintf(b, "aof_enabled:%d\n", enabled)
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\n", rewriting)
+	fmt.Fprintf(b, "aof_last_bgrewrite_status:%s\n", gAof.rewriteStatus)
+	if enabled == 1 {
+		fmt.Fprintf(b, "aof_current_size:%d\n", gAof.size)
+		fmt.Fprintf(b, "aof_base_size:%d\n", gAof.baseSize)
+		fmt.Fprintf(b, "aof_fsync:%s\n", aofFsyncNames[gConfig.appendfsync])
+		fmt.Fprintf(b, "aof_last_write_status:%s\n", gAof.writeStatus)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"math"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Generic commands that work on keys of any type.
+
+// exists key [key ...]
+// Replies the number of keys that exist, counting repeats.
+func doExists(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	n := 0
+	for _, key := range cmd[1:] {
+		if _, ok := lookupEntry(key); ok {
+			n++
+		}
+	}
+	return []byte(strconv.Itoa(n)), RES_OK
+}
+
+// type key
+func doType(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	ent, ok := lookupEntry(cmd[1])
+	if !ok {
+		return []byte("none"), RES_OK
+	}
+	return []byte(typeNames[ent.typ]), RES_OK
+}
+
+// rename src dst and renamenx src dst
+// The entry is moved with its TTL. RENAMENX replies RES_NX if `dst` exists.
+func doRename(cmd []string, nx bool) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	ent, ok := lookupEntry(cmd[1])
+	if !ok {
+		return []byte("no such key"), RES_ERR
+	}
+	if cmd[1] == cmd[2] {
+		if nx {
+			return nil, RES_NX
+		}
+		return nil, RES_OK
+	}
+	if _, exists := lookupEntry(cmd[2]); exists && nx {
+		return nil, RES_NX
+	}
+	dbDelete(cmd[1])
+	dbSet(cmd[2], ent)
+	return nil, RES_OK
+}
+
+// cloneEntry returns a deep copy of the entry, including its TTL.
+func cloneEntry(ent *Entry) (*Entry, error) {
+	val, err := decodeValue(ent.typ, &decoder{data: encodeValue(ent, nil)})
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{typ: ent.typ, val: val, expireAt: ent.expireAt}, nil
+}
+
+// copy src dst [REPLACE]
+// Replies RES_NX if `dst` exists and REPLACE is not given.
+func doCopy(cmd []string) ([]byte, ResponseCode) {
+	replace := false
+	if len(cmd) == 4 {
+		if !cmdIs(cmd[3], "replace") {
+			return []byte("syntax error"), RES_ERR
+		}
+		replace = true
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	ent, ok := lookupEntry(cmd[1])
+	if !ok {
+		return nil, RES_NX
+	}
+	if cmd[1] == cmd[2] {
+		return []byte("source and destination are the same"), RES_ERR
+	}
+	if _, exists := lookupEntry(cmd[2]); exists && !replace {
+		return nil, RES_NX
+	}
+	clone, err := cloneEntry(ent)
+	if err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+	dbSet(cmd[2], clone)
+	return nil, RES_OK
+}
+
+// dumpPayload serializes the value of an entry for RESTORE: the type,
+// the value written by encodeValue(), the format version and a CRC-64 of
+// the rest.
+func dumpPayload(ent *Entry) []byte {
+	out := []byte{byte(ent.typ)}
+	out = encodeValue(ent, out)
+	out = appendU32(out, kSnapshotVersion)
+	return appendU64(out, crc64.Checksum(out, gCrcTable))
+}
+
+// parsePayload decodes a payload made by dumpPayload().
+func parsePayload(data []byte) (*Entry, error) {
+	if len(data) < 1+4+8 {
+		return nil, errBadPayload
+	}
+	body := data[:len(data)-8]
+	if (&decoder{data: data[len(body):]}).u64() != crc64.Checksum(body, gCrcTable) {
+		return nil, errBadPayload
+	}
+	version := (&decoder{data: body[len(body)-4:]}).u32()
+	if version > kSnapshotVersion {
+		return nil, fmt.Errorf("unsupported payload version %d", version)
+	}
+	typ := ValueType(body[0])
+	if int(typ) >= len(typeNames) {
+		return nil, errBadPayload
+	}
+	d := &decoder{data: body[1 : len(body)-4]}
+	val, err := decodeValue(typ, d)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.data) != 0 {
+		return nil, errBadPayload
+	}
+	return &Entry{typ: typ, val: val}, nil
+}
+
+var errBadPayload = errors.New("bad payload")
+
+// dump key
+// Replies the serialized value, without the TTL, for RESTORE.
+func doDump(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	ent, ok := lookupEntry(cmd[1])
+	if !ok {
+		return nil, RES_NX
+	}
+	return dumpPayload(ent), RES_OK
+}
+
+// restore key ttl payload [REPLACE] [ABSTTL]
+// Creates the key from a DUMP payload. `ttl` is in milliseconds, 0 for
+// no TTL, or a unix time in milliseconds with ABSTTL.
+func doRestore(cmd []string) ([]byte, ResponseCode) {
+	replace, absTTL := false, false
+	for _, opt := range cmd[4:] {
+		if cmdIs(opt, "replace") {
+			replace = true
+		} else if cmdIs(opt, "absttl") {
+			absTTL = true
+		} else {
+			return []byte("syntax error"), RES_ERR
+		}
+	}
+	ttl, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil || ttl < 0 || ttl > math.MaxInt64/int64(time.Millisecond)/2 {
+		return []byte("invalid TTL value"), RES_ERR
+	}
+	ent, err := parsePayload([]byte(cmd[3]))
+	if err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	if _, exists := lookupEntry(cmd[1]); exists && !replace {
+		return []byte("target key name is busy"), RES_ERR
+	}
+	now := nowNs()
+	if ttl > 0 {
+		ent.expireAt = ttl * int64(time.Millisecond)
+		if !absTTL {
+			ent.expireAt += now
+		}
+	}
+	if ent.expired(now) {
+		// Already expired, like setting a TTL in the past
+		dbDelete(cmd[1])
+		return nil, RES_OK
+	}
+	dbSet(cmd[1], ent)
+	return nil, RES_OK
+}
+
+// randomkey
+func doRandomKey(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	now := nowNs()
+	for i := 0; i < 100 && gMap.m.Len() > 0; i++ {
+		if key, ent, _ := gMap.m.Random(); !ent.expired(now) {
+			return []byte(key), RES_OK
+		}
+	}
+	// Mostly expired keys, look for a live one
+	var found string
+	ok := false
+	gMap.m.Range(func(key string, ent *Entry) bool {
+		found, ok = key, !ent.expired(now)
+		return !ok
+	})
+	if !ok {
+		return nil, RES_NX
+	}
+	return []byte(found), RES_OK
+}
+
+// dbsize
+// Expired keys that are not deleted yet are counted.
+func doDbSize(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	return []byte(strconv.Itoa(gMap.m.Len())), RES_OK
+}
+
+// freeKeyspace drops every entry of `h` and returns the memory to the OS,
+// which takes a full collection. A running save keeps the nodes of its
+// snapshot.
+func freeKeyspace(h *Hamt) {
+	h.root = nil
+	h.size = 0
+	debug.FreeOSMemory()
+}
+
+func parseFlushMode(cmd []string) (async bool, ok bool) {
+	if len(cmd) == 2 {
+		if cmdIs(cmd[1], "async") {
+			return true, true
+		}
+		return false, cmdIs(cmd[1], "sync")
+	}
+	return false, true
+}
+
+// flushall [ASYNC | SYNC]
+// Empties every database. With ASYNC a goroutine also returns the memory
+// of the old keyspace to the OS, off the event loop. Otherwise the
+// collector frees it at its own pace.
+func doFlushAll(cmd []string) ([]byte, ResponseCode) {
+	async, ok := parseFlushMode(cmd)
+	if !ok {
+		return []byte("syntax error"), RES_ERR
+	}
+
+	gMap.Lock()
+	old := gMap.dbs
+	resetDatabases(len(old))
+	gMap.Unlock()
+
+	if async {
+		go func() {
+			for _, m := range old {
+				freeKeyspace(m)
+			}
+		}()
+	}
+	return nil, RES_OK
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"hash/crc64"
+	"math"
+	"testing"
+)
+
+// signPayload wraps an encoded value like dumpPayload() does, so that a
+// corrupted value passes the CRC.
+func signPayload(typ ValueType, body []byte) string {
+	out := append([]byte{byte(typ)}, body...)
+	out = appendU32(out, kSnapshotVersion)
+	return string(appendU64(out, crc64.Checksum(out, gCrcTable)))
+}
+
+func TestRestoreBadData(t *testing.T) {
+	newVset := func() *VectorSet {
+		vs := newVectorSet(2, MetricL2, 4, 10, 10)
+		for i, name := range []string{"a", "b", "c", "d"} {
+			vs.Add(name, []float32{float32(i), 1})
+		}
+		return vs
+	}
+	newTs := func() *TimeSeries {
+		s := newTimeSeries(0, 64)
+		s.rules = append(s.rules, &tsRule{dest: "d", agg: AggSum, bucket: 10})
+		for i := int64(0); i < 100; i++ {
+			s.Add(i, float64(i))
+		}
+		return s
+	}
+	newBloom := func() *BloomFilter {
+		return newBloomFilter(0.01, 100, 2, false)
+	}
+
+	for _, c := range []struct {
+		name string
+		typ  ValueType
+		body func() []byte
+	}{
+		{"vector set link to a removed node", TypeVset, func() []byte {
+			vs := newVset()
+			removed := vs.byName["b"]
+			vs.Remove("b")
+			a := vs.nodes[vs.byName["a"]]
+			a.links[0] = append(a.links[0], removed)
+			return vs.Encode(nil)
+		}},
+		{"vector set top above the entry point", TypeVset, func() []byte {
+			vs := newVset()
+			vs.top++
+			return vs.Encode(nil)
+		}},
+		{"vector set M below 2", TypeVset, func() []byte {
+			vs := newVset()
+			vs.m = 1
+			return vs.Encode(nil)
+		}},
+		{"vector set EF too large", TypeVset, func() []byte {
+			vs := newVset()
+			vs.efSearch = kVecMaxEf + 1
+			return vs.Encode(nil)
+		}},
+		{"time series sample count", TypeTs, func() []byte {
+			s := newTs()
+			s.chunks[0].count++
+			return s.Encode(nil)
+		}},
+		{"time series bits", TypeTs, func() []byte {
+			s := newTs()
+			s.chunks[0].w.buf[3] ^= 0x10
+			return s.Encode(nil)
+		}},
+		{"time series bucket of 0", TypeTs, func() []byte {
+			s := newTs()
+			s.rules[0].bucket = 0
+			return s.Encode(nil)
+		}},
+		{"time series aggregation", TypeTs, func() []byte {
+			s := newTs()
+			s.rules[0].agg = TsAgg(len(tsAggNames))
+			return s.Encode(nil)
+		}},
+		{"bloom hash count", TypeBloom, func() []byte {
+			bf := newBloom()
+			bf.layers[0].k = 1 << 30
+			return bf.Encode(nil)
+		}},
+		{"bloom expansion of 0", TypeBloom, func() []byte {
+			bf := newBloom()
+			bf.expansion = 0
+			return bf.Encode(nil)
+		}},
+		{"bloom count above the capacity", TypeBloom, func() []byte {
+			bf := newBloom()
+			bf.layers[0].count = bf.layers[0].capacity + 1
+			return bf.Encode(nil)
+		}},
+		{"bloom capacity", TypeBloom, func() []byte {
+			bf := newBloom()
+			bf.layers[0].capacity = 1 << 40
+			return bf.Encode(nil)
+		}},
+		{"top-k of 0 items", TypeTopK, func() []byte {
+			tk := newTopK(1, 8, 2, 0.9)
+			tk.k = 0
+			return tk.Encode(nil)
+		}},
+		{"top-k decay", TypeTopK, func() []byte {
+			return newTopK(1, 8, 2, 1.5).Encode(nil)
+		}},
+		{"t-digest compression", TypeTDigest, func() []byte {
+			return newTDigest(1e9).Encode(nil)
+		}},
+		{"t-digest infinite mean", TypeTDigest, func() []byte {
+			out := appendF64(nil, 100)
+			out = appendF64(out, 1)
+			out = appendF64(out, 1)
+			out = appendU32(out, 1)
+			out = appendF64(out, math.Inf(1))
+			return appendF64(out, 1)
+		}},
+		{"hash without fields", TypeHash, func() []byte {
+			return appendU32(nil, 0)
+		}},
+		{"hash with a repeated field", TypeHash, func() []byte {
+			out := appendU32(nil, 2)
+			for i := 0; i < 2; i++ {
+				out = appendStr(out, "f")
+				out = appendStr(out, "v")
+				out = appendU64(out, 0)
+			}
+			return out
+		}},
+		{"suggestions with a repeated string", TypeSug, func() []byte {
+			out := appendU32(nil, 2)
+			for i := 0; i < 2; i++ {
+				out = appendStr(out, "s")
+				out = appendF64(out, 1)
+			}
+			return out
+		}},
+	} {
+		s := newTestServer(t)
+		if got := s.reply("restore", "k", "0", signPayload(c.typ, c.body())); got != "(error) "+errBadData.Error() {
+			t.Errorf("%s: %s", c.name, got)
+		}
+		s.expect("0", "exists", "k")
+	}
+}
+
+func TestRestoreValid(t *testing.T) {
+	s := newTestServer(t)
+	s.expect("1", "vadd", "v", "values", "2", "1", "0", "a")
+	s.expect("1", "vadd", "v", "values", "2", "0", "1", "b")
+	s.expect("", "ts.create", "t")
+	s.expect("", "bf.reserve", "b", "0.01", "100")
+	s.expect("1", "bf.add", "b", "x")
+	for _, key := range []string{"v", "t", "b"} {
+		payload, _ := s.do("dump", key)
+		s.expect("", "restore", key+"2", "0", string(payload))
+		s.expect("(error) target key name is busy", "restore", key+"2", "0", string(payload))
+		// A flipped bit fails the CRC
+		bad := append([]byte(nil), payload...)
+		bad[1] ^= 1
+		s.expect("(error) "+errBadPayload.Error(), "restore", key+"3", "0", string(bad))
+	}
+	s.expect("[a b]", "vsim", "v2", "values", "2", "1", "0")
+	s.expect("1", "bf.exists", "b2", "x")
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"byor/04/util"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The lsm storage engine keeps the strings in a log-structured merge
+// tree. Writes go to a log (WAL) and to the memtable in memory. A full
+// memtable is written out as an SSTable in level 0, whose tables may
+// overlap. Compactions merge them down into levels 1 and more, where the
+// tables of a level don't overlap and each level holds ten times more
+// than the one above. A lookup checks the memtables, then the tables from
+// the newest, so it reads at most one block per level 0 table and one
+// per other level. Flushes and compactions run on a background
+// goroutine. The MANIFEST file lists the live tables.
+
+const (
+	kLsmLevels          = 7
+	kLsmL0Compaction    = 4  // level 0 tables that trigger a compaction
+	kLsmLevelMultiplier = 10 // size ratio of adjacent levels
+	kLsmManifest        = "MANIFEST"
+)
+
+type memtable struct {
+	m     map[string]lsmEntry
+	bytes int64
+}
+
+func newMemtable() *memtable {
+	return &memtable{m: make(map[string]lsmEntry)}
+}
+
+func (mt *memtable) put(e lsmEntry) {
+	if old, ok := mt.m[e.key]; ok {
+		mt.bytes -= int64(len(old.key) + len(old.val) + 16)
+	}
+	mt.m[e.key] = e
+	mt.bytes += int64(len(e.key) + len(e.val) + 16)
+}
+
+// sorted returns the entries in key order.
+func (mt *memtable) sorted() []lsmEntry {
+	out := make([]lsmEntry, 0, len(mt.m))
+	for _, e := range mt.m {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key < out[j].key })
+	return out
+}
+
+type lsmDB struct {
+	mu      sync.RWMutex
+	flushed *sync.Cond // signaled when `imm` is written out
+	dir     string
+	memSize int64 // memtable size that triggers a flush
+
+	mem    *memtable
+	imm    *memtable // full, being flushed
+	wal    *os.File  // log of `mem`
+	walNum uint64
+	immWal uint64 // log of `imm`
+
+	// Level 0 is newest first, the others are sorted by key. Only the
+	// background goroutine changes them, under the write lock.
+	levels     [kLsmLevels][]*sstable
+	compactPtr [kLsmLevels]string // where the next compaction of a level starts
+	next       uint64             // file number
+	bgErr      error              // of the background goroutine, fails the writes
+
+	work chan struct{}
+	done chan struct{}
+
+	flushes     int64
+	compactions int64
+}
+
+// lsmKey returns the key of the engine for `key` of database `db`.
+func lsmKey(db int, key string) string {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(db))
+	return string(prefix[:]) + key
+}
+
+func (l *lsmDB) path(num uint64, ext string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d.%s", num, ext))
+}
+
+// openLsm opens the engine in `dir`. Tables missing from the manifest
+// are leftovers of an interrupted compaction and are deleted. The logs
+// are replayed and written out as a level 0 table.
+func openLsm(dir string, memSize int64) (*lsmDB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &lsmDB{
+		dir:     dir,
+		memSize: memSize,
+		mem:     newMemtable(),
+		next:    1,
+		work:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	l.flushed = sync.NewCond(&l.mu)
+	if err := l.readManifest(); err != nil {
+		l.closeTables()
+		return nil, err
+	}
+
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		l.closeTables()
+		return nil, err
+	}
+	live := map[uint64]bool{}
+	for _, level := range l.levels {
+		for _, t := range level {
+			live[t.num] = true
+		}
+	}
+	var wals []uint64
+	for _, de := range names {
+		name := de.Name()
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			continue
+		}
+		num, err := strconv.ParseUint(name[:dot], 10, 64)
+		if err != nil {
+			continue
+		}
+		if num >= l.next {
+			l.next = num + 1
+		}
+		if strings.HasSuffix(name, ".log") {
+			wals = append(wals, num)
+		} else if strings.HasSuffix(name, ".sst") && !live[num] {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	sort.Slice(wals, func(i, j int) bool { return wals[i] < wals[j] })
+	for _, num := range wals {
+		if err := l.replayWal(l.path(num, "log")); err != nil {
+			l.closeTables()
+			return nil, err
+		}
+	}
+	if len(l.mem.m) > 0 {
+		t, err := l.writeTable(l.mem.sorted())
+		if err != nil {
+			l.closeTables()
+			return nil, err
+		}
+		l.levels[0] = append([]*sstable{t}, l.levels[0]...)
+		l.mem = newMemtable()
+	}
+	if err := l.saveManifest(); err != nil {
+		l.closeTables()
+		return nil, err
+	}
+	for _, num := range wals {
+		os.Remove(l.path(num, "log"))
+	}
+	if err := l.newWal(); err != nil {
+		l.closeTables()
+		return nil, err
+	}
+
+	go l.run()
+	l.work <- struct{}{} // in case a compaction is due
+	return l, nil
+}
+
+// readManifest opens the tables listed in the manifest: a "next n" line
+// with the next file number, then a "level num" line per table.
+func (l *lsmDB) readManifest() error {
+	data, err := os.ReadFile(filepath.Join(l.dir, kLsmManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "next" && i == 0 {
+			if l.next, err = strconv.ParseUint(fields[1], 10, 64); err == nil {
+				continue
+			}
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s: bad line %d", kLsmManifest, i+1)
+		}
+		level, err1 := strconv.Atoi(fields[0])
+		num, err2 := strconv.ParseUint(fields[1], 10, 64)
+		if err1 != nil || err2 != nil || level < 0 || level >= kLsmLevels {
+			return fmt.Errorf("%s: bad line %d", kLsmManifest, i+1)
+		}
+		t, err := openSstable(l.path(num, "sst"), num)
+		if err != nil {
+			return err
+		}
+		l.levels[level] = append(l.levels[level], t)
+	}
+	for level := 1; level < kLsmLevels; level++ {
+		sortTables(l.levels[level])
+	}
+	return nil
+}
+
+// saveManifest replaces the manifest through a temp file. The caller
+// must hold the write lock, or be opening the engine.
+func (l *lsmDB) saveManifest() error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "next %d\n", l.next)
+	for level, tables := range l.levels {
+		for _, t := range tables {
+			fmt.Fprintf(&b, "%d %d\n", level, t.num)
+		}
+	}
+	path := filepath.Join(l.dir, kLsmManifest)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(l.dir)
+}
+
+// The log records are a u32 length, the entry encoded as in the tables,
+// and its CRC-64.
+func (l *lsmDB) replayWal(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	d := &decoder{data: data}
+	for len(d.data) > 0 {
+		off := len(data) - len(d.data)
+		body := d.bytes(int(d.u32()))
+		crc := d.u64()
+		if d.err != nil || crc64.Checksum(body, gCrcTable) != crc {
+			util.Msg(fmt.Sprintf("%s ends with a bad record at offset %d, dropping %d bytes", path, off, len(data)-off))
+			break
+		}
+		e := decodeLsmEntry(&decoder{data: body})
+		l.mem.put(e)
+	}
+	return nil
+}
+
+func (l *lsmDB) newWal() error {
+	num := l.next
+	l.next++
+	f, err := os.OpenFile(l.path(num, "log"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	l.wal = f
+	l.walNum = num
+	return nil
+}
+
+// put applies a write. The caller must hold the write lock.
+func (l *lsmDB) put(e lsmEntry) error {
+	if l.bgErr != nil {
+		return l.bgErr
+	}
+	body := appendLsmEntry(nil, &e)
+	rec := appendU32(nil, uint32(len(body)))
+	rec = append(rec, body...)
+	rec = appendU64(rec, crc64.Checksum(body, gCrcTable))
+	if _, err := l.wal.Write(rec); err != nil {
+		return err
+	}
+	l.mem.put(e)
+	if l.mem.bytes < l.memSize {
+		return nil
+	}
+
+	// Stall until the previous memtable is written out
+	for l.imm != nil && l.bgErr == nil {
+		l.flushed.Wait()
+	}
+	if l.bgErr != nil {
+		return l.bgErr
+	}
+	old := l.wal
+	l.imm, l.immWal = l.mem, l.walNum
+	l.mem = newMemtable()
+	if err := l.newWal(); err != nil {
+		l.bgErr = err
+		return err
+	}
+	old.Close()
+	select {
+	case l.work <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// lookup returns the newest entry of `key`, or nil. The caller must hold
+// the lock.
+func (l *lsmDB) lookup(key string) (*lsmEntry, error) {
+	if e, ok := l.mem.m[key]; ok {
+		return &e, nil
+	}
+	if l.imm != nil {
+		if e, ok := l.imm.m[key]; ok {
+			return &e, nil
+		}
+	}
+	for _, t := range l.levels[0] {
+		if e, err := t.get(key); e != nil || err != nil {
+			return e, err
+		}
+	}
+	for _, tables := range l.levels[1:] {
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].last >= key })
+		if i == len(tables) {
+			continue
+		}
+		if e, err := tables[i].get(key); e != nil || err != nil {
+			return e, err
+		}
+	}
+	return nil, nil
+}
+
+func (l *lsmDB) Get(db int, key string) ([]byte, int64, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	e, err := l.lookup(lsmKey(db, key))
+	if err != nil || e == nil || e.deleted || (e.expireAt != 0 && e.expireAt <= nowNs()) {
+		return nil, 0, false, err
+	}
+	return e.val, e.expireAt, true, nil
+}
+
+func (l *lsmDB) Set(db int, key string, val []byte, expireAt int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.put(lsmEntry{key: lsmKey(db, key), val: val, expireAt: expireAt})
+}
+
+func (l *lsmDB) Del(db int, key string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k := lsmKey(db, key)
+	e, err := l.lookup(k)
+	if err != nil {
+		return false, err
+	}
+	if e == nil || e.deleted || (e.expireAt != 0 && e.expireAt <= nowNs()) {
+		return false, nil
+	}
+	return true, l.put(lsmEntry{key: k, deleted: true})
+}
+
+func (l *lsmDB) Info(b *strings.Builder) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	fmt.Fprintf(b, "lsm_memtable_bytes:%d\n", l.mem.bytes)
+	fmt.Fprintf(b, "lsm_flushes:%d\n", l.flushes)
+	fmt.Fprintf(b, "lsm_compactions:%d\n", l.compactions)
+	for level, tables := range l.levels {
+		if len(tables) > 0 {
+			fmt.Fprintf(b, "lsm_level%d:tables=%d,bytes=%d\n", level, len(tables), levelBytes(tables))
+		}
+	}
+	if l.bgErr != nil {
+		fmt.Fprintf(b, "lsm_error:%s\n", l.bgErr)
+	}
+}
+
+// run is the background goroutine. It flushes the full memtable, runs
+// the compactions that are due, and syncs the log every second.
+func (l *lsmDB) run() {
+	defer close(l.done)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case _, ok := <-l.work:
+			if !ok {
+				return
+			}
+		case <-tick.C:
+			l.mu.RLock()
+			f := l.wal
+			l.mu.RUnlock()
+			if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+				util.Msg("fsync of the lsm log: " + err.Error())
+			}
+			continue
+		}
+		if err := l.background(); err != nil {
+			util.Msg("lsm storage: " + err.Error())
+			l.mu.Lock()
+			l.bgErr = err
+			l.flushed.Broadcast()
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (l *lsmDB) background() error {
+	l.mu.RLock()
+	imm := l.imm
+	l.mu.RUnlock()
+	if imm != nil {
+		if err := l.flushImm(imm); err != nil {
+			return err
+		}
+	}
+	for {
+		level, inputs := l.pickCompaction()
+		if inputs == nil {
+			return nil
+		}
+		if err := l.compact(level, inputs); err != nil {
+			return err
+		}
+	}
+}
+
+// writeTable writes sorted entries to a new table.
+func (l *lsmDB) writeTable(entries []lsmEntry) (*sstable, error) {
+	l.mu.Lock()
+	num := l.next
+	l.next++
+	l.mu.Unlock()
+	w, err := createSstable(l.path(num, "sst"), num)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if err := w.add(&entries[i]); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	return w.finish()
+}
+
+func (l *lsmDB) flushImm(imm *memtable) error {
+	t, err := l.writeTable(imm.sorted())
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.levels[0] = append([]*sstable{t}, l.levels[0]...)
+	l.imm = nil
+	wal := l.immWal
+	err = l.saveManifest()
+	l.flushes++
+	l.flushed.Broadcast()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	os.Remove(l.path(wal, "log"))
+	return syncDir(l.dir)
+}
+
+func levelBytes(tables []*sstable) int64 {
+	total := int64(0)
+	for _, t := range tables {
+		total += t.size
+	}
+	return total
+}
+
+// maxLevelBytes returns the size above which level `level` (1 or more)
+// is compacted.
+func (l *lsmDB) maxLevelBytes(level int) int64 {
+	max := l.memSize * kLsmLevelMultiplier
+	for i := 1; i < level; i++ {
+		max *= kLsmLevelMultiplier
+	}
+	return max
+}
+
+func sortTables(tables []*sstable) {
+	sort.Slice(tables, func(i, j int) bool { return tables[i].first < tables[j].first })
+}
+
+// keyRange returns the smallest and largest keys of the tables.
+func keyRange(tables []*sstable) (string, string) {
+	first, last := tables[0].first, tables[0].last
+	for _, t := range tables[1:] {
+		if t.first < first {
+			first = t.first
+		}
+		if t.last > last {
+			last = t.last
+		}
+	}
+	return first, last
+}
+
+func overlapping(tables []*sstable, first, last string) []*sstable {
+	var out []*sstable
+	for _, t := range tables {
+		if t.overlaps(first, last) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// pickCompaction returns the level to compact and the input tables: some
+// of that level, newest first, then the overlapping ones of the next
+// level. Level 0 is compacted as a whole once it has enough tables. The
+// others are compacted a table at a time, round robin, while they are
+// too large.
+func (l *lsmDB) pickCompaction() (int, []*sstable) {
+	var inputs []*sstable
+	level := -1
+	if len(l.levels[0]) >= kLsmL0Compaction {
+		level = 0
+		inputs = append(inputs, l.levels[0]...)
+	} else {
+		for i := 1; i < kLsmLevels-1; i++ {
+			tables := l.levels[i]
+			if levelBytes(tables) <= l.maxLevelBytes(i) {
+				continue
+			}
+			j := sort.Search(len(tables), func(j int) bool { return tables[j].first > l.compactPtr[i] })
+			if j == len(tables) {
+				j = 0
+			}
+			level = i
+			inputs = append(inputs, tables[j])
+			break
+		}
+	}
+	if level < 0 {
+		return 0, nil
+	}
+	first, last := keyRange(inputs)
+	return level, append(inputs, overlapping(l.levels[level+1], first, last)...)
+}
+
+// compact merges the inputs into new tables of level+1. For a key in
+// several inputs only the newest entry is kept. Expired entries become
+// tombstones, and tombstones are dropped when no deeper level can hold an
+// older entry of the key.
+func (l *lsmDB) compact(level int, inputs []*sstable) (err error) {
+	out := level + 1
+	first, last := keyRange(inputs)
+	bottom := true
+	for i := out + 1; i < kLsmLevels; i++ {
+		if len(overlapping(l.levels[i], first, last)) > 0 {
+			bottom = false
+		}
+	}
+
+	iters := make([]*sstIter, len(inputs))
+	heads := make([]*lsmEntry, len(inputs))
+	for i, t := range inputs {
+		iters[i] = &sstIter{t: t}
+		if heads[i], err = iters[i].next(); err != nil {
+			return err
+		}
+	}
+	var outputs []*sstable
+	var w *sstWriter
+	defer func() {
+		if err != nil {
+			if w != nil {
+				w.abort()
+			}
+			for _, t := range outputs {
+				t.close()
+				os.Remove(t.path)
+			}
+		}
+	}()
+
+	target := l.memSize
+	now := nowNs()
+	for {
+		// The inputs are newest first, so the first head with the
+		// smallest key wins
+		var e *lsmEntry
+		for _, h := range heads {
+			if h != nil && (e == nil || h.key < e.key) {
+				e = h
+			}
+		}
+		if e == nil {
+			break
+		}
+		merged := *e
+		for i, h := range heads {
+			if h != nil && h.key == merged.key {
+				if heads[i], err = iters[i].next(); err != nil {
+					return err
+				}
+			}
+		}
+		if merged.expireAt != 0 && merged.expireAt <= now {
+			merged = lsmEntry{key: merged.key, deleted: true}
+		}
+		if merged.deleted && bottom {
+			continue
+		}
+
+		if w == nil {
+			l.mu.Lock()
+			num := l.next
+			l.next++
+			l.mu.Unlock()
+			if w, err = createSstable(l.path(num, "sst"), num); err != nil {
+				w = nil
+				return err
+			}
+		}
+		if err = w.add(&merged); err != nil {
+			return err
+		}
+		if w.size() >= target {
+			t, err := w.finish()
+			w = nil
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, t)
+		}
+	}
+	if w != nil {
+		t, err := w.finish()
+		w = nil
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+	}
+
+	l.mu.Lock()
+	drop := map[*sstable]bool{}
+	for _, t := range inputs {
+		drop[t] = true
+	}
+	for _, i := range []int{level, out} {
+		kept := l.levels[i][:0:0]
+		for _, t := range l.levels[i] {
+			if !drop[t] {
+				kept = append(kept, t)
+			}
+		}
+		l.levels[i] = kept
+	}
+	l.levels[out] = append(l.levels[out], outputs...)
+	sortTables(l.levels[out])
+	if level > 0 {
+		l.compactPtr[level] = inputs[0].last
+	}
+	err = l.saveManifest()
+	l.compactions++
+	l.mu.Unlock()
+	if err != nil {
+		outputs = nil // listed in the levels, so not removed
+		return err
+	}
+	for _, t := range inputs {
+		t.close()
+		os.Remove(t.path)
+	}
+	return nil
+}
+
+func (l *lsmDB) closeTables() {
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			t.close()
+		}
+	}
+}
+
+// close stops the background goroutine and closes the files. The
+// memtable is left in the log.
+func (l *lsmDB) close() error {
+	close(l.work)
+	<-l.done
+	l.closeTables()
+	err := l.wal.Sync()
+	if err1 := l.wal.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
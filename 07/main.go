@@ -4,6 +4,7 @@ import (
 	"byor/04/util"
 	"encoding/binary"
 	"errors"
+	"math"
 	"net"
 	"os"
 	"strings"
@@ -35,6 +36,7 @@ const (
 	StateReq ConnectionState = iota
 	StateRes
 	StateEnd
+	StateWait // for cold values to load, see tier.go
 )
 
 type Conn struct {
@@ -42,9 +44,12 @@ type Conn struct {
 	state    ConnectionState
 	rbufSize int
 	rbuf     [4 + util.KMaxMsg]byte
+	discard  int // bytes left of an oversized request
 	wbufSize int
 	wbufSent int
 	wbuf     [4 + util.KMaxMsg]byte
+	db       int   // the selected database
+	tierErr  error // of loading the cold values of the request
 }
 
 func connPut(fd2conn *[]*Conn, conn *Conn) {
@@ -113,49 +118,336 @@ const (
 	RES_OK  ResponseCode = iota // 0
 	RES_ERR                     // 1
 	RES_NX                      // 2
+	RES_ARR                     // 3: ResponseData holds a serialized array
 )
 
+// Tags of the values inside a RES_ARR response
+const (
+	SER_NIL = 0 // Like `NULL`
+	SER_ERR = 1 // An error message
+	SER_STR = 2 // A string
+	SER_INT = 3 // An int64
+	SER_DBL = 4 // A float64
+	SER_ARR = 5 // An array
+)
+
+func appendU32(out []byte, val uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], val)
+	return append(out, buf[:]...)
+}
+
+func appendU64(out []byte, val uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], val)
+	return append(out, buf[:]...)
+}
+
+func outNil(out *[]byte) {
+	*out = append(*out, SER_NIL)
+}
+
+func outStr(out *[]byte, val string) {
+	*out = append(*out, SER_STR)
+	*out = appendU32(*out, uint32(len(val)))
+	*out = append(*out, val...)
+}
+
+func outInt(out *[]byte, val int64) {
+	*out = append(*out, SER_INT)
+	*out = appendU64(*out, uint64(val))
+}
+
+func outDbl(out *[]byte, val float64) {
+	*out = append(*out, SER_DBL)
+	*out = appendU64(*out, math.Float64bits(val))
+}
+
+func outErr(out *[]byte, msg string) {
+	*out = append(*out, SER_ERR)
+	*out = appendU32(*out, uint32(len(msg)))
+	*out = append(*out, msg...)
+}
+
+func outArr(out *[]byte, n uint32) {
+	*out = append(*out, SER_ARR)
+	*out = appendU32(*out, n)
+}
+
 func cmdIs(word, cmd string) bool {
 	return strings.EqualFold(word, cmd)
 }
 
+type ValueType int
+
+const (
+	TypeStr ValueType = iota
+	TypeSug
+	TypeVset
+	TypeBloom
+	TypeCms
+	TypeTopK
+	TypeTDigest
+	TypeTs
+	TypeHash
+)
+
+// The names replied by the TYPE command
+var typeNames = []string{
+	TypeStr:     "string",
+	TypeSug:     "suggest",
+	TypeVset:    "vectorset",
+	TypeBloom:   "bloom",
+	TypeCms:     "cms",
+	TypeTopK:    "topk",
+	TypeTDigest: "tdigest",
+	TypeTs:      "timeseries",
+	TypeHash:    "hash",
+}
+
+// Entry is a value in the keyspace. `val` holds a []byte for TypeStr
+// and a pointer to the data structure for the other types.
+type Entry struct {
+	typ      ValueType
+	val      interface{}
+	expireAt int64 // in nowNs() time, 0 if the key doesn't expire
+	size     int64 // approximate memory use, see entryMemUsage()
+	atime    int64 // last access in nowNs() time, for LRU and LFU decay
+	freq     uint8 // logarithmic access counter, for LFU
+}
+
+func (ent *Entry) expired(now int64) bool {
+	return ent.expireAt != 0 && ent.expireAt <= now
+}
+
+// The keyspace is split into numbered databases. `m` is the database of
+// the request being processed, selected by doRequest().
 var gMap = struct {
 	sync.RWMutex
-	m map[string]string
-}{
-	m: make(map[string]string),
+	dbs  []*Hamt
+	used []int64   // approximate memory use of each database
+	exp  []*keySet // the keys with a TTL of each database
+	hexp []*keySet // the hashes with field TTLs of each database
+	cur  int
+	m    *Hamt // dbs[cur]
+}{}
+
+func init() {
+	initKeyspace(kDefaultDatabases)
+}
+
+const errWrongType = "wrong type"
+
+// lookupEntry returns the entry at `key` unless it has expired. Expired
+// entries are not deleted here since the caller may only hold the read
+// lock; writers overwrite them. The caller must hold the lock of gMap.
+func lookupEntry(key string) (*Entry, bool) {
+	return lookupEntryIn(gMap.cur, key)
+}
+
+func lookupEntryIn(db int, key string) (*Entry, bool) {
+	now := nowNs()
+	ent, ok := gMap.dbs[db].Get(key)
+	if !ok || ent.expired(now) || hashExpired(ent, now) {
+		return nil, false
+	}
+	// Requests are processed one at a time by the event loop, so this is
+	// safe under the read lock too.
+	ent.touch(now)
+	if gSave.writeCmd {
+		protectForSave(key, ent)
+	}
+	return ent, true
 }
 
 func doGet(cmd []string) ([]byte, ResponseCode) {
 	gMap.RLock()
-	val, ok := gMap.m[cmd[1]]
-	gMap.RUnlock()
-
+	defer gMap.RUnlock()
+	val, _, ok, err := gStorage.Get(gMap.cur, cmd[1])
+	if err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
 	if !ok {
 		return nil, RES_NX
 	}
 
-	res := []byte(val)
+	// Copy since the value can be modified in place
+	res := append([]byte(nil), val...)
 	return res, RES_OK
 }
 
-func doSet(cmd []string) ResponseCode {
+// set key value [NX | XX | IFEQ cmp] [GET]
+//
+//	[EX seconds | PX ms | EXAT unix-seconds | PXAT unix-ms | KEEPTTL]
+//
+// NX sets only a missing key, XX only an existing one and IFEQ only a
+// string equal to `cmp`. Replies RES_NX if the condition fails. With GET
+// the old value is replied instead, or RES_NX if there was none.
+func doSet(cmd []string) ([]byte, ResponseCode) {
+	nx, xx, get, keepTTL := false, false, false, false
+	ifeq := ""
+	hasIfeq := false
+	expireAt := int64(0)
+	for i := 3; i < len(cmd); i++ {
+		if cmdIs(cmd[i], "nx") {
+			nx = true
+		} else if cmdIs(cmd[i], "xx") {
+			xx = true
+		} else if cmdIs(cmd[i], "get") {
+			get = true
+		} else if cmdIs(cmd[i], "keepttl") {
+			keepTTL = true
+		} else if cmdIs(cmd[i], "ifeq") && i+1 < len(cmd) {
+			hasIfeq = true
+			ifeq = cmd[i+1]
+			i++
+		} else if isExpireOption(cmd[i]) && i+1 < len(cmd) && expireAt == 0 {
+			at, ok := parseExpireOption(cmd[i], cmd[i+1])
+			if !ok {
+				return []byte("invalid expire time"), RES_ERR
+			}
+			expireAt = at
+			i++
+		} else {
+			return []byte("syntax error"), RES_ERR
+		}
+	}
+	conds := 0
+	for _, c := range []bool{nx, xx, hasIfeq} {
+		if c {
+			conds++
+		}
+	}
+	if conds > 1 || (keepTTL && expireAt != 0) {
+		return []byte("syntax error"), RES_ERR
+	}
+
 	gMap.Lock()
-	gMap.m[cmd[1]] = cmd[2]
-	gMap.Unlock()
+	defer gMap.Unlock()
+	old, oldExpireAt, exists, err := gStorage.Get(gMap.cur, cmd[1])
+	if err == errNotString {
+		if get || hasIfeq {
+			return []byte(errWrongType), RES_ERR
+		}
+	} else if err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+
+	var res []byte
+	code := RES_OK
+	if get {
+		if exists {
+			res = append([]byte(nil), old...)
+		} else {
+			code = RES_NX
+		}
+	}
 
-	return RES_OK
+	if (nx && exists) || (xx && !exists) || (hasIfeq && (!exists || string(old) != ifeq)) {
+		if get {
+			return res, code
+		}
+		return nil, RES_NX
+	}
+
+	if keepTTL && exists {
+		expireAt = oldExpireAt
+	}
+	if err := gStorage.Set(gMap.cur, cmd[1], []byte(cmd[2]), expireAt); err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+	return res, code
 }
 
-func doDel(cmd []string) ResponseCode {
+// del key [IFEQ value]
+// With IFEQ the key is deleted only if it holds a string equal to `value`,
+// which releases a lock only for its owner; RES_NX is replied otherwise.
+func doDel(cmd []string) ([]byte, ResponseCode) {
+	if len(cmd) == 4 && !cmdIs(cmd[2], "ifeq") {
+		return []byte("syntax error"), RES_ERR
+	}
+
 	gMap.Lock()
-	delete(gMap.m, cmd[1])
-	gMap.Unlock()
-	return RES_OK
+	defer gMap.Unlock()
+	if len(cmd) == 4 {
+		val, _, ok, err := gStorage.Get(gMap.cur, cmd[1])
+		if err != nil {
+			return []byte(err.Error()), RES_ERR
+		}
+		if !ok || string(val) != cmd[3] {
+			return nil, RES_NX
+		}
+	}
+	if _, err := gStorage.Del(gMap.cur, cmd[1]); err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+	return nil, RES_OK
+}
+
+// Command flags
+const (
+	cmdWrite   = 1 << iota // modifies the keyspace
+	cmdDenyOOM             // may use more memory, rejected above maxmemory
+)
+
+var gCmdFlags = map[string]int{
+	"set":            cmdWrite | cmdDenyOOM,
+	"del":            cmdWrite,
+	"expire":         cmdWrite,
+	"pexpire":        cmdWrite,
+	"expireat":       cmdWrite,
+	"pexpireat":      cmdWrite,
+	"persist":        cmdWrite,
+	"mset":           cmdWrite | cmdDenyOOM,
+	"msetnx":         cmdWrite | cmdDenyOOM,
+	"rename":         cmdWrite,
+	"renamenx":       cmdWrite,
+	"copy":           cmdWrite | cmdDenyOOM,
+	"restore":        cmdWrite | cmdDenyOOM,
+	"rdbimport":      cmdWrite | cmdDenyOOM,
+	"swapdb":         cmdWrite,
+	"move":           cmdWrite,
+	"flushdb":        cmdWrite,
+	"flushall":       cmdWrite,
+	"append":         cmdWrite | cmdDenyOOM,
+	"setrange":       cmdWrite | cmdDenyOOM,
+	"getdel":         cmdWrite,
+	"getex":          cmdWrite,
+	"sugadd":         cmdWrite | cmdDenyOOM,
+	"sugdel":         cmdWrite,
+	"vadd":           cmdWrite | cmdDenyOOM,
+	"vrem":           cmdWrite,
+	"bf.reserve":     cmdWrite | cmdDenyOOM,
+	"bf.add":         cmdWrite | cmdDenyOOM,
+	"bf.madd":        cmdWrite | cmdDenyOOM,
+	"cms.initbydim":  cmdWrite | cmdDenyOOM,
+	"cms.initbyprob": cmdWrite | cmdDenyOOM,
+	"cms.incrby":     cmdWrite,
+	"cms.merge":      cmdWrite,
+	"topk.reserve":   cmdWrite | cmdDenyOOM,
+	"topk.add":       cmdWrite,
+	"topk.incrby":    cmdWrite,
+	"tdigest.create": cmdWrite | cmdDenyOOM,
+	"tdigest.add":    cmdWrite | cmdDenyOOM,
+	"tdigest.merge":  cmdWrite | cmdDenyOOM,
+	"tdigest.reset":  cmdWrite,
+	"ts.create":      cmdWrite | cmdDenyOOM,
+	"ts.add":         cmdWrite | cmdDenyOOM,
+	"ts.createrule":  cmdWrite,
+	"ts.deleterule":  cmdWrite,
+	"throttle":       cmdWrite | cmdDenyOOM,
+	"hset":           cmdWrite | cmdDenyOOM,
+	"hdel":           cmdWrite,
+	"hexpire":        cmdWrite,
+	"hpexpire":       cmdWrite,
+	"hexpireat":      cmdWrite,
+	"hpexpireat":     cmdWrite,
+	"hpersist":       cmdWrite,
 }
 
 type Request struct {
 	RequestData []byte
+	Conn        *Conn
 }
 
 type Response struct {
@@ -170,47 +462,302 @@ func doRequest(req Request) (Response, error) {
 		response.ResponseData = []byte("bad req")
 		return response, errors.New("bad req")
 	}
+	selectDB(req.Conn.db)
+	if err := req.Conn.tierErr; err != nil {
+		req.Conn.tierErr = nil
+		response.ResponseCode = RES_ERR
+		response.ResponseData = []byte(err.Error())
+		return response, nil
+	}
+	if len(cmd) > 1 && !gAof.loading && tierSuspend(req.Conn, cmd) {
+		return response, errSuspended
+	}
+	now := nowNs()
+	flags := 0
+	if len(cmd) > 0 {
+		flags = gCmdFlags[strings.ToLower(cmd[0])]
+	}
+	gSave.writeCmd = flags&cmdWrite != 0
+	if gConfig.storage != StorageMemory && len(cmd) > 0 && !gStorageCmds[strings.ToLower(cmd[0])] {
+		response.ResponseCode = RES_ERR
+		response.ResponseData = []byte("command not supported by the " + storageEngineNames[gConfig.storage] + " storage engine")
+		return response, nil
+	}
+	if flags&cmdDenyOOM != 0 && !gAof.loading && !freeMemoryIfNeeded() {
+		response.ResponseCode = RES_ERR
+		response.ResponseData = []byte(errOOM)
+		return response, nil
+	}
 
 	if len(cmd) == 2 && cmdIs(cmd[0], "get") {
 		response.ResponseData, response.ResponseCode = doGet(cmd)
-	} else if len(cmd) == 3 && cmdIs(cmd[0], "set") {
-		response.ResponseCode = doSet(cmd)
-	} else if len(cmd) == 2 && cmdIs(cmd[0], "del") {
-		response.ResponseCode = doDel(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "set") {
+		response.ResponseData, response.ResponseCode = doSet(cmd)
+	} else if (len(cmd) == 2 || len(cmd) == 4) && cmdIs(cmd[0], "del") {
+		response.ResponseData, response.ResponseCode = doDel(cmd)
+	} else if len(cmd) == 3 && (cmdIs(cmd[0], "expire") || cmdIs(cmd[0], "pexpire") ||
+		cmdIs(cmd[0], "expireat") || cmdIs(cmd[0], "pexpireat")) {
+		response.ResponseData, response.ResponseCode = doExpire(cmd)
+	} else if len(cmd) == 2 && (cmdIs(cmd[0], "ttl") || cmdIs(cmd[0], "pttl")) {
+		response.ResponseData, response.ResponseCode = doTTL(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "persist") {
+		response.ResponseData, response.ResponseCode = doPersist(cmd)
+	} else if len(cmd) >= 2 && cmdIs(cmd[0], "mget") {
+		response.ResponseData, response.ResponseCode = doMGet(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "mset") {
+		response.ResponseData, response.ResponseCode = doMSet(cmd, false)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "msetnx") {
+		response.ResponseData, response.ResponseCode = doMSet(cmd, true)
+	} else if len(cmd) >= 2 && cmdIs(cmd[0], "exists") {
+		response.ResponseData, response.ResponseCode = doExists(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "type") {
+		response.ResponseData, response.ResponseCode = doType(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "rename") {
+		response.ResponseData, response.ResponseCode = doRename(cmd, false)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "renamenx") {
+		response.ResponseData, response.ResponseCode = doRename(cmd, true)
+	} else if (len(cmd) == 3 || len(cmd) == 4) && cmdIs(cmd[0], "copy") {
+		response.ResponseData, response.ResponseCode = doCopy(cmd)
+	} else if len(cmd) == 1 && cmdIs(cmd[0], "randomkey") {
+		response.ResponseData, response.ResponseCode = doRandomKey(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "select") {
+		response.ResponseData, response.ResponseCode = doSelect(req.Conn, cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "swapdb") {
+		response.ResponseData, response.ResponseCode = doSwapDB(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "move") {
+		response.ResponseData, response.ResponseCode = doMove(cmd)
+	} else if (len(cmd) == 1 || len(cmd) == 2) && cmdIs(cmd[0], "flushdb") {
+		response.ResponseData, response.ResponseCode = doFlushDB(cmd)
+	} else if (len(cmd) == 1 || len(cmd) == 2) && cmdIs(cmd[0], "info") {
+		response.ResponseData, response.ResponseCode = doInfo(cmd)
+	} else if len(cmd) == 1 && cmdIs(cmd[0], "dbsize") {
+		response.ResponseData, response.ResponseCode = doDbSize(cmd)
+	} else if (len(cmd) == 1 || len(cmd) == 2) && cmdIs(cmd[0], "flushall") {
+		response.ResponseData, response.ResponseCode = doFlushAll(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "append") {
+		response.ResponseData, response.ResponseCode = doAppend(cmd)
+	} else if len(cmd) == 4 && cmdIs(cmd[0], "getrange") {
+		response.ResponseData, response.ResponseCode = doGetRange(cmd)
+	} else if len(cmd) == 4 && cmdIs(cmd[0], "setrange") {
+		response.ResponseData, response.ResponseCode = doSetRange(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "strlen") {
+		response.ResponseData, response.ResponseCode = doStrlen(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "getdel") {
+		response.ResponseData, response.ResponseCode = doGetDel(cmd)
+	} else if len(cmd) >= 2 && cmdIs(cmd[0], "getex") {
+		response.ResponseData, response.ResponseCode = doGetEx(cmd)
+	} else if (len(cmd) == 4 || len(cmd) == 5) && cmdIs(cmd[0], "sugadd") {
+		response.ResponseData, response.ResponseCode = doSugAdd(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "sugget") {
+		response.ResponseData, response.ResponseCode = doSugGet(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "sugdel") {
+		response.ResponseData, response.ResponseCode = doSugDel(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "suginfo") {
+		response.ResponseData, response.ResponseCode = doSugInfo(cmd)
+	} else if len(cmd) >= 5 && cmdIs(cmd[0], "vadd") {
+		response.ResponseData, response.ResponseCode = doVAdd(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "vsim") {
+		response.ResponseData, response.ResponseCode = doVSim(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "vrem") {
+		response.ResponseData, response.ResponseCode = doVRem(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "vcard") {
+		response.ResponseData, response.ResponseCode = doVCard(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "vinfo") {
+		response.ResponseData, response.ResponseCode = doVInfo(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "bf.reserve") {
+		response.ResponseData, response.ResponseCode = doBfReserve(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "bf.add") {
+		response.ResponseData, response.ResponseCode = doBfAdd(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "bf.madd") {
+		response.ResponseData, response.ResponseCode = doBfMAdd(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "bf.exists") {
+		response.ResponseData, response.ResponseCode = doBfExists(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "bf.mexists") {
+		response.ResponseData, response.ResponseCode = doBfMExists(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "bf.info") {
+		response.ResponseData, response.ResponseCode = doBfInfo(cmd)
+	} else if len(cmd) == 4 && cmdIs(cmd[0], "cms.initbydim") {
+		response.ResponseData, response.ResponseCode = doCmsInitByDim(cmd)
+	} else if len(cmd) == 4 && cmdIs(cmd[0], "cms.initbyprob") {
+		response.ResponseData, response.ResponseCode = doCmsInitByProb(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "cms.incrby") {
+		response.ResponseData, response.ResponseCode = doCmsIncrBy(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "cms.query") {
+		response.ResponseData, response.ResponseCode = doCmsQuery(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "cms.merge") {
+		response.ResponseData, response.ResponseCode = doCmsMerge(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "cms.info") {
+		response.ResponseData, response.ResponseCode = doCmsInfo(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "topk.reserve") {
+		response.ResponseData, response.ResponseCode = doTopkReserve(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "topk.add") {
+		response.ResponseData, response.ResponseCode = doTopkAdd(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "topk.incrby") {
+		response.ResponseData, response.ResponseCode = doTopkIncrBy(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "topk.query") {
+		response.ResponseData, response.ResponseCode = doTopkQuery(cmd, false)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "topk.count") {
+		response.ResponseData, response.ResponseCode = doTopkQuery(cmd, true)
+	} else if (len(cmd) == 2 || len(cmd) == 3) && cmdIs(cmd[0], "topk.list") {
+		response.ResponseData, response.ResponseCode = doTopkList(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "topk.info") {
+		response.ResponseData, response.ResponseCode = doTopkInfo(cmd)
+	} else if len(cmd) >= 2 && cmdIs(cmd[0], "tdigest.create") {
+		response.ResponseData, response.ResponseCode = doTDigestCreate(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "tdigest.add") {
+		response.ResponseData, response.ResponseCode = doTDigestAdd(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "tdigest.quantile") {
+		response.ResponseData, response.ResponseCode = doTDigestQuery(cmd, false)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "tdigest.cdf") {
+		response.ResponseData, response.ResponseCode = doTDigestQuery(cmd, true)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "tdigest.merge") {
+		response.ResponseData, response.ResponseCode = doTDigestMerge(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "tdigest.reset") {
+		response.ResponseData, response.ResponseCode = doTDigestReset(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "tdigest.info") {
+		response.ResponseData, response.ResponseCode = doTDigestInfo(cmd)
+	} else if len(cmd) >= 2 && cmdIs(cmd[0], "ts.create") {
+		response.ResponseData, response.ResponseCode = doTsCreate(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "ts.add") {
+		response.ResponseData, response.ResponseCode = doTsAdd(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "ts.get") {
+		response.ResponseData, response.ResponseCode = doTsGet(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "ts.range") {
+		response.ResponseData, response.ResponseCode = doTsRange(cmd)
+	} else if len(cmd) == 6 && cmdIs(cmd[0], "ts.createrule") {
+		response.ResponseData, response.ResponseCode = doTsCreateRule(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "ts.deleterule") {
+		response.ResponseData, response.ResponseCode = doTsDeleteRule(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "ts.info") {
+		response.ResponseData, response.ResponseCode = doTsInfo(cmd)
+	} else if (len(cmd) == 5 || len(cmd) == 6) && cmdIs(cmd[0], "throttle") {
+		response.ResponseData, response.ResponseCode = doThrottle(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "dump") {
+		response.ResponseData, response.ResponseCode = doDump(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "restore") {
+		response.ResponseData, response.ResponseCode = doRestore(cmd)
+	} else if len(cmd) == 1 && cmdIs(cmd[0], "save") {
+		response.ResponseData, response.ResponseCode = doSave(cmd)
+	} else if len(cmd) == 1 && cmdIs(cmd[0], "bgsave") {
+		response.ResponseData, response.ResponseCode = doBgSave(cmd)
+	} else if len(cmd) == 1 && cmdIs(cmd[0], "backup") {
+		response.ResponseData, response.ResponseCode = doBackup(cmd)
+	} else if len(cmd) == 1 && cmdIs(cmd[0], "bgrewriteaof") {
+		response.ResponseData, response.ResponseCode = doBgRewriteAof(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "rdbimport") {
+		response.ResponseData, response.ResponseCode = doRdbImport(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "rdbexport") {
+		response.ResponseData, response.ResponseCode = doRdbExport(cmd)
+	} else if len(cmd) == 1 && cmdIs(cmd[0], "lastsave") {
+		response.ResponseData, response.ResponseCode = doLastSave(cmd)
+	} else if len(cmd) >= 4 && cmdIs(cmd[0], "hset") {
+		response.ResponseData, response.ResponseCode = doHSet(cmd)
+	} else if len(cmd) == 3 && cmdIs(cmd[0], "hget") {
+		response.ResponseData, response.ResponseCode = doHGet(cmd)
+	} else if len(cmd) >= 3 && cmdIs(cmd[0], "hdel") {
+		response.ResponseData, response.ResponseCode = doHDel(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "hlen") {
+		response.ResponseData, response.ResponseCode = doHLen(cmd)
+	} else if len(cmd) == 2 && cmdIs(cmd[0], "hgetall") {
+		response.ResponseData, response.ResponseCode = doHGetAll(cmd)
+	} else if len(cmd) >= 6 && (cmdIs(cmd[0], "hexpire") || cmdIs(cmd[0], "hpexpire") ||
+		cmdIs(cmd[0], "hexpireat") || cmdIs(cmd[0], "hpexpireat")) {
+		response.ResponseData, response.ResponseCode = doHExpire(cmd)
+	} else if len(cmd) >= 5 && (cmdIs(cmd[0], "httl") || cmdIs(cmd[0], "hpttl")) {
+		response.ResponseData, response.ResponseCode = doHTTL(cmd)
+	} else if len(cmd) >= 5 && cmdIs(cmd[0], "hpersist") {
+		response.ResponseData, response.ResponseCode = doHPersist(cmd)
 	} else {
 		response.ResponseCode = RES_ERR
 		response.ResponseData = []byte("Unknown cmd")
 		return response, nil
 	}
 
+	// A write that failed changed nothing
+	if flags&cmdWrite != 0 && response.ResponseCode != RES_ERR {
+		// BGSAVE updates the count from its goroutine
+		gMap.Lock()
+		gSave.dirty++
+		gMap.Unlock()
+		if len(cmd) >= 2 {
+			// The value may have been modified in place
+			updateMemUsage(cmd[1])
+		}
+		aofFeedCommand(req.Conn.db, cmd, now, response)
+	}
 	return response, nil
 }
 
+// consumeRbuf removes `n` bytes from the front of the read buffer.
+func consumeRbuf(conn *Conn, n int) {
+	// Note: Frequent copy is inefficient
+	// Note: Need better handling for production code
+	remain := conn.rbufSize - n
+	if remain > 0 {
+		copy(conn.rbuf[:], conn.rbuf[n:n+remain])
+	}
+	conn.rbufSize = remain
+}
+
 func tryOneRequest(conn *Conn) bool {
+	// Skip the rest of an oversized request
+	if conn.discard > 0 {
+		n := conn.discard
+		if n > conn.rbufSize {
+			n = conn.rbufSize
+		}
+		consumeRbuf(conn, n)
+		conn.discard -= n
+		if conn.discard > 0 {
+			return false
+		}
+	}
+
 	// Try to parse a request from the buffer
 	if conn.rbufSize < 4 {
 		// Not enough data in the buffer. Will retry in the next iteration
 		return false
 	}
 	length := binary.LittleEndian.Uint32(conn.rbuf[:4])
+	var response Response
 	if length > util.KMaxMsg {
+		// The request can't fit in the buffer. Reply an error and skip
+		// its body as it arrives instead of dropping the connection.
 		util.Msg("too long 1")
-		conn.state = StateEnd
-		return false
-	}
-	if 4+int(length) > conn.rbufSize {
-		// Not enough data in the buffer. Will retry in the next iteration
-		return false
-	}
+		response.ResponseCode = RES_ERR
+		response.ResponseData = []byte("request is too big")
+		consumeRbuf(conn, 4)
+		conn.discard = int(length)
+	} else {
+		if 4+int(length) > conn.rbufSize {
+			// Not enough data in the buffer. Will retry in the next iteration
+			return false
+		}
+
+		// Got one request, do something with it
+		request := Request{
+			RequestData: conn.rbuf[4 : 4+length],
+			Conn:        conn,
+		}
+		var err error
+		response, err = doRequest(request)
+		if err == errSuspended {
+			// Run again by resumeConn() once the values are loaded
+			conn.state = StateWait
+			return false
+		}
+		if err != nil {
+			conn.state = StateEnd
+			return false
+		}
 
-	// Got one request, do something with it
-	request := Request{
-		RequestData: conn.rbuf[4 : 4+length],
+		// Remove the request from the buffer
+		consumeRbuf(conn, 4+int(length))
 	}
-	response, err := doRequest(request)
-	if err != nil {
-		conn.state = StateEnd
-		return false
+
+	if len(response.ResponseData) > util.KMaxMsg-4 {
+		response.ResponseCode = RES_ERR
+		response.ResponseData = []byte("response is too big")
 	}
 	wLen := uint32(len(response.ResponseData)) + 4
 	binary.LittleEndian.PutUint32(conn.wbuf[:4], wLen)
@@ -218,15 +765,6 @@ func tryOneRequest(conn *Conn) bool {
 	copy(conn.wbuf[8:], response.ResponseData)
 	conn.wbufSize = int(4 + wLen)
 
-	// Remove the request from the buffer
-	// Note: Frequent copy is inefficient
-	// Note: Need better handling for production code
-	remain := conn.rbufSize - (4 + int(length))
-	if remain > 0 {
-		copy(conn.rbuf[:], conn.rbuf[4+length:int(4+length)+remain])
-	}
-	conn.rbufSize = remain
-
 	// Change state
 	conn.state = StateRes
 	stateRes(conn)
@@ -272,7 +810,7 @@ func tryFillBuffer(conn *Conn) bool {
 
 	conn.rbufSize += int(rv)
 
-	if conn.rbufSize > len(conn.rbuf)-conn.rbufSize {
+	if conn.rbufSize > len(conn.rbuf) {
 		panic("Buffer size exceeded")
 	}
 
@@ -337,6 +875,29 @@ func connectionIO(conn *Conn) {
 }
 
 func main() {
+	parseFlags()
+	initKeyspace(gConfig.databases)
+	if err := initCrypt(); err != nil {
+		util.Msg(err.Error())
+		os.Exit(1)
+	}
+	if err := openStorage(); err != nil {
+		util.Msg(err.Error())
+		os.Exit(1)
+	}
+	if err := loadDataFiles(); err != nil {
+		util.Msg(err.Error())
+		os.Exit(1)
+	}
+	if err := tierInit(); err != nil {
+		util.Msg("opening the value log: " + err.Error())
+		os.Exit(1)
+	}
+	if err := backupInit(); err != nil {
+		util.Msg(err.Error())
+		os.Exit(1)
+	}
+
 	// Create socket
 	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
 	if err != nil {
@@ -350,7 +911,7 @@ func main() {
 	}
 
 	// Bind
-	addr := &syscall.SockaddrInet4{Port: 1234}
+	addr := &syscall.SockaddrInet4{Port: gConfig.port}
 	copy(addr.Addr[:], net.IPv4(0, 0, 0, 0)) // Wildcard address 0.0.0.0
 	err = syscall.Bind(fd, addr)
 	if err != nil {
@@ -373,12 +934,14 @@ func main() {
 	for {
 		// Prepare the arguments of the poll()
 		pollArgs = pollArgs[:0]
-		// For convenience, the listening fd is put in the first position
+		// For convenience, the listening fd is put in the first position,
+		// and the pipe signaling loaded cold values in the second
 		pollArgs = append(pollArgs, unix.PollFd{Fd: int32(fd), Events: unix.POLLIN})
+		pollArgs = append(pollArgs, unix.PollFd{Fd: int32(gTier.wake[0]), Events: unix.POLLIN})
 
 		// Connection fds
 		for _, conn := range fd2conn {
-			if conn == nil {
+			if conn == nil || conn.state == StateWait {
 				continue
 			}
 			var events int16
@@ -392,13 +955,13 @@ func main() {
 		}
 
 		// Poll for active fds
-		_, err := unix.Poll(pollArgs, 1000)
+		_, err := unix.Poll(pollArgs, activeExpireTimeout())
 		if err != nil {
 			util.Die("poll", err)
 		}
 
 		// Process active connections
-		for i := 1; i < len(pollArgs); i++ {
+		for i := 2; i < len(pollArgs); i++ {
 			if pollArgs[i].Revents != 0 {
 				conn := fd2conn[pollArgs[i].Fd]
 				connectionIO(conn)
@@ -411,9 +974,25 @@ func main() {
 			}
 		}
 
+		// Resume the connections whose cold values are loaded
+		if pollArgs[1].Revents != 0 {
+			for _, conn := range tierFinishLoads() {
+				resumeConn(conn)
+				if conn.state == StateEnd {
+					fd2conn[conn.fd] = nil
+					_ = syscall.Close(conn.fd)
+				}
+			}
+		}
+
 		// Try to accept a new connection if the listening fd is active
 		if pollArgs[0].Revents != 0 {
 			_ = acceptNewConn(&fd2conn, fd)
 		}
+
+		activeExpireCycle()
+		aofCron()
+		tierCron()
+		backupCron()
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	now int64
+}
+
+func (c *fakeClock) Now() int64 {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now += int64(d)
+}
+
+// useFakeClock makes a fake clock the server clock until the test ends.
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()}
+	old := gClock
+	gClock = c
+	t.Cleanup(func() { gClock = old })
+	return c
+}
+
+// testServer is a fresh keyspace with a data directory of its own, and a
+// client connection to send commands through doRequest().
+type testServer struct {
+	t    *testing.T
+	conn *Conn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	gConfig.dir = t.TempDir()
+	initKeyspace(16)
+	return &testServer{t: t, conn: &Conn{}}
+}
+
+// do runs a command and returns its reply.
+func (s *testServer) do(args ...string) ([]byte, ResponseCode) {
+	body := appendU32(nil, uint32(len(args)))
+	for _, a := range args {
+		body = appendStr(body, a)
+	}
+	res, err := doRequest(Request{RequestData: body, Conn: s.conn})
+	if err != nil {
+		s.t.Fatalf("%v: %v", args, err)
+	}
+	return res.ResponseData, res.ResponseCode
+}
+
+// reply runs a command and returns its reply as a string: the value of a
+// RES_OK, "(nil)" for RES_NX, "(error) msg" for RES_ERR, and the values of
+// a RES_ARR formatted by fmt.
+func (s *testServer) reply(args ...string) string {
+	data, code := s.do(args...)
+	switch code {
+	case RES_OK:
+		return string(data)
+	case RES_NX:
+		return "(nil)"
+	case RES_ERR:
+		return "(error) " + string(data)
+	}
+	d := &decoder{data: data}
+	v := decodeReply(d)
+	if d.err != nil || len(d.data) != 0 {
+		s.t.Fatalf("%v: bad reply %q", args, data)
+	}
+	return fmt.Sprint(v)
+}
+
+// decodeReply decodes a serialized value of a RES_ARR reply.
+func decodeReply(d *decoder) interface{} {
+	switch d.u8() {
+	case SER_NIL:
+		return nil
+	case SER_ERR:
+		return "(error) " + d.str()
+	case SER_STR:
+		return d.str()
+	case SER_INT:
+		return int64(d.u64())
+	case SER_DBL:
+		return math.Float64frombits(d.u64())
+	case SER_ARR:
+		n := d.u32()
+		out := []interface{}{}
+		for i := uint32(0); i < n && d.err == nil; i++ {
+			out = append(out, decodeReply(d))
+		}
+		return out
+	}
+	d.err = errShortData
+	return nil
+}
+
+// expect checks the reply of a command.
+func (s *testServer) expect(want string, args ...string) {
+	s.t.Helper()
+	if got := s.reply(args...); got != want {
+		s.t.Fatalf("%v: got %q, want %q", args, got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand"
+	"unsafe"
+)
+
+// The memory use of the keyspace is estimated per entry, from the sizes
+// of the data structures rather than from the Go heap, which lags behind
+// the garbage collector.
+const kEntryOverhead = int64(unsafe.Sizeof(Entry{})) + 48 // map slot and key header
+
+// entryMemUsage returns the approximate bytes used by the entry.
+func entryMemUsage(key string, ent *Entry) int64 {
+	size := kEntryOverhead + int64(len(key))
+	if _, ok := ent.val.(*coldValue); ok {
+		return size + kColdStubSize
+	}
+	switch ent.typ {
+	case TypeStr:
+		size += int64(cap(ent.val.([]byte)))
+	case TypeSug:
+		// Walking the trie is too slow to do on every write
+		d := ent.val.(*SugDict)
+		size += int64(d.nodes) * (int64(unsafe.Sizeof(sugNode{})) + 24)
+	case TypeVset:
+		vs := ent.val.(*VectorSet)
+		node := int64(unsafe.Sizeof(hnswNode{})) + int64(vs.dim*4+(vs.m0+vs.m)*4) + 64
+		size += int64(len(vs.nodes)) * node
+	case TypeBloom:
+		size += int64(ent.val.(*BloomFilter).Bytes())
+	case TypeCms:
+		size += int64(len(ent.val.(*CountMinSketch).counters)) * 8
+	case TypeTopK:
+		t := ent.val.(*TopK)
+		size += int64(len(t.buckets))*8 + int64(t.k)*64
+	case TypeTDigest:
+		t := ent.val.(*TDigest)
+		size += int64(cap(t.centroids)+cap(t.buf)) * 16
+	case TypeTs:
+		size += int64(ent.val.(*TimeSeries).MemUsage())
+	case TypeHash:
+		size += ent.val.(*Hash).bytes
+	}
+	return size
+}
+
+// dbSet stores the entry at `key` in the selected database. The caller
+// must hold the lock of gMap.
+func dbSet(key string, ent *Entry) {
+	dbSetIn(gMap.cur, key, ent)
+}
+
+func dbSetIn(db int, key string, ent *Entry) {
+	if old, ok := gMap.dbs[db].Get(key); ok {
+		gMap.used[db] -= old.size
+		if old != ent {
+			forgetCold(old)
+		}
+	}
+	if ent.atime == 0 {
+		ent.atime = nowNs()
+		ent.freq = kLFUInitVal
+	}
+	ent.size = entryMemUsage(key, ent)
+	gMap.used[db] += ent.size
+	gMap.dbs[db].Set(key, ent)
+	if ent.expireAt != 0 {
+		gMap.exp[db].Add(key)
+	} else {
+		gMap.exp[db].Remove(key)
+	}
+	if ent.typ == TypeHash && ent.val.(*Hash).volatile.Len() > 0 {
+		gMap.hexp[db].Add(key)
+	} else {
+		gMap.hexp[db].Remove(key)
+	}
+}
+
+// dbDelete removes `key` from the selected database. The caller must hold
+// the lock of gMap.
+func dbDelete(key string) {
+	dbDeleteIn(gMap.cur, key)
+}
+
+func dbDeleteIn(db int, key string) {
+	if old, ok := gMap.dbs[db].Get(key); ok {
+		gMap.used[db] -= old.size
+		forgetCold(old)
+		gMap.dbs[db].Delete(key)
+		gMap.exp[db].Remove(key)
+		gMap.hexp[db].Remove(key)
+	}
+}
+
+// updateMemUsage re-estimates the size of `key` after a command modified
+// its value in place.
+func updateMemUsage(key string) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	if ent, ok := gMap.m.Get(key); ok {
+		updateMemUsageIn(gMap.cur, key, ent)
+	}
+}
+
+func updateMemUsageIn(db int, key string, ent *Entry) {
+	size := entryMemUsage(key, ent)
+	gMap.used[db] += size - ent.size
+	ent.size = size
+}
+
+// usedMemory returns the approximate memory use of all databases. The
+// caller must hold the lock of gMap.
+func usedMemory() int64 {
+	total := int64(0)
+	for _, used := range gMap.used {
+		total += used
+	}
+	return total
+}
+
+// The LFU counter grows logarithmically: an access increments it with a
+// probability that falls as it gets larger, so 255 is reached after about
+// a million accesses. It drops by one for every kLFUDecayTime without an
+// access.
+const (
+	kLFUInitVal   = 5 // so new keys are not evicted right away
+	kLFULogFactor = 10
+	kLFUDecayTime = 60 * 1000 * 1000 * 1000 // 1 minute in ns
+)
+
+// decayedFreq returns the LFU counter minus one per decay period elapsed
+// since the last access.
+func (ent *Entry) decayedFreq(now int64) uint8 {
+	periods := (now - ent.atime) / kLFUDecayTime
+	if periods >= int64(ent.freq) {
+		return 0
+	}
+	return ent.freq - uint8(periods)
+}
+
+// touch records an access for the LRU and LFU policies.
+func (ent *Entry) touch(now int64) {
+	freq := ent.decayedFreq(now)
+	if freq < 255 {
+		base := float64(0)
+		if freq > kLFUInitVal {
+			base = float64(freq - kLFUInitVal)
+		}
+		if rand.Float64() < 1/(base*kLFULogFactor+1) {
+			freq++
+		}
+	}
+	ent.freq = freq
+	ent.atime = now
+}
@@ -0,0 +1,1095 @@
+package main
+
+import (
+	"bufio"
+	"byor/04/util"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import and export of the Redis RDB file format, so datasets can move
+// between Redis and this server. Strings and hashes map to the types of
+// the server. Lists, sets and sorted sets are read, in all their
+// encodings, but can't be stored here, so they are skipped and reported.
+// The types of the server that Redis doesn't have are skipped and
+// reported on export.
+
+const (
+	kRdbVersion    = 9  // written; Redis 5.0 and later load it
+	kRdbMaxVersion = 12 // read
+
+	kRdbOpSlotInfo     = 0xf4
+	kRdbOpFunction2    = 0xf5
+	kRdbOpFunctionPre  = 0xf6
+	kRdbOpModuleAux    = 0xf7
+	kRdbOpIdle         = 0xf8
+	kRdbOpFreq         = 0xf9
+	kRdbOpAux          = 0xfa
+	kRdbOpResizeDB     = 0xfb
+	kRdbOpExpireTimeMs = 0xfc
+	kRdbOpExpireTime   = 0xfd
+	kRdbOpSelectDB     = 0xfe
+	kRdbOpEOF          = 0xff
+
+	// Special string encodings, after a length byte with the top bits 11
+	kRdbEncInt8  = 0
+	kRdbEncInt16 = 1
+	kRdbEncInt32 = 2
+	kRdbEncLZF   = 3
+)
+
+// The value types of RDB files
+const (
+	kRdbTypeString           = 0
+	kRdbTypeList             = 1
+	kRdbTypeSet              = 2
+	kRdbTypeZset             = 3
+	kRdbTypeHash             = 4
+	kRdbTypeZset2            = 5
+	kRdbTypeModule           = 6
+	kRdbTypeModule2          = 7
+	kRdbTypeHashZipmap       = 9
+	kRdbTypeListZiplist      = 10
+	kRdbTypeSetIntset        = 11
+	kRdbTypeZsetZiplist      = 12
+	kRdbTypeHashZiplist      = 13
+	kRdbTypeListQuicklist    = 14
+	kRdbTypeStreamListpacks  = 15
+	kRdbTypeHashListpack     = 16
+	kRdbTypeZsetListpack     = 17
+	kRdbTypeListQuicklist2   = 18
+	kRdbTypeStreamListpacks2 = 19
+	kRdbTypeSetListpack      = 20
+	kRdbTypeStreamListpacks3 = 21
+	kRdbTypeHashMetadataPre  = 22
+	kRdbTypeHashListpackExP  = 23
+	kRdbTypeHashMetadata     = 24
+	kRdbTypeHashListpackEx   = 25
+)
+
+var errBadRdb = errors.New("bad RDB data")
+
+// Redis checksums RDB files with CRC-64/Jones, without the inversions of
+// hash/crc64.
+var gRdbCrcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+type rdbCrc struct {
+	sum uint64
+}
+
+func (c *rdbCrc) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.sum = gRdbCrcTable[byte(c.sum)^b] ^ (c.sum >> 8)
+	}
+	return len(p), nil
+}
+
+// An rdbObject is a value read from an RDB file.
+type rdbObject struct {
+	kind   string    // "string", "list", "set", "zset" or "hash"
+	str    string    // of a string
+	elems  []string  // of a list or set, zset members, or hash fields and values
+	scores []float64 // of a zset
+	ttls   []int64   // unix ms of each hash field, 0 for none; nil if none has a TTL
+}
+
+// An rdbRecord is a key read from an RDB file.
+type rdbRecord struct {
+	db       int
+	key      string
+	expireMs int64 // unix ms, 0 if none
+	obj      *rdbObject
+	skipped  string // the kind of a value that can't be represented, if any
+}
+
+// rdbLen reads a length. `enc` is set for the special string encodings,
+// whose kind is returned instead.
+func rdbLen(d *decoder) (n uint64, enc bool) {
+	b := d.u8()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false
+	case 1:
+		return uint64(b&0x3f)<<8 | uint64(d.u8()), false
+	case 2:
+		if b == 0x80 {
+			if p := d.bytes(4); p != nil {
+				return uint64(binary.BigEndian.Uint32(p)), false
+			}
+		} else if b == 0x81 {
+			if p := d.bytes(8); p != nil {
+				return binary.BigEndian.Uint64(p), false
+			}
+		} else if d.err == nil {
+			d.err = errBadRdb
+		}
+		return 0, false
+	}
+	return uint64(b & 0x3f), true
+}
+
+// rdbCount reads a length that counts items, each at least one byte.
+func rdbCount(d *decoder) int {
+	n, enc := rdbLen(d)
+	if enc || n > uint64(len(d.data)) {
+		if d.err == nil {
+			d.err = errBadRdb
+		}
+		return 0
+	}
+	return int(n)
+}
+
+func rdbString(d *decoder) string {
+	n, enc := rdbLen(d)
+	if !enc {
+		if n > uint64(len(d.data)) {
+			d.err = errShortData
+			return ""
+		}
+		return string(d.bytes(int(n)))
+	}
+	switch n {
+	case kRdbEncInt8:
+		return strconv.Itoa(int(int8(d.u8())))
+	case kRdbEncInt16:
+		return strconv.Itoa(int(int16(rdbU16(d))))
+	case kRdbEncInt32:
+		return strconv.Itoa(int(int32(d.u32())))
+	case kRdbEncLZF:
+		clen, _ := rdbLen(d)
+		ulen, _ := rdbLen(d)
+		// A back reference of 3 bytes expands to 264 bytes at most
+		if clen > uint64(len(d.data)) || ulen > kMaxStrLen || ulen > clen*88 {
+			d.err = errBadRdb
+			return ""
+		}
+		out, err := lzfDecompress(d.bytes(int(clen)), int(ulen))
+		if err != nil && d.err == nil {
+			d.err = err
+		}
+		return string(out)
+	default:
+		if d.err == nil {
+			d.err = errBadRdb
+		}
+	}
+	return ""
+}
+
+// rdbScore reads a zset score of the old format: a length byte and the
+// score as text, or 253-255 for NaN, +inf and -inf.
+func rdbScore(d *decoder) float64 {
+	switch n := d.u8(); n {
+	case 253:
+		return math.NaN()
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	default:
+		return parseScore(d, string(d.bytes(int(n))))
+	}
+}
+
+func parseScore(d *decoder, s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil && d.err == nil {
+		d.err = errBadRdb
+	}
+	return v
+}
+
+// lzfDecompress expands LZF data to `outLen` bytes. A control byte below
+// 32 starts a run of that many plus one literal bytes; otherwise its top
+// 3 bits, or 7 plus the next byte, are the length minus 2 of a back
+// reference whose offset minus 1 is in the low 5 bits and the byte after.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errBadRdb
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errBadRdb
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errBadRdb
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errBadRdb
+		}
+		// The reference may overlap the bytes it produces
+		for k := 0; k < n+2; k++ {
+			out = append(out, out[ref+k])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errBadRdb
+	}
+	return out, nil
+}
+
+// lzfCompress compresses `in` in the format of lzfDecompress(), or
+// returns nil if that doesn't save at least 4 bytes, like Redis.
+func lzfCompress(in []byte) []byte {
+	const (
+		kHashBits = 14
+		kMaxOff   = 1 << 13
+		kMaxRef   = 7 + 255 + 2
+	)
+	if len(in) <= 4 {
+		return nil
+	}
+	var table [1 << kHashBits]int // the last position+1 of each 3-byte hash
+	out := make([]byte, 0, len(in))
+	lit := 0 // pending literal bytes, ending at i
+	flush := func(end int) {
+		for lit > 0 {
+			n := lit
+			if n > 32 {
+				n = 32
+			}
+			out = append(out, byte(n-1))
+			out = append(out, in[end-lit:end-lit+n]...)
+			lit -= n
+		}
+	}
+	i := 0
+	for i+2 < len(in) {
+		v := uint32(in[i])<<16 | uint32(in[i+1])<<8 | uint32(in[i+2])
+		h := (v * 2654435761) >> (32 - kHashBits)
+		ref := table[h] - 1
+		table[h] = i + 1
+		off := i - ref - 1
+		if ref < 0 || off >= kMaxOff || in[ref] != in[i] || in[ref+1] != in[i+1] || in[ref+2] != in[i+2] {
+			lit++
+			i++
+			continue
+		}
+		maxLen := len(in) - i
+		if maxLen > kMaxRef {
+			maxLen = kMaxRef
+		}
+		n := 3
+		for n < maxLen && in[ref+n] == in[i+n] {
+			n++
+		}
+		flush(i)
+		if l := n - 2; l < 7 {
+			out = append(out, byte(l<<5|off>>8), byte(off))
+		} else {
+			out = append(out, byte(7<<5|off>>8), byte(l-7), byte(off))
+		}
+		i += n
+	}
+	lit += len(in) - i
+	flush(len(in))
+	if len(out) >= len(in)-4 {
+		return nil
+	}
+	return out
+}
+
+// ziplistEntries returns the entries of a ziplist, the compact encoding
+// of small lists, hashes and zsets before Redis 7.
+func ziplistEntries(zl []byte) ([]string, error) {
+	d := &decoder{data: zl}
+	d.bytes(4 + 4 + 2) // total bytes, tail offset, count
+	var out []string
+	for d.err == nil {
+		if len(d.data) == 0 {
+			return nil, errBadRdb
+		}
+		if d.data[0] == 0xff {
+			return out, nil
+		}
+		if d.u8() == 0xfe { // the length of the previous entry
+			d.bytes(4)
+		}
+		enc := d.u8()
+		switch {
+		case enc>>6 == 0:
+			out = append(out, string(d.bytes(int(enc&0x3f))))
+		case enc>>6 == 1:
+			out = append(out, string(d.bytes(int(enc&0x3f)<<8|int(d.u8()))))
+		case enc>>6 == 2:
+			if p := d.bytes(4); p != nil {
+				out = append(out, string(d.bytes(int(binary.BigEndian.Uint32(p)))))
+			}
+		case enc == 0xc0:
+			out = append(out, strconv.Itoa(int(int16(rdbU16(d)))))
+		case enc == 0xd0:
+			out = append(out, strconv.Itoa(int(int32(d.u32()))))
+		case enc == 0xe0:
+			out = append(out, strconv.FormatInt(int64(d.u64()), 10))
+		case enc == 0xf0:
+			out = append(out, strconv.Itoa(int(int24(d.bytes(3)))))
+		case enc == 0xfe:
+			out = append(out, strconv.Itoa(int(int8(d.u8()))))
+		case enc >= 0xf1 && enc <= 0xfd:
+			out = append(out, strconv.Itoa(int(enc&0x0f)-1))
+		default:
+			return nil, errBadRdb
+		}
+	}
+	return nil, d.err
+}
+
+func rdbU16(d *decoder) uint16 {
+	if p := d.bytes(2); p != nil {
+		return binary.LittleEndian.Uint16(p)
+	}
+	return 0
+}
+
+func int24(p []byte) int32 {
+	if len(p) < 3 {
+		return 0
+	}
+	return int32(uint32(p[0])<<8|uint32(p[1])<<16|uint32(p[2])<<24) >> 8
+}
+
+// listpackEntries returns the entries of a listpack, the compact encoding
+// of Redis 7.
+func listpackEntries(lp []byte) ([]string, error) {
+	d := &decoder{data: lp}
+	d.bytes(4 + 2) // total bytes, count
+	var out []string
+	for d.err == nil {
+		if len(d.data) == 0 {
+			return nil, errBadRdb
+		}
+		b := d.data[0]
+		if b == 0xff {
+			return out, nil
+		}
+		start := len(d.data)
+		d.u8()
+		switch {
+		case b&0x80 == 0: // 7-bit uint
+			out = append(out, strconv.Itoa(int(b)))
+		case b&0xc0 == 0x80: // 6-bit length string
+			out = append(out, string(d.bytes(int(b&0x3f))))
+		case b&0xe0 == 0xc0: // 13-bit int
+			v := int(b&0x1f)<<8 | int(d.u8())
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			out = append(out, strconv.Itoa(v))
+		case b&0xf0 == 0xe0: // 12-bit length string
+			out = append(out, string(d.bytes(int(b&0x0f)<<8|int(d.u8()))))
+		case b == 0xf0: // 32-bit length string
+			out = append(out, string(d.bytes(int(d.u32()))))
+		case b == 0xf1:
+			out = append(out, strconv.Itoa(int(int16(rdbU16(d)))))
+		case b == 0xf2:
+			out = append(out, strconv.Itoa(int(int24(d.bytes(3)))))
+		case b == 0xf3:
+			out = append(out, strconv.Itoa(int(int32(d.u32()))))
+		case b == 0xf4:
+			out = append(out, strconv.FormatInt(int64(d.u64()), 10))
+		default:
+			return nil, errBadRdb
+		}
+		// Skip the length of the entry, kept for backward traversal
+		l := start - len(d.data)
+		switch {
+		case l <= 127:
+			d.bytes(1)
+		case l < 16383:
+			d.bytes(2)
+		case l < 2097151:
+			d.bytes(3)
+		case l < 268435455:
+			d.bytes(4)
+		default:
+			d.bytes(5)
+		}
+	}
+	return nil, d.err
+}
+
+// intsetEntries returns the integers of an intset.
+func intsetEntries(is []byte) ([]string, error) {
+	d := &decoder{data: is}
+	width := d.u32()
+	n := d.u32()
+	if d.err != nil || (width != 2 && width != 4 && width != 8) || uint64(n)*uint64(width) != uint64(len(d.data)) {
+		return nil, errBadRdb
+	}
+	out := make([]string, 0, n)
+	for i := uint32(0); i < n; i++ {
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(rdbU16(d)))
+		case 4:
+			v = int64(int32(d.u32()))
+		case 8:
+			v = int64(d.u64())
+		}
+		out = append(out, strconv.FormatInt(v, 10))
+	}
+	return out, nil
+}
+
+// zipmapEntries returns the fields and values of a zipmap, the compact
+// encoding of small hashes before Redis 2.6.
+func zipmapEntries(zm []byte) ([]string, error) {
+	d := &decoder{data: zm}
+	d.u8() // count
+	zmLen := func() (int, bool) {
+		b := d.u8()
+		if b == 0xff {
+			return 0, false
+		}
+		if b == 254 {
+			return int(d.u32()), true
+		}
+		return int(b), true
+	}
+	var out []string
+	for d.err == nil {
+		n, ok := zmLen()
+		if !ok {
+			return out, d.err
+		}
+		field := string(d.bytes(n))
+		n, ok = zmLen()
+		if !ok {
+			return nil, errBadRdb
+		}
+		free := int(d.u8())
+		out = append(out, field, string(d.bytes(n)))
+		d.bytes(free)
+	}
+	return nil, d.err
+}
+
+// rdbSkipModuleValue skips a value saved by a module in the self-describing
+// format of RDB_TYPE_MODULE_2.
+func rdbSkipModuleValue(d *decoder) {
+	for d.err == nil {
+		op, _ := rdbLen(d)
+		switch op {
+		case 0: // EOF
+			return
+		case 1, 2: // signed and unsigned ints
+			rdbLen(d)
+		case 3: // float
+			d.bytes(4)
+		case 4: // double
+			d.bytes(8)
+		case 5: // string
+			rdbString(d)
+		default:
+			d.err = errBadRdb
+		}
+	}
+}
+
+// rdbLoadObject reads a value of RDB type `typ`. Returns a non-empty
+// `skipped` for the values that were read but can't be represented.
+func rdbLoadObject(d *decoder, typ byte) (obj *rdbObject, skipped string, err error) {
+	blobEntries := func(parse func([]byte) ([]string, error)) []string {
+		blob := rdbString(d)
+		if d.err != nil {
+			return nil
+		}
+		out, err := parse([]byte(blob))
+		if err != nil {
+			d.err = err
+		}
+		return out
+	}
+	pairs := func(entries []string) []string {
+		if len(entries)%2 != 0 && d.err == nil {
+			d.err = errBadRdb
+		}
+		return entries
+	}
+	zset := func(entries []string) *rdbObject {
+		obj := &rdbObject{kind: "zset"}
+		entries = pairs(entries)
+		for i := 0; i+1 < len(entries); i += 2 {
+			obj.elems = append(obj.elems, entries[i])
+			obj.scores = append(obj.scores, parseScore(d, entries[i+1]))
+		}
+		return obj
+	}
+	// Hashes with field TTLs, new in Redis 7.4
+	hashWithTTLs := func(entries []string) *rdbObject {
+		if len(entries)%3 != 0 && d.err == nil {
+			d.err = errBadRdb
+		}
+		obj := &rdbObject{kind: "hash"}
+		for i := 0; i+2 < len(entries); i += 3 {
+			ttl, err := strconv.ParseInt(entries[i+2], 10, 64)
+			if err != nil && d.err == nil {
+				d.err = errBadRdb
+			}
+			obj.elems = append(obj.elems, entries[i], entries[i+1])
+			obj.ttls = append(obj.ttls, ttl)
+		}
+		return obj
+	}
+
+	switch typ {
+	case kRdbTypeString:
+		obj = &rdbObject{kind: "string", str: rdbString(d)}
+	case kRdbTypeList, kRdbTypeSet:
+		obj = &rdbObject{kind: "list"}
+		if typ == kRdbTypeSet {
+			obj.kind = "set"
+		}
+		for n := rdbCount(d); n > 0 && d.err == nil; n-- {
+			obj.elems = append(obj.elems, rdbString(d))
+		}
+	case kRdbTypeZset, kRdbTypeZset2:
+		obj = &rdbObject{kind: "zset"}
+		for n := rdbCount(d); n > 0 && d.err == nil; n-- {
+			obj.elems = append(obj.elems, rdbString(d))
+			if typ == kRdbTypeZset {
+				obj.scores = append(obj.scores, rdbScore(d))
+			} else {
+				obj.scores = append(obj.scores, d.f64())
+			}
+		}
+	case kRdbTypeHash:
+		obj = &rdbObject{kind: "hash"}
+		for n := rdbCount(d); n > 0 && d.err == nil; n-- {
+			obj.elems = append(obj.elems, rdbString(d), rdbString(d))
+		}
+	case kRdbTypeHashMetadataPre, kRdbTypeHashMetadata:
+		minExpire := int64(0)
+		if typ == kRdbTypeHashMetadata {
+			minExpire = int64(d.u64()) - 1 // TTLs are stored relative to it, plus 1
+		}
+		obj = &rdbObject{kind: "hash"}
+		for n := rdbCount(d); n > 0 && d.err == nil; n-- {
+			ttl, _ := rdbLen(d)
+			if ttl != 0 {
+				ttl += uint64(minExpire)
+			}
+			obj.elems = append(obj.elems, rdbString(d), rdbString(d))
+			obj.ttls = append(obj.ttls, int64(ttl))
+		}
+	case kRdbTypeHashZipmap:
+		obj = &rdbObject{kind: "hash", elems: pairs(blobEntries(zipmapEntries))}
+	case kRdbTypeHashZiplist:
+		obj = &rdbObject{kind: "hash", elems: pairs(blobEntries(ziplistEntries))}
+	case kRdbTypeHashListpack:
+		obj = &rdbObject{kind: "hash", elems: pairs(blobEntries(listpackEntries))}
+	case kRdbTypeHashListpackExP, kRdbTypeHashListpackEx:
+		if typ == kRdbTypeHashListpackEx {
+			d.u64() // the minimum TTL; the listpack has absolute ones
+		}
+		obj = hashWithTTLs(blobEntries(listpackEntries))
+	case kRdbTypeListZiplist:
+		obj = &rdbObject{kind: "list", elems: blobEntries(ziplistEntries)}
+	case kRdbTypeSetIntset:
+		obj = &rdbObject{kind: "set", elems: blobEntries(intsetEntries)}
+	case kRdbTypeSetListpack:
+		obj = &rdbObject{kind: "set", elems: blobEntries(listpackEntries)}
+	case kRdbTypeZsetZiplist:
+		obj = zset(blobEntries(ziplistEntries))
+	case kRdbTypeZsetListpack:
+		obj = zset(blobEntries(listpackEntries))
+	case kRdbTypeListQuicklist, kRdbTypeListQuicklist2:
+		obj = &rdbObject{kind: "list"}
+		for n := rdbCount(d); n > 0 && d.err == nil; n-- {
+			container := uint64(2) // a packed ziplist or listpack
+			if typ == kRdbTypeListQuicklist2 {
+				container, _ = rdbLen(d)
+			}
+			if container == 1 { // a plain element
+				obj.elems = append(obj.elems, rdbString(d))
+			} else if typ == kRdbTypeListQuicklist {
+				obj.elems = append(obj.elems, blobEntries(ziplistEntries)...)
+			} else {
+				obj.elems = append(obj.elems, blobEntries(listpackEntries)...)
+			}
+		}
+	case kRdbTypeModule2:
+		rdbLen(d) // the module id
+		rdbSkipModuleValue(d)
+		return nil, "module", d.err
+	case kRdbTypeStreamListpacks, kRdbTypeStreamListpacks2, kRdbTypeStreamListpacks3:
+		return nil, "", errors.New("streams are not supported")
+	default:
+		return nil, "", fmt.Errorf("unsupported value type %d", typ)
+	}
+	if d.err != nil {
+		return nil, "", d.err
+	}
+	if obj.kind != "string" && obj.kind != "hash" {
+		return obj, obj.kind, nil
+	}
+	return obj, "", nil
+}
+
+// readRdb parses a whole RDB file.
+func readRdb(data []byte) ([]rdbRecord, error) {
+	if len(data) < 9 || !bytes.HasPrefix(data, []byte("REDIS")) {
+		return nil, errors.New("not an RDB file")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > kRdbMaxVersion {
+		return nil, fmt.Errorf("unsupported RDB version %q", data[5:9])
+	}
+
+	d := &decoder{data: data[9:]}
+	var records []rdbRecord
+	db := 0
+	expireMs := int64(0)
+	for {
+		offset := len(data) - len(d.data)
+		fail := func(err error) ([]rdbRecord, error) {
+			if errors.Is(err, errShortData) {
+				err = errors.New("truncated")
+			}
+			return nil, fmt.Errorf("RDB offset %d: %v", offset, err)
+		}
+		op := d.u8()
+		if d.err != nil {
+			return fail(errors.New("truncated"))
+		}
+		switch op {
+		case kRdbOpEOF:
+			if version >= 5 {
+				crc := &rdbCrc{}
+				crc.Write(data[:offset+1])
+				// A zero checksum means checksums were turned off
+				if sum := d.u64(); d.err == nil && sum != 0 && sum != crc.sum {
+					return nil, errors.New("RDB checksum mismatch")
+				}
+			}
+			if d.err != nil {
+				return fail(errors.New("truncated checksum"))
+			}
+			return records, nil
+		case kRdbOpSelectDB:
+			n, _ := rdbLen(d)
+			if n > math.MaxInt32 {
+				return fail(errors.New("bad database index"))
+			}
+			db = int(n)
+		case kRdbOpResizeDB:
+			rdbLen(d)
+			rdbLen(d)
+		case kRdbOpAux:
+			rdbString(d)
+			rdbString(d)
+		case kRdbOpExpireTimeMs:
+			expireMs = int64(d.u64())
+		case kRdbOpExpireTime:
+			expireMs = int64(d.u32()) * 1000
+		case kRdbOpIdle:
+			rdbLen(d)
+		case kRdbOpFreq:
+			d.u8()
+		case kRdbOpSlotInfo:
+			rdbLen(d)
+			rdbLen(d)
+			rdbLen(d)
+		case kRdbOpModuleAux:
+			rdbLen(d) // module id
+			rdbLen(d) // when opcode
+			rdbLen(d) // when
+			rdbSkipModuleValue(d)
+			records = append(records, rdbRecord{db: db, skipped: "module aux data"})
+		case kRdbOpFunction2:
+			rdbString(d)
+			records = append(records, rdbRecord{db: db, skipped: "function library"})
+		case kRdbOpFunctionPre:
+			return fail(errors.New("functions of Redis 7.0 release candidates are not supported"))
+		default:
+			key := rdbString(d)
+			if d.err != nil {
+				return fail(d.err)
+			}
+			obj, skipped, err := rdbLoadObject(d, op)
+			if err != nil {
+				return fail(fmt.Errorf("key %q: %v", key, err))
+			}
+			records = append(records, rdbRecord{db: db, key: key, expireMs: expireMs, obj: obj, skipped: skipped})
+			expireMs = 0
+		}
+		if d.err != nil {
+			return fail(d.err)
+		}
+	}
+}
+
+// rdbEntry converts an imported value, dropping what has expired at
+// `now`. Returns nil if nothing is left.
+func rdbEntry(rec *rdbRecord, now int64) *Entry {
+	ent := &Entry{expireAt: rec.expireMs * int64(time.Millisecond)}
+	if ent.expired(now) {
+		return nil
+	}
+	obj := rec.obj
+	if obj.kind == "string" {
+		ent.typ = TypeStr
+		ent.val = []byte(obj.str)
+		return ent
+	}
+	h := newHash()
+	for i := 0; i+1 < len(obj.elems); i += 2 {
+		h.Set(obj.elems[i], []byte(obj.elems[i+1]), now)
+		if obj.ttls != nil && obj.ttls[i/2] != 0 {
+			at := obj.ttls[i/2] * int64(time.Millisecond)
+			if at <= now {
+				h.Del(obj.elems[i])
+			} else {
+				h.SetExpire(obj.elems[i], h.fields[obj.elems[i]], at)
+			}
+		}
+	}
+	if h.Len() == 0 {
+		return nil
+	}
+	ent.typ = TypeHash
+	ent.val = h
+	return ent
+}
+
+// formatCounts formats counts by kind, like "list: 2, set: 1".
+func formatCounts(counts map[string]int) string {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%s: %d", kind, counts[kind]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rdbimport name
+// Adds the strings and hashes of the Redis RDB file `name` of the data
+// directory to the keyspace, replacing existing keys. Other values are
+// skipped; the reply counts them by type and the server log names their
+// keys.
+func doRdbImport(cmd []string) ([]byte, ResponseCode) {
+	path, ok := rdbPath(cmd[1])
+	if !ok {
+		return errRdbName, RES_ERR
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+	records, err := readRdb(data)
+	if err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	for _, rec := range records {
+		if rec.skipped == "" && rec.db >= len(gMap.dbs) {
+			return []byte(fmt.Sprintf("RDB database %d is out of range", rec.db)), RES_ERR
+		}
+	}
+	now := nowNs()
+	imported, expired := 0, 0
+	skipped := map[string]int{}
+	for i := range records {
+		rec := &records[i]
+		if rec.skipped != "" {
+			skipped[rec.skipped]++
+			if rec.key != "" {
+				util.Msg(fmt.Sprintf("rdbimport: skipped %s key %q of db %d", rec.skipped, rec.key, rec.db))
+			}
+			continue
+		}
+		ent := rdbEntry(rec, now)
+		if ent == nil {
+			expired++
+			continue
+		}
+		dbSetIn(rec.db, rec.key, ent)
+		aofFeedEntry(rec.db, rec.key, ent)
+		imported++
+	}
+	msg := fmt.Sprintf("imported %d keys, %d expired", imported, expired)
+	if len(skipped) > 0 {
+		msg += ", skipped unsupported " + formatCounts(skipped)
+	}
+	return []byte(msg), RES_OK
+}
+
+func appendRdbLen(out []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(out, byte(n))
+	case n < 1<<14:
+		return append(out, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		return append(out, 0x80, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x81)
+		for shift := 56; shift >= 0; shift -= 8 {
+			out = append(out, byte(n>>shift))
+		}
+		return out
+	}
+}
+
+// appendRdbString writes a string as an integer if it is one, LZF
+// compressed if that pays off, or as is, like Redis does.
+func appendRdbString(out []byte, s string) []byte {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(v, 10) == s {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				return append(out, 0xc0|kRdbEncInt8, byte(v))
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				return append(out, 0xc0|kRdbEncInt16, byte(v), byte(v>>8))
+			default:
+				return appendU32(append(out, 0xc0|kRdbEncInt32), uint32(v))
+			}
+		}
+	}
+	if len(s) > 20 {
+		if c := lzfCompress([]byte(s)); c != nil {
+			out = append(out, 0xc0|kRdbEncLZF)
+			out = appendRdbLen(out, uint64(len(c)))
+			out = appendRdbLen(out, uint64(len(s)))
+			return append(out, c...)
+		}
+	}
+	out = appendRdbLen(out, uint64(len(s)))
+	return append(out, s...)
+}
+
+// appendRdbRecord writes the entry if Redis has its type. Returns false
+// otherwise. Field TTLs of hashes need a newer RDB version and are
+// dropped; `fieldTTLs` tells if there were any.
+func appendRdbRecord(out []byte, key string, ent *Entry, now int64) (_ []byte, ok bool, fieldTTLs bool) {
+	if ent.typ != TypeStr && ent.typ != TypeHash {
+		return out, false, false
+	}
+	if ent.expireAt != 0 {
+		out = append(out, kRdbOpExpireTimeMs)
+		out = appendU64(out, uint64(nsToMs(ent.expireAt)))
+	}
+	if ent.typ == TypeStr {
+		out = append(out, kRdbTypeString)
+		out = appendRdbString(out, key)
+		return appendRdbString(out, string(ent.val.([]byte))), true, false
+	}
+
+	h := ent.val.(*Hash)
+	fields := make([]string, 0, h.Len())
+	for field := range h.fields {
+		if f, ok := h.Get(field, now); ok {
+			fields = append(fields, field)
+			fieldTTLs = fieldTTLs || f.expireAt != 0
+		}
+	}
+	out = append(out, kRdbTypeHash)
+	out = appendRdbString(out, key)
+	out = appendRdbLen(out, uint64(len(fields)))
+	for _, field := range fields {
+		out = appendRdbString(out, field)
+		out = appendRdbString(out, string(h.fields[field].val))
+	}
+	return out, true, fieldTTLs
+}
+
+var gRdbExport = struct {
+	running    bool
+	lastStatus string // of the last export
+}{lastStatus: "ok"}
+
+// rdbExport counts the keys encoded by an RDB export.
+type rdbExport struct {
+	written int
+	skipped map[string]int // by type
+	dropped int            // hashes whose field TTLs were dropped
+}
+
+// encode appends the RDB record of the entry, or nothing if it expired
+// at `now` or Redis lacks its type. A snapshotJob calls it once per entry.
+func (x *rdbExport) encode(out []byte, key string, ent *Entry, now int64) []byte {
+	if ent.expired(now) {
+		return out
+	}
+	out, ok, ttls := appendRdbRecord(out, key, ent, now)
+	if !ok {
+		x.skipped[typeNames[ent.typ]]++
+		return out
+	}
+	x.written++
+	if ttls {
+		x.dropped++
+	}
+	return out
+}
+
+func (x *rdbExport) String() string {
+	msg := fmt.Sprintf("exported %d keys", x.written)
+	if len(x.skipped) > 0 {
+		msg += ", skipped unsupported " + formatCounts(x.skipped)
+	}
+	if x.dropped > 0 {
+		msg += fmt.Sprintf(", dropped the field TTLs of %d hashes", x.dropped)
+	}
+	return msg
+}
+
+// writeRdb writes the databases to `path` in the RDB format, through a
+// temp file like writeSnapshot(). `record` returns the RDB record of an
+// entry.
+func writeRdb(path string, dbs []*Hamt, record func(key string, ent *Entry) ([]byte, error)) (err error) {
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	buf := bufio.NewWriterSize(f, 64<<10)
+	crc := &rdbCrc{}
+	w := io.MultiWriter(buf, crc)
+
+	out := []byte(fmt.Sprintf("REDIS%04d", kRdbVersion))
+	out = append(out, kRdbOpAux)
+	out = appendRdbString(out, "redis-bits")
+	out = appendRdbString(out, "64")
+	out = append(out, kRdbOpAux)
+	out = appendRdbString(out, "ctime")
+	out = appendRdbString(out, strconv.FormatInt(time.Now().Unix(), 10))
+	for i, db := range dbs {
+		if db.Len() == 0 {
+			continue
+		}
+		out = append(out, kRdbOpSelectDB)
+		out = appendRdbLen(out, uint64(i))
+		db.Range(func(key string, ent *Entry) bool {
+			var rec []byte
+			if rec, err = record(key, ent); err != nil {
+				return false
+			}
+			out = append(out, rec...)
+			if len(out) >= 64<<10 {
+				if _, err = w.Write(out); err != nil {
+					return false
+				}
+				out = out[:0]
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	out = append(out, kRdbOpEOF)
+	if _, err = w.Write(out); err != nil {
+		return err
+	}
+	if _, err = buf.Write(appendU64(nil, crc.sum)); err != nil {
+		return err
+	}
+
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// rdbPath returns the path of the RDB file `name`. Clients may only name
+// .rdb files in the data directory, so they can't reach other files.
+func rdbPath(name string) (string, bool) {
+	if !strings.HasSuffix(name, ".rdb") || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return "", false
+	}
+	return filepath.Join(gConfig.dir, name), true
+}
+
+var errRdbName = []byte("the file must be named like dump.rdb, it is in the data directory")
+
+// rdbexport name
+// Writes the strings and hashes of all databases to the RDB file `name` of
+// the data directory, from a goroutine like BGSAVE. The server log counts
+// the keys of other types, which are skipped.
+func doRdbExport(cmd []string) ([]byte, ResponseCode) {
+	if gCrypt.key != nil {
+		return []byte("RDB files can't be encrypted, export is off with encryption at rest"), RES_ERR
+	}
+	path, ok := rdbPath(cmd[1])
+	if !ok {
+		return errRdbName, RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	if gSave.job != nil {
+		return errJobRunning(), RES_ERR
+	}
+	x := &rdbExport{skipped: map[string]int{}}
+	job := newSnapshotJob(x.encode)
+	gRdbExport.running = true
+
+	go func() {
+		err := writeRdb(path, job.dbs, job.record)
+		gMap.Lock()
+		defer gMap.Unlock()
+		gSave.job = nil
+		gRdbExport.running = false
+		if err != nil {
+			util.Msg("rdbexport: " + err.Error())
+			gRdbExport.lastStatus = "err"
+			return
+		}
+		// The job is cleared, nothing calls x.encode() anymore
+		util.Msg(fmt.Sprintf("rdbexport: %s to %s", x, path))
+		gRdbExport.lastStatus = "ok"
+	}()
+	return []byte("Background RDB export started"), RES_OK
+}
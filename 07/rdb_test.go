@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRdbCrc(t *testing.T) {
+	// The check value of CRC-64/Jones as Redis uses it
+	c := &rdbCrc{}
+	c.Write([]byte("123456789"))
+	if c.sum != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("crc %x", c.sum)
+	}
+}
+
+func TestLzf(t *testing.T) {
+	noise := make([]byte, 5000)
+	for i := range noise {
+		noise[i] = byte(i * 7 % 13)
+	}
+	for _, in := range [][]byte{
+		noise,
+		[]byte(strings.Repeat("abcabcabc", 100)),
+		[]byte(strings.Repeat("a", 1000)),
+		[]byte("hello world hello world hello world!"),
+	} {
+		c := lzfCompress(in)
+		if c == nil {
+			t.Fatalf("%q... didn't compress", in[:10])
+		}
+		out, err := lzfDecompress(c, len(in))
+		if err != nil || !bytes.Equal(out, in) {
+			t.Fatalf("%q...: %v", in[:10], err)
+		}
+	}
+	if lzfCompress([]byte("abcdefgh")) != nil {
+		t.Fatal("compressed a string that doesn't shrink")
+	}
+}
+
+// waitSaveJob waits for the background job started by the last command.
+func waitSaveJob(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		gMap.RLock()
+		running := gSave.job != nil
+		gMap.RUnlock()
+		if !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the background job didn't end")
+}
+
+func TestRdbExportImport(t *testing.T) {
+	s := newTestServer(t)
+	long := strings.Repeat("xyz", 300)
+	s.expect("", "set", "s", "hello")
+	for _, n := range []string{"12", "-300", "70000", "123456789012", "007"} {
+		s.expect("", "set", "n"+n, n)
+	}
+	s.expect("", "set", "long", long)
+	s.expect("", "pexpire", "long", "100000")
+	s.expect("2", "hset", "h", "a", "1", "b", strings.Repeat("q", 100))
+	s.expect("[1]", "hexpire", "h", "100", "fields", "1", "a")
+	s.expect("1", "bf.add", "bf", "x")
+	s.expect("", "select", "3")
+	s.expect("", "set", "in3", "v")
+	s.expect("", "select", "0")
+
+	s.expect("Background RDB export started", "rdbexport", "x.rdb")
+	waitSaveJob(t)
+	if gRdbExport.lastStatus != "ok" {
+		t.Fatal("the export failed")
+	}
+	initKeyspace(16)
+	s.expect("imported 9 keys, 0 expired", "rdbimport", "x.rdb")
+
+	s.expect("hello", "get", "s")
+	for _, n := range []string{"12", "-300", "70000", "123456789012", "007"} {
+		s.expect(n, "get", "n"+n)
+	}
+	s.expect(long, "get", "long")
+	if ttl := s.reply("pttl", "long"); ttl < "99000" || len(ttl) != 5 {
+		t.Fatalf("pttl %s", ttl)
+	}
+	// RDB 11 has no field TTLs
+	s.expect("[-1]", "httl", "h", "fields", "1", "a")
+	s.expect("1", "hget", "h", "a")
+	s.expect("none", "type", "bf")
+	s.expect("", "select", "3")
+	s.expect("v", "get", "in3")
+}
+
+func TestRdbPaths(t *testing.T) {
+	s := newTestServer(t)
+	outside := filepath.Join(t.TempDir(), "x.rdb")
+	for _, name := range []string{outside, "../x.rdb", "a/x.rdb", `a\x.rdb`, "..rdb", "dump.snap", ""} {
+		s.expect("(error) "+string(errRdbName), "rdbexport", name)
+		s.expect("(error) "+string(errRdbName), "rdbimport", name)
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Fatal("exported outside of the data directory")
+	}
+}
+
+// Builders of the compact encodings of Redis
+
+func lpEntry(s string) []byte {
+	if len(s) < 64 {
+		e := append([]byte{0x80 | byte(len(s))}, s...)
+		return append(e, byte(len(e)))
+	}
+	e := append([]byte{0xe0 | byte(len(s)>>8), byte(len(s))}, s...)
+	return append(e, byte(len(e)>>7), byte(len(e)&127))
+}
+
+func listpack(items ...[]byte) []byte {
+	body := bytes.Join(items, nil)
+	out := appendU32(nil, uint32(6+len(body)+1))
+	out = append(out, byte(len(items)), 0)
+	out = append(out, body...)
+	return append(out, 0xff)
+}
+
+func ziplist(items ...[]byte) []byte {
+	var body []byte
+	prev := 0
+	for _, it := range items {
+		e := append([]byte{byte(prev)}, it...)
+		body = append(body, e...)
+		prev = len(e)
+	}
+	out := appendU32(nil, uint32(10+len(body)+1))
+	out = appendU32(out, 0)
+	out = append(out, byte(len(items)), 0)
+	out = append(out, body...)
+	return append(out, 0xff)
+}
+
+func zlStr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func appendRdbBlob(out []byte, typ byte, key string, blob []byte) []byte {
+	out = append(out, typ)
+	out = appendRdbString(out, key)
+	out = appendRdbLen(out, uint64(len(blob)))
+	return append(out, blob...)
+}
+
+// redis7Fixture returns an RDB file as Redis 7.2 writes it, with the
+// encodings of the older versions it still loads, and the big string.
+func redis7Fixture() ([]byte, []byte) {
+	b := []byte("REDIS0011")
+	b = append(b, kRdbOpAux)
+	b = appendRdbString(b, "redis-ver")
+	b = appendRdbString(b, "7.2.4")
+	b = append(b, kRdbOpSelectDB, 0, kRdbOpResizeDB, 10, 1)
+
+	// A hash in a listpack, with ints of 7 and 13 bits
+	lp := listpack(lpEntry("f1"), lpEntry("v1"), []byte{0x05, 0x01}, lpEntry("f3"), lpEntry("f4"), []byte{0xc1, 0x00, 0x02})
+	b = appendRdbBlob(b, kRdbTypeHashListpack, "lph", lp)
+	// A hash in a ziplist, with an int of 4 bits and one of 8 bits
+	b = appendRdbBlob(b, kRdbTypeHashZiplist, "zlh", ziplist(zlStr("za"), []byte{0xf3}, zlStr("zb"), []byte{0xfe, 0xff}))
+	// A set of 16-bit ints
+	is := appendU32(nil, 2)
+	is = appendU32(is, 3)
+	is = append(is, 1, 0, 2, 0, 0xff, 0xff)
+	b = appendRdbBlob(b, kRdbTypeSetIntset, "iset", is)
+	// A list of a packed and a plain node
+	b = append(b, kRdbTypeListQuicklist2)
+	b = appendRdbString(b, "ql")
+	b = append(b, 2, 2)
+	lp = listpack(lpEntry("a"), lpEntry("b"))
+	b = appendRdbLen(b, uint64(len(lp)))
+	b = append(b, lp...)
+	b = append(b, 1)
+	b = appendRdbString(b, "plain")
+	// Zsets in a listpack and with binary scores
+	b = appendRdbBlob(b, kRdbTypeZsetListpack, "zs", listpack(lpEntry("m"), lpEntry("1.5")))
+	b = append(b, kRdbTypeZset2)
+	b = appendRdbString(b, "zs2")
+	b = append(b, 1)
+	b = appendRdbString(b, "m")
+	b = appendU64(b, math.Float64bits(2.5))
+	// A string with a TTL and a 32-bit length
+	b = append(b, kRdbOpExpireTimeMs)
+	b = appendU64(b, uint64(nsToMs(nowNs()+int64(time.Hour))))
+	b = append(b, kRdbTypeString)
+	b = appendRdbString(b, "big")
+	big := make([]byte, 20000)
+	for i := range big {
+		big[i] = byte(i * 31 % 251)
+	}
+	b = append(b, 0x80, 0, 0, 0x4e, 0x20)
+	b = append(b, big...)
+	// An expired string
+	b = append(b, kRdbOpExpireTimeMs)
+	b = appendU64(b, 1000)
+	b = append(b, kRdbTypeString)
+	b = appendRdbString(b, "old")
+	b = appendRdbString(b, "x")
+	// A hash in a zipmap
+	b = appendRdbBlob(b, kRdbTypeHashZipmap, "zmh", []byte{1, 2, 'k', '1', 2, 0, 'v', '1', 0xff})
+	// A hash with field TTLs, of Redis 7.4
+	b = append(b, kRdbTypeHashMetadata)
+	b = appendRdbString(b, "hm")
+	minExpire := uint64(nsToMs(nowNs() + int64(time.Hour)))
+	b = appendU64(b, minExpire)
+	b = append(b, 2, 0)
+	b = appendRdbString(b, "nottl")
+	b = appendRdbString(b, "v")
+	b = appendRdbLen(b, 1+5000)
+	b = appendRdbString(b, "ttl")
+	b = appendRdbString(b, "v")
+
+	b = append(b, kRdbOpSelectDB, 5)
+	b = append(b, kRdbTypeString)
+	b = appendRdbString(b, "db5")
+	b = appendRdbString(b, "five")
+	b = append(b, kRdbOpEOF)
+	crc := &rdbCrc{}
+	crc.Write(b)
+	return appendU64(b, crc.sum), big
+}
+
+func TestRdbImportRedis7(t *testing.T) {
+	s := newTestServer(t)
+	fixture, big := redis7Fixture()
+	path := filepath.Join(gConfig.dir, "redis.rdb")
+	if err := os.WriteFile(path, fixture, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.expect("imported 6 keys, 1 expired, skipped unsupported list: 1, set: 1, zset: 2", "rdbimport", "redis.rdb")
+
+	hgetall := func(key string) map[string]string {
+		gMap.RLock()
+		defer gMap.RUnlock()
+		out := map[string]string{}
+		h, _ := lookupHash(key, false)
+		for field, f := range h.fields {
+			out[field] = string(f.val)
+		}
+		return out
+	}
+	for key, want := range map[string]string{
+		"lph": "map[5:f3 f1:v1 f4:256]",
+		"zlh": "map[za:2 zb:-1]",
+		"zmh": "map[k1:v1]",
+		"hm":  "map[nottl:v ttl:v]",
+	} {
+		if got := fmt.Sprint(hgetall(key)); got != want {
+			t.Errorf("%s: %s, want %s", key, got, want)
+		}
+	}
+	s.expect("[-1 3605]", "httl", "hm", "fields", "2", "nottl", "ttl")
+	if data, _ := s.do("get", "big"); !bytes.Equal(data, big) {
+		t.Error("big string differs")
+	}
+	s.expect("3600", "ttl", "big")
+	s.expect("0", "exists", "old")
+	s.expect("", "select", "5")
+	s.expect("five", "get", "db5")
+}
+
+func TestRdbImportDamaged(t *testing.T) {
+	s := newTestServer(t)
+	fixture, _ := redis7Fixture()
+	path := filepath.Join(gConfig.dir, "bad.rdb")
+	for _, data := range [][]byte{
+		fixture[:100],
+		fixture[:9],
+		append(append([]byte(nil), fixture[:40]...), append([]byte{fixture[40] ^ 0xff}, fixture[41:]...)...),
+	} {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if reply := s.reply("rdbimport", "bad.rdb"); !strings.HasPrefix(reply, "(error)") {
+			t.Errorf("imported a damaged file: %s", reply)
+		}
+	}
+	s.expect("0", "dbsize")
+
+	// An LZF string claiming a huge length is rejected before allocating
+	b := []byte("REDIS0011")
+	b = append(b, kRdbOpSelectDB, 0, kRdbTypeString)
+	b = appendRdbString(b, "k")
+	b = append(b, 0xc0|kRdbEncLZF)
+	b = appendRdbLen(b, 4)
+	b = appendRdbLen(b, 1<<32)
+	b = append(b, 0, 'a', 0xe0, 0)
+	b = append(b, kRdbOpEOF)
+	crc := &rdbCrc{}
+	crc.Write(b)
+	if _, err := readRdb(appendU64(b, crc.sum)); err == nil {
+		t.Fatal("read a string of 4 GiB")
+	}
+}
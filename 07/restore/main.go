@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// restore [-list] [-at time] [-to path] dir
+// Restores a backup of the backup directory `dir` as a snapshot file,
+// for the server to load at its next start. Picks the newest backup taken
+// at or before -at, or the newest one, and checks it against the
+// manifest first. With the AOF on, the server loads the snapshot only if
+// there is no AOF, so move the AOF away too. The formats are those of
+// backup.go.
+
+const (
+	kBackupManifest   = "MANIFEST"
+	kBackupPrefix     = "backup-"
+	kBackupSuffix     = ".snap"
+	kBackupTimeLayout = "20060102T150405Z"
+)
+
+type backup struct {
+	name   string
+	time   time.Time
+	size   int64
+	sha256 string
+}
+
+// readManifest returns the backups of `dir`, oldest first.
+func readManifest(dir string) ([]backup, error) {
+	data, err := os.ReadFile(filepath.Join(dir, kBackupManifest))
+	if err != nil {
+		return nil, err
+	}
+	var out []backup
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		bad := len(fields) != 3 || !strings.HasPrefix(fields[0], kBackupPrefix) || !strings.HasSuffix(fields[0], kBackupSuffix)
+		var b backup
+		if !bad {
+			b.name = fields[0]
+			b.sha256 = fields[2]
+			b.time, err = time.Parse(kBackupTimeLayout, b.name[len(kBackupPrefix):len(b.name)-len(kBackupSuffix)])
+			bad = err != nil
+			b.size, err = strconv.ParseInt(fields[1], 10, 64)
+			bad = bad || err != nil
+		}
+		if bad {
+			return nil, fmt.Errorf("%s: bad line %d", kBackupManifest, i+1)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// verify checks the size and checksum of the backup file.
+func verify(dir string, b backup) error {
+	f, err := os.Open(filepath.Join(dir, b.name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if n != b.size || hex.EncodeToString(h.Sum(nil)) != b.sha256 {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// parseTime parses a time as RFC 3339, as in the names of the backups
+// like 20240131T153000Z, or as a local date with an optional time of day.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(kBackupTimeLayout, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", s)
+}
+
+// pick returns the newest backup taken at or before `at`.
+func pick(backups []backup, at time.Time) (backup, bool) {
+	for i := len(backups) - 1; i >= 0; i-- {
+		if !backups[i].time.After(at) {
+			return backups[i], true
+		}
+	}
+	return backup{}, false
+}
+
+// copyFile copies `src` to `dst` through a temp file, so `dst` is either
+// the old file or the complete new one.
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := fmt.Sprintf("%s.tmp-%d", dst, os.Getpid())
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d, err := os.Open(filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func main() {
+	list := flag.Bool("list", false, "list the backups and check them")
+	at := flag.String("at", "", "restore the newest backup taken at or before this time (default the newest)")
+	to := flag.String("to", "dump.snap", "snapshot file to write")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: restore [-list] [-at time] [-to path] dir")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := flag.Arg(0)
+	backups, err := readManifest(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *list {
+		ok := true
+		for _, b := range backups {
+			status := "ok"
+			if err := verify(dir, b); err != nil {
+				status = err.Error()
+				ok = false
+			}
+			fmt.Printf("%s  %s  %d bytes  %s\n", b.time.Local().Format(time.RFC3339), b.name, b.size, status)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	when := time.Now()
+	if *at != "" {
+		if when, err = parseTime(*at); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	b, found := pick(backups, when)
+	if !found {
+		fmt.Fprintf(os.Stderr, "no backup taken at or before %s\n", when.Format(time.RFC3339))
+		os.Exit(1)
+	}
+	if err := verify(dir, b); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", b.name, err)
+		os.Exit(1)
+	}
+	if err := copyFile(filepath.Join(dir, b.name), *to); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("restored %s, taken at %s, to %s\n", b.name, b.time.Local().Format(time.RFC3339), *to)
+}
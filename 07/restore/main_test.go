@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeBackups makes a backup directory with a backup per hour from
+// `first`, as the server writes them.
+func writeBackups(t *testing.T, first time.Time, n int) string {
+	dir := t.TempDir()
+	var manifest strings.Builder
+	for i := 0; i < n; i++ {
+		name := kBackupPrefix + first.Add(time.Duration(i)*time.Hour).Format(kBackupTimeLayout) + kBackupSuffix
+		data := []byte(fmt.Sprint("snapshot ", i))
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(&manifest, "%s %d %s\n", name, len(data), hex.EncodeToString(sum[:]))
+	}
+	if err := os.WriteFile(filepath.Join(dir, kBackupManifest), []byte(manifest.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRestore(t *testing.T) {
+	first := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	dir := writeBackups(t, first, 3)
+	backups, err := readManifest(dir)
+	if err != nil || len(backups) != 3 {
+		t.Fatalf("%d backups: %v", len(backups), err)
+	}
+	for _, b := range backups {
+		if err := verify(dir, b); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+	}
+
+	for _, c := range []struct {
+		at   string
+		want int // -1 if none
+	}{
+		{"20240131T115959Z", -1},
+		{"20240131T120000Z", 0},
+		{"2024-01-31T13:30:00Z", 1},
+		{"2024-01-31T14:30:00+01:00", 1},
+		{"2024-02-01T00:00:00Z", 2},
+	} {
+		at, err := parseTime(c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, ok := pick(backups, at)
+		if !ok && c.want >= 0 || ok && (c.want < 0 || b.name != backups[c.want].name) {
+			t.Errorf("at %s: picked %s %v, want %d", c.at, b.name, ok, c.want)
+		}
+	}
+	if _, err := parseTime("yesterday"); err == nil {
+		t.Error("parsed yesterday")
+	}
+
+	to := filepath.Join(t.TempDir(), "dump.snap")
+	if err := os.WriteFile(to, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(filepath.Join(dir, backups[1].name), to); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(to); string(data) != "snapshot 1" {
+		t.Fatalf("restored %q", data)
+	}
+	if tmp, _ := filepath.Glob(to + ".tmp*"); len(tmp) != 0 {
+		t.Fatalf("left %v", tmp)
+	}
+
+	// A damaged or missing backup is refused
+	if err := os.WriteFile(filepath.Join(dir, backups[2].name), []byte("snapshot 9"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(dir, backups[2]); err == nil {
+		t.Error("verified a damaged backup")
+	}
+	if err := os.Remove(filepath.Join(dir, backups[0].name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(dir, backups[0]); err == nil {
+		t.Error("verified a missing backup")
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	for _, line := range []string{
+		"backup-20240131T120000Z.snap 10",
+		"backup-20240131T120000Z.snap x 00",
+		"backup-2024.snap 10 00",
+		"dump.snap 10 00",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, kBackupManifest), []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readManifest(dir); err == nil {
+			t.Errorf("read %q", line)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"byor/04/util"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Snapshot file format. Integers are little-endian and strings are
+// prefixed by a uint32 length, like the values of codec.go.
+//
+//	header:   "BYORSNAP" u32 version
+//	database: u8 kOpSelectDB u32 index, then its entries
+//	entry:    u8 type u64 expireAt str key str value
+//	footer:   u8 kOpEOF u64 checksum
+//
+// `expireAt` is in nowNs() time, 0 if the key doesn't expire. The value is
+// written by encodeValue(). The checksum is the CRC-64 (ECMA) of everything
+// before it.
+const (
+	kSnapshotMagic   = "BYORSNAP"
+	kSnapshotVersion = 1
+
+	kOpSelectDB = 0xfe
+	kOpEOF      = 0xff
+)
+
+var gCrcTable = crc64.MakeTable(crc64.ECMA)
+
+// A background save writes the keyspace as it was when the save started,
+// without stopping the event loop. Go can't fork(), so the saver works
+// on snapshots of the databases, see Hamt, and encodes the entries one by
+// one under the read lock. Entries are modified in place by commands, so
+// before a command modifies an entry that the saver hasn't reached, its
+// record is encoded ahead and kept in `cow`. The AOF rewrite uses the same
+// job with another encoding.
+type snapshotJob struct {
+	dbs    []*Hamt // snapshots taken when the save started
+	now    int64
+	encode func(out []byte, key string, ent *Entry, now int64) []byte
+	mu     sync.Mutex
+	done   map[*Entry]bool   // entries written by the saver
+	cow    map[*Entry][]byte // records encoded before a change
+}
+
+// newSnapshotJob starts a point-in-time copy of the keyspace whose
+// records are made by `encode`. The caller must hold the write lock of
+// gMap.
+func newSnapshotJob(encode func(out []byte, key string, ent *Entry, now int64) []byte) *snapshotJob {
+	job := &snapshotJob{
+		dbs:    make([]*Hamt, len(gMap.dbs)),
+		now:    nowNs(),
+		encode: encode,
+		done:   make(map[*Entry]bool),
+		cow:    make(map[*Entry][]byte),
+	}
+	for i, db := range gMap.dbs {
+		job.dbs[i] = db.Snapshot()
+	}
+	gSave.job = job
+	return job
+}
+
+var gSave = struct {
+	job        *snapshotJob // the running BGSAVE or AOF rewrite, nil if none
+	writeCmd   bool         // the current command is a write
+	dirty      int64        // write commands since the last save
+	lastSave   int64        // unix time of the last successful save
+	lastStatus string       // of the last BGSAVE
+}{lastStatus: "ok"}
+
+func snapshotPath() string {
+	return filepath.Join(gConfig.dir, gConfig.dbfilename)
+}
+
+// appendRecord encodes the entry, or returns `out` unchanged if the entry
+// has expired at `now`.
+func appendRecord(out []byte, key string, ent *Entry, now int64) []byte {
+	if ent.expired(now) {
+		return out
+	}
+	out = append(out, byte(ent.typ))
+	out = appendU64(out, uint64(ent.expireAt))
+	out = appendStr(out, key)
+	// The value is length-prefixed, its size is known once encoded
+	pos := len(out)
+	out = appendU32(out, 0)
+	out = encodeValue(ent, out)
+	binary.LittleEndian.PutUint32(out[pos:], uint32(len(out)-pos-4))
+	return out
+}
+
+// writeSnapshot writes the databases to `path`. `record` encodes an
+// entry. The file is written to a temp file and renamed into place, so a
+// crash never leaves a partial snapshot at `path`.
+func writeSnapshot(path string, dbs []*Hamt, record func(key string, ent *Entry) ([]byte, error)) (err error) {
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	sw, err := newSealWriter(f)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriterSize(sw, 64<<10)
+	crc := crc64.New(gCrcTable)
+	w := io.MultiWriter(buf, crc)
+
+	header := appendU32([]byte(kSnapshotMagic), kSnapshotVersion)
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	for i, db := range dbs {
+		if db.Len() == 0 {
+			continue
+		}
+		if _, err = w.Write(appendU32([]byte{kOpSelectDB}, uint32(i))); err != nil {
+			return err
+		}
+		db.Range(func(key string, ent *Entry) bool {
+			var rec []byte
+			if rec, err = record(key, ent); err == nil {
+				_, err = w.Write(rec)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = w.Write([]byte{kOpEOF}); err != nil {
+		return err
+	}
+	if _, err = buf.Write(appendU64(nil, crc.Sum64())); err != nil {
+		return err
+	}
+
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename in `dir` durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// protect encodes the record of the entry at `key` before a command
+// modifies it, if the saver still has to write it. The caller must hold
+// the write lock of gMap.
+func (job *snapshotJob) protect(key string, ent *Entry) {
+	// SWAPDB and MOVE may have moved the entry to another database
+	found := false
+	for _, db := range job.dbs {
+		if old, _ := db.Get(key); old == ent {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return // created after the save started
+	}
+	if _, ok := ent.val.(*coldValue); ok {
+		return // the command works on the value loaded back
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.done[ent] || job.cow[ent] != nil {
+		return
+	}
+	job.cow[ent] = job.encode([]byte{}, key, ent, job.now)
+}
+
+// record returns the record of the entry as it was when the save started.
+func (job *snapshotJob) record(key string, ent *Entry) ([]byte, error) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if rec, ok := job.cow[ent]; ok {
+		delete(job.cow, ent)
+		return rec, nil
+	}
+	job.done[ent] = true
+	hot, err := hotEntry(ent)
+	if err != nil {
+		return nil, err
+	}
+	return job.encode(nil, key, hot, job.now), nil
+}
+
+// protectForSave is called before an entry is modified in place.
+func protectForSave(key string, ent *Entry) {
+	if gSave.job != nil {
+		gSave.job.protect(key, ent)
+	}
+}
+
+// errJobRunning returns the error for a background job that can't start
+// while the current one runs.
+func errJobRunning() []byte {
+	if gAof.rewrite != nil {
+		return []byte("background AOF rewrite in progress")
+	}
+	if gRdbExport.running {
+		return []byte("background RDB export in progress")
+	}
+	return []byte("background save already in progress")
+}
+
+// save
+func doSave(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	if gSave.job != nil {
+		return errJobRunning(), RES_ERR
+	}
+	now := nowNs()
+	err := writeSnapshot(snapshotPath(), gMap.dbs, func(key string, ent *Entry) ([]byte, error) {
+		hot, err := hotEntry(ent)
+		if err != nil {
+			return nil, err
+		}
+		return appendRecord(nil, key, hot, now), nil
+	})
+	if err != nil {
+		return []byte(err.Error()), RES_ERR
+	}
+	gSave.dirty = 0
+	gSave.lastSave = time.Now().Unix()
+	return nil, RES_OK
+}
+
+// bgsave
+func doBgSave(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	if gSave.job != nil {
+		return errJobRunning(), RES_ERR
+	}
+	job := newSnapshotJob(appendRecord)
+	dirty := gSave.dirty
+
+	go func() {
+		err := writeSnapshot(snapshotPath(), job.dbs, job.record)
+		gMap.Lock()
+		defer gMap.Unlock()
+		gSave.job = nil
+		if err != nil {
+			util.Msg("bgsave: " + err.Error())
+			gSave.lastStatus = "err"
+			return
+		}
+		gSave.dirty -= dirty
+		gSave.lastSave = time.Now().Unix()
+		gSave.lastStatus = "ok"
+	}()
+	return []byte("Background saving started"), RES_OK
+}
+
+// lastsave
+// Replies the unix time of the last successful save.
+func doLastSave(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	return []byte(strconv.FormatInt(gSave.lastSave, 10)), RES_OK
+}
+
+// loadSnapshot fills the empty keyspace from the snapshot at `path`.
+func loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	plain, _, end, err := unseal(data)
+	if err != nil {
+		return err
+	}
+	if end != len(data) {
+		return fmt.Errorf("snapshot truncated in the encrypted chunk at offset %d", end)
+	}
+	gMap.Lock()
+	defer gMap.Unlock()
+	return decodeSnapshot(plain, nowNs())
+}
+
+// reencryptSnapshot writes the snapshot again from the keyspace if it is
+// not encrypted with the current key, see crypt.go.
+func reencryptSnapshot() error {
+	seal, err := fileSealer(snapshotPath())
+	if errors.Is(err, fs.ErrNotExist) || err == nil && seal.current() {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading the snapshot: %v", err)
+	}
+	gMap.RLock()
+	defer gMap.RUnlock()
+	now := nowNs()
+	err = writeSnapshot(snapshotPath(), gMap.dbs, func(key string, ent *Entry) ([]byte, error) {
+		return appendRecord(nil, key, ent, now), nil
+	})
+	if err != nil {
+		return fmt.Errorf("encrypting the snapshot: %v", err)
+	}
+	return nil
+}
+
+var errBadSnapshot = errors.New("not a snapshot file")
+
+// decodeSnapshot adds the entries of the snapshot to the keyspace,
+// skipping those expired at `now`. The caller must hold the lock of gMap.
+func decodeSnapshot(data []byte, now int64) error {
+	headerLen := len(kSnapshotMagic) + 4
+	if len(data) < headerLen+1+8 || !bytes.HasPrefix(data, []byte(kSnapshotMagic)) {
+		return errBadSnapshot
+	}
+	body := data[:len(data)-8]
+	d := &decoder{data: data[len(kSnapshotMagic):]}
+	if version := d.u32(); version > kSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	if sum := (&decoder{data: data[len(body):]}).u64(); sum != crc64.Checksum(body, gCrcTable) {
+		return errors.New("snapshot checksum mismatch")
+	}
+
+	d.data = body[headerLen:]
+	db := -1
+	for {
+		offset := len(body) - len(d.data)
+		op := d.u8()
+		if d.err != nil {
+			return fmt.Errorf("snapshot truncated at offset %d", offset)
+		}
+		if op == kOpEOF {
+			break
+		}
+		if op == kOpSelectDB {
+			db = int(d.u32())
+			if db >= len(gMap.dbs) {
+				return fmt.Errorf("snapshot database %d is out of range", db)
+			}
+			continue
+		}
+		if db < 0 || int(op) >= len(typeNames) {
+			return fmt.Errorf("bad snapshot record at offset %d", offset)
+		}
+		expireAt := int64(d.u64())
+		key := d.str()
+		raw := d.bytes(int(d.u32()))
+		if d.err != nil {
+			return fmt.Errorf("snapshot truncated at offset %d", offset)
+		}
+		val, err := decodeValue(ValueType(op), &decoder{data: raw})
+		if err != nil {
+			return fmt.Errorf("bad %s value of key %q at offset %d: %v", typeNames[op], key, offset, err)
+		}
+		ent := &Entry{typ: ValueType(op), val: val, expireAt: expireAt}
+		if !ent.expired(now) {
+			dbSetIn(db, key, ent)
+		}
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("trailing data after the end of the snapshot")
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestDirtyCountSkipsErrors(t *testing.T) {
+	s := newTestServer(t)
+	gSave.dirty = 0
+	s.expect("", "set", "k", "v")
+	s.expect("1", "hset", "h", "f", "v")
+	s.expect("(error) "+errWrongType, "hset", "k", "f", "v")
+	s.expect("(error) expect int", "expire", "k", "soon")
+	if gSave.dirty != 2 {
+		t.Fatalf("dirty %d, want 2", gSave.dirty)
+	}
+}
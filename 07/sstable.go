@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"os"
+	"sort"
+)
+
+// An SSTable holds entries of the lsm engine sorted by key, in a file:
+//
+//	data blocks  entries, about kSstBlockSize bytes each
+//	index        u32-prefixed first key, u32 block count, then for each
+//	             block its last key, u64 offset, u32 length and CRC-64
+//	bloom filter u64 bit count, u32 hash count, u64 words
+//	footer       u64 index offset, u32 index length, u32 filter length,
+//	             u64 entry count, CRC-64 of index and filter, magic
+//
+// An entry is its u32-prefixed key, u8 flags, u64 expireAt and u32-prefixed
+// value. A lookup checks the key range and the Bloom filter, then reads
+// the one block whose last key is not below the key.
+
+const (
+	kSstMagic          = "BYORSST1"
+	kSstBlockSize      = 4 << 10
+	kSstFooterSize     = 8 + 4 + 4 + 8 + 8 + len(kSstMagic)
+	kSstBloomErrorRate = 0.01
+)
+
+const kLsmDeleted = 1 // entry flag of the tombstones
+
+var errBadSstable = errors.New("corrupt SSTable")
+
+// lsmEntry is a key of the lsm engine. Keys are prefixed by their
+// database, see lsmKey().
+type lsmEntry struct {
+	key      string
+	val      []byte
+	expireAt int64 // in nowNs() time, 0 if the key doesn't expire
+	deleted  bool  // a tombstone, hiding older entries of the key
+}
+
+func appendLsmEntry(out []byte, e *lsmEntry) []byte {
+	out = appendStr(out, e.key)
+	flags := byte(0)
+	if e.deleted {
+		flags |= kLsmDeleted
+	}
+	out = append(out, flags)
+	out = appendU64(out, uint64(e.expireAt))
+	out = appendU32(out, uint32(len(e.val)))
+	return append(out, e.val...)
+}
+
+func decodeLsmEntry(d *decoder) lsmEntry {
+	var e lsmEntry
+	e.key = d.str()
+	e.deleted = d.u8()&kLsmDeleted != 0
+	e.expireAt = int64(d.u64())
+	e.val = append([]byte(nil), d.bytes(int(d.u32()))...)
+	return e
+}
+
+type sstBlock struct {
+	last   string
+	off    int64
+	length uint32
+	crc    uint64
+}
+
+type sstable struct {
+	num    uint64
+	path   string
+	f      *os.File
+	size   int64
+	first  string
+	last   string
+	count  uint64
+	blocks []sstBlock
+	bloom  *bloomLayer
+}
+
+// sstWriter writes a new SSTable from entries added in key order.
+type sstWriter struct {
+	t      *sstable
+	w      *bufio.Writer
+	block  []byte
+	hashes [][2]uint64 // of the keys, for the Bloom filter
+}
+
+func createSstable(path string, num uint64) (*sstWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{
+		t: &sstable{num: num, path: path, f: f},
+		w: bufio.NewWriterSize(f, 64<<10),
+	}, nil
+}
+
+func (w *sstWriter) add(e *lsmEntry) error {
+	if w.t.count == 0 {
+		w.t.first = e.key
+	}
+	w.t.last = e.key
+	w.t.count++
+	h1, h2 := bloomHash(e.key)
+	w.hashes = append(w.hashes, [2]uint64{h1, h2})
+	w.block = appendLsmEntry(w.block, e)
+	if len(w.block) >= kSstBlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *sstWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.t.blocks = append(w.t.blocks, sstBlock{
+		last:   w.t.last,
+		off:    w.t.size,
+		length: uint32(len(w.block)),
+		crc:    crc64.Checksum(w.block, gCrcTable),
+	})
+	if _, err := w.w.Write(w.block); err != nil {
+		return err
+	}
+	w.t.size += int64(len(w.block))
+	w.block = w.block[:0]
+	return nil
+}
+
+// size returns the bytes written so far.
+func (w *sstWriter) size() int64 {
+	return w.t.size + int64(len(w.block))
+}
+
+// finish writes the index, filter and footer and syncs the file, which
+// stays open for reading.
+func (w *sstWriter) finish() (*sstable, error) {
+	if err := w.flushBlock(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	t := w.t
+	t.bloom = newBloomLayer(uint64(len(w.hashes)), kSstBloomErrorRate)
+	for _, h := range w.hashes {
+		t.bloom.set(h[0], h[1])
+	}
+
+	index := appendStr(nil, t.first)
+	index = appendU32(index, uint32(len(t.blocks)))
+	for _, b := range t.blocks {
+		index = appendStr(index, b.last)
+		index = appendU64(index, uint64(b.off))
+		index = appendU32(index, b.length)
+		index = appendU64(index, b.crc)
+	}
+	filter := appendU64(nil, t.bloom.nbits)
+	filter = appendU32(filter, t.bloom.k)
+	for _, word := range t.bloom.bits {
+		filter = appendU64(filter, word)
+	}
+	footer := appendU64(nil, uint64(t.size))
+	footer = appendU32(footer, uint32(len(index)))
+	footer = appendU32(footer, uint32(len(filter)))
+	footer = appendU64(footer, t.count)
+	crc := crc64.Update(crc64.Checksum(index, gCrcTable), gCrcTable, filter)
+	footer = appendU64(footer, crc)
+	footer = append(footer, kSstMagic...)
+
+	for _, part := range [][]byte{index, filter, footer} {
+		if _, err := w.w.Write(part); err != nil {
+			w.abort()
+			return nil, err
+		}
+		t.size += int64(len(part))
+	}
+	err := w.w.Flush()
+	if err == nil {
+		err = t.f.Sync()
+	}
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	return t, nil
+}
+
+// abort closes and removes the unfinished table.
+func (w *sstWriter) abort() {
+	w.t.f.Close()
+	os.Remove(w.t.path)
+}
+
+// openSstable opens a table and loads its index and filter.
+func openSstable(path string, num uint64) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readSstable(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	t.num = num
+	t.path = path
+	return t, nil
+}
+
+func readSstable(f *os.File) (*sstable, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < int64(kSstFooterSize) {
+		return nil, errBadSstable
+	}
+	footer := make([]byte, kSstFooterSize)
+	if _, err := f.ReadAt(footer, size-int64(kSstFooterSize)); err != nil {
+		return nil, err
+	}
+	d := &decoder{data: footer}
+	indexOff := int64(d.u64())
+	indexLen := int64(d.u32())
+	filterLen := int64(d.u32())
+	count := d.u64()
+	crc := d.u64()
+	if string(d.data) != kSstMagic || indexOff+indexLen+filterLen != size-int64(kSstFooterSize) {
+		return nil, errBadSstable
+	}
+	meta := make([]byte, indexLen+filterLen)
+	if _, err := f.ReadAt(meta, indexOff); err != nil {
+		return nil, err
+	}
+	if crc64.Checksum(meta, gCrcTable) != crc {
+		return nil, errBadSstable
+	}
+
+	t := &sstable{f: f, size: size, count: count}
+	d = &decoder{data: meta[:indexLen]}
+	t.first = d.str()
+	n := d.u32()
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		var b sstBlock
+		b.last = d.str()
+		b.off = int64(d.u64())
+		b.length = d.u32()
+		b.crc = d.u64()
+		if b.off+int64(b.length) > indexOff {
+			return nil, errBadSstable
+		}
+		t.blocks = append(t.blocks, b)
+	}
+	if d.err != nil || len(t.blocks) == 0 {
+		return nil, errBadSstable
+	}
+	t.last = t.blocks[len(t.blocks)-1].last
+
+	d = &decoder{data: meta[indexLen:]}
+	nbits := d.u64()
+	k := d.u32()
+	if d.err != nil || nbits == 0 || uint64(len(d.data)) != (nbits+63)/64*8 {
+		return nil, errBadSstable
+	}
+	t.bloom = &bloomLayer{bits: make([]uint64, (nbits+63)/64), nbits: nbits, k: k, capacity: count, count: count}
+	for i := range t.bloom.bits {
+		t.bloom.bits[i] = d.u64()
+	}
+	return t, nil
+}
+
+// readBlock returns the entries of block `i`.
+func (t *sstable) readBlock(i int) ([]lsmEntry, error) {
+	b := t.blocks[i]
+	data := make([]byte, b.length)
+	if _, err := t.f.ReadAt(data, b.off); err != nil {
+		return nil, err
+	}
+	if crc64.Checksum(data, gCrcTable) != b.crc {
+		return nil, fmt.Errorf("%s: block at offset %d: checksum mismatch", t.path, b.off)
+	}
+	var out []lsmEntry
+	d := &decoder{data: data}
+	for len(d.data) > 0 && d.err == nil {
+		out = append(out, decodeLsmEntry(d))
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%s: block at offset %d: %v", t.path, b.off, errBadSstable)
+	}
+	return out, nil
+}
+
+// get returns the entry of `key`, or nil if the table doesn't have it.
+func (t *sstable) get(key string) (*lsmEntry, error) {
+	if key < t.first || key > t.last || !t.bloom.test(bloomHash(key)) {
+		return nil, nil
+	}
+	i := sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].last >= key })
+	entries, err := t.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].key >= key })
+	if j < len(entries) && entries[j].key == key {
+		return &entries[j], nil
+	}
+	return nil, nil
+}
+
+// sstIter reads the entries of a table in order, a block at a time.
+type sstIter struct {
+	t       *sstable
+	block   int
+	entries []lsmEntry
+}
+
+// next returns the next entry, or nil at the end.
+func (it *sstIter) next() (*lsmEntry, error) {
+	for len(it.entries) == 0 {
+		if it.block == len(it.t.blocks) {
+			return nil, nil
+		}
+		entries, err := it.t.readBlock(it.block)
+		if err != nil {
+			return nil, err
+		}
+		it.entries = entries
+		it.block++
+	}
+	e := &it.entries[0]
+	it.entries = it.entries[1:]
+	return e, nil
+}
+
+// overlaps reports whether the table has keys in [first, last].
+func (t *sstable) overlaps(first, last string) bool {
+	return t.last >= first && t.first <= last
+}
+
+func (t *sstable) close() {
+	t.f.Close()
+}
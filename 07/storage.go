@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Storage holds the strings served by GET, SET and DEL. The memory engine
+// keeps them in gMap with the other types. The LSM engine keeps them on
+// disk, for datasets larger than memory, and then serves only those
+// commands. The caller must hold the lock of gMap.
+type Storage interface {
+	// Get returns the string at `key` and its expire time in nowNs()
+	// time. `ok` is false if the key is missing or expired. The value
+	// must not be modified. Fails with errNotString if the key holds
+	// another type, with `ok` set and the expire time of that key.
+	Get(db int, key string) (val []byte, expireAt int64, ok bool, err error)
+	// Set stores the string at `key`, replacing any value. The value must
+	// not be modified afterwards.
+	Set(db int, key string, val []byte, expireAt int64) error
+	// Del removes `key`. Returns false if it was missing.
+	Del(db int, key string) (bool, error)
+	// Info reports the state of the engine to INFO.
+	Info(b *strings.Builder)
+}
+
+var errNotString = errors.New(errWrongType)
+
+type StorageEngine int
+
+const (
+	StorageMemory StorageEngine = iota
+	StorageLsm
+)
+
+var storageEngineNames = []string{"memory", "lsm"}
+
+func parseStorageEngine(s string) (StorageEngine, bool) {
+	for i, name := range storageEngineNames {
+		if strings.EqualFold(s, name) {
+			return StorageEngine(i), true
+		}
+	}
+	return 0, false
+}
+
+var gStorage Storage = memStorage{}
+
+// The commands served by engines other than the memory one. The rest
+// would see the empty gMap instead of the stored keys.
+var gStorageCmds = map[string]bool{
+	"get":    true,
+	"set":    true,
+	"del":    true,
+	"select": true,
+	"info":   true,
+}
+
+// openStorage opens the engine picked by the config.
+func openStorage() error {
+	if gConfig.storage == StorageMemory {
+		gStorage = memStorage{}
+		return nil
+	}
+	if gConfig.appendonly {
+		return errors.New("the AOF is not supported by the lsm storage engine, which has its own log")
+	}
+	db, err := openLsm(filepath.Join(gConfig.dir, "lsm"), gConfig.lsmMemtableSize)
+	if err != nil {
+		return fmt.Errorf("opening the lsm storage: %v", err)
+	}
+	gStorage = db
+	return nil
+}
+
+// memStorage is the engine of gMap.
+type memStorage struct{}
+
+func (memStorage) Get(db int, key string) ([]byte, int64, bool, error) {
+	ent, ok := lookupEntryIn(db, key)
+	if !ok {
+		return nil, 0, false, nil
+	}
+	if ent.typ != TypeStr {
+		return nil, ent.expireAt, true, errNotString
+	}
+	return ent.val.([]byte), ent.expireAt, true, nil
+}
+
+func (memStorage) Set(db int, key string, val []byte, expireAt int64) error {
+	dbSetIn(db, key, &Entry{typ: TypeStr, val: val, expireAt: expireAt})
+	return nil
+}
+
+func (memStorage) Del(db int, key string) (bool, error) {
+	ent, ok := gMap.dbs[db].Get(key)
+	dbDeleteIn(db, key)
+	return ok && !ent.expired(nowNs()), nil
+}
+
+func (memStorage) Info(b *strings.Builder) {}
+
+func infoStorage(b *strings.Builder) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	fmt.Fprintf(b, "storage_engine:%s\n", storageEngineNames[gConfig.storage])
+	gStorage.Info(b)
+}
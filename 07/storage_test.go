@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testStorage checks an engine against a map through random operations
+// on 3 databases. `reopen`, if not nil, closes the engine and opens it
+// again from what it persisted.
+func testStorage(t *testing.T, s Storage, reopen func() Storage) {
+	clock := useFakeClock(t)
+	model := map[string]string{}
+	rng := rand.New(rand.NewSource(1))
+	check := func(db int, key string) {
+		t.Helper()
+		val, _, ok, err := s.Get(db, key)
+		want, had := model[fmt.Sprint(db, " ", key)]
+		if err != nil || ok != had || string(val) != want {
+			t.Fatalf("get %d %s: %q %v %v, want %q %v", db, key, val, ok, err, want, had)
+		}
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	for i := 0; i < 60000; i++ {
+		db, key := rng.Intn(3), fmt.Sprint("k", rng.Intn(5000))
+		switch rng.Intn(4) {
+		case 0, 1:
+			val := fmt.Sprint("v", i)
+			if err := s.Set(db, key, []byte(val), 0); err != nil {
+				t.Fatal(err)
+			}
+			model[fmt.Sprint(db, " ", key)] = val
+		case 2:
+			_, had := model[fmt.Sprint(db, " ", key)]
+			if ok, err := s.Del(db, key); err != nil || ok != had {
+				t.Fatalf("del %d %s: %v %v, want %v", db, key, ok, err, had)
+			}
+			delete(model, fmt.Sprint(db, " ", key))
+		case 3:
+			check(db, key)
+		}
+		if i == 30000 && reopen != nil {
+			gMap.Unlock()
+			s = reopen()
+			gMap.Lock()
+		}
+	}
+
+	// Expired keys are missing, and stay so once persisted
+	expireAt := nowNs() + int64(time.Second)
+	if err := s.Set(1, "exp", []byte("x"), expireAt); err != nil {
+		t.Fatal(err)
+	}
+	if val, at, ok, err := s.Get(1, "exp"); err != nil || !ok || string(val) != "x" || at != expireAt {
+		t.Fatalf("get exp: %q %d %v %v", val, at, ok, err)
+	}
+	clock.advance(time.Second)
+	if _, _, ok, err := s.Get(1, "exp"); err != nil || ok {
+		t.Fatalf("get exp after its expire time: %v %v", ok, err)
+	}
+	if ok, err := s.Del(1, "exp"); err != nil || ok {
+		t.Fatalf("del exp after its expire time: %v %v", ok, err)
+	}
+	if reopen != nil {
+		gMap.Unlock()
+		s = reopen()
+		gMap.Lock()
+	}
+	for i := 0; i < 5000; i++ {
+		for db := 0; db < 3; db++ {
+			check(db, fmt.Sprint("k", i))
+		}
+	}
+	check(1, "exp")
+}
+
+func TestMemStorage(t *testing.T) {
+	newTestServer(t)
+	testStorage(t, memStorage{}, nil)
+
+	// Other types are reported, not overwritten
+	gMap.Lock()
+	defer gMap.Unlock()
+	h := newHash()
+	h.fields["f"] = &hashField{val: []byte("v")}
+	dbSetIn(0, "h", &Entry{typ: TypeHash, val: h})
+	if _, _, ok, err := (memStorage{}).Get(0, "h"); !ok || err != errNotString {
+		t.Fatalf("get of a hash: %v %v", ok, err)
+	}
+}
+
+func TestLsmStorage(t *testing.T) {
+	newTestServer(t)
+	dir := t.TempDir()
+	// A small memtable to flush and compact often
+	l, err := openLsm(dir, 16<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flushes, compactions int64
+	testStorage(t, l, func() Storage {
+		if err := l.close(); err != nil {
+			t.Fatal(err)
+		}
+		flushes += l.flushes
+		compactions += l.compactions
+		if l, err = openLsm(dir, 16<<10); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	})
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	flushes += l.flushes
+	compactions += l.compactions
+	if flushes == 0 || compactions == 0 {
+		t.Errorf("%d flushes and %d compactions", flushes, compactions)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"strconv"
+)
+
+// Commands that edit string values in place. Values are binary safe and
+// offsets are in bytes.
+
+const (
+	kMaxStrLen = 512 << 20
+	// Growing a string doubles its capacity up to this size, then adds
+	// this much, so repeated appends don't copy the value each time.
+	kStrPreallocMax = 1 << 20
+)
+
+// growStr returns `buf` extended to `n` bytes, zero padded, with spare
+// capacity for further growth.
+func growStr(buf []byte, n int) []byte {
+	if n <= cap(buf) {
+		old := len(buf)
+		buf = buf[:n]
+		for i := old; i < n; i++ {
+			buf[i] = 0
+		}
+		return buf
+	}
+	newCap := n * 2
+	if n >= kStrPreallocMax {
+		newCap = n + kStrPreallocMax
+	}
+	out := make([]byte, n, newCap)
+	copy(out, buf)
+	return out
+}
+
+// lookupStr returns the entry of the string at `key`. The caller must hold
+// the lock of gMap.
+func lookupStr(key string) (*Entry, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		return nil, ""
+	}
+	if ent.typ != TypeStr {
+		return nil, errWrongType
+	}
+	return ent, ""
+}
+
+// append key value
+func doAppend(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	ent, errMsg := lookupStr(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if ent == nil {
+		ent = &Entry{typ: TypeStr, val: []byte{}}
+		dbSet(cmd[1], ent)
+	}
+	buf := ent.val.([]byte)
+	if len(buf)+len(cmd[2]) > kMaxStrLen {
+		return []byte("string exceeds maximum allowed size"), RES_ERR
+	}
+	old := len(buf)
+	buf = growStr(buf, old+len(cmd[2]))
+	copy(buf[old:], cmd[2])
+	ent.val = buf
+	return []byte(strconv.Itoa(len(buf))), RES_OK
+}
+
+// getrange key start end
+// Negative offsets count from the end; both ends are inclusive.
+func doGetRange(cmd []string) ([]byte, ResponseCode) {
+	start, err1 := strconv.Atoi(cmd[2])
+	end, err2 := strconv.Atoi(cmd[3])
+	if err1 != nil || err2 != nil {
+		return []byte("expect int"), RES_ERR
+	}
+
+	gMap.RLock()
+	defer gMap.RUnlock()
+	ent, errMsg := lookupStr(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if ent == nil {
+		return []byte{}, RES_OK
+	}
+	buf := ent.val.([]byte)
+	n := len(buf)
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end || n == 0 {
+		return []byte{}, RES_OK
+	}
+	return append([]byte(nil), buf[start:end+1]...), RES_OK
+}
+
+// setrange key offset value
+// Writing past the end pads the string with zero bytes. Replies the new
+// length.
+func doSetRange(cmd []string) ([]byte, ResponseCode) {
+	offset, err := strconv.Atoi(cmd[2])
+	if err != nil || offset < 0 {
+		return []byte("offset is out of range"), RES_ERR
+	}
+	if offset > kMaxStrLen-len(cmd[3]) {
+		return []byte("string exceeds maximum allowed size"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	ent, errMsg := lookupStr(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if ent == nil {
+		if len(cmd[3]) == 0 {
+			return []byte("0"), RES_OK
+		}
+		ent = &Entry{typ: TypeStr, val: []byte{}}
+		dbSet(cmd[1], ent)
+	}
+	buf := ent.val.([]byte)
+	if len(cmd[3]) > 0 {
+		if end := offset + len(cmd[3]); end > len(buf) {
+			buf = growStr(buf, end)
+		}
+		copy(buf[offset:], cmd[3])
+		ent.val = buf
+	}
+	return []byte(strconv.Itoa(len(buf))), RES_OK
+}
+
+// strlen key
+func doStrlen(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	ent, errMsg := lookupStr(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if ent == nil {
+		return []byte("0"), RES_OK
+	}
+	return []byte(strconv.Itoa(len(ent.val.([]byte)))), RES_OK
+}
+
+// getdel key
+func doGetDel(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	ent, errMsg := lookupStr(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if ent == nil {
+		return nil, RES_NX
+	}
+	dbDelete(cmd[1])
+	return ent.val.([]byte), RES_OK
+}
+
+// getex key [EX seconds | PX ms | EXAT unix-seconds | PXAT unix-ms | PERSIST]
+func doGetEx(cmd []string) ([]byte, ResponseCode) {
+	expireAt := int64(0)
+	persist := false
+	if len(cmd) == 3 && cmdIs(cmd[2], "persist") {
+		persist = true
+	} else if len(cmd) == 4 && isExpireOption(cmd[2]) {
+		at, ok := parseExpireOption(cmd[2], cmd[3])
+		if !ok {
+			return []byte("invalid expire time"), RES_ERR
+		}
+		expireAt = at
+	} else if len(cmd) != 2 {
+		return []byte("syntax error"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	ent, errMsg := lookupStr(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if ent == nil {
+		return nil, RES_NX
+	}
+	if persist {
+		setExpire(cmd[1], ent, 0)
+	} else if expireAt != 0 {
+		setExpire(cmd[1], ent, expireAt)
+	}
+	return append([]byte(nil), ent.val.([]byte)...), RES_OK
+}
+
+// mget key [key ...]
+// Replies an array with nil for each missing key or non-string value.
+func doMGet(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	out := []byte{}
+	outArr(&out, uint32(len(cmd)-1))
+	for _, key := range cmd[1:] {
+		ent, errMsg := lookupStr(key)
+		if ent == nil || errMsg != "" {
+			outNil(&out)
+		} else {
+			outStr(&out, string(ent.val.([]byte)))
+		}
+	}
+	return out, RES_ARR
+}
+
+// mset key value [key value ...] and msetnx key value [key value ...]
+// All pairs are set under one lock. MSETNX sets nothing and replies
+// RES_NX if any of the keys exists.
+func doMSet(cmd []string, nx bool) ([]byte, ResponseCode) {
+	if len(cmd)%2 != 1 {
+		return []byte("syntax error"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	if nx {
+		for i := 1; i < len(cmd); i += 2 {
+			if _, ok := lookupEntry(cmd[i]); ok {
+				return nil, RES_NX
+			}
+		}
+	}
+	for i := 1; i < len(cmd); i += 2 {
+		dbSet(cmd[i], &Entry{typ: TypeStr, val: []byte(cmd[i+1])})
+	}
+	return nil, RES_OK
+}
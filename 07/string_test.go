@@ -0,0 +1,19 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestSetRangeLimits(t *testing.T) {
+	s := newTestServer(t)
+	s.expect("5", "setrange", "k", "0", "hello")
+	for _, offset := range []int{math.MaxInt64 - 1, math.MaxInt64 - 5, kMaxStrLen - 4} {
+		s.expect("(error) string exceeds maximum allowed size", "setrange", "k", strconv.Itoa(offset), "hello")
+	}
+	s.expect("(error) offset is out of range", "setrange", "k", "-1", "hello")
+	s.expect("hello", "get", "k")
+	s.expect("8", "setrange", "k", "3", "world")
+	s.expect("helworld", "get", "k")
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"container/heap"
+	"strconv"
+	"unsafe"
+)
+
+// A suggestion dictionary is a compressed trie (radix tree) of strings,
+// each with a score. Every node also caches the highest score in its
+// subtree, so the top-N completions of a prefix can be found best-first
+// without visiting the whole subtree.
+type sugNode struct {
+	label    string     // the edge label leading into this node
+	children []*sugNode // sorted by the first byte of the label
+	terminal bool       // a string ends at this node
+	score    float64
+	best     float64 // max score in this subtree
+}
+
+type SugDict struct {
+	root  sugNode
+	size  int // number of strings
+	nodes int // number of nodes, excluding the root
+}
+
+func newSugDict() *SugDict {
+	return &SugDict{}
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// findChild returns the index of the child whose label starts with `c`,
+// or the position it should be inserted at.
+func (node *sugNode) findChild(c byte) (int, bool) {
+	lo, hi := 0, len(node.children)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if node.children[mid].label[0] < c {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, lo < len(node.children) && node.children[lo].label[0] == c
+}
+
+func (node *sugNode) updateBest() {
+	first := true
+	if node.terminal {
+		node.best = node.score
+		first = false
+	}
+	for _, child := range node.children {
+		if first || child.best > node.best {
+			node.best = child.best
+			first = false
+		}
+	}
+}
+
+// Add inserts `key` or updates its score. With `incr`, the score is added
+// to the existing one. Returns the new score.
+func (d *SugDict) Add(key string, score float64, incr bool) float64 {
+	return d.add(&d.root, key, score, incr)
+}
+
+func (d *SugDict) add(node *sugNode, key string, score float64, incr bool) float64 {
+	if key == "" {
+		if node.terminal && incr {
+			score += node.score
+		}
+		if !node.terminal {
+			node.terminal = true
+			d.size++
+		}
+		node.score = score
+		node.updateBest()
+		return score
+	}
+
+	idx, ok := node.findChild(key[0])
+	if !ok {
+		child := &sugNode{label: key, terminal: true, score: score, best: score}
+		node.children = append(node.children, nil)
+		copy(node.children[idx+1:], node.children[idx:])
+		node.children[idx] = child
+		d.size++
+		d.nodes++
+		node.updateBest()
+		return score
+	}
+
+	child := node.children[idx]
+	n := commonPrefix(child.label, key)
+	if n < len(child.label) {
+		// Split the edge
+		mid := &sugNode{label: child.label[:n], children: []*sugNode{child}}
+		child.label = child.label[n:]
+		mid.updateBest()
+		node.children[idx] = mid
+		d.nodes++
+		child = mid
+	}
+	score = d.add(child, key[n:], score, incr)
+	node.updateBest()
+	return score
+}
+
+// Del removes `key`. Returns false if it was not found.
+func (d *SugDict) Del(key string) bool {
+	return d.del(&d.root, key)
+}
+
+func (d *SugDict) del(node *sugNode, key string) bool {
+	if key == "" {
+		if !node.terminal {
+			return false
+		}
+		node.terminal = false
+		node.score = 0
+		d.size--
+		node.updateBest()
+		return true
+	}
+
+	idx, ok := node.findChild(key[0])
+	if !ok {
+		return false
+	}
+	child := node.children[idx]
+	n := commonPrefix(child.label, key)
+	if n < len(child.label) || !d.del(child, key[n:]) {
+		return false
+	}
+
+	// Keep the tree compressed
+	if !child.terminal && len(child.children) == 0 {
+		node.children = append(node.children[:idx], node.children[idx+1:]...)
+		d.nodes--
+	} else if !child.terminal && len(child.children) == 1 {
+		grandchild := child.children[0]
+		grandchild.label = child.label + grandchild.label
+		node.children[idx] = grandchild
+		d.nodes--
+	}
+	node.updateBest()
+	return true
+}
+
+// Score returns the score of `key`.
+func (d *SugDict) Score(key string) (float64, bool) {
+	node := &d.root
+	for key != "" {
+		idx, ok := node.findChild(key[0])
+		if !ok {
+			return 0, false
+		}
+		child := node.children[idx]
+		n := commonPrefix(child.label, key)
+		if n < len(child.label) {
+			return 0, false
+		}
+		node, key = child, key[n:]
+	}
+	return node.score, node.terminal
+}
+
+// locate finds the node whose subtree holds every string starting with
+// `prefix`. `path` is the full string leading to that node.
+func (d *SugDict) locate(prefix string) (node *sugNode, path string) {
+	node = &d.root
+	rest := prefix
+	for rest != "" {
+		idx, ok := node.findChild(rest[0])
+		if !ok {
+			return nil, ""
+		}
+		child := node.children[idx]
+		n := commonPrefix(child.label, rest)
+		if n < len(rest) && n < len(child.label) {
+			return nil, ""
+		}
+		path += child.label
+		node = child
+		rest = rest[n:]
+	}
+	return node, path
+}
+
+type Suggestion struct {
+	Key   string
+	Score float64
+}
+
+// A max-heap of subtrees and finished suggestions. A subtree is ranked by
+// its best score, which is never below any suggestion inside it, so a
+// suggestion popped from the heap has the highest remaining score.
+type sugItem struct {
+	node  *sugNode // nil for a finished suggestion
+	path  string
+	score float64
+}
+
+type sugHeap []sugItem
+
+func (h sugHeap) Len() int            { return len(h) }
+func (h sugHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h sugHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sugHeap) Push(x interface{}) { *h = append(*h, x.(sugItem)) }
+func (h *sugHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// topN returns up to `limit` suggestions from the given subtrees, ordered
+// by score from high to low.
+func topN(roots []sugItem, limit int) []Suggestion {
+	h := sugHeap(roots)
+	heap.Init(&h)
+	out := []Suggestion{}
+	for h.Len() > 0 && len(out) < limit {
+		item := heap.Pop(&h).(sugItem)
+		if item.node == nil {
+			out = append(out, Suggestion{Key: item.path, Score: item.score})
+			continue
+		}
+		if item.node.terminal {
+			heap.Push(&h, sugItem{path: item.path, score: item.node.score})
+		}
+		for _, child := range item.node.children {
+			heap.Push(&h, sugItem{node: child, path: item.path + child.label, score: child.best})
+		}
+	}
+	return out
+}
+
+// Get returns the top `limit` completions of `prefix`.
+func (d *SugDict) Get(prefix string, limit int) []Suggestion {
+	node, path := d.locate(prefix)
+	if node == nil {
+		return []Suggestion{}
+	}
+	return topN([]sugItem{{node: node, path: path, score: node.best}}, limit)
+}
+
+// GetFuzzy returns the top `limit` completions of any string within edit
+// distance 1 of `prefix`. The distance is measured in bytes.
+func (d *SugDict) GetFuzzy(prefix string, limit int) []Suggestion {
+	// Levenshtein distances between `prefix` and the path so far
+	row := make([]int, len(prefix)+1)
+	for i := range row {
+		row[i] = i
+	}
+	roots := []sugItem{}
+	if row[len(prefix)] <= 1 {
+		roots = append(roots, sugItem{node: &d.root, score: d.root.best})
+	} else {
+		d.fuzzyWalk(&d.root, "", prefix, row, &roots)
+	}
+	return topN(roots, limit)
+}
+
+func (d *SugDict) fuzzyWalk(node *sugNode, path, prefix string, row []int, roots *[]sugItem) {
+	for _, child := range node.children {
+		cur := row
+		matched := false
+		pruned := false
+		for i := 0; i < len(child.label); i++ {
+			cur = levenshteinStep(cur, prefix, child.label[i])
+			if cur[len(prefix)] <= 1 {
+				matched = true
+				break
+			}
+			if minInts(cur) > 1 {
+				pruned = true
+				break
+			}
+		}
+		childPath := path + child.label
+		if matched {
+			// Every string below this point is a completion
+			*roots = append(*roots, sugItem{node: child, path: childPath, score: child.best})
+		} else if !pruned {
+			d.fuzzyWalk(child, childPath, prefix, cur, roots)
+		}
+	}
+}
+
+func levenshteinStep(prev []int, word string, c byte) []int {
+	cur := make([]int, len(prev))
+	cur[0] = prev[0] + 1
+	for i := 1; i < len(prev); i++ {
+		cost := 1
+		if word[i-1] == c {
+			cost = 0
+		}
+		cur[i] = prev[i-1] + cost
+		if prev[i]+1 < cur[i] {
+			cur[i] = prev[i] + 1
+		}
+		if cur[i-1]+1 < cur[i] {
+			cur[i] = cur[i-1] + 1
+		}
+	}
+	return cur
+}
+
+func minInts(vals []int) int {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// MemUsage estimates the bytes used by the trie.
+func (d *SugDict) MemUsage() int {
+	return int(unsafe.Sizeof(*d)) + nodeMemUsage(&d.root) - int(unsafe.Sizeof(d.root))
+}
+
+func nodeMemUsage(node *sugNode) int {
+	total := int(unsafe.Sizeof(*node)) + len(node.label) + cap(node.children)*int(unsafe.Sizeof(node))
+	for _, child := range node.children {
+		total += nodeMemUsage(child)
+	}
+	return total
+}
+
+// Encode serializes the strings and their scores.
+func (d *SugDict) Encode(out []byte) []byte {
+	out = appendU32(out, uint32(d.size))
+	var walk func(node *sugNode, path string)
+	walk = func(node *sugNode, path string) {
+		if node.terminal {
+			out = appendStr(out, path)
+			out = appendF64(out, node.score)
+		}
+		for _, child := range node.children {
+			walk(child, path+child.label)
+		}
+	}
+	walk(&d.root, "")
+	return out
+}
+
+func decodeSugDict(d *decoder) (*SugDict, error) {
+	dict := newSugDict()
+	n := d.u32()
+	if d.err == nil && n == 0 {
+		return nil, errBadData
+	}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		key := d.str()
+		score := d.f64()
+		if _, dup := dict.Score(key); dup {
+			return nil, errBadData
+		}
+		dict.Add(key, score, false)
+	}
+	return dict, d.err
+}
+
+// lookupSug returns the suggestion dictionary at `key`, creating it if
+// `create` is set. The caller must hold the lock of gMap.
+func lookupSug(key string, create bool) (*SugDict, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		if !create {
+			return nil, ""
+		}
+		ent = &Entry{typ: TypeSug, val: newSugDict()}
+		dbSet(key, ent)
+	}
+	if ent.typ != TypeSug {
+		return nil, errWrongType
+	}
+	return ent.val.(*SugDict), ""
+}
+
+// sugadd key string score [INCR]
+func doSugAdd(cmd []string) ([]byte, ResponseCode) {
+	score, err := strconv.ParseFloat(cmd[3], 64)
+	if err != nil {
+		return []byte("expect float"), RES_ERR
+	}
+	incr := false
+	if len(cmd) == 5 {
+		if !cmdIs(cmd[4], "incr") {
+			return []byte("syntax error"), RES_ERR
+		}
+		incr = true
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	dict, errMsg := lookupSug(cmd[1], true)
+	if dict == nil {
+		return []byte(errMsg), RES_ERR
+	}
+	dict.Add(cmd[2], score, incr)
+	return []byte(strconv.Itoa(dict.size)), RES_OK
+}
+
+// sugget key prefix [FUZZY] [WITHSCORES] [MAX n]
+func doSugGet(cmd []string) ([]byte, ResponseCode) {
+	fuzzy := false
+	withScores := false
+	limit := 5
+	for i := 3; i < len(cmd); i++ {
+		if cmdIs(cmd[i], "fuzzy") {
+			fuzzy = true
+		} else if cmdIs(cmd[i], "withscores") {
+			withScores = true
+		} else if cmdIs(cmd[i], "max") && i+1 < len(cmd) {
+			n, err := strconv.Atoi(cmd[i+1])
+			if err != nil || n < 0 {
+				return []byte("expect int"), RES_ERR
+			}
+			limit = n
+			i++
+		} else {
+			return []byte("syntax error"), RES_ERR
+		}
+	}
+
+	gMap.RLock()
+	defer gMap.RUnlock()
+	dict, errMsg := lookupSug(cmd[1], false)
+	if dict == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+
+	var sugs []Suggestion
+	if fuzzy {
+		sugs = dict.GetFuzzy(cmd[2], limit)
+	} else {
+		sugs = dict.Get(cmd[2], limit)
+	}
+
+	out := []byte{}
+	if withScores {
+		outArr(&out, uint32(2*len(sugs)))
+	} else {
+		outArr(&out, uint32(len(sugs)))
+	}
+	for _, sug := range sugs {
+		outStr(&out, sug.Key)
+		if withScores {
+			outDbl(&out, sug.Score)
+		}
+	}
+	return out, RES_ARR
+}
+
+// sugdel key string
+func doSugDel(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	dict, errMsg := lookupSug(cmd[1], false)
+	if dict == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	if !dict.Del(cmd[2]) {
+		return nil, RES_NX
+	}
+	if dict.size == 0 {
+		dbDelete(cmd[1])
+	}
+	return nil, RES_OK
+}
+
+// suginfo key
+func doSugInfo(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	dict, errMsg := lookupSug(cmd[1], false)
+	if dict == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+
+	mem := dict.MemUsage()
+	out := []byte{}
+	outArr(&out, 8)
+	outStr(&out, "entries")
+	outInt(&out, int64(dict.size))
+	outStr(&out, "nodes")
+	outInt(&out, int64(dict.nodes))
+	outStr(&out, "memory")
+	outInt(&out, int64(mem))
+	outStr(&out, "memory_per_entry")
+	outDbl(&out, float64(mem)/float64(dict.size))
+	return out, RES_ARR
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSugCommands(t *testing.T) {
+	s := newTestServer(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"sugadd", "d", "hello", "3"}, "1"},
+		{[]string{"sugadd", "d", "help", "5"}, "2"},
+		{[]string{"sugadd", "d", "hell", "1"}, "3"},
+		{[]string{"sugadd", "d", "world", "2"}, "4"},
+		{[]string{"sugget", "d", "hel"}, "[help hello hell]"},
+		{[]string{"sugget", "d", "hel", "max", "2", "withscores"}, "[help 5 hello 3]"},
+		{[]string{"sugget", "d", "x"}, "[]"},
+		{[]string{"sugget", "d", ""}, "[help hello world hell]"},
+		// INCR adds to the score
+		{[]string{"sugadd", "d", "hell", "10", "incr"}, "4"},
+		{[]string{"sugget", "d", "h", "max", "1", "withscores"}, "[hell 11]"},
+		// One edit away: a substitution, an insertion, a deletion
+		{[]string{"sugget", "d", "wprld", "fuzzy"}, "[world]"},
+		{[]string{"sugget", "d", "hxel", "fuzzy", "max", "10"}, "[hell help hello]"},
+		{[]string{"sugget", "d", "wrld", "fuzzy"}, "[world]"},
+		{[]string{"sugget", "d", "wxyld", "fuzzy"}, "[]"},
+		{[]string{"sugdel", "d", "help"}, ""},
+		{[]string{"sugdel", "d", "help"}, "(nil)"},
+		{[]string{"sugget", "d", "hel"}, "[hell hello]"},
+		{[]string{"sugget", "d", "hel", "max", "-1"}, "(error) expect int"},
+		{[]string{"sugget", "d", "hel", "bogus"}, "(error) syntax error"},
+		{[]string{"sugadd", "d", "a", "x"}, "(error) expect float"},
+		{[]string{"sugget", "nokey", "a"}, "(nil)"},
+		// The key goes with its last string
+		{[]string{"sugdel", "d", "hell"}, ""},
+		{[]string{"sugdel", "d", "hello"}, ""},
+		{[]string{"sugdel", "d", "world"}, ""},
+		{[]string{"exists", "d"}, "0"},
+		{[]string{"set", "str", "v"}, ""},
+		{[]string{"sugadd", "str", "a", "1"}, "(error) " + errWrongType},
+	} {
+		s.expect(c.want, c.args...)
+	}
+}
+
+// sugFuzzyMatch tells if some prefix of `key` is within edit distance 1
+// of `prefix`.
+func sugFuzzyMatch(key, prefix string) bool {
+	row := make([]int, len(prefix)+1)
+	for i := range row {
+		row[i] = i
+	}
+	for i := 0; ; i++ {
+		if row[len(prefix)] <= 1 {
+			return true
+		}
+		if i == len(key) {
+			return false
+		}
+		row = levenshteinStep(row, prefix, key[i])
+	}
+}
+
+func TestSugDictRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	dict := newSugDict()
+	want := map[string]float64{}
+	randKey := func() string {
+		b := make([]byte, 1+rng.Intn(6))
+		for i := range b {
+			b[i] = "abc"[rng.Intn(3)]
+		}
+		return string(b)
+	}
+	for i := 0; i < 3000; i++ {
+		key := randKey()
+		if rng.Intn(4) == 0 {
+			_, had := want[key]
+			if dict.Del(key) != had {
+				t.Fatalf("del %s: %v", key, !had)
+			}
+			delete(want, key)
+			continue
+		}
+		// Distinct scores, so the order of the results is known
+		want[key] = float64(i)
+		dict.Add(key, float64(i), false)
+	}
+	if dict.size != len(want) {
+		t.Fatalf("%d strings, want %d", dict.size, len(want))
+	}
+
+	// bruteForce returns the top 10 of the strings matching `match`.
+	bruteForce := func(match func(key string) bool) string {
+		var keys []string
+		for key := range want {
+			if match(key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return want[keys[i]] > want[keys[j]] })
+		if len(keys) > 10 {
+			keys = keys[:10]
+		}
+		return fmt.Sprint(keys)
+	}
+	keysOf := func(sugs []Suggestion) string {
+		var keys []string
+		for _, sug := range sugs {
+			keys = append(keys, sug.Key)
+		}
+		return fmt.Sprint(keys)
+	}
+	for i := 0; i < 200; i++ {
+		prefix := randKey()
+		if len(prefix) > 3 {
+			prefix = prefix[:3]
+		}
+		exact := bruteForce(func(key string) bool { return strings.HasPrefix(key, prefix) })
+		if got := keysOf(dict.Get(prefix, 10)); got != exact {
+			t.Fatalf("get %s: %s, want %s", prefix, got, exact)
+		}
+		fuzzy := bruteForce(func(key string) bool { return sugFuzzyMatch(key, prefix) })
+		if got := keysOf(dict.GetFuzzy(prefix, 10)); got != fuzzy {
+			t.Fatalf("fuzzy get %s: %s, want %s", prefix, got, fuzzy)
+		}
+	}
+
+	got, err := decodeSugDict(&decoder{data: dict.Encode(nil)})
+	if err != nil || got.size != dict.size {
+		t.Fatalf("decoded %d strings: %v", got.size, err)
+	}
+	for key, score := range want {
+		if s, ok := got.Score(key); !ok || s != score {
+			t.Fatalf("decoded %s: %v %v, want %v", key, s, ok, score)
+		}
+	}
+
+	// Deleting every string leaves no node behind
+	for key := range want {
+		dict.Del(key)
+	}
+	if dict.size != 0 || dict.nodes != 0 || len(dict.root.children) != 0 {
+		t.Fatalf("%d strings and %d nodes left", dict.size, dict.nodes)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// A t-digest (Dunning) summarizes a distribution with a sorted list of
+// centroids. Centroids near the tails are kept small with the k1 scale
+// function, so extreme quantiles like p999 stay accurate. New samples are
+// buffered and merged into the centroids in batches.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	buf         []centroid // unmerged samples
+	total       float64    // total weight including the buffer
+	min         float64
+	max         float64
+}
+
+const (
+	kTDigestDefaultCompression = 100
+	kTDigestMaxCompression     = 10000 // buffers 5 * compression values
+)
+
+func newTDigest(compression float64) *TDigest {
+	return &TDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+func (t *TDigest) Reset() {
+	t.centroids = nil
+	t.buf = nil
+	t.total = 0
+	t.min = math.Inf(1)
+	t.max = math.Inf(-1)
+}
+
+func (t *TDigest) addCentroid(c centroid) {
+	t.buf = append(t.buf, c)
+	t.total += c.weight
+	if c.mean < t.min {
+		t.min = c.mean
+	}
+	if c.mean > t.max {
+		t.max = c.mean
+	}
+	if len(t.buf) >= int(5*t.compression) {
+		t.compress()
+	}
+}
+
+func (t *TDigest) Add(val float64) {
+	t.addCentroid(centroid{val, 1})
+}
+
+// scale is the k1 scale function. Adjacent merged centroids may span at
+// most 1 unit of it.
+func (t *TDigest) scale(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// compress merges the buffer into the centroids.
+func (t *TDigest) compress() {
+	if len(t.buf) == 0 {
+		return
+	}
+	t.centroids = t.merged()
+	t.buf = nil
+}
+
+// merged returns the centroids with the buffer merged in, leaving the
+// digest as is.
+func (t *TDigest) merged() []centroid {
+	if len(t.buf) == 0 {
+		return t.centroids
+	}
+	all := make([]centroid, 0, len(t.centroids)+len(t.buf))
+	all = append(append(all, t.centroids...), t.buf...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	out := make([]centroid, 0, len(t.centroids)+1)
+	cur := all[0]
+	soFar := 0.0
+	kLow := t.scale(0)
+	for _, next := range all[1:] {
+		q := (soFar + cur.weight + next.weight) / t.total
+		if t.scale(q)-kLow <= 1 {
+			// Merge into the current centroid
+			cur.weight += next.weight
+			cur.mean += (next.mean - cur.mean) * next.weight / cur.weight
+			continue
+		}
+		out = append(out, cur)
+		soFar += cur.weight
+		kLow = t.scale(soFar / t.total)
+		cur = next
+	}
+	return append(out, cur)
+}
+
+// Quantile returns the estimated value at quantile q in [0, 1].
+func (t *TDigest) Quantile(q float64) float64 {
+	t.compress()
+	cs := t.centroids
+	if len(cs) == 0 {
+		return math.NaN()
+	}
+	if len(cs) == 1 || q <= 0 {
+		if q <= 0 {
+			return t.min
+		}
+		return cs[0].mean
+	}
+	if q >= 1 {
+		return t.max
+	}
+
+	index := q * t.total
+	// Between the minimum and the center of the first centroid
+	if index < cs[0].weight/2 {
+		return t.min + (cs[0].mean-t.min)*index/(cs[0].weight/2)
+	}
+	soFar := cs[0].weight / 2
+	for i := 0; i+1 < len(cs); i++ {
+		dw := (cs[i].weight + cs[i+1].weight) / 2
+		if soFar+dw > index {
+			return cs[i].mean + (cs[i+1].mean-cs[i].mean)*(index-soFar)/dw
+		}
+		soFar += dw
+	}
+	// Between the center of the last centroid and the maximum
+	last := cs[len(cs)-1]
+	z := index - soFar
+	return last.mean + (t.max-last.mean)*z/(last.weight/2)
+}
+
+// CDF returns the estimated fraction of samples at or below `val`.
+func (t *TDigest) CDF(val float64) float64 {
+	t.compress()
+	cs := t.centroids
+	if len(cs) == 0 {
+		return math.NaN()
+	}
+	if val < t.min {
+		return 0
+	}
+	if val >= t.max {
+		return 1
+	}
+	if len(cs) == 1 {
+		return (val - t.min) / (t.max - t.min)
+	}
+
+	if val < cs[0].mean {
+		return (val - t.min) / (cs[0].mean - t.min) * cs[0].weight / 2 / t.total
+	}
+	soFar := cs[0].weight / 2
+	for i := 0; i+1 < len(cs); i++ {
+		dw := (cs[i].weight + cs[i+1].weight) / 2
+		if val < cs[i+1].mean {
+			return (soFar + dw*(val-cs[i].mean)/(cs[i+1].mean-cs[i].mean)) / t.total
+		}
+		soFar += dw
+	}
+	last := cs[len(cs)-1]
+	return (soFar + last.weight/2*(val-last.mean)/(t.max-last.mean)) / t.total
+}
+
+// Merge adds the centroids of `src` to the digest.
+func (t *TDigest) Merge(src *TDigest) {
+	src.compress()
+	for _, c := range src.centroids {
+		t.addCentroid(c)
+	}
+	if src.min < t.min {
+		t.min = src.min
+	}
+	if src.max > t.max {
+		t.max = src.max
+	}
+}
+
+// Encode doesn't change the digest, as it runs under the read lock.
+func (t *TDigest) Encode(out []byte) []byte {
+	cs := t.merged()
+	out = appendF64(out, t.compression)
+	out = appendF64(out, t.min)
+	out = appendF64(out, t.max)
+	out = appendU32(out, uint32(len(cs)))
+	for _, c := range cs {
+		out = appendF64(out, c.mean)
+		out = appendF64(out, c.weight)
+	}
+	return out
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// decodeTDigest reads a digest written by Encode(). The centroids must be
+// finite, sorted and within [min, max].
+func decodeTDigest(d *decoder) (*TDigest, error) {
+	t := newTDigest(d.f64())
+	t.min = d.f64()
+	t.max = d.f64()
+	n := d.u32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if !(t.compression >= 10 && t.compression <= kTDigestMaxCompression) {
+		return nil, errBadData
+	}
+	if n == 0 && !(math.IsInf(t.min, 1) && math.IsInf(t.max, -1)) ||
+		n > 0 && !(isFinite(t.min) && isFinite(t.max) && t.min <= t.max) {
+		return nil, errBadData
+	}
+	if uint64(n) > uint64(len(d.data))/16 {
+		return nil, errShortData
+	}
+	prev := t.min
+	for i := uint32(0); i < n; i++ {
+		c := centroid{d.f64(), d.f64()}
+		if !(c.mean >= prev && c.mean <= t.max && c.weight > 0 && isFinite(c.weight)) {
+			return nil, errBadData
+		}
+		prev = c.mean
+		t.centroids = append(t.centroids, c)
+		t.total += c.weight
+	}
+	if !isFinite(t.total) {
+		return nil, errBadData
+	}
+	return t, d.err
+}
+
+// lookupTDigest returns the t-digest at `key`. The caller must hold the
+// lock of gMap.
+func lookupTDigest(key string) (*TDigest, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		return nil, ""
+	}
+	if ent.typ != TypeTDigest {
+		return nil, errWrongType
+	}
+	return ent.val.(*TDigest), ""
+}
+
+func parseCompression(cmd []string, pos int) (float64, bool) {
+	if pos+1 >= len(cmd) || !cmdIs(cmd[pos], "compression") {
+		return 0, false
+	}
+	c, err := strconv.ParseFloat(cmd[pos+1], 64)
+	if err != nil || c < 10 || c > kTDigestMaxCompression {
+		return 0, false
+	}
+	return c, true
+}
+
+// tdigest.create key [COMPRESSION c]
+func doTDigestCreate(cmd []string) ([]byte, ResponseCode) {
+	compression := float64(kTDigestDefaultCompression)
+	if len(cmd) > 2 {
+		c, ok := parseCompression(cmd, 2)
+		if !ok || len(cmd) != 4 {
+			return []byte(fmt.Sprintf("compression should be between 10 and %d", kTDigestMaxCompression)), RES_ERR
+		}
+		compression = c
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	if _, ok := lookupEntry(cmd[1]); ok {
+		return []byte("item exists"), RES_ERR
+	}
+	dbSet(cmd[1], &Entry{typ: TypeTDigest, val: newTDigest(compression)})
+	return nil, RES_OK
+}
+
+// tdigest.add key value [value ...]
+func doTDigestAdd(cmd []string) ([]byte, ResponseCode) {
+	vals := make([]float64, 0, len(cmd)-2)
+	for _, arg := range cmd[2:] {
+		v, err := strconv.ParseFloat(arg, 64)
+		// An infinite value would turn the means of the centroids into NaN
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return []byte("expect finite float"), RES_ERR
+		}
+		vals = append(vals, v)
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	t, errMsg := lookupTDigest(cmd[1])
+	if t == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	for _, v := range vals {
+		t.Add(v)
+	}
+	return nil, RES_OK
+}
+
+// tdigest.quantile key q [q ...] and tdigest.cdf key value [value ...]
+func doTDigestQuery(cmd []string, cdf bool) ([]byte, ResponseCode) {
+	args := make([]float64, 0, len(cmd)-2)
+	for _, arg := range cmd[2:] {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || (!cdf && (v < 0 || v > 1)) {
+			return []byte("bad argument"), RES_ERR
+		}
+		args = append(args, v)
+	}
+
+	// Queries merge the buffer, so they need the write lock
+	gMap.Lock()
+	defer gMap.Unlock()
+	t, errMsg := lookupTDigest(cmd[1])
+	if t == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	out := []byte{}
+	outArr(&out, uint32(len(args)))
+	for _, v := range args {
+		if cdf {
+			outDbl(&out, t.CDF(v))
+		} else {
+			outDbl(&out, t.Quantile(v))
+		}
+	}
+	return out, RES_ARR
+}
+
+// tdigest.merge dest numkeys src [src ...] [COMPRESSION c] [OVERRIDE]
+// The destination is created if missing. With OVERRIDE its old content
+// is replaced instead of merged into.
+func doTDigestMerge(cmd []string) ([]byte, ResponseCode) {
+	n, err := strconv.Atoi(cmd[2])
+	if err != nil || n <= 0 || 3+n > len(cmd) {
+		return []byte("bad number of keys"), RES_ERR
+	}
+	srcKeys := cmd[3 : 3+n]
+	compression := 0.0
+	override := false
+	for i := 3 + n; i < len(cmd); i++ {
+		if cmdIs(cmd[i], "override") {
+			override = true
+		} else if c, ok := parseCompression(cmd, i); ok {
+			compression = c
+			i++
+		} else {
+			return []byte("syntax error"), RES_ERR
+		}
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	srcs := make([]*TDigest, n)
+	for i, key := range srcKeys {
+		var errMsg string
+		srcs[i], errMsg = lookupTDigest(key)
+		if srcs[i] == nil {
+			if errMsg != "" {
+				return []byte(errMsg), RES_ERR
+			}
+			return nil, RES_NX
+		}
+	}
+	if compression == 0 {
+		// Default to the largest compression of the inputs
+		for _, src := range srcs {
+			compression = math.Max(compression, src.compression)
+		}
+	}
+
+	dst, errMsg := lookupTDigest(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	merged := newTDigest(compression)
+	if dst != nil && !override {
+		merged.compression = math.Max(merged.compression, dst.compression)
+		merged.Merge(dst)
+	}
+	for _, src := range srcs {
+		merged.Merge(src)
+	}
+	merged.compress()
+	dbSet(cmd[1], &Entry{typ: TypeTDigest, val: merged})
+	return nil, RES_OK
+}
+
+// tdigest.reset key
+func doTDigestReset(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	t, errMsg := lookupTDigest(cmd[1])
+	if t == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	t.Reset()
+	return nil, RES_OK
+}
+
+// tdigest.info key
+func doTDigestInfo(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	t, errMsg := lookupTDigest(cmd[1])
+	if t == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	t.compress()
+	out := []byte{}
+	outArr(&out, 10)
+	outStr(&out, "compression")
+	outDbl(&out, t.compression)
+	outStr(&out, "centroids")
+	outInt(&out, int64(len(t.centroids)))
+	outStr(&out, "observations")
+	outDbl(&out, t.total)
+	outStr(&out, "min")
+	outDbl(&out, t.min)
+	outStr(&out, "max")
+	outDbl(&out, t.max)
+	return out, RES_ARR
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// exactQuantile returns the sample at quantile q of the sorted samples.
+func exactQuantile(sorted []float64, q float64) float64 {
+	i := int(q * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func TestTDigestQuantiles(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	dists := map[string]func() float64{
+		"uniform":     rng.Float64,
+		"normal":      rng.NormFloat64,
+		"exponential": rng.ExpFloat64,
+		"lognormal":   func() float64 { return math.Exp(2 * rng.NormFloat64()) },
+	}
+	for name, draw := range dists {
+		td := newTDigest(kTDigestDefaultCompression)
+		samples := make([]float64, 100000)
+		for i := range samples {
+			samples[i] = draw()
+			td.Add(samples[i])
+		}
+		sort.Float64s(samples)
+
+		for _, q := range []float64{0.001, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999} {
+			est := td.Quantile(q)
+			// Compare by rank, since the value scale differs by distribution
+			rank := float64(sort.SearchFloat64s(samples, est)) / float64(len(samples))
+			// The k1 scale keeps the tails tighter than the middle
+			tol := 0.01
+			if q < 0.01 || q > 0.99 {
+				tol = 0.001
+			}
+			if math.Abs(rank-q) > tol {
+				t.Errorf("%s: quantile %g estimated %g at rank %g, exact %g", name, q, est, rank, exactQuantile(samples, q))
+			}
+			if cdf := td.CDF(exactQuantile(samples, q)); math.Abs(cdf-q) > tol {
+				t.Errorf("%s: cdf at quantile %g is %g", name, q, cdf)
+			}
+		}
+		if td.Quantile(0) != samples[0] || td.Quantile(1) != samples[len(samples)-1] {
+			t.Errorf("%s: min or max is off", name)
+		}
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	a, b := newTDigest(100), newTDigest(100)
+	var samples []float64
+	for i := 0; i < 50000; i++ {
+		v := rng.NormFloat64()
+		samples = append(samples, v)
+		a.Add(v)
+		v = 3 + rng.NormFloat64()
+		samples = append(samples, v)
+		b.Add(v)
+	}
+	sort.Float64s(samples)
+	a.Merge(b)
+	for _, q := range []float64{0.01, 0.25, 0.5, 0.75, 0.99} {
+		rank := float64(sort.SearchFloat64s(samples, a.Quantile(q))) / float64(len(samples))
+		if math.Abs(rank-q) > 0.01 {
+			t.Errorf("quantile %g at rank %g after merging", q, rank)
+		}
+	}
+}
+
+func TestTDigestEncode(t *testing.T) {
+	td := newTDigest(50)
+	for i := 0; i < 1100; i++ {
+		td.Add(float64(i))
+	}
+	// Leaves the buffer alone, it may run under the read lock
+	buffered := len(td.buf)
+	if buffered == 0 {
+		t.Fatal("nothing buffered")
+	}
+	data := td.Encode(nil)
+	if len(td.buf) != buffered {
+		t.Fatal("encoding changed the digest")
+	}
+	got, err := decodeTDigest(&decoder{data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		if got.Quantile(q) != td.Quantile(q) {
+			t.Errorf("quantile %g: %g after decoding, %g before", q, got.Quantile(q), td.Quantile(q))
+		}
+	}
+}
+
+func TestTDigestLimits(t *testing.T) {
+	s := newTestServer(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"tdigest.create", "t", "compression", "9"}, "(error) compression should be between 10 and 10000"},
+		{[]string{"tdigest.create", "t", "compression", "1e9"}, "(error) compression should be between 10 and 10000"},
+		{[]string{"tdigest.create", "t", "compression", "10000"}, ""},
+		{[]string{"tdigest.add", "t", "1", "2", "3"}, ""},
+		{[]string{"tdigest.add", "t", "inf"}, "(error) expect finite float"},
+		{[]string{"tdigest.add", "t", "-Inf"}, "(error) expect finite float"},
+		{[]string{"tdigest.add", "t", "1e309"}, "(error) expect finite float"},
+		{[]string{"tdigest.add", "t", "nan"}, "(error) expect finite float"},
+		{[]string{"tdigest.cdf", "t", "+inf"}, "(error) bad argument"},
+		{[]string{"tdigest.quantile", "t", "nan"}, "(error) bad argument"},
+		// The rejected values left the digest alone
+		{[]string{"tdigest.quantile", "t", "0", "0.5", "1"}, "[1 2 3]"},
+	} {
+		s.expect(c.want, c.args...)
+	}
+}
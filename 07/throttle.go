@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Rate limiting with the generic cell rate algorithm (GCRA). Each key
+// stores a theoretical arrival time (TAT): when the next request would be
+// due if requests arrived exactly at the allowed rate. A request is
+// allowed if, after adding its cost, the TAT is at most the burst
+// tolerance ahead of now. Reading and updating the TAT happen under one
+// lock, so concurrent clients can't race past the limit.
+
+// Bounds the period, the burst tolerance and the cost of a request, so
+// that a TAT plus a cost still fits in an int64.
+const kThrottleMaxSpan = int64(50 * 365 * 24 * time.Hour)
+
+type throttleResult struct {
+	limited    bool
+	limit      int64
+	remaining  int64
+	retryAfter time.Duration // -1 if allowed
+	resetAfter time.Duration // until the limiter is back to a full burst
+}
+
+// gcra applies a request of `quantity` at time `now` to the stored `tat`.
+// `period`/`count` is the emission interval and `maxBurst` extra requests
+// may come at once. Returns the result and the new TAT to store, or 0 if
+// it is unchanged. The tolerance and the increment must be at most
+// kThrottleMaxSpan.
+func gcra(tat, now int64, maxBurst, count int64, period time.Duration, quantity int64) (throttleResult, int64) {
+	interval := int64(period) / count
+	tolerance := interval * (maxBurst + 1)
+	increment := interval * quantity
+	res := throttleResult{limit: maxBurst + 1}
+
+	if tat < now {
+		tat = now
+	}
+	newTat := tat + increment
+	allowAt := newTat - tolerance
+	diff := now - allowAt
+	if diff < 0 {
+		res.limited = true
+		res.retryAfter = -1
+		if increment <= tolerance {
+			res.retryAfter = time.Duration(-diff)
+		}
+		res.resetAfter = time.Duration(tat - now)
+		if remaining := now - (tat - tolerance); remaining > 0 {
+			res.remaining = remaining / interval
+		}
+		return res, 0
+	}
+
+	res.retryAfter = -1
+	res.resetAfter = time.Duration(newTat - now)
+	res.remaining = diff / interval
+	return res, newTat
+}
+
+// throttle key max_burst count period [quantity]
+// `count` requests are allowed per `period` seconds with bursts of up to
+// `max_burst` + 1. Replies with [limited, limit, remaining, retry_after,
+// reset_after]; the times are in milliseconds and retry_after is -1 when
+// the request is allowed.
+func doThrottle(cmd []string) ([]byte, ResponseCode) {
+	args := make([]int64, 4)
+	args[3] = 1
+	for i, arg := range cmd[2:] {
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 0 || (i > 0 && n == 0) {
+			return []byte("expect positive int"), RES_ERR
+		}
+		args[i] = n
+	}
+	maxBurst, count, quantity := args[0], args[1], args[3]
+	if args[2] > kThrottleMaxSpan/int64(time.Second) {
+		return []byte("period is too long"), RES_ERR
+	}
+	period := time.Duration(args[2]) * time.Second
+	interval := int64(period) / count
+	if interval == 0 {
+		return []byte("rate is too high"), RES_ERR
+	}
+	if maxBurst >= kThrottleMaxSpan/interval {
+		return []byte("max_burst is too large for the rate"), RES_ERR
+	}
+	if quantity > kThrottleMaxSpan/interval {
+		return []byte("quantity is too large for the rate"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	now := nowNs()
+	tat := int64(0)
+	if ent, ok := lookupEntry(cmd[1]); ok {
+		if ent.typ != TypeStr {
+			return []byte(errWrongType), RES_ERR
+		}
+		var err error
+		tat, err = strconv.ParseInt(string(ent.val.([]byte)), 10, 64)
+		// A TAT is never more than the tolerance ahead of now
+		if err != nil || tat > now+kThrottleMaxSpan {
+			return []byte("value is not a rate limiter"), RES_ERR
+		}
+	}
+
+	res, newTat := gcra(tat, now, maxBurst, count, period, quantity)
+	if newTat != 0 {
+		// The key is useless once the TAT has passed
+		dbSet(cmd[1], &Entry{typ: TypeStr, val: []byte(strconv.FormatInt(newTat, 10)), expireAt: newTat})
+	}
+
+	limited := int64(0)
+	if res.limited {
+		limited = 1
+	}
+	retryAfter := int64(-1)
+	if res.retryAfter >= 0 {
+		retryAfter = res.retryAfter.Milliseconds()
+	}
+	out := []byte{}
+	outArr(&out, 5)
+	outInt(&out, limited)
+	outInt(&out, res.limit)
+	outInt(&out, res.remaining)
+	outInt(&out, retryAfter)
+	outInt(&out, res.resetAfter.Milliseconds())
+	return out, RES_ARR
+}
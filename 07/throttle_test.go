@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newTestServer(t)
+
+	// 1 per second with bursts of 3
+	s.expect("[0 3 2 -1 1000]", "throttle", "u", "2", "1", "1")
+	s.expect("[0 3 1 -1 2000]", "throttle", "u", "2", "1", "1")
+	s.expect("[0 3 0 -1 3000]", "throttle", "u", "2", "1", "1")
+	s.expect("[1 3 0 1000 3000]", "throttle", "u", "2", "1", "1")
+
+	clock.advance(400 * time.Millisecond)
+	s.expect("[1 3 0 600 2600]", "throttle", "u", "2", "1", "1")
+	clock.advance(600 * time.Millisecond)
+	s.expect("[0 3 0 -1 3000]", "throttle", "u", "2", "1", "1")
+
+	// A request costing more than a burst is never allowed
+	s.expect("[1 3 0 -1 3000]", "throttle", "u", "2", "1", "1", "4")
+
+	// The limiter expires once it is back to a full burst
+	clock.advance(2999 * time.Millisecond)
+	s.expect("1", "exists", "u")
+	clock.advance(time.Millisecond)
+	s.expect("0", "exists", "u")
+	s.expect("[0 3 2 -1 1000]", "throttle", "u", "2", "1", "1")
+}
+
+func TestMonotonicClock(t *testing.T) {
+	c := newMonotonicClock()
+	if d := c.Now() - time.Now().UnixNano(); d > int64(time.Second) || d < -int64(time.Second) {
+		t.Fatalf("clock is %v off the wall clock", time.Duration(d))
+	}
+	prev := c.Now()
+	for i := 0; i < 1000; i++ {
+		now := c.Now()
+		if now < prev {
+			t.Fatal("clock went backwards")
+		}
+		prev = now
+	}
+}
+
+func TestThrottleLimits(t *testing.T) {
+	s := newTestServer(t)
+	useFakeClock(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"throttle", "u", "0", "1", "9223372036"}, "(error) period is too long"},
+		{[]string{"throttle", "u", "0", "1", "1576800001"}, "(error) period is too long"},
+		{[]string{"throttle", "u", "0", "2000000000", "1"}, "(error) rate is too high"},
+		{[]string{"throttle", "u", "9223372036854775807", "1", "1"}, "(error) max_burst is too large for the rate"},
+		{[]string{"throttle", "u", "1576800000", "1", "1"}, "(error) max_burst is too large for the rate"},
+		{[]string{"throttle", "u", "0", "1", "1", "9223372036854775807"}, "(error) quantity is too large for the rate"},
+		{[]string{"throttle", "u", "0", "1", "1", "1576800001"}, "(error) quantity is too large for the rate"},
+		{[]string{"exists", "u"}, "0"},
+		// The largest values are allowed and leave a TAT in the future
+		{[]string{"throttle", "u", "0", "1", "1576800000"}, "[0 1 0 -1 1576800000000]"},
+		{[]string{"throttle", "u", "0", "1", "1576800000"}, "[1 1 0 1576800000000 1576800000000]"},
+		{[]string{"throttle", "v", "1576799999", "1", "1", "1576800000"}, "[0 1576800000 0 -1 1576800000000]"},
+		{[]string{"set", "w", "9223372036854775807"}, ""},
+		{[]string{"throttle", "w", "1", "1", "1"}, "(error) value is not a rate limiter"},
+	} {
+		s.expect(c.want, c.args...)
+	}
+}
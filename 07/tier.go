@@ -0,0 +1,311 @@
+package main
+
+import (
+	"byor/04/util"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Values not accessed for longer than -tier-idle are spilled to the value
+// log, a file of records: u32 length, the value written by encodeValue(),
+// and its CRC-64. The entry keeps its type, TTL and access time, and its
+// value becomes a *coldValue pointing at the record.
+//
+// Commands never see cold values. Before a command runs, doRequest()
+// checks its arguments for keys with cold values. If there are some, the
+// Conn is suspended in StateWait and a goroutine reads the values, so the
+// event loop doesn't wait for the disk. Once they are read, the event
+// loop puts them back in the entries and runs the request again.
+//
+// The value log is only a cache: snapshots and the AOF hold the values,
+// so it starts empty. With encryption on, the values are encrypted with
+// the key of the data files, see crypt.go. Records of values loaded back
+// or deleted are not reused, the file is truncated once no cold value is
+// left.
+
+const (
+	kTierValueLog  = "values.vlog"
+	kTierCronEvery = 100 * 1000 * 1000 // ns between spill cycles
+	kTierSamples   = 64                // keys checked per database and cycle
+)
+
+// coldValue is the value of a spilled entry.
+type coldValue struct {
+	off    int64  // of the value in the value log
+	length uint32 // of the value
+}
+
+const kColdStubSize = int64(unsafe.Sizeof(coldValue{})) + 16
+
+var errSuspended = errors.New("suspended")
+
+// A tierLoad reads the cold values of the arguments of a request.
+type tierLoad struct {
+	conn  *Conn
+	db    int
+	items []tierItem
+	err   error
+}
+
+type tierItem struct {
+	key string
+	ent *Entry
+	cv  *coldValue
+	val interface{}
+}
+
+var gTier = struct {
+	file     *os.File
+	seal     *sealer
+	size     int64 // of the value log
+	cold     int64 // cold values
+	live     int64 // bytes of the value log used by them
+	loads    int   // in flight
+	lastCron int64
+	wake     [2]int // pipe that wakes up the event loop when a load is done
+
+	mu   sync.Mutex
+	done []*tierLoad // loads to finish, under `mu`
+
+	spills    int64
+	coldLoads int64
+}{}
+
+// tierInit opens an empty value log if tiering is on, and the wake-up
+// pipe of the event loop.
+func tierInit() error {
+	if err := syscall.Pipe2(gTier.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		return err
+	}
+	if gConfig.tierIdle <= 0 {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(gConfig.dir, kTierValueLog), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gTier.file = f
+	gTier.seal, err = newSealer()
+	return err
+}
+
+// load reads the value back from the value log.
+func (cv *coldValue) load(typ ValueType) (interface{}, error) {
+	buf := make([]byte, int(cv.length)+8)
+	if _, err := gTier.file.ReadAt(buf, cv.off); err != nil {
+		return nil, err
+	}
+	d := &decoder{data: buf[cv.length:]}
+	if crc64.Checksum(buf[:cv.length], gCrcTable) != d.u64() {
+		return nil, fmt.Errorf("value log offset %d: checksum mismatch", cv.off)
+	}
+	data := buf[:cv.length]
+	if gTier.seal != nil {
+		var err error
+		if data, err = gTier.seal.openAt(data, cv.off-4); err != nil {
+			return nil, err
+		}
+	}
+	return decodeValue(typ, &decoder{data: data})
+}
+
+// hotEntry returns the entry, or a copy with its value read back if it is
+// cold. It blocks on the disk, so it is for the writers of whole
+// datasets. The caller must hold the lock of gMap.
+func hotEntry(ent *Entry) (*Entry, error) {
+	cv, ok := ent.val.(*coldValue)
+	if !ok {
+		return ent, nil
+	}
+	val, err := cv.load(ent.typ)
+	if err != nil {
+		return nil, err
+	}
+	hot := *ent
+	hot.val = val
+	return &hot, nil
+}
+
+// forgetCold is called when an entry leaves the keyspace.
+func forgetCold(ent *Entry) {
+	if cv, ok := ent.val.(*coldValue); ok {
+		gTier.cold--
+		gTier.live -= int64(cv.length) + 12
+	}
+}
+
+// tierRecount counts the cold values again after databases were dropped.
+// The caller must hold the write lock of gMap.
+func tierRecount() {
+	gTier.cold = 0
+	gTier.live = 0
+	for _, db := range gMap.dbs {
+		db.Range(func(key string, ent *Entry) bool {
+			if cv, ok := ent.val.(*coldValue); ok {
+				gTier.cold++
+				gTier.live += int64(cv.length) + 12
+			}
+			return true
+		})
+	}
+}
+
+// tierSuspend starts loading the cold values of the keys among the
+// arguments of the command. Returns false if there are none. Arguments
+// that are not keys may load a value for nothing, which is harmless.
+func tierSuspend(conn *Conn, cmd []string) bool {
+	if gTier.cold == 0 {
+		return false
+	}
+	gMap.RLock()
+	defer gMap.RUnlock()
+	ld := &tierLoad{conn: conn, db: conn.db}
+	seen := map[string]bool{}
+	for _, arg := range cmd[1:] {
+		ent, ok := gMap.dbs[conn.db].Get(arg)
+		if !ok || seen[arg] {
+			continue
+		}
+		if cv, ok := ent.val.(*coldValue); ok {
+			seen[arg] = true
+			ld.items = append(ld.items, tierItem{key: arg, ent: ent, cv: cv})
+		}
+	}
+	if len(ld.items) == 0 {
+		return false
+	}
+
+	gTier.loads++
+	go func() {
+		for i := range ld.items {
+			it := &ld.items[i]
+			if it.val, ld.err = it.cv.load(it.ent.typ); ld.err != nil {
+				ld.err = fmt.Errorf("loading the cold value of %q: %v", it.key, ld.err)
+				break
+			}
+		}
+		gTier.mu.Lock()
+		gTier.done = append(gTier.done, ld)
+		gTier.mu.Unlock()
+		syscall.Write(gTier.wake[1], []byte{1})
+	}()
+	return true
+}
+
+// tierFinishLoads puts the loaded values back in their entries, unless a
+// command replaced the entry meanwhile, and returns the Conns to resume.
+func tierFinishLoads() []*Conn {
+	var buf [64]byte
+	for {
+		if n, _ := syscall.Read(gTier.wake[0], buf[:]); n <= 0 {
+			break
+		}
+	}
+	gTier.mu.Lock()
+	done := gTier.done
+	gTier.done = nil
+	gTier.mu.Unlock()
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	now := nowNs()
+	var conns []*Conn
+	for _, ld := range done {
+		gTier.loads--
+		conns = append(conns, ld.conn)
+		if ld.err != nil {
+			util.Msg(ld.err.Error())
+			ld.conn.tierErr = ld.err
+			continue
+		}
+		for _, it := range ld.items {
+			if ent, _ := gMap.dbs[ld.db].Get(it.key); ent != it.ent || it.ent.val != it.cv {
+				continue
+			}
+			forgetCold(it.ent)
+			it.ent.val = it.val
+			it.ent.atime = now
+			updateMemUsageIn(ld.db, it.key, it.ent)
+			gTier.coldLoads++
+		}
+	}
+	return conns
+}
+
+// tierCron spills idle values, sampling some keys of every database like
+// the eviction. Spilling appends to the value log, which doesn't wait for
+// the disk.
+func tierCron() {
+	now := nowNs()
+	if gTier.file == nil || now-gTier.lastCron < kTierCronEvery {
+		return
+	}
+	gTier.lastCron = now
+	gMap.Lock()
+	defer gMap.Unlock()
+	if gSave.job != nil {
+		return // the saver may read the value log
+	}
+	if gTier.cold == 0 && gTier.loads == 0 && gTier.size > 0 {
+		if err := gTier.file.Truncate(0); err != nil {
+			util.Msg("truncating the value log: " + err.Error())
+			return
+		}
+		gTier.size = 0
+	}
+
+	idle := int64(gConfig.tierIdle)
+	for db := range gMap.dbs {
+		for i := 0; i < kTierSamples && gMap.dbs[db].Len() > 0; i++ {
+			key, ent, _ := gMap.dbs[db].Random()
+			if _, ok := ent.val.(*coldValue); ok || now-ent.atime < idle || ent.size < gConfig.tierMinSize || ent.expired(now) {
+				continue
+			}
+			if ent.typ == TypeHash && ent.val.(*Hash).volatile.Len() > 0 {
+				continue // the field expiry needs the value
+			}
+			if err := spill(db, key, ent); err != nil {
+				util.Msg("writing the value log: " + err.Error())
+				return
+			}
+		}
+	}
+}
+
+// spill moves the value of the entry to the value log.
+func spill(db int, key string, ent *Entry) error {
+	rec := appendU32(nil, 0)
+	if gTier.seal != nil {
+		rec = gTier.seal.sealAt(rec, encodeValue(ent, nil), gTier.size)
+	} else {
+		rec = encodeValue(ent, rec)
+	}
+	length := uint32(len(rec) - 4)
+	binary.LittleEndian.PutUint32(rec, length)
+	rec = appendU64(rec, crc64.Checksum(rec[4:], gCrcTable))
+	if _, err := gTier.file.WriteAt(rec, gTier.size); err != nil {
+		return err
+	}
+	ent.val = &coldValue{off: gTier.size + 4, length: length}
+	gTier.size += int64(len(rec))
+	gTier.cold++
+	gTier.live += int64(len(rec))
+	gTier.spills++
+	updateMemUsageIn(db, key, ent)
+	return nil
+}
+
+// resumeConn runs the request of a Conn whose cold values were loaded,
+// then the requests pipelined after it.
+func resumeConn(conn *Conn) {
+	conn.state = StateReq
+	for tryOneRequest(conn) {
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// useTiering opens a value log in the data directory of the test server
+// and spills any value idle for a minute.
+func useTiering(t *testing.T) {
+	oldIdle, oldMinSize := gConfig.tierIdle, gConfig.tierMinSize
+	gConfig.tierIdle = time.Minute
+	gConfig.tierMinSize = 0
+	if err := tierInit(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		gTier.file.Close()
+		syscall.Close(gTier.wake[0])
+		syscall.Close(gTier.wake[1])
+		gTier.file, gTier.seal = nil, nil
+		gTier.size, gTier.cold, gTier.live, gTier.loads, gTier.lastCron = 0, 0, 0, 0, 0
+		gConfig.tierIdle, gConfig.tierMinSize = oldIdle, oldMinSize
+	})
+}
+
+// spillIdle runs a spill cycle once the values are idle.
+func spillIdle(clock *fakeClock) {
+	clock.advance(2 * time.Minute)
+	tierCron()
+}
+
+// isCold tells if the value of `key` is in the value log.
+func isCold(key string) bool {
+	ent, ok := gMap.m.Get(key)
+	if !ok {
+		return false
+	}
+	_, cold := ent.val.(*coldValue)
+	return cold
+}
+
+// loadCold reads back the cold values among the arguments of a command,
+// like the event loop does before it runs the command.
+func loadCold(s *testServer, args ...string) {
+	if !tierSuspend(s.conn, args) {
+		return
+	}
+	for {
+		gTier.mu.Lock()
+		n := len(gTier.done)
+		gTier.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tierFinishLoads()
+}
+
+func TestTierSpillAndLoad(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newTestServer(t)
+	useTiering(t)
+
+	for _, c := range []struct {
+		setup []string
+		read  []string
+		want  string
+	}{
+		{[]string{"set", "str", strings.Repeat("x", 300)}, []string{"strlen", "str"}, "300"},
+		{[]string{"hset", "h", "f", "v"}, []string{"hget", "h", "f"}, "v"},
+		{[]string{"bf.add", "bf", "x"}, []string{"bf.exists", "bf", "x"}, "1"},
+		{[]string{"sugadd", "sug", "hello", "1"}, []string{"sugget", "sug", "he"}, "[hello]"},
+	} {
+		if _, code := s.do(c.setup...); code == RES_ERR {
+			t.Fatalf("%v failed", c.setup)
+		}
+		before := usedMemory()
+		spillIdle(clock)
+		key := c.setup[1]
+		if !isCold(key) {
+			t.Fatalf("%s is not spilled", key)
+		}
+		if usedMemory() >= before {
+			t.Errorf("%s: memory %d after the spill, %d before", key, usedMemory(), before)
+		}
+		loadCold(s, c.read...)
+		if isCold(key) {
+			t.Fatalf("%s is not loaded back", key)
+		}
+		s.expect(c.want, c.read...)
+	}
+
+	// The value log is cut once no value is cold. A cycle spilled the
+	// values of the earlier cases again.
+	loadCold(s, "exists", "str", "h", "bf", "sug")
+	if gTier.cold != 0 || gTier.size == 0 {
+		t.Fatalf("%d cold values in a value log of %d bytes", gTier.cold, gTier.size)
+	}
+	clock.advance(time.Second)
+	tierCron()
+	if gTier.size != 0 {
+		t.Fatalf("value log of %d bytes", gTier.size)
+	}
+}
+
+func TestTierHashFieldExpiry(t *testing.T) {
+	clock := useFakeClock(t)
+	s := newTestServer(t)
+	useTiering(t)
+
+	// A hash with a field TTL stays in memory for the expiry
+	s.expect("1", "hset", "h", "f", "v")
+	s.expect("[1]", "hpexpire", "h", "600000", "fields", "1", "f")
+	spillIdle(clock)
+	if isCold("h") {
+		t.Fatal("a hash with a field TTL is spilled")
+	}
+
+	// Without a TTL left it can go, and the expiry sweep no longer visits it
+	s.expect("[1]", "hpersist", "h", "fields", "1", "f")
+	if gMap.hexp[0].Len() != 0 {
+		t.Fatal("the hash has no field TTL left but is still visited by the expiry cycle")
+	}
+	spillIdle(clock)
+	if !isCold("h") {
+		t.Fatal("the hash is not spilled")
+	}
+	activeExpireHashFields(0, nowNs()+int64(time.Second))
+
+	// A key left behind by another path is dropped from the sweep
+	gMap.hexp[0].Add("h")
+	gMap.hexp[0].Add("gone")
+	activeExpireHashFields(0, nowNs()+int64(time.Second))
+	if gMap.hexp[0].Len() != 0 {
+		t.Fatalf("%d keys left to visit", gMap.hexp[0].Len())
+	}
+	loadCold(s, "hget", "h", "f")
+	s.expect("v", "hget", "h", "f")
+
+	// Overwriting or deleting the last field with a TTL also ends the visits
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"hset", "h", "g", "w"}, "0"},
+		{[]string{"hdel", "h", "g"}, "1"},
+	} {
+		s.do("hset", "h", "g", "x")
+		s.expect("[1]", "hpexpire", "h", "600000", "fields", "1", "g")
+		s.expect(c.want, c.args...)
+		if gMap.hexp[0].Len() != 0 {
+			t.Fatalf("%v: the hash is still visited by the expiry cycle", c.args)
+		}
+	}
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"strconv"
+	"time"
+)
+
+// A time series is a list of (timestamp, value) samples in increasing
+// timestamp order, stored in compressed chunks with the Gorilla encoding
+// (Pelkonen et al.): timestamps as delta-of-deltas and values XORed with
+// the previous value. Samples older than the retention period are dropped
+// chunk by chunk. Compaction rules aggregate the samples into buckets
+// that are appended to another series as each bucket closes.
+
+type bitWriter struct {
+	buf   []byte
+	nbits uint64
+}
+
+func (w *bitWriter) writeBits(val uint64, n uint) {
+	for n > 0 {
+		if w.nbits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		free := 8 - uint(w.nbits%8)
+		take := free
+		if n < take {
+			take = n
+		}
+		chunk := byte(val>>(n-take)) & byte(1<<take-1)
+		w.buf[len(w.buf)-1] |= chunk << (free - take)
+		w.nbits += uint64(take)
+		n -= take
+	}
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if bit {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint64
+}
+
+// readBits reads `n` bits, the first one highest. Bits past the end of
+// the buffer read as 0, so a corrupted chunk can't index out of range.
+func (r *bitReader) readBits(n uint) uint64 {
+	val := uint64(0)
+	for n > 0 {
+		if r.pos/8 >= uint64(len(r.buf)) {
+			r.pos += uint64(n)
+			return val << n
+		}
+		avail := 8 - uint(r.pos%8)
+		take := avail
+		if n < take {
+			take = n
+		}
+		b := r.buf[r.pos/8] >> (avail - take) & byte(1<<take-1)
+		val = val<<take | uint64(b)
+		r.pos += uint64(take)
+		n -= take
+	}
+	return val
+}
+
+func (r *bitReader) readBit() bool {
+	return r.readBits(1) == 1
+}
+
+// Encoder state shared by the writer and the reader of a chunk
+type gorillaState struct {
+	ts       int64
+	delta    int64
+	val      uint64
+	leading  uint8
+	trailing uint8
+}
+
+type tsChunk struct {
+	w       bitWriter
+	count   int
+	firstTs int64
+	state   gorillaState // the state after the last sample
+}
+
+// Buckets for the delta-of-delta: the prefix and the width of the value
+var dodBuckets = []struct {
+	prefix, prefixBits uint64
+	width              uint
+}{
+	{0x2, 2, 7},  // 10
+	{0x6, 3, 9},  // 110
+	{0xe, 4, 12}, // 1110
+	{0xf, 4, 64}, // 1111
+}
+
+func (c *tsChunk) append(ts int64, val float64) {
+	vbits := math.Float64bits(val)
+	st := &c.state
+	if c.count == 0 {
+		c.firstTs = ts
+		c.w.writeBits(uint64(ts), 64)
+		c.w.writeBits(vbits, 64)
+		*st = gorillaState{ts: ts, val: vbits, leading: 0xff}
+		c.count++
+		return
+	}
+
+	delta := ts - st.ts
+	dod := delta - st.delta
+	if dod == 0 {
+		c.w.writeBit(false)
+	} else {
+		for _, b := range dodBuckets {
+			if b.width == 64 || (dod >= -(1<<(b.width-1)) && dod < 1<<(b.width-1)) {
+				c.w.writeBits(b.prefix, uint(b.prefixBits))
+				c.w.writeBits(uint64(dod), b.width)
+				break
+			}
+		}
+	}
+
+	xor := vbits ^ st.val
+	if xor == 0 {
+		c.w.writeBit(false)
+	} else {
+		c.w.writeBit(true)
+		leading := uint8(bits.LeadingZeros64(xor))
+		trailing := uint8(bits.TrailingZeros64(xor))
+		if leading > 31 {
+			leading = 31
+		}
+		if st.leading != 0xff && leading >= st.leading && trailing >= st.trailing {
+			// Reuse the previous window
+			c.w.writeBit(false)
+			c.w.writeBits(xor>>st.trailing, uint(64-st.leading-st.trailing))
+		} else {
+			sig := 64 - leading - trailing
+			c.w.writeBit(true)
+			c.w.writeBits(uint64(leading), 5)
+			c.w.writeBits(uint64(sig&63), 6) // 64 is written as 0
+			c.w.writeBits(xor>>trailing, uint(sig))
+			st.leading, st.trailing = leading, trailing
+		}
+	}
+
+	st.delta = delta
+	st.ts = ts
+	st.val = vbits
+	c.count++
+}
+
+// each calls `fn` for every sample in the chunk until it returns false.
+func (c *tsChunk) each(fn func(ts int64, val float64) bool) bool {
+	r := bitReader{buf: c.w.buf}
+	st := gorillaState{}
+	for i := 0; i < c.count; i++ {
+		if i == 0 {
+			st.ts = int64(r.readBits(64))
+			st.val = r.readBits(64)
+		} else {
+			dod := int64(0)
+			if r.readBit() {
+				width := uint(0)
+				for _, b := range dodBuckets {
+					width = b.width
+					if b.width == 64 || !r.readBit() {
+						break
+					}
+				}
+				raw := r.readBits(width)
+				// Sign extend
+				dod = int64(raw<<(64-width)) >> (64 - width)
+			}
+			st.delta += dod
+			st.ts += st.delta
+
+			if r.readBit() {
+				if r.readBit() {
+					st.leading = uint8(r.readBits(5))
+					sig := uint8(r.readBits(6))
+					if sig == 0 {
+						sig = 64
+					}
+					st.trailing = 64 - st.leading - sig
+				}
+				sig := uint(64 - st.leading - st.trailing)
+				st.val ^= r.readBits(sig) << st.trailing
+			}
+		}
+		if !fn(st.ts, math.Float64frombits(st.val)) {
+			return false
+		}
+	}
+	return true
+}
+
+// valid tells if the chunk holds `count` increasing samples and is
+// exactly what append() writes for them, state included.
+func (c *tsChunk) valid() bool {
+	if c.count <= 0 || c.w.nbits > uint64(len(c.w.buf))*8 || uint64(c.count) > c.w.nbits {
+		return false
+	}
+	again := &tsChunk{}
+	ok := c.each(func(ts int64, val float64) bool {
+		if again.count > 0 && ts <= again.state.ts {
+			return false
+		}
+		again.append(ts, val)
+		return true
+	})
+	return ok && again.firstTs == c.firstTs && again.state == c.state &&
+		again.w.nbits == c.w.nbits && bytes.Equal(again.w.buf, c.w.buf)
+}
+
+type TsAgg int
+
+const (
+	AggAvg TsAgg = iota
+	AggMin
+	AggMax
+	AggSum
+	AggCount
+)
+
+var tsAggNames = []string{"avg", "min", "max", "sum", "count"}
+
+func parseTsAgg(name string) (TsAgg, bool) {
+	for i, n := range tsAggNames {
+		if cmdIs(name, n) {
+			return TsAgg(i), true
+		}
+	}
+	return 0, false
+}
+
+// tsBucket accumulates the samples of one aggregation bucket.
+type tsBucket struct {
+	start int64
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func (b *tsBucket) reset(start int64) {
+	*b = tsBucket{start: start, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (b *tsBucket) add(val float64) {
+	b.count++
+	b.sum += val
+	b.min = math.Min(b.min, val)
+	b.max = math.Max(b.max, val)
+}
+
+func (b *tsBucket) result(agg TsAgg) float64 {
+	switch agg {
+	case AggAvg:
+		return b.sum / float64(b.count)
+	case AggMin:
+		return b.min
+	case AggMax:
+		return b.max
+	case AggSum:
+		return b.sum
+	default:
+		return float64(b.count)
+	}
+}
+
+func bucketStart(ts, size int64) int64 {
+	start := ts - ts%size
+	if ts < 0 && ts%size != 0 {
+		start -= size
+	}
+	return start
+}
+
+// A compaction rule writes the aggregate of each closed bucket to `dest`.
+type tsRule struct {
+	dest   string
+	agg    TsAgg
+	bucket int64
+	cur    tsBucket // the open bucket, empty if count is 0
+}
+
+type TimeSeries struct {
+	chunks    []*tsChunk
+	chunkSize int   // bytes per chunk
+	retention int64 // ms, 0 keeps everything
+	total     int
+	rules     []*tsRule
+}
+
+const kTsDefaultChunkSize = 4096
+
+func newTimeSeries(retention int64, chunkSize int) *TimeSeries {
+	return &TimeSeries{retention: retention, chunkSize: chunkSize}
+}
+
+func (s *TimeSeries) lastTs() (int64, bool) {
+	if len(s.chunks) == 0 {
+		return 0, false
+	}
+	return s.chunks[len(s.chunks)-1].state.ts, true
+}
+
+func (s *TimeSeries) firstTs() (int64, bool) {
+	if len(s.chunks) == 0 {
+		return 0, false
+	}
+	return s.chunks[0].firstTs, true
+}
+
+// Add appends a sample. The timestamp must be newer than the last sample.
+// The closed buckets of compaction rules are returned for the caller to
+// write to their destinations.
+func (s *TimeSeries) Add(ts int64, val float64) (bool, []tsClosedBucket) {
+	if last, ok := s.lastTs(); ok && ts <= last {
+		return false, nil
+	}
+	if len(s.chunks) == 0 || len(s.chunks[len(s.chunks)-1].w.buf) >= s.chunkSize {
+		s.chunks = append(s.chunks, &tsChunk{})
+	}
+	s.chunks[len(s.chunks)-1].append(ts, val)
+	s.total++
+	s.trim()
+
+	var closed []tsClosedBucket
+	for _, rule := range s.rules {
+		start := bucketStart(ts, rule.bucket)
+		if rule.cur.count > 0 && rule.cur.start != start {
+			closed = append(closed, tsClosedBucket{rule.dest, rule.cur.start, rule.cur.result(rule.agg)})
+			rule.cur.reset(start)
+		} else if rule.cur.count == 0 {
+			rule.cur.reset(start)
+		}
+		rule.cur.add(val)
+	}
+	return true, closed
+}
+
+type tsClosedBucket struct {
+	dest string
+	ts   int64
+	val  float64
+}
+
+// trim drops the chunks that are entirely older than the retention period.
+func (s *TimeSeries) trim() {
+	if s.retention <= 0 {
+		return
+	}
+	last, _ := s.lastTs()
+	n := 0
+	for n < len(s.chunks)-1 && s.chunks[n].state.ts < last-s.retention {
+		s.total -= s.chunks[n].count
+		n++
+	}
+	s.chunks = s.chunks[n:]
+}
+
+// each calls `fn` for the samples in [from, to] within the retention period.
+func (s *TimeSeries) each(from, to int64, fn func(ts int64, val float64) bool) {
+	if last, ok := s.lastTs(); ok && s.retention > 0 && from < last-s.retention {
+		from = last - s.retention
+	}
+	for _, c := range s.chunks {
+		if c.state.ts < from {
+			continue
+		}
+		if c.firstTs > to {
+			return
+		}
+		ok := c.each(func(ts int64, val float64) bool {
+			if ts < from {
+				return true
+			}
+			if ts > to {
+				return false
+			}
+			return fn(ts, val)
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+type tsSample struct {
+	ts  int64
+	val float64
+}
+
+// Range returns up to `limit` samples in [from, to], aggregated into
+// buckets of `bucket` ms if it is positive.
+func (s *TimeSeries) Range(from, to int64, agg TsAgg, bucket int64, limit int) []tsSample {
+	out := []tsSample{}
+	if bucket <= 0 {
+		s.each(from, to, func(ts int64, val float64) bool {
+			out = append(out, tsSample{ts, val})
+			return len(out) < limit
+		})
+		return out
+	}
+
+	cur := tsBucket{}
+	s.each(from, to, func(ts int64, val float64) bool {
+		start := bucketStart(ts, bucket)
+		if cur.count > 0 && cur.start != start {
+			out = append(out, tsSample{cur.start, cur.result(agg)})
+			if len(out) >= limit {
+				return false
+			}
+		}
+		if cur.count == 0 || cur.start != start {
+			cur.reset(start)
+		}
+		cur.add(val)
+		return true
+	})
+	if cur.count > 0 && len(out) < limit {
+		out = append(out, tsSample{cur.start, cur.result(agg)})
+	}
+	return out
+}
+
+func (s *TimeSeries) MemUsage() int {
+	total := 0
+	for _, c := range s.chunks {
+		total += cap(c.w.buf) + 64
+	}
+	return total
+}
+
+func (s *TimeSeries) Encode(out []byte) []byte {
+	out = appendU64(out, uint64(s.retention))
+	out = appendU32(out, uint32(s.chunkSize))
+	out = appendU32(out, uint32(len(s.chunks)))
+	for _, c := range s.chunks {
+		out = appendU32(out, uint32(c.count))
+		out = appendU64(out, uint64(c.firstTs))
+		out = appendU64(out, uint64(c.state.ts))
+		out = appendU64(out, uint64(c.state.delta))
+		out = appendU64(out, c.state.val)
+		out = append(out, c.state.leading, c.state.trailing)
+		out = appendU64(out, c.w.nbits)
+		out = appendStr(out, string(c.w.buf))
+	}
+	out = appendU32(out, uint32(len(s.rules)))
+	for _, r := range s.rules {
+		out = appendStr(out, r.dest)
+		out = append(out, byte(r.agg))
+		out = appendU64(out, uint64(r.bucket))
+		out = appendU64(out, uint64(r.cur.start))
+		out = appendU64(out, uint64(r.cur.count))
+		out = appendF64(out, r.cur.sum)
+		out = appendF64(out, r.cur.min)
+		out = appendF64(out, r.cur.max)
+	}
+	return out
+}
+
+func decodeTimeSeries(d *decoder) (*TimeSeries, error) {
+	s := newTimeSeries(int64(d.u64()), int(d.u32()))
+	if d.err == nil && (s.retention < 0 || s.chunkSize < 64) {
+		return nil, errBadData
+	}
+	n := d.u32()
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		c := &tsChunk{}
+		c.count = int(d.u32())
+		c.firstTs = int64(d.u64())
+		c.state.ts = int64(d.u64())
+		c.state.delta = int64(d.u64())
+		c.state.val = d.u64()
+		c.state.leading = d.u8()
+		c.state.trailing = d.u8()
+		c.w.nbits = d.u64()
+		c.w.buf = []byte(d.str())
+		if d.err != nil {
+			break
+		}
+		if !c.valid() {
+			return nil, errBadData
+		}
+		if last, ok := s.lastTs(); ok && c.firstTs <= last {
+			return nil, errBadData
+		}
+		s.chunks = append(s.chunks, c)
+		s.total += c.count
+	}
+	n = d.u32()
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		r := &tsRule{}
+		r.dest = d.str()
+		r.agg = TsAgg(d.u8())
+		r.bucket = int64(d.u64())
+		r.cur.start = int64(d.u64())
+		r.cur.count = int64(d.u64())
+		r.cur.sum = d.f64()
+		r.cur.min = d.f64()
+		r.cur.max = d.f64()
+		if d.err == nil && (int(r.agg) >= len(tsAggNames) || r.bucket <= 0 || r.cur.count < 0) {
+			return nil, errBadData
+		}
+		s.rules = append(s.rules, r)
+	}
+	return s, d.err
+}
+
+// lookupTs returns the time series at `key`. The caller must hold the lock
+// of gMap.
+func lookupTs(key string) (*TimeSeries, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		return nil, ""
+	}
+	if ent.typ != TypeTs {
+		return nil, errWrongType
+	}
+	return ent.val.(*TimeSeries), ""
+}
+
+// tsAdd appends a sample and feeds the closed buckets of the compaction
+// rules to their destinations. The caller must hold the lock of gMap.
+func tsAdd(s *TimeSeries, ts int64, val float64) bool {
+	ok, closed := s.Add(ts, val)
+	for _, b := range closed {
+		// A missing or mistyped destination is skipped
+		ent, ok := lookupEntry(b.dest)
+		if !ok || ent.typ != TypeTs {
+			continue
+		}
+		tsAdd(ent.val.(*TimeSeries), b.ts, b.val)
+		// doRequest() only measures the key of the command again
+		updateMemUsageIn(gMap.cur, b.dest, ent)
+	}
+	return ok
+}
+
+// parseTsOptions reads RETENTION ms and CHUNK_SIZE bytes.
+func parseTsOptions(args []string, retention *int64, chunkSize *int) string {
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return "syntax error"
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n < 0 {
+			return "expect non-negative int"
+		}
+		if cmdIs(args[i], "retention") {
+			*retention = n
+		} else if cmdIs(args[i], "chunk_size") && n >= 64 {
+			*chunkSize = int(n)
+		} else {
+			return "syntax error"
+		}
+	}
+	return ""
+}
+
+// ts.create key [RETENTION ms] [CHUNK_SIZE bytes]
+func doTsCreate(cmd []string) ([]byte, ResponseCode) {
+	retention, chunkSize := int64(0), kTsDefaultChunkSize
+	if errMsg := parseTsOptions(cmd[2:], &retention, &chunkSize); errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	if _, ok := lookupEntry(cmd[1]); ok {
+		return []byte("item exists"), RES_ERR
+	}
+	dbSet(cmd[1], &Entry{typ: TypeTs, val: newTimeSeries(retention, chunkSize)})
+	return nil, RES_OK
+}
+
+// ts.add key timestamp|* value [RETENTION ms] [CHUNK_SIZE bytes]
+// The options are used if the key is created.
+func doTsAdd(cmd []string) ([]byte, ResponseCode) {
+	var ts int64
+	if cmd[2] == "*" {
+		ts = nowNs() / int64(time.Millisecond)
+	} else {
+		var err error
+		ts, err = strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil {
+			return []byte("expect int"), RES_ERR
+		}
+	}
+	val, err := strconv.ParseFloat(cmd[3], 64)
+	if err != nil {
+		return []byte("expect float"), RES_ERR
+	}
+	retention, chunkSize := int64(0), kTsDefaultChunkSize
+	if errMsg := parseTsOptions(cmd[4:], &retention, &chunkSize); errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	s, errMsg := lookupTs(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if s == nil {
+		s = newTimeSeries(retention, chunkSize)
+		dbSet(cmd[1], &Entry{typ: TypeTs, val: s})
+	}
+	if !tsAdd(s, ts, val) {
+		return []byte("timestamp must be newer than the last sample"), RES_ERR
+	}
+	return []byte(strconv.FormatInt(ts, 10)), RES_OK
+}
+
+// ts.get key
+func doTsGet(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	s, errMsg := lookupTs(cmd[1])
+	if s == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	last, ok := s.lastTs()
+	if !ok {
+		return nil, RES_NX
+	}
+	c := s.chunks[len(s.chunks)-1]
+	out := []byte{}
+	outArr(&out, 2)
+	outInt(&out, last)
+	outDbl(&out, math.Float64frombits(c.state.val))
+	return out, RES_ARR
+}
+
+func parseTsTime(arg string, dflt int64) (int64, bool) {
+	if arg == "-" || arg == "+" {
+		return dflt, true
+	}
+	ts, err := strconv.ParseInt(arg, 10, 64)
+	return ts, err == nil
+}
+
+// ts.range key from|- to|+ [COUNT n] [AGGREGATION avg|min|max|sum|count bucket]
+func doTsRange(cmd []string) ([]byte, ResponseCode) {
+	from, ok1 := parseTsTime(cmd[2], math.MinInt64)
+	to, ok2 := parseTsTime(cmd[3], math.MaxInt64)
+	if !ok1 || !ok2 {
+		return []byte("expect timestamp"), RES_ERR
+	}
+	limit := math.MaxInt32
+	agg, bucket := AggAvg, int64(0)
+	for i := 4; i < len(cmd); i++ {
+		if cmdIs(cmd[i], "count") && i+1 < len(cmd) {
+			n, err := strconv.Atoi(cmd[i+1])
+			if err != nil || n <= 0 {
+				return []byte("expect positive int"), RES_ERR
+			}
+			limit = n
+			i++
+		} else if cmdIs(cmd[i], "aggregation") && i+2 < len(cmd) {
+			var ok bool
+			if agg, ok = parseTsAgg(cmd[i+1]); !ok {
+				return []byte("unknown aggregation"), RES_ERR
+			}
+			n, err := strconv.ParseInt(cmd[i+2], 10, 64)
+			if err != nil || n <= 0 {
+				return []byte("expect positive bucket size"), RES_ERR
+			}
+			bucket = n
+			i += 2
+		} else {
+			return []byte("syntax error"), RES_ERR
+		}
+	}
+
+	gMap.RLock()
+	defer gMap.RUnlock()
+	s, errMsg := lookupTs(cmd[1])
+	if s == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	samples := s.Range(from, to, agg, bucket, limit)
+	out := []byte{}
+	outArr(&out, uint32(len(samples)))
+	for _, sample := range samples {
+		outArr(&out, 2)
+		outInt(&out, sample.ts)
+		outDbl(&out, sample.val)
+	}
+	return out, RES_ARR
+}
+
+// ts.createrule src dest AGGREGATION avg|min|max|sum|count bucket
+func doTsCreateRule(cmd []string) ([]byte, ResponseCode) {
+	if !cmdIs(cmd[3], "aggregation") {
+		return []byte("syntax error"), RES_ERR
+	}
+	agg, ok := parseTsAgg(cmd[4])
+	if !ok {
+		return []byte("unknown aggregation"), RES_ERR
+	}
+	bucket, err := strconv.ParseInt(cmd[5], 10, 64)
+	if err != nil || bucket <= 0 {
+		return []byte("expect positive bucket size"), RES_ERR
+	}
+	if cmd[1] == cmd[2] {
+		return []byte("source and destination are the same"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	src, errMsg := lookupTs(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	dest, errMsg2 := lookupTs(cmd[2])
+	if errMsg2 != "" {
+		return []byte(errMsg2), RES_ERR
+	}
+	if src == nil || dest == nil {
+		return nil, RES_NX
+	}
+	if len(dest.rules) > 0 {
+		// Keeps the rules free of cycles
+		return []byte("destination has its own rules"), RES_ERR
+	}
+	for _, r := range src.rules {
+		if r.dest == cmd[2] {
+			return []byte("rule exists"), RES_ERR
+		}
+	}
+	src.rules = append(src.rules, &tsRule{dest: cmd[2], agg: agg, bucket: bucket})
+	return nil, RES_OK
+}
+
+// ts.deleterule src dest
+func doTsDeleteRule(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	src, errMsg := lookupTs(cmd[1])
+	if src == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	for i, r := range src.rules {
+		if r.dest == cmd[2] {
+			src.rules = append(src.rules[:i], src.rules[i+1:]...)
+			return nil, RES_OK
+		}
+	}
+	return nil, RES_NX
+}
+
+// ts.info key
+func doTsInfo(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	s, errMsg := lookupTs(cmd[1])
+	if s == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	first, _ := s.firstTs()
+	last, _ := s.lastTs()
+	out := []byte{}
+	outArr(&out, 16)
+	outStr(&out, "total_samples")
+	outInt(&out, int64(s.total))
+	outStr(&out, "memory_usage")
+	outInt(&out, int64(s.MemUsage()))
+	outStr(&out, "first_timestamp")
+	outInt(&out, first)
+	outStr(&out, "last_timestamp")
+	outInt(&out, last)
+	outStr(&out, "retention")
+	outInt(&out, s.retention)
+	outStr(&out, "chunk_count")
+	outInt(&out, int64(len(s.chunks)))
+	outStr(&out, "chunk_size")
+	outInt(&out, int64(s.chunkSize))
+	outStr(&out, "rules")
+	outArr(&out, uint32(len(s.rules)))
+	for _, r := range s.rules {
+		outArr(&out, 3)
+		outStr(&out, r.dest)
+		outStr(&out, tsAggNames[r.agg])
+		outInt(&out, r.bucket)
+	}
+	return out, RES_ARR
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestGorillaChunk(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]tsSample, 500)
+	for i := range random {
+		random[i] = tsSample{int64(i)*1000 + rng.Int63n(1000), rng.NormFloat64() * 1e6}
+	}
+	for _, c := range []struct {
+		name    string
+		samples []tsSample
+	}{
+		{"one sample", []tsSample{{-5, 1}}},
+		{"equal values", []tsSample{{0, 7}, {10, 7}, {20, 7}, {30, 7}}},
+		{"regular", []tsSample{{1000, 1}, {2000, 2}, {3000, 3}, {4000, 4}}},
+		{"negative deltas", []tsSample{{100, 5}, {50, -5}, {-1000, 3}, {-1001, 2.5}}},
+		// Each width of the delta-of-delta, then beyond 12 bits
+		{"gaps", []tsSample{{0, 0}, {1, 0}, {65, 0}, {320, 0}, {2400, 0}, {1 << 40, 0}, {1<<40 + 1, 0}, {math.MaxInt64, 0}}},
+		{"extreme timestamps", []tsSample{{math.MinInt64, 1}, {0, 1}, {math.MaxInt64, 1}}},
+		{"special values", []tsSample{{0, math.Inf(1)}, {1, math.Inf(-1)}, {2, 0}, {3, math.Copysign(0, -1)},
+			{4, math.MaxFloat64}, {5, math.SmallestNonzeroFloat64}, {6, -1}, {7, 1}}},
+		{"random", random},
+	} {
+		chunk := &tsChunk{}
+		for _, sample := range c.samples {
+			chunk.append(sample.ts, sample.val)
+		}
+		var got []tsSample
+		chunk.each(func(ts int64, val float64) bool {
+			got = append(got, tsSample{ts, val})
+			return true
+		})
+		if len(got) != len(c.samples) {
+			t.Fatalf("%s: %d samples, want %d", c.name, len(got), len(c.samples))
+		}
+		for i, want := range c.samples {
+			// Compare the bits to tell 0 from -0
+			if got[i].ts != want.ts || math.Float64bits(got[i].val) != math.Float64bits(want.val) {
+				t.Fatalf("%s: sample %d is %v, want %v", c.name, i, got[i], want)
+			}
+		}
+	}
+}
+
+func TestTimeSeriesEncode(t *testing.T) {
+	s := newTimeSeries(0, 64)
+	s.rules = append(s.rules, &tsRule{dest: "d", agg: AggMax, bucket: 100})
+	for i := 0; i < 1000; i++ {
+		s.Add(int64(i*7), float64(i%13))
+	}
+	if len(s.chunks) < 2 {
+		t.Fatalf("%d chunks", len(s.chunks))
+	}
+	got, err := decodeTimeSeries(&decoder{data: s.Encode(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprint(s.Range(math.MinInt64, math.MaxInt64, AggAvg, 0, 0))
+	if fmt.Sprint(got.Range(math.MinInt64, math.MaxInt64, AggAvg, 0, 0)) != want {
+		t.Fatal("samples differ after decoding")
+	}
+	// The decoded chunk can be appended to
+	s.Add(7000, 1)
+	got.Add(7000, 1)
+	if fmt.Sprint(got.Range(6990, 7000, AggAvg, 0, 0)) != fmt.Sprint(s.Range(6990, 7000, AggAvg, 0, 0)) {
+		t.Fatal("samples differ after appending to the decoded series")
+	}
+}
+
+func TestTsCompactionMemory(t *testing.T) {
+	s := newTestServer(t)
+	s.expect("", "ts.create", "src")
+	s.expect("", "ts.create", "dst")
+	s.expect("", "ts.createrule", "src", "dst", "aggregation", "avg", "10")
+	for i := 0; i < 5000; i++ {
+		s.do("ts.add", "src", fmt.Sprint(i), fmt.Sprint(i%100))
+	}
+	s.expect("[[4980 84.5]]", "ts.range", "dst", "4980", "4980")
+
+	gMap.RLock()
+	defer gMap.RUnlock()
+	total := int64(0)
+	for _, key := range []string{"src", "dst"} {
+		ent, _ := gMap.m.Get(key)
+		if want := entryMemUsage(key, ent); ent.size != want {
+			t.Errorf("%s: size %d, measured %d", key, ent.size, want)
+		}
+		total += ent.size
+	}
+	if gMap.used[gMap.cur] != total {
+		t.Errorf("used %d, sizes sum to %d", gMap.used[gMap.cur], total)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// Top-K tracks the most frequent items with HeavyKeeper (Gong et al.).
+// Each of the `depth` rows has `width` buckets holding a fingerprint and
+// a counter. A colliding item decays the counter of the bucket's owner
+// with probability decay^count, so small flows are evicted while heavy
+// hitters keep their buckets. The current top `k` items are kept in a
+// min-heap by their estimated count.
+type hkBucket struct {
+	fp    uint32
+	count uint32
+}
+
+type topkItem struct {
+	name  string
+	count uint32
+}
+
+// topkHeap is a min-heap by count with the position of each item.
+type topkHeap struct {
+	items []topkItem
+	pos   map[string]int
+}
+
+func (h *topkHeap) Len() int           { return len(h.items) }
+func (h *topkHeap) Less(i, j int) bool { return h.items[i].count < h.items[j].count }
+func (h *topkHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.pos[h.items[i].name] = i
+	h.pos[h.items[j].name] = j
+}
+func (h *topkHeap) Push(x interface{}) {
+	item := x.(topkItem)
+	h.pos[item.name] = len(h.items)
+	h.items = append(h.items, item)
+}
+func (h *topkHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.pos, item.name)
+	return item
+}
+
+type TopK struct {
+	k       uint32
+	width   uint32
+	depth   uint32
+	decay   float64
+	buckets []hkBucket // row major
+	top     topkHeap
+	rng     *rand.Rand
+}
+
+const (
+	kTopkDefaultWidth = 8
+	kTopkDefaultDepth = 7
+	kTopkDefaultDecay = 0.9
+
+	// Bounds width*depth, 512 MiB of buckets
+	kTopkMaxBuckets = 1 << 26
+	// Bounds the decrements of a bucket by one increment. Only a decay
+	// close to 1 gets near it.
+	kTopkMaxDecays = 1 << 16
+)
+
+func newTopK(k, width, depth uint32, decay float64) *TopK {
+	return &TopK{
+		k:       k,
+		width:   width,
+		depth:   depth,
+		decay:   decay,
+		buckets: make([]hkBucket, uint64(width)*uint64(depth)),
+		top:     topkHeap{pos: make(map[string]int)},
+		rng:     rand.New(rand.NewSource(1)),
+	}
+}
+
+// topkFingerprint mixes the hashes of an item into its fingerprint. The
+// last bytes of the item only reach the low bits of each hash, so items
+// like "key1" and "key2" would share the high bits of one.
+func topkFingerprint(h1, h2 uint64) uint32 {
+	x := h1 ^ h2
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x >> 32)
+}
+
+// IncrBy counts the item `incr` more times. If this pushes another item
+// out of the top k, that item is returned.
+func (t *TopK) IncrBy(item string, incr uint32) (string, bool) {
+	h1, h2 := bloomHash(item)
+	fp := topkFingerprint(h1, h2)
+	est := uint32(0)
+	for row := uint32(0); row < t.depth; row++ {
+		b := &t.buckets[uint64(row)*uint64(t.width)+(h1+uint64(row)*h2)%uint64(t.width)]
+		if b.count == 0 {
+			b.fp = fp
+			b.count = incr
+		} else if b.fp == fp {
+			b.count = addSatU32(b.count, incr)
+		} else {
+			t.decayBucket(b, fp, incr)
+		}
+		if b.fp == fp && b.count > est {
+			est = b.count
+		}
+	}
+
+	if i, ok := t.top.pos[item]; ok {
+		if est > t.top.items[i].count {
+			t.top.items[i].count = est
+			heap.Fix(&t.top, i)
+		}
+		return "", false
+	}
+	if uint32(t.top.Len()) < t.k {
+		heap.Push(&t.top, topkItem{item, est})
+		return "", false
+	}
+	if est > t.top.items[0].count {
+		expelled := t.top.items[0].name
+		delete(t.top.pos, expelled)
+		t.top.items[0] = topkItem{item, est}
+		t.top.pos[item] = 0
+		heap.Fix(&t.top, 0)
+		return expelled, true
+	}
+	return "", false
+}
+
+// decayBucket applies `incr` collisions of the item with fingerprint `fp`
+// to a bucket owned by another item. Each one decrements the count with
+// probability decay^count, and the item takes the bucket over once it
+// reaches 0. Rather than flipping a coin per unit, the number of units up
+// to the next decrement is drawn from the geometric distribution.
+func (t *TopK) decayBucket(b *hkBucket, fp uint32, incr uint32) {
+	left := uint64(incr) // including the unit that decrements
+	if t.decay >= 1 {
+		if left < uint64(b.count) {
+			b.count -= incr
+			return
+		}
+		b.fp = fp
+		b.count = uint32(left - uint64(b.count) + 1)
+		return
+	}
+	for i := 0; i < kTopkMaxDecays; i++ {
+		p := math.Pow(t.decay, float64(b.count))
+		// 1-Float64() is in (0, 1], a p of 0 gives +Inf or NaN
+		steps := math.Floor(math.Log(1-t.rng.Float64())/math.Log1p(-p)) + 1
+		if !(steps <= float64(left)) {
+			return
+		}
+		left -= uint64(steps) - 1
+		b.count--
+		if b.count == 0 {
+			b.fp = fp
+			b.count = uint32(left)
+			return
+		}
+		left--
+	}
+}
+
+// addSatU32 returns a+b, or the largest uint32 if that overflows.
+func addSatU32(a, b uint32) uint32 {
+	if a > math.MaxUint32-b {
+		return math.MaxUint32
+	}
+	return a + b
+}
+
+// Query reports whether the item is in the top k.
+func (t *TopK) Query(item string) bool {
+	_, ok := t.top.pos[item]
+	return ok
+}
+
+// Count returns the estimated count of the item.
+func (t *TopK) Count(item string) uint32 {
+	h1, h2 := bloomHash(item)
+	fp := topkFingerprint(h1, h2)
+	est := uint32(0)
+	for row := uint32(0); row < t.depth; row++ {
+		b := t.buckets[uint64(row)*uint64(t.width)+(h1+uint64(row)*h2)%uint64(t.width)]
+		if b.fp == fp && b.count > est {
+			est = b.count
+		}
+	}
+	return est
+}
+
+// List returns the top k items ordered by count from high to low.
+func (t *TopK) List() []topkItem {
+	out := make([]topkItem, len(t.top.items))
+	copy(out, t.top.items)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].count != out[j].count {
+			return out[i].count > out[j].count
+		}
+		return out[i].name < out[j].name
+	})
+	return out
+}
+
+func (t *TopK) Encode(out []byte) []byte {
+	out = appendU32(out, t.k)
+	out = appendU32(out, t.width)
+	out = appendU32(out, t.depth)
+	out = appendF64(out, t.decay)
+	for _, b := range t.buckets {
+		out = appendU32(out, b.fp)
+		out = appendU32(out, b.count)
+	}
+	out = appendU32(out, uint32(len(t.top.items)))
+	for _, item := range t.top.items {
+		out = appendStr(out, item.name)
+		out = appendU32(out, item.count)
+	}
+	return out
+}
+
+func decodeTopK(d *decoder) (*TopK, error) {
+	k := d.u32()
+	width := d.u32()
+	depth := d.u32()
+	decay := d.f64()
+	if d.err != nil {
+		return nil, d.err
+	}
+	n := uint64(width) * uint64(depth)
+	if k == 0 || n == 0 || n > kTopkMaxBuckets || !(decay > 0 && decay <= 1) {
+		return nil, errBadData
+	}
+	if n > uint64(len(d.data))/8 {
+		return nil, errShortData
+	}
+	t := newTopK(k, width, depth, decay)
+	for i := range t.buckets {
+		t.buckets[i].fp = d.u32()
+		t.buckets[i].count = d.u32()
+	}
+	size := d.u32()
+	if d.err == nil && size > k {
+		return nil, errBadData
+	}
+	for i := uint32(0); i < size && d.err == nil; i++ {
+		name := d.str()
+		count := d.u32()
+		if _, dup := t.top.pos[name]; dup {
+			return nil, errBadData
+		}
+		heap.Push(&t.top, topkItem{name, count})
+	}
+	return t, d.err
+}
+
+// lookupTopK returns the Top-K at `key`. The caller must hold the lock of
+// gMap.
+func lookupTopK(key string) (*TopK, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		return nil, ""
+	}
+	if ent.typ != TypeTopK {
+		return nil, errWrongType
+	}
+	return ent.val.(*TopK), ""
+}
+
+// topk.reserve key k [width depth decay]
+func doTopkReserve(cmd []string) ([]byte, ResponseCode) {
+	k, err := strconv.ParseUint(cmd[2], 10, 32)
+	if err != nil || k == 0 {
+		return []byte("expect positive int"), RES_ERR
+	}
+	// Default to a few buckets per tracked item
+	width, depth, decay := k*kTopkDefaultWidth, uint64(kTopkDefaultDepth), kTopkDefaultDecay
+	if len(cmd) == 6 {
+		var err1, err2, err3 error
+		width, err1 = strconv.ParseUint(cmd[3], 10, 32)
+		depth, err2 = strconv.ParseUint(cmd[4], 10, 32)
+		decay, err3 = strconv.ParseFloat(cmd[5], 64)
+		if err1 != nil || err2 != nil || err3 != nil || width == 0 || depth == 0 || decay <= 0 || decay > 1 {
+			return []byte("bad parameters"), RES_ERR
+		}
+	} else if len(cmd) != 3 {
+		return []byte("syntax error"), RES_ERR
+	}
+	if width*depth > kTopkMaxBuckets {
+		return []byte("width * depth is too large"), RES_ERR
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	if _, ok := lookupEntry(cmd[1]); ok {
+		return []byte("item exists"), RES_ERR
+	}
+	t := newTopK(uint32(k), uint32(width), uint32(depth), decay)
+	dbSet(cmd[1], &Entry{typ: TypeTopK, val: t})
+	return nil, RES_OK
+}
+
+func topkIncr(cmd []string, items []string, incrs []uint32) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	t, errMsg := lookupTopK(cmd[1])
+	if t == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	out := []byte{}
+	outArr(&out, uint32(len(items)))
+	for i, item := range items {
+		if expelled, ok := t.IncrBy(item, incrs[i]); ok {
+			outStr(&out, expelled)
+		} else {
+			outNil(&out)
+		}
+	}
+	return out, RES_ARR
+}
+
+// topk.add key item [item ...]
+func doTopkAdd(cmd []string) ([]byte, ResponseCode) {
+	items := cmd[2:]
+	incrs := make([]uint32, len(items))
+	for i := range incrs {
+		incrs[i] = 1
+	}
+	return topkIncr(cmd, items, incrs)
+}
+
+// topk.incrby key item incr [item incr ...]
+func doTopkIncrBy(cmd []string) ([]byte, ResponseCode) {
+	if len(cmd)%2 != 0 {
+		return []byte("syntax error"), RES_ERR
+	}
+	items := []string{}
+	incrs := []uint32{}
+	for i := 2; i < len(cmd); i += 2 {
+		incr, err := strconv.ParseUint(cmd[i+1], 10, 32)
+		if err != nil {
+			return []byte("expect int"), RES_ERR
+		}
+		items = append(items, cmd[i])
+		incrs = append(incrs, uint32(incr))
+	}
+	return topkIncr(cmd, items, incrs)
+}
+
+// topk.query key item [item ...] and topk.count key item [item ...]
+func doTopkQuery(cmd []string, counts bool) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	t, errMsg := lookupTopK(cmd[1])
+	if t == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	out := []byte{}
+	outArr(&out, uint32(len(cmd)-2))
+	for _, item := range cmd[2:] {
+		if counts {
+			outInt(&out, int64(t.Count(item)))
+		} else if t.Query(item) {
+			outInt(&out, 1)
+		} else {
+			outInt(&out, 0)
+		}
+	}
+	return out, RES_ARR
+}
+
+// topk.list key [WITHCOUNT]
+func doTopkList(cmd []string) ([]byte, ResponseCode) {
+	withCount := false
+	if len(cmd) == 3 {
+		if !cmdIs(cmd[2], "withcount") {
+			return []byte("syntax error"), RES_ERR
+		}
+		withCount = true
+	}
+
+	gMap.RLock()
+	defer gMap.RUnlock()
+	t, errMsg := lookupTopK(cmd[1])
+	if t == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	list := t.List()
+	out := []byte{}
+	if withCount {
+		outArr(&out, uint32(2*len(list)))
+	} else {
+		outArr(&out, uint32(len(list)))
+	}
+	for _, item := range list {
+		outStr(&out, item.name)
+		if withCount {
+			outInt(&out, int64(item.count))
+		}
+	}
+	return out, RES_ARR
+}
+
+// topk.info key
+func doTopkInfo(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	t, errMsg := lookupTopK(cmd[1])
+	if t == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	out := []byte{}
+	outArr(&out, 8)
+	outStr(&out, "k")
+	outInt(&out, int64(t.k))
+	outStr(&out, "width")
+	outInt(&out, int64(t.width))
+	outStr(&out, "depth")
+	outInt(&out, int64(t.depth))
+	outStr(&out, "decay")
+	outDbl(&out, t.decay)
+	return out, RES_ARR
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestTopkHeavyHitters(t *testing.T) {
+	const k = 10
+	for seed := int64(1); seed <= 5; seed++ {
+		tk := newTopK(k, k*kTopkDefaultWidth, kTopkDefaultDepth, kTopkDefaultDecay)
+		stream, exact := zipfStream(seed, 200000, 100000)
+		for _, item := range stream {
+			tk.IncrBy(item, 1)
+		}
+
+		items := make([]string, 0, len(exact))
+		for item := range exact {
+			items = append(items, item)
+		}
+		sort.Slice(items, func(i, j int) bool { return exact[items[i]] > exact[items[j]] })
+		for _, item := range items {
+			// HeavyKeeper only decays counts, a fingerprint collision aside
+			if est := uint64(tk.Count(item)); est > exact[item] {
+				t.Fatalf("seed %d: %s estimated %d, counted %d", seed, item, est, exact[item])
+			}
+		}
+		// The heaviest items stand well apart in a Zipf stream
+		for _, item := range items[:k/2] {
+			if !tk.Query(item) {
+				t.Errorf("seed %d: %s counted %d is not in the top k", seed, item, exact[item])
+			}
+		}
+		list := tk.List()
+		if len(list) != k {
+			t.Fatalf("seed %d: listed %d items", seed, len(list))
+		}
+		for i := 1; i < len(list); i++ {
+			if list[i].count > list[i-1].count {
+				t.Fatalf("seed %d: list not sorted by count", seed)
+			}
+		}
+	}
+}
+
+func TestTopkDecay(t *testing.T) {
+	// A large increment against a heavy bucket is not applied unit by unit
+	tk := newTopK(1, 1, 1, 0.999999)
+	tk.IncrBy("a", math.MaxUint32)
+	tk.IncrBy("a", 5)
+	if c := tk.Count("a"); c != math.MaxUint32 {
+		t.Fatalf("count %d, want it saturated", c)
+	}
+	tk.IncrBy("b", math.MaxUint32)
+
+	// With no decay, each colliding unit decrements
+	tk = newTopK(1, 1, 1, 1)
+	tk.IncrBy("a", 10)
+	tk.IncrBy("b", 4)
+	if c := tk.Count("a"); c != 6 {
+		t.Fatalf("count of a %d, want 6", c)
+	}
+	tk.IncrBy("b", 9)
+	if ca, cb := tk.Count("a"), tk.Count("b"); ca != 0 || cb != 4 {
+		t.Fatalf("counts %d %d, want b to take the bucket with 4", ca, cb)
+	}
+
+	// A small item is expelled from a bucket quickly
+	tk = newTopK(1, 1, 1, kTopkDefaultDecay)
+	tk.IncrBy("a", 3)
+	tk.IncrBy("b", 1000)
+	if c := tk.Count("b"); c < 900 {
+		t.Fatalf("count of b %d after taking over", c)
+	}
+}
+
+func TestTopkReserveLimits(t *testing.T) {
+	for _, cmd := range [][]string{
+		{"topk.reserve", "t", "536870912"},
+		{"topk.reserve", "t", "10", "4294967295", "4294967295", "0.9"},
+		{"topk.reserve", "t", "10", "0", "7", "0.9"},
+		{"topk.reserve", "t", "10", "100000000", "1", "0.9"},
+	} {
+		if _, code := doTopkReserve(cmd); code != RES_ERR {
+			t.Errorf("%v: %v, want an error", cmd, code)
+		}
+	}
+}
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// A vector set maps names to float32 vectors of a fixed dimension and
+// indexes them with HNSW (Hierarchical Navigable Small World graphs,
+// Malkov & Yashunin). Nearest-neighbour queries walk the graph from the
+// top layer down; the TRUTH option scans every vector instead, which is
+// what the approximate results are checked against.
+
+type VecMetric int
+
+const (
+	MetricCosine VecMetric = iota
+	MetricL2
+)
+
+type hnswNode struct {
+	name  string
+	vec   []float32
+	links [][]int32 // neighbour ids per layer, layer 0 first
+}
+
+type VectorSet struct {
+	dim            int
+	metric         VecMetric
+	m              int // max links per node above layer 0
+	m0             int // max links per node on layer 0
+	efConstruction int
+	efSearch       int
+	levelMult      float64
+
+	nodes  []*hnswNode // indexed by id, nil for removed nodes
+	free   []int32     // ids of removed nodes for reuse
+	byName map[string]int32
+	entry  int32 // entry point, -1 when empty
+	top    int   // the highest layer
+	rng    *rand.Rand
+}
+
+const (
+	kVecDefaultM        = 16
+	kVecDefaultEfConstr = 200
+	kVecDefaultEfSearch = 50
+	kVecMaxM            = 1024    // a node has up to 2*M links at layer 0
+	kVecMaxEf           = 1 << 20 // candidates kept by a search
+)
+
+func newVectorSet(dim int, metric VecMetric, m, efConstruction, efSearch int) *VectorSet {
+	return &VectorSet{
+		dim:            dim,
+		metric:         metric,
+		m:              m,
+		m0:             2 * m,
+		efConstruction: efConstruction,
+		efSearch:       efSearch,
+		levelMult:      1 / math.Log(float64(m)),
+		byName:         make(map[string]int32),
+		entry:          -1,
+		rng:            rand.New(rand.NewSource(1)),
+	}
+}
+
+func (vs *VectorSet) Len() int {
+	return len(vs.byName)
+}
+
+func (vs *VectorSet) distance(a, b []float32) float32 {
+	if vs.metric == MetricCosine {
+		// Vectors are normalized on insert
+		dot := float32(0)
+		for i := range a {
+			dot += a[i] * b[i]
+		}
+		return 1 - dot
+	}
+	sum := float32(0)
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return sum
+}
+
+// prepare copies the vector, normalizing it for the cosine metric.
+func (vs *VectorSet) prepare(vec []float32) []float32 {
+	out := make([]float32, len(vec))
+	copy(out, vec)
+	if vs.metric == MetricCosine {
+		norm := float64(0)
+		for _, v := range out {
+			norm += float64(v) * float64(v)
+		}
+		if norm > 0 {
+			inv := float32(1 / math.Sqrt(norm))
+			for i := range out {
+				out[i] *= inv
+			}
+		}
+	}
+	return out
+}
+
+type distItem struct {
+	id   int32
+	dist float32
+}
+
+// distQueue is a binary heap of distItem, nearest first unless `far` is set.
+type distQueue struct {
+	items []distItem
+	far   bool
+}
+
+func (q *distQueue) Len() int { return len(q.items) }
+func (q *distQueue) Less(i, j int) bool {
+	if q.far {
+		return q.items[i].dist > q.items[j].dist
+	}
+	return q.items[i].dist < q.items[j].dist
+}
+func (q *distQueue) Swap(i, j int)      { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *distQueue) Push(x interface{}) { q.items = append(q.items, x.(distItem)) }
+func (q *distQueue) Pop() interface{} {
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return item
+}
+
+// sortedNearest drains the queue into a slice ordered nearest first.
+func (q *distQueue) sortedNearest() []distItem {
+	out := make([]distItem, q.Len())
+	if q.far {
+		for i := len(out) - 1; i >= 0; i-- {
+			out[i] = heap.Pop(q).(distItem)
+		}
+	} else {
+		for i := range out {
+			out[i] = heap.Pop(q).(distItem)
+		}
+	}
+	return out
+}
+
+// searchLayer finds the `ef` nearest nodes to `vec` on one layer, starting
+// from `entries`. The result is ordered nearest first.
+func (vs *VectorSet) searchLayer(vec []float32, entries []distItem, ef int, layer int) []distItem {
+	visited := make(map[int32]bool)
+	cand := &distQueue{}
+	found := &distQueue{far: true}
+	for _, e := range entries {
+		visited[e.id] = true
+		heap.Push(cand, e)
+		heap.Push(found, e)
+	}
+	for found.Len() > ef {
+		heap.Pop(found)
+	}
+
+	for cand.Len() > 0 {
+		cur := heap.Pop(cand).(distItem)
+		if found.Len() >= ef && cur.dist > found.items[0].dist {
+			break // all the remaining candidates are farther
+		}
+		for _, nb := range vs.nodes[cur.id].links[layer] {
+			if visited[nb] {
+				continue
+			}
+			visited[nb] = true
+			d := vs.distance(vec, vs.nodes[nb].vec)
+			if found.Len() < ef || d < found.items[0].dist {
+				heap.Push(cand, distItem{nb, d})
+				heap.Push(found, distItem{nb, d})
+				if found.Len() > ef {
+					heap.Pop(found)
+				}
+			}
+		}
+	}
+	return found.sortedNearest()
+}
+
+// selectNeighbors picks up to `m` links from `cands` (ordered nearest first)
+// with the diversity heuristic: a candidate is skipped if it is closer to
+// an already selected neighbour than to the base. Skipped candidates fill
+// any remaining slots.
+func (vs *VectorSet) selectNeighbors(cands []distItem, m int) []int32 {
+	out := make([]int32, 0, m)
+	skipped := []int32{}
+	for _, c := range cands {
+		if len(out) >= m {
+			break
+		}
+		good := true
+		for _, s := range out {
+			if vs.distance(vs.nodes[c.id].vec, vs.nodes[s].vec) < c.dist {
+				good = false
+				break
+			}
+		}
+		if good {
+			out = append(out, c.id)
+		} else {
+			skipped = append(skipped, c.id)
+		}
+	}
+	for _, id := range skipped {
+		if len(out) >= m {
+			break
+		}
+		out = append(out, id)
+	}
+	return out
+}
+
+func (vs *VectorSet) maxLinks(layer int) int {
+	if layer == 0 {
+		return vs.m0
+	}
+	return vs.m
+}
+
+// connect adds a link from `id` to `nb` on `layer`, shrinking the links of
+// `id` if it has too many.
+func (vs *VectorSet) connect(id, nb int32, layer int) {
+	node := vs.nodes[id]
+	node.links[layer] = append(node.links[layer], nb)
+	if len(node.links[layer]) <= vs.maxLinks(layer) {
+		return
+	}
+	cands := &distQueue{}
+	for _, other := range node.links[layer] {
+		heap.Push(cands, distItem{other, vs.distance(node.vec, vs.nodes[other].vec)})
+	}
+	node.links[layer] = vs.selectNeighbors(cands.sortedNearest(), vs.maxLinks(layer))
+}
+
+func (vs *VectorSet) randomLevel() int {
+	return int(-math.Log(1-vs.rng.Float64()) * vs.levelMult)
+}
+
+// Add inserts or replaces the vector of `name`. Returns true if the name
+// is new.
+func (vs *VectorSet) Add(name string, vec []float32) bool {
+	_, exists := vs.byName[name]
+	if exists {
+		vs.Remove(name)
+	}
+
+	vec = vs.prepare(vec)
+	level := vs.randomLevel()
+	node := &hnswNode{name: name, vec: vec, links: make([][]int32, level+1)}
+	var id int32
+	if n := len(vs.free); n > 0 {
+		id = vs.free[n-1]
+		vs.free = vs.free[:n-1]
+		vs.nodes[id] = node
+	} else {
+		id = int32(len(vs.nodes))
+		vs.nodes = append(vs.nodes, node)
+	}
+	vs.byName[name] = id
+
+	if vs.entry < 0 {
+		vs.entry = id
+		vs.top = level
+		return !exists
+	}
+
+	eps := []distItem{{vs.entry, vs.distance(vec, vs.nodes[vs.entry].vec)}}
+	for layer := vs.top; layer > level; layer-- {
+		eps = vs.searchLayer(vec, eps, 1, layer)
+	}
+	for layer := minInt(level, vs.top); layer >= 0; layer-- {
+		eps = vs.searchLayer(vec, eps, vs.efConstruction, layer)
+		neighbors := vs.selectNeighbors(eps, vs.maxLinks(layer))
+		node.links[layer] = neighbors
+		for _, nb := range neighbors {
+			vs.connect(nb, id, layer)
+		}
+	}
+	if level > vs.top {
+		vs.entry = id
+		vs.top = level
+	}
+	return !exists
+}
+
+// Remove deletes `name` from the graph. Every node that linked to the
+// removed node is relinked using the removed node's neighbours, so the
+// graph stays connected. This scans all nodes since links are directed.
+func (vs *VectorSet) Remove(name string) bool {
+	id, ok := vs.byName[name]
+	if !ok {
+		return false
+	}
+	node := vs.nodes[id]
+	delete(vs.byName, name)
+	vs.nodes[id] = nil
+	vs.free = append(vs.free, id)
+
+	for xid, x := range vs.nodes {
+		if x == nil {
+			continue
+		}
+		for layer := 0; layer < len(x.links) && layer < len(node.links); layer++ {
+			if !containsID(x.links[layer], id) {
+				continue
+			}
+			// Drop the link to the removed node and merge in its neighbours
+			cands := &distQueue{}
+			seen := map[int32]bool{int32(xid): true, id: true}
+			for _, list := range [][]int32{x.links[layer], node.links[layer]} {
+				for _, other := range list {
+					if seen[other] || vs.nodes[other] == nil {
+						continue
+					}
+					seen[other] = true
+					heap.Push(cands, distItem{other, vs.distance(x.vec, vs.nodes[other].vec)})
+				}
+			}
+			x.links[layer] = vs.selectNeighbors(cands.sortedNearest(), vs.maxLinks(layer))
+		}
+	}
+
+	if vs.entry == id {
+		vs.entry = -1
+		vs.top = 0
+		for i, n := range vs.nodes {
+			if n != nil && (vs.entry < 0 || len(n.links)-1 > vs.top) {
+				vs.entry = int32(i)
+				vs.top = len(n.links) - 1
+			}
+		}
+	}
+	return true
+}
+
+// Search returns the `k` approximate nearest neighbours of `vec`.
+func (vs *VectorSet) Search(vec []float32, k int, ef int) []distItem {
+	if vs.entry < 0 || k <= 0 {
+		return nil
+	}
+	if ef < k {
+		ef = k
+	}
+	vec = vs.prepare(vec)
+	eps := []distItem{{vs.entry, vs.distance(vec, vs.nodes[vs.entry].vec)}}
+	for layer := vs.top; layer > 0; layer-- {
+		eps = vs.searchLayer(vec, eps, 1, layer)
+	}
+	eps = vs.searchLayer(vec, eps, ef, 0)
+	if len(eps) > k {
+		eps = eps[:k]
+	}
+	return eps
+}
+
+// SearchExact returns the `k` exact nearest neighbours of `vec` by
+// comparing against every vector.
+func (vs *VectorSet) SearchExact(vec []float32, k int) []distItem {
+	if k <= 0 {
+		return nil
+	}
+	vec = vs.prepare(vec)
+	found := &distQueue{far: true}
+	for id, node := range vs.nodes {
+		if node == nil {
+			continue
+		}
+		d := vs.distance(vec, node.vec)
+		if found.Len() < k {
+			heap.Push(found, distItem{int32(id), d})
+		} else if d < found.items[0].dist {
+			found.items[0] = distItem{int32(id), d}
+			heap.Fix(found, 0)
+		}
+	}
+	return found.sortedNearest()
+}
+
+// Encode serializes the parameters and the graph, so decoding doesn't
+// have to rebuild the index.
+func (vs *VectorSet) Encode(out []byte) []byte {
+	out = appendU32(out, uint32(vs.dim))
+	out = append(out, byte(vs.metric))
+	out = appendU32(out, uint32(vs.m))
+	out = appendU32(out, uint32(vs.efConstruction))
+	out = appendU32(out, uint32(vs.efSearch))
+	out = appendU32(out, uint32(vs.entry))
+	out = appendU32(out, uint32(vs.top))
+	out = appendU32(out, uint32(len(vs.nodes)))
+	for _, node := range vs.nodes {
+		if node == nil {
+			out = append(out, 0)
+			continue
+		}
+		out = append(out, 1)
+		out = appendStr(out, node.name)
+		for _, v := range node.vec {
+			out = appendU32(out, math.Float32bits(v))
+		}
+		out = appendU32(out, uint32(len(node.links)))
+		for _, links := range node.links {
+			out = appendU32(out, uint32(len(links)))
+			for _, id := range links {
+				out = appendU32(out, uint32(id))
+			}
+		}
+	}
+	return out
+}
+
+// decodeVectorSet reads a set written by Encode() and checks the graph,
+// so that a search never follows a link to a missing node or layer.
+func decodeVectorSet(d *decoder) (*VectorSet, error) {
+	dim := int(d.u32())
+	metric := VecMetric(d.u8())
+	m := int(d.u32())
+	efC := int(d.u32())
+	efS := int(d.u32())
+	entry := int32(d.u32())
+	top := int(d.u32())
+	n := d.u32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if uint64(n) > uint64(len(d.data)) {
+		return nil, errShortData
+	}
+	if dim <= 0 || (metric != MetricCosine && metric != MetricL2) ||
+		m < 2 || m > kVecMaxM || efC <= 0 || efC > kVecMaxEf || efS <= 0 || efS > kVecMaxEf {
+		return nil, errBadData
+	}
+	vs := newVectorSet(dim, metric, m, efC, efS)
+	vs.entry = entry
+	vs.top = top
+	vs.nodes = make([]*hnswNode, n)
+	for i := range vs.nodes {
+		if d.u8() == 0 {
+			vs.free = append(vs.free, int32(i))
+			continue
+		}
+		name := d.str()
+		if d.err != nil || uint64(dim) > uint64(len(d.data))/4 {
+			return nil, errShortData
+		}
+		node := &hnswNode{name: name, vec: make([]float32, dim)}
+		for j := range node.vec {
+			node.vec[j] = math.Float32frombits(d.u32())
+		}
+		layers := d.u32()
+		if d.err != nil || uint64(layers) > uint64(len(d.data)) {
+			return nil, errShortData
+		}
+		if layers == 0 {
+			return nil, errBadData
+		}
+		node.links = make([][]int32, layers)
+		for l := range node.links {
+			cnt := d.u32()
+			if d.err != nil || uint64(cnt) > uint64(len(d.data))/4 {
+				return nil, errShortData
+			}
+			if int(cnt) > vs.maxLinks(l) {
+				return nil, errBadData
+			}
+			node.links[l] = make([]int32, cnt)
+			for k := range node.links[l] {
+				node.links[l][k] = int32(d.u32())
+				if uint32(node.links[l][k]) >= n {
+					return nil, errBadData
+				}
+			}
+		}
+		if _, dup := vs.byName[name]; dup {
+			return nil, errBadData
+		}
+		vs.nodes[i] = node
+		vs.byName[name] = int32(i)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	// Links go to nodes that have the layer, and the entry point is on
+	// the top layer
+	for _, node := range vs.nodes {
+		if node == nil {
+			continue
+		}
+		if len(node.links) > top+1 {
+			return nil, errBadData
+		}
+		for l, links := range node.links {
+			for _, id := range links {
+				if vs.nodes[id] == nil || len(vs.nodes[id].links) <= l {
+					return nil, errBadData
+				}
+			}
+		}
+	}
+	if vs.Len() == 0 || entry < 0 || entry >= int32(n) || vs.nodes[entry] == nil ||
+		len(vs.nodes[entry].links) != top+1 {
+		return nil, errBadData
+	}
+	return vs, nil
+}
+
+func containsID(ids []int32, id int32) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parseVector reads `VALUES n v1 .. vn` or `FP32 blob` starting at cmd[pos].
+// Returns the vector and the position after it.
+func parseVector(cmd []string, pos int) ([]float32, int, string) {
+	if pos+1 >= len(cmd) {
+		return nil, 0, "syntax error"
+	}
+	if cmdIs(cmd[pos], "fp32") {
+		blob := cmd[pos+1]
+		if len(blob) == 0 || len(blob)%4 != 0 {
+			return nil, 0, "bad fp32 blob"
+		}
+		vec := make([]float32, len(blob)/4)
+		for i := range vec {
+			vec[i] = math.Float32frombits(binary.LittleEndian.Uint32([]byte(blob[4*i : 4*i+4])))
+		}
+		return vec, pos + 2, ""
+	}
+	if !cmdIs(cmd[pos], "values") {
+		return nil, 0, "syntax error"
+	}
+	n, err := strconv.Atoi(cmd[pos+1])
+	if err != nil || n <= 0 || pos+2+n > len(cmd) {
+		return nil, 0, "bad vector"
+	}
+	vec := make([]float32, n)
+	for i := range vec {
+		v, err := strconv.ParseFloat(cmd[pos+2+i], 32)
+		if err != nil {
+			return nil, 0, "expect float"
+		}
+		vec[i] = float32(v)
+	}
+	return vec, pos + 2 + n, ""
+}
+
+// lookupVset returns the vector set at `key`. The caller must hold the
+// lock of gMap.
+func lookupVset(key string) (*VectorSet, string) {
+	ent, ok := lookupEntry(key)
+	if !ok {
+		return nil, ""
+	}
+	if ent.typ != TypeVset {
+		return nil, errWrongType
+	}
+	return ent.val.(*VectorSet), ""
+}
+
+// vadd key (VALUES n v1 .. vn | FP32 blob) element [options]
+// with the options METRIC cosine|l2, M m, EF efConstruction and EFSEARCH ef.
+// The options only take effect when the key is created.
+func doVAdd(cmd []string) ([]byte, ResponseCode) {
+	vec, pos, errMsg := parseVector(cmd, 2)
+	if vec == nil {
+		return []byte(errMsg), RES_ERR
+	}
+	if pos >= len(cmd) {
+		return []byte("syntax error"), RES_ERR
+	}
+	name := cmd[pos]
+
+	metric := MetricCosine
+	m, efC, efS := kVecDefaultM, kVecDefaultEfConstr, kVecDefaultEfSearch
+	for i := pos + 1; i < len(cmd); i += 2 {
+		if i+1 >= len(cmd) {
+			return []byte("syntax error"), RES_ERR
+		}
+		if cmdIs(cmd[i], "metric") {
+			if cmdIs(cmd[i+1], "cosine") {
+				metric = MetricCosine
+			} else if cmdIs(cmd[i+1], "l2") {
+				metric = MetricL2
+			} else {
+				return []byte("unknown metric"), RES_ERR
+			}
+			continue
+		}
+		n, err := strconv.Atoi(cmd[i+1])
+		if err != nil || n <= 0 {
+			return []byte("expect positive int"), RES_ERR
+		}
+		if cmdIs(cmd[i], "m") {
+			if n < 2 || n > kVecMaxM {
+				return []byte(fmt.Sprintf("M must be between 2 and %d", kVecMaxM)), RES_ERR
+			}
+			m = n
+		} else if cmdIs(cmd[i], "ef") || cmdIs(cmd[i], "efsearch") {
+			if n > kVecMaxEf {
+				return []byte(fmt.Sprintf("EF must be at most %d", kVecMaxEf)), RES_ERR
+			}
+			if cmdIs(cmd[i], "ef") {
+				efC = n
+			} else {
+				efS = n
+			}
+		} else {
+			return []byte("syntax error"), RES_ERR
+		}
+	}
+
+	gMap.Lock()
+	defer gMap.Unlock()
+	vs, errMsg := lookupVset(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if vs == nil {
+		vs = newVectorSet(len(vec), metric, m, efC, efS)
+		dbSet(cmd[1], &Entry{typ: TypeVset, val: vs})
+	}
+	if len(vec) != vs.dim {
+		return []byte("vector dimension mismatch"), RES_ERR
+	}
+	if vs.Add(name, vec) {
+		return []byte("1"), RES_OK
+	}
+	return []byte("0"), RES_OK
+}
+
+// vsim key (ELE element | VALUES n v1 .. vn | FP32 blob) [options]
+// with the options COUNT k, EF efSearch, WITHSCORES and TRUTH.
+// The scores are distances: 1 - cosine similarity, or the squared L2
+// distance.
+func doVSim(cmd []string) ([]byte, ResponseCode) {
+	var vec []float32
+	var ele string
+	pos := 2
+	if cmdIs(cmd[2], "ele") && len(cmd) > 3 {
+		ele = cmd[3]
+		pos = 4
+	} else {
+		var errMsg string
+		vec, pos, errMsg = parseVector(cmd, 2)
+		if vec == nil {
+			return []byte(errMsg), RES_ERR
+		}
+	}
+
+	count, ef := 10, 0
+	withScores, truth := false, false
+	for i := pos; i < len(cmd); i++ {
+		if cmdIs(cmd[i], "withscores") {
+			withScores = true
+		} else if cmdIs(cmd[i], "truth") {
+			truth = true
+		} else if (cmdIs(cmd[i], "count") || cmdIs(cmd[i], "ef")) && i+1 < len(cmd) {
+			n, err := strconv.Atoi(cmd[i+1])
+			if err != nil || n <= 0 {
+				return []byte("expect positive int"), RES_ERR
+			}
+			if cmdIs(cmd[i], "count") {
+				count = n
+			} else if n > kVecMaxEf {
+				return []byte(fmt.Sprintf("EF must be at most %d", kVecMaxEf)), RES_ERR
+			} else {
+				ef = n
+			}
+			i++
+		} else {
+			return []byte("syntax error"), RES_ERR
+		}
+	}
+
+	gMap.RLock()
+	defer gMap.RUnlock()
+	vs, errMsg := lookupVset(cmd[1])
+	if vs == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	if vec == nil {
+		id, ok := vs.byName[ele]
+		if !ok {
+			return nil, RES_NX
+		}
+		vec = vs.nodes[id].vec
+	}
+	if len(vec) != vs.dim {
+		return []byte("vector dimension mismatch"), RES_ERR
+	}
+	if ef == 0 {
+		ef = vs.efSearch
+	}
+
+	var res []distItem
+	if truth {
+		res = vs.SearchExact(vec, count)
+	} else {
+		res = vs.Search(vec, count, ef)
+	}
+
+	out := []byte{}
+	if withScores {
+		outArr(&out, uint32(2*len(res)))
+	} else {
+		outArr(&out, uint32(len(res)))
+	}
+	for _, item := range res {
+		outStr(&out, vs.nodes[item.id].name)
+		if withScores {
+			outDbl(&out, float64(item.dist))
+		}
+	}
+	return out, RES_ARR
+}
+
+// vrem key element
+func doVRem(cmd []string) ([]byte, ResponseCode) {
+	gMap.Lock()
+	defer gMap.Unlock()
+	vs, errMsg := lookupVset(cmd[1])
+	if vs == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	if !vs.Remove(cmd[2]) {
+		return nil, RES_NX
+	}
+	if vs.Len() == 0 {
+		dbDelete(cmd[1])
+	}
+	return nil, RES_OK
+}
+
+// vcard key
+func doVCard(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	vs, errMsg := lookupVset(cmd[1])
+	if errMsg != "" {
+		return []byte(errMsg), RES_ERR
+	}
+	if vs == nil {
+		return []byte("0"), RES_OK
+	}
+	return []byte(strconv.Itoa(vs.Len())), RES_OK
+}
+
+// vinfo key
+func doVInfo(cmd []string) ([]byte, ResponseCode) {
+	gMap.RLock()
+	defer gMap.RUnlock()
+	vs, errMsg := lookupVset(cmd[1])
+	if vs == nil {
+		if errMsg != "" {
+			return []byte(errMsg), RES_ERR
+		}
+		return nil, RES_NX
+	}
+	metric := "cosine"
+	if vs.metric == MetricL2 {
+		metric = "l2"
+	}
+	out := []byte{}
+	outArr(&out, 14)
+	outStr(&out, "size")
+	outInt(&out, int64(vs.Len()))
+	outStr(&out, "dim")
+	outInt(&out, int64(vs.dim))
+	outStr(&out, "metric")
+	outStr(&out, metric)
+	outStr(&out, "m")
+	outInt(&out, int64(vs.m))
+	outStr(&out, "ef_construction")
+	outInt(&out, int64(vs.efConstruction))
+	outStr(&out, "ef_search")
+	outInt(&out, int64(vs.efSearch))
+	outStr(&out, "max_level")
+	outInt(&out, int64(vs.top))
+	return out, RES_ARR
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func randomVectors(rng *rand.Rand, n int, dim int) [][]float32 {
+	out := make([][]float32, n)
+	for i := range out {
+		out[i] = make([]float32, dim)
+		for j := range out[i] {
+			out[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	return out
+}
+
+// bruteForce returns the names of the `k` nearest vectors by sorting
+// all of them.
+func bruteForce(vs *VectorSet, query []float32, k int) []string {
+	q := vs.prepare(query)
+	type scored struct {
+		name string
+		dist float32
+	}
+	var all []scored
+	for name, id := range vs.byName {
+		all = append(all, scored{name, vs.distance(q, vs.nodes[id].vec)})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].dist < all[j].dist })
+	var out []string
+	for i := 0; i < k && i < len(all); i++ {
+		out = append(out, all[i].name)
+	}
+	return out
+}
+
+// recall returns the fraction of the true neighbours found by Search.
+func recall(vs *VectorSet, queries [][]float32, k int) float64 {
+	hits, total := 0, 0
+	for _, q := range queries {
+		truth := map[string]bool{}
+		for _, name := range bruteForce(vs, q, k) {
+			truth[name] = true
+		}
+		for _, it := range vs.Search(q, k, vs.efSearch) {
+			if truth[vs.nodes[it.id].name] {
+				hits++
+			}
+		}
+		total += len(truth)
+	}
+	return float64(hits) / float64(total)
+}
+
+func TestVectorSetRecall(t *testing.T) {
+	const n, dim, k = 1000, 32, 10
+	for _, metric := range []VecMetric{MetricCosine, MetricL2} {
+		rng := rand.New(rand.NewSource(7))
+		vs := newVectorSet(dim, metric, kVecDefaultM, kVecDefaultEfConstr, kVecDefaultEfSearch)
+		for i, vec := range randomVectors(rng, n, dim) {
+			vs.Add(fmt.Sprint("v", i), vec)
+		}
+		queries := randomVectors(rng, 100, dim)
+		if r := recall(vs, queries, k); r < 0.9 {
+			t.Errorf("metric %d: recall %.3f", metric, r)
+		}
+
+		// Removals relink the graph
+		for i := 0; i < n; i += 3 {
+			vs.Remove(fmt.Sprint("v", i))
+		}
+		if r := recall(vs, queries, k); r < 0.9 {
+			t.Errorf("metric %d: recall %.3f after removals", metric, r)
+		}
+
+		// The exact search is the truth
+		for _, q := range queries[:10] {
+			truth := bruteForce(vs, q, k)
+			for i, it := range vs.SearchExact(q, k) {
+				if vs.nodes[it.id].name != truth[i] {
+					t.Fatalf("metric %d: exact search differs from brute force", metric)
+				}
+			}
+		}
+	}
+}
+
+func TestVectorSetEncode(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	vs := newVectorSet(8, MetricL2, 8, 100, 40)
+	for i, vec := range randomVectors(rng, 300, 8) {
+		vs.Add(fmt.Sprint("v", i), vec)
+	}
+	vs.Remove("v5")
+	got, err := decodeVectorSet(&decoder{data: vs.Encode(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != vs.Len() {
+		t.Fatalf("decoded %d vectors, want %d", got.Len(), vs.Len())
+	}
+	for _, q := range randomVectors(rng, 20, 8) {
+		a, b := vs.Search(q, 5, 40), got.Search(q, 5, 40)
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			t.Fatalf("search after decoding: %v, want %v", b, a)
+		}
+	}
+}
+
+func TestVAddLimits(t *testing.T) {
+	s := newTestServer(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"vadd", "v", "values", "2", "1", "0", "a", "m", "1"}, "(error) M must be between 2 and 1024"},
+		{[]string{"vadd", "v", "values", "2", "1", "0", "a", "m", "4000000000"}, "(error) M must be between 2 and 1024"},
+		{[]string{"vadd", "v", "values", "2", "1", "0", "a", "ef", "4000000000"}, "(error) EF must be at most 1048576"},
+		{[]string{"vadd", "v", "values", "2", "1", "0", "a", "efsearch", "1048577"}, "(error) EF must be at most 1048576"},
+		{[]string{"vadd", "v", "values", "2", "1", "0", "a", "m", "0"}, "(error) expect positive int"},
+		{[]string{"vadd", "v", "values", "2", "1", "0", "a", "bogus", "5"}, "(error) syntax error"},
+		{[]string{"exists", "v"}, "0"},
+		{[]string{"vadd", "v", "values", "2", "1", "0", "a", "m", "1024", "ef", "1048576"}, "1"},
+		{[]string{"vadd", "v", "values", "2", "0", "1", "b"}, "1"},
+		{[]string{"vsim", "v", "values", "2", "1", "0", "count", "1"}, "[a]"},
+		{[]string{"vsim", "v", "values", "2", "1", "0", "ef", "1048577"}, "(error) EF must be at most 1048576"},
+	} {
+		s.expect(c.want, c.args...)
+	}
+}